@@ -11,6 +11,7 @@ import (
 	"git.arvados.org/arvados.git/lib/cmd"
 	"git.arvados.org/arvados.git/lib/deduplicationreport"
 	"git.arvados.org/arvados.git/lib/mount"
+	"git.arvados.org/arvados.git/lib/upload"
 )
 
 var (
@@ -55,6 +56,7 @@ var (
 
 		"mount":                mount.Command,
 		"deduplication-report": deduplicationreport.Command,
+		"upload":               upload.Command,
 	})
 )
 
@@ -82,11 +82,25 @@ var whitelist = map[string]bool{
 	"Collections":                                  true,
 	"Collections.BalanceCollectionBatch":           false,
 	"Collections.BalanceCollectionBuffers":         false,
+	"Collections.BalanceFullScanPeriod":            false,
+	"Collections.BalanceMaintenanceTimeZone":       false,
+	"Collections.BalanceMaintenanceWindows":        false,
 	"Collections.BalancePeriod":                    false,
+	"Collections.BalancePullRate":                  false,
 	"Collections.BalanceTimeout":                   false,
+	"Collections.BlobChangeLogSize":                false,
 	"Collections.BlobDeleteConcurrency":            false,
+	"Collections.BlobEncryptionKeyID":              false,
+	"Collections.BlobEncryptionKeys":               false,
+	"Collections.BlobMissingFileReport":            false,
+	"Collections.BlobMissingProperty":              false,
+	"Collections.BlobMissingRecoverySources":       false,
 	"Collections.BlobMissingReport":                false,
+	"Collections.BlobMissingUntrash":               false,
+	"Collections.BlobPullRate":                     false,
 	"Collections.BlobReplicateConcurrency":         false,
+	"Collections.BlobScrubRate":                    false,
+	"Collections.BlobScrubStateDir":                false,
 	"Collections.BlobSigning":                      true,
 	"Collections.BlobSigningKey":                   false,
 	"Collections.BlobSigningTTL":                   true,
@@ -96,15 +110,21 @@ var whitelist = map[string]bool{
 	"Collections.BlobTrashLifetime":                false,
 	"Collections.CollectionVersioning":             false,
 	"Collections.DefaultReplication":               true,
+	"Collections.DefaultStorageQuota":              false,
 	"Collections.DefaultTrashLifetime":             true,
 	"Collections.ForwardSlashNameSubstitution":     true,
+	"Collections.KeepproxyCacheDir":                false,
+	"Collections.KeepproxyCacheSize":               false,
 	"Collections.ManagedProperties":                true,
 	"Collections.ManagedProperties.*":              true,
 	"Collections.ManagedProperties.*.*":            true,
 	"Collections.PreserveVersionIfIdle":            true,
 	"Collections.S3FolderObjects":                  true,
+	"Collections.S3MultipartUploadTTL":             false,
+	"Collections.StorageQuotas":                    false,
 	"Collections.TrashSweepInterval":               false,
 	"Collections.TrustAllContent":                  false,
+	"Collections.VolumeHealth":                     false,
 	"Collections.WebDAVCache":                      false,
 	"Containers":                                   true,
 	"Containers.CloudVMs":                          false,
@@ -195,6 +215,9 @@ var whitelist = map[string]bool{
 	"Services.*":                                   true,
 	"Services.*.ExternalURL":                       true,
 	"Services.*.InternalURLs":                      false,
+	"StorageClasses":                               true,
+	"StorageClasses.*":                             true,
+	"StorageClasses.*.*":                           true,
 	"SystemLogs":                                   false,
 	"SystemRootToken":                              false,
 	"TLS":                                          false,
@@ -220,6 +243,7 @@ var whitelist = map[string]bool{
 	"Volumes.*.AccessViaHosts":                     true,
 	"Volumes.*.AccessViaHosts.*":                   true,
 	"Volumes.*.AccessViaHosts.*.ReadOnly":          true,
+	"Volumes.*.Compression":                        false,
 	"Volumes.*.ReadOnly":                           true,
 	"Volumes.*.Replication":                        true,
 	"Volumes.*.StorageClasses":                     true,
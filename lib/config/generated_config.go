@@ -353,6 +353,24 @@ Clusters:
       # when no such processes are running.
       BlobSigningKey: ""
 
+      # Secret keys used by the "Encrypted" keepstore volume driver
+      # to encrypt and decrypt data blocks, indexed by key ID. Key
+      # IDs can be up to 32 characters long. IMPORTANT: These are
+      # site secrets. Each key should be at least 50 characters.
+      #
+      # Each encrypted block is tagged with the ID of the key that
+      # was used to encrypt it. To rotate keys, add a new key here,
+      # change BlobEncryptionKeyID to the new key's ID, and keep the
+      # old key until all blocks encrypted with it have been deleted
+      # or rewritten. Removing a key that is still in use makes the
+      # affected blocks unreadable.
+      BlobEncryptionKeys:
+        SAMPLE: ""
+
+      # ID of the key in BlobEncryptionKeys that is used to encrypt
+      # newly written blocks.
+      BlobEncryptionKeyID: ""
+
       # Enable garbage collection of unreferenced blobs in Keep.
       BlobTrash: true
 
@@ -382,6 +400,77 @@ Clusters:
       # process.
       BlobReplicateConcurrency: 4
 
+      # Maximum rate, in bytes per second, at which a single keepstore
+      # process pulls blocks from other keepstore servers when
+      # instructed by keep-balance (e.g., "20MiB"). This limit does
+      # not apply during maintenance windows (see
+      # BalanceMaintenanceWindows). 0 means no limit.
+      #
+      # keep-balance also uses this value to limit the size of the
+      # pull list it sends to each keepstore server in each run.
+      BlobPullRate: 0
+
+      # Keepstore tracks the error rate and average latency of
+      # recent operations on each volume mount. If either one
+      # exceeds its threshold, the mount is "degraded": keepstore
+      # still reads from it, but stops writing new blocks to it
+      # until a probe succeeds. Degraded mounts are reported in
+      # keepstore's /mounts and /_health/volumes endpoints and its
+      # Prometheus metrics, and keep-balance treats them as
+      # read-only. With the default thresholds (0), mounts are
+      # never degraded.
+      VolumeHealth:
+        # Fraction of recent operations (between 0 and 1) that can
+        # fail before a mount is degraded, e.g., 0.5. 0 means never
+        # degrade a mount because of errors.
+        ErrorRateThreshold: 0
+
+        # Average duration of recent operations above which a mount
+        # is degraded. 0 means no limit.
+        LatencyThreshold: 0s
+
+        # Minimum number of operations on a mount (since startup,
+        # or since it recovered from a degraded state) before it
+        # can be degraded.
+        MinOperations: 20
+
+        # Interval between attempts to write and read back the
+        # empty block on a degraded mount. When an attempt
+        # succeeds, the mount is returned to service.
+        ProbeInterval: 1m
+
+      # Rate (in bytes per second, per volume mount) at which
+      # keepstore re-reads stored blocks in the background to check
+      # their MD5 hashes, e.g., "10MiB". 0 means do not scrub.
+      #
+      # A block whose data does not match its hash is quarantined:
+      # keepstore reports it as corrupt in its /mounts API, and
+      # keep-balance trashes the corrupt copy and makes a new
+      # replica from a good copy elsewhere. Scrub progress and
+      # quarantined blocks are reported by keepstore's
+      # /mounts/{uuid} endpoint and Prometheus metrics.
+      BlobScrubRate: 0
+
+      # Directory where keepstore saves each mount's scrub progress
+      # and list of quarantined blocks, so scrubbing resumes where
+      # it left off after a restart. If empty, progress is not
+      # saved, and each restart begins a new pass.
+      BlobScrubStateDir: /var/lib/arvados/keepstore-scrub
+
+      # Maximum number of recent block changes (writes, touches,
+      # and deletions) keepstore remembers for each mount, so
+      # keep-balance can update its previous state instead of
+      # retrieving the mount's full index (see
+      # BalanceFullScanPeriod). Each entry uses about 100 bytes of
+      # memory. If more changes than this happen between
+      # keep-balance runs, or keepstore restarts, keep-balance
+      # retrieves the full index of the mount.
+      #
+      # Recording a change costs an extra timestamp lookup on the
+      # volume for each write and deletion. If zero, changes are not
+      # recorded, and keep-balance always retrieves full indexes.
+      BlobChangeLogSize: 0
+
       # Default replication level for collections. This is used when a
       # collection's replication_desired attribute is nil.
       DefaultReplication: 2
@@ -418,6 +507,51 @@ Clusters:
       # Updated automically during each successful run.
       BlobMissingReport: ""
 
+      # When running keep-balance, this is the destination filename for
+      # a JSON list of the files affected by lost blocks, one entry
+      # per collection, file, and block, like
+      # {"collection_uuid": "...", "path": "dir/file.txt", "locator": "..."}.
+      # Only current (not trashed, not old version) collections are
+      # listed. Updated automatically during each successful run.
+      BlobMissingFileReport: ""
+
+      # If non-empty, keep-balance adds a property with this name to
+      # each current collection that references lost blocks. The
+      # property value is the list of lost block hashes. Collections
+      # are only updated when keep-balance is run with -commit-pulls.
+      BlobMissingProperty: ""
+
+      # When running with -commit-pulls, try to recover lost blocks
+      # by untrashing them on the keepstore servers (i.e., blocks that
+      # are still referenced but were trashed, e.g., because of a
+      # race or a bug).
+      BlobMissingUntrash: false
+
+      # When running with -commit-pulls, try to recover lost blocks by
+      # copying them from these sources, in order, before reporting
+      # them as lost. Each source is either a remote cluster listed in
+      # RemoteClusters, or a keepproxy server, e.g., at a backup
+      # site. Token must be valid on the source.
+      #
+      # Blocks are retrieved from a remote cluster by looking up a
+      # collection with the same portable data hash as one of the
+      # collections that reference the block, so Token must be able
+      # to read such a collection.
+      #
+      # Blocks are retrieved from a keepproxy server directly. If
+      # the source cluster has BlobSigning enabled, BlobSigningKey
+      # must be set to the source cluster's BlobSigningKey.
+      #
+      # Recovered blocks are written to a single keepstore mount, and
+      # further replicas are made in the next run.
+      BlobMissingRecoverySources:
+        SAMPLE:
+          RemoteCluster: ""
+          KeepproxyURL: ""
+          Insecure: false
+          Token: ""
+          BlobSigningKey: ""
+
       # keep-balance operates periodically, i.e.: do a
       # scan/balance operation, sleep, repeat.
       #
@@ -450,6 +584,67 @@ Clusters:
       # long-running balancing operation.
       BalanceTimeout: 6h
 
+      # Interval between full scans when keep-balance runs in
+      # incremental mode.
+      #
+      # In a full scan, keep-balance retrieves every collection and
+      # the full block index of every keepstore mount. In incremental
+      # mode, keep-balance keeps its block state in memory between
+      # runs. Each subsequent run retrieves only the collections
+      # modified since the previous run, and the recent changes on
+      # each keepstore mount (see BlobChangeLogSize). A full scan is
+      # still done when this interval has elapsed since the last one,
+      # after a failed run, and when the list of keep services
+      # changes.
+      #
+      # Mounts whose device is attached to more than one keepstore
+      # server (e.g., an S3 bucket accessed by several keepstore
+      # servers) are fully indexed in every run.
+      #
+      # In incremental mode, keep-balance does not lower a block's
+      # desired replication when a collection is modified or deleted
+      # until the next full scan, so some excess replicas are
+      # trashed later than they would be otherwise.
+      #
+      # If zero, every run is a full scan.
+      BalanceFullScanPeriod: 0s
+
+      # Maximum rate, in bytes per second, at which keep-balance asks
+      # keepstore servers to pull blocks, across the whole cluster
+      # (e.g., "100MiB"). In each run, keep-balance sends pull lists
+      # for at most BalancePullRate x BalancePeriod bytes; the
+      # remaining pulls are sent in subsequent runs. Pulls that
+      # restore the replication of underreplicated blocks are sent
+      # before pulls that only move blocks to better positions. This
+      # limit does not apply during maintenance windows. 0 means no
+      # limit.
+      #
+      # See also BlobPullRate, which limits each keepstore server.
+      BalancePullRate: 0
+
+      # Weekly time windows when keep-balance may send trash lists,
+      # and pulls are not limited by BalancePullRate and BlobPullRate.
+      # Each entry has the form "[days] [HH:MM-HH:MM]", for example:
+      #
+      #   BalanceMaintenanceWindows:
+      #     - "Mon-Fri 20:00-06:00"
+      #     - "Sat,Sun"
+      #
+      # Days can be given as a comma-separated list of days and
+      # ranges of days; if omitted, the window applies every day. If
+      # the time range is omitted, the window lasts all day. A window
+      # whose end time is earlier than its start time ends on the
+      # following day.
+      #
+      # If no windows are given, trash lists are sent in every run,
+      # and pulls are always limited by BalancePullRate and
+      # BlobPullRate.
+      BalanceMaintenanceWindows: []
+
+      # Time zone for BalanceMaintenanceWindows, e.g.,
+      # "America/New_York". "" means UTC.
+      BalanceMaintenanceTimeZone: ""
+
       # Default lifetime for ephemeral collections: 2 weeks. This must not
       # be less than BlobSigningTTL.
       DefaultTrashLifetime: 336h
@@ -492,6 +687,12 @@ Clusters:
       # Include "folder objects" in S3 ListObjects responses.
       S3FolderObjects: true
 
+      # How long an S3 multipart upload can remain incomplete. Parts
+      # of an upload that has not been completed or aborted within
+      # this time are moved to the trash and eventually deleted. Set
+      # to 0 to disable multipart uploads.
+      S3MultipartUploadTTL: 24h
+
       # Managed collection properties. At creation time, if the client didn't
       # provide the listed keys, they will be automatically populated following
       # one of the following behaviors:
@@ -536,6 +737,56 @@ Clusters:
         MaxPermissionEntries: 1000
         MaxUUIDEntries:       1000
 
+        # If not empty, keep-web also caches blocks in files in
+        # this directory, so they survive a restart. The directory
+        # can be shared with other keep-web processes (and other
+        # Arvados clients) on the same host. It is created if
+        # needed.
+        DiskCacheDir: ""
+
+        # Maximum total size of the blocks cached in DiskCacheDir.
+        DiskCacheSize: 1GiB
+
+      # If not empty, keepproxy caches the blocks it serves in files
+      # in this directory, so blocks that are read repeatedly only
+      # need to be retrieved from the keepstore servers once. This
+      # is useful when keepproxy is far from the keepstore servers,
+      # e.g., at a remote site. Clients' tokens and permission
+      # signatures are still checked on every request.
+      KeepproxyCacheDir: ""
+
+      # Maximum total size of the blocks cached in KeepproxyCacheDir.
+      KeepproxyCacheSize: 10GiB
+
+      # Storage quotas, limiting the total size of the distinct
+      # blocks referenced by the collections owned by each user or
+      # project, including the collections in its subprojects
+      # (counting one replica of each block). Usage is computed by
+      # keep-balance after each full scan (see
+      # BalanceFullScanPeriod), and retrieved by the controller from
+      # keep-balance's InternalURLs using ManagementToken. Quotas are
+      # not enforced until keep-balance has reported usage at least
+      # once.
+      #
+      # When a collection is created or updated through the
+      # controller, the request fails if the blocks it adds would
+      # take the collection's owner, or any of the projects or user
+      # above it, over quota. Keepproxy and keep-web also refuse
+      # uploads from users (or into collections owned by users or
+      # projects) who have reached their quotas.
+      #
+      # Quota for users and projects that are not listed in
+      # StorageQuotas. 0 means no quota.
+      DefaultStorageQuota: 0
+
+      # Quotas for individual users and projects (0 means no
+      # quota), e.g.:
+      #
+      # StorageQuotas:
+      #   zzzzz-tpzed-xurymjxw79nv3jz: 10TiB
+      #   zzzzz-j7d0g-fffffffffffffff: 100TiB
+      StorageQuotas: {}
+
     Login:
       # One of the following mechanisms (SSO, Google, PAM, LDAP, or
       # LoginCluster) should be enabled; see
@@ -803,6 +1054,11 @@ Clusters:
 
       # Extra arguments to add to crunch-run invocation
       # Example: ["--cgroup-parent-subsystem=memory"]
+      #
+      # To cache Keep blocks on each compute node's local disk,
+      # so containers on the same node don't retrieve the same
+      # data again, add ["--disk-cache-dir=/var/cache/arvados/keep",
+      # "--disk-cache-size=10000000000"].
       CrunchRunArgumentsList: []
 
       # Extra RAM to reserve on the node, in addition to
@@ -1094,6 +1350,30 @@ Clusters:
         Price: 0.1
         Preemptible: false
 
+    StorageClasses:
+
+      # Use the storage class name as the key (in place of "SAMPLE"
+      # in this sample entry). Storage classes that are not listed
+      # here store each block as full replicas, according to the
+      # replication level requested by each collection.
+      SAMPLE:
+        # If DataShards is greater than zero, keep-balance stores
+        # each block in this class as DataShards+ParityShards
+        # erasure-coded shards on distinct volumes, instead of full
+        # replicas. The block can be read as long as any DataShards
+        # of the shards are available. Raw storage used is
+        # (DataShards+ParityShards)/DataShards times the block size.
+        #
+        # Full replicas are kept until all shards have been written,
+        # so it is safe to add or remove erasure coding for a class
+        # with existing data. Changing DataShards for a class that
+        # already has erasure-coded data is not supported.
+        #
+        # DataShards must be at least 2, ParityShards must be at
+        # least 1, and the total must not exceed 256.
+        DataShards: 0
+        ParityShards: 0
+
     Volumes:
       SAMPLE:
         # AccessViaHosts specifies which keepstore processes can read
@@ -1119,6 +1399,20 @@ Clusters:
         StorageClasses:
           default: true
           SAMPLE: true
+
+        # Compress blocks when writing them to this volume, and
+        # decompress them transparently when reading. Blocks stored
+        # without compression (e.g., before Compression was enabled)
+        # remain readable. Compression does not affect block
+        # locators. The volume's index lists a block without a size
+        # if keepstore hasn't read or written it since it started,
+        # rather than reading every block to find its size;
+        # keep-balance matches such entries by hash. With the
+        # Encrypted driver, blocks are compressed before they are
+        # encrypted.
+        #
+        # Supported values are "" (no compression) and "zstd".
+        Compression: ""
         Driver: s3
         DriverParameters:
           # for s3 driver -- see
@@ -1161,6 +1455,45 @@ Clusters:
           WriteRaceInterval: 15s
           WriteRacePollTime: 1s
 
+          # for GCS driver -- Bucket, Endpoint, IndexPageSize,
+          # RaceWindow, and UnsafeDelete have the same meaning as
+          # for the s3 driver (an empty Endpoint means the default
+          # Google Cloud Storage JSON API endpoint), and
+          # RequestTimeout has the same meaning as for the azure
+          # driver. If CredentialsFile is empty, Google application
+          # default credentials are used, e.g., the service account
+          # attached to the GCE instance where keepstore is running.
+          CredentialsFile: ""
+
+          # for Encrypted driver -- blocks are encrypted using
+          # Collections.BlobEncryptionKeys, then stored on an
+          # underlying volume using the given Driver and
+          # DriverParameters, e.g.:
+          #
+          #   Driver: Encrypted
+          #   DriverParameters:
+          #     Driver: S3
+          #     DriverParameters:
+          #       Bucket: aaaaa
+          #       ...
+          Driver: ""
+          DriverParameters: {}
+
+          # for Cached driver -- blocks are stored on an underlying
+          # volume given by Driver and DriverParameters (as for the
+          # Encrypted driver), and copies of recently read blocks
+          # are kept in a local directory, CacheRoot, which must not
+          # be used by any other volume. When the cache exceeds
+          # CacheSize, the least recently used blocks are removed
+          # from the cache. If CacheMaxAge is non-zero, blocks that
+          # have not been used for CacheMaxAge are also removed. If
+          # WriteThrough is true, newly written blocks are added to
+          # the cache as well.
+          CacheRoot: ""
+          CacheSize: 0
+          CacheMaxAge: 0s
+          WriteThrough: false
+
           # for local directory driver -- see
           # https://doc.arvados.org/install/configure-fs-storage.html
           Root: /var/lib/arvados/keep-data
@@ -273,6 +273,8 @@ func (ldr *Loader) Load() (*arvados.Config, error) {
 			checkKeyConflict(fmt.Sprintf("Clusters.%s.PostgreSQL.Connection", id), cc.PostgreSQL.Connection),
 			ldr.checkEmptyKeepstores(cc),
 			ldr.checkUnlistedKeepstores(cc),
+			checkStorageClasses(fmt.Sprintf("Clusters.%s.StorageClasses", id), cc.StorageClasses),
+			checkMaintenanceWindows(fmt.Sprintf("Clusters.%s.Collections", id), cc.Collections.BalanceMaintenanceWindows, cc.Collections.BalanceMaintenanceTimeZone),
 		} {
 			if err != nil {
 				return nil, err
@@ -294,6 +296,26 @@ func checkKeyConflict(label string, m map[string]string) error {
 	return nil
 }
 
+func checkStorageClasses(label string, classes map[string]arvados.StorageClassConfig) error {
+	for name, sc := range classes {
+		if !sc.ErasureCoded() {
+			continue
+		}
+		if sc.DataShards < 2 || sc.ParityShards < 1 || sc.DataShards+sc.ParityShards > 256 {
+			return fmt.Errorf("%s.%s: invalid erasure coding parameters DataShards=%d, ParityShards=%d (need DataShards>=2, ParityShards>=1, total<=256)", label, name, sc.DataShards, sc.ParityShards)
+		}
+	}
+	return nil
+}
+
+func checkMaintenanceWindows(label string, windows []string, timezone string) error {
+	_, err := arvados.NewMaintenanceSchedule(windows, timezone)
+	if err != nil {
+		return fmt.Errorf("%s.BalanceMaintenanceWindows: %v", label, err)
+	}
+	return nil
+}
+
 func removeSampleKeys(m map[string]interface{}) {
 	delete(m, "SAMPLE")
 	for _, v := range m {
@@ -291,6 +291,51 @@ Clusters:
 	c.Check(err, check.ErrorMatches, `Clusters.zzzzz.PostgreSQL.Connection: multiple entries for "(dbname|host)".*`)
 }
 
+func (s *LoadSuite) TestErasureCodingParameters(c *check.C) {
+	for _, trial := range []struct {
+		data, parity int
+		ok           bool
+	}{
+		{0, 0, true},
+		{4, 2, true},
+		{1, 2, false},
+		{4, 0, false},
+		{200, 57, false},
+	} {
+		_, err := testLoader(c, fmt.Sprintf(`
+Clusters:
+ zzzzz:
+  StorageClasses:
+   archival:
+    DataShards: %d
+    ParityShards: %d
+`, trial.data, trial.parity), nil).Load()
+		if trial.ok {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, `Clusters.zzzzz.StorageClasses.archival: invalid erasure coding parameters.*`)
+		}
+	}
+}
+
+func (s *LoadSuite) TestMaintenanceWindows(c *check.C) {
+	_, err := testLoader(c, `
+Clusters:
+ zzzzz:
+  Collections:
+   BalanceMaintenanceWindows: ["Mon-Fri 20:00-06:00", "Sat,Sun"]
+   BalanceMaintenanceTimeZone: UTC
+`, nil).Load()
+	c.Check(err, check.IsNil)
+	_, err = testLoader(c, `
+Clusters:
+ zzzzz:
+  Collections:
+   BalanceMaintenanceWindows: ["Mon-Fri 8pm-6am"]
+`, nil).Load()
+	c.Check(err, check.ErrorMatches, `Clusters.zzzzz.Collections.BalanceMaintenanceWindows: invalid maintenance window "Mon-Fri 8pm-6am".*`)
+}
+
 func (s *LoadSuite) TestBadType(c *check.C) {
 	for _, data := range []string{`
 Clusters:
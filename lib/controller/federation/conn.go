@@ -527,6 +527,10 @@ func (conn *Conn) APIClientAuthorizationCurrent(ctx context.Context, options arv
 	return conn.chooseBackend(options.UUID).APIClientAuthorizationCurrent(ctx, options)
 }
 
+func (conn *Conn) StorageUsageGet(ctx context.Context, options arvados.StorageUsageGetOptions) (arvados.StorageUsage, error) {
+	return conn.chooseBackend(options.OwnerUUID).StorageUsageGet(ctx, options)
+}
+
 type backend interface {
 	arvados.API
 	BaseURL() url.URL
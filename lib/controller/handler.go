@@ -90,6 +90,7 @@ func (h *Handler) setup() {
 	rtr := router.New(federation.New(h.Cluster), ctrlctx.WrapCallsInTransactions(h.db))
 	mux.Handle("/arvados/v1/config", rtr)
 	mux.Handle("/"+arvados.EndpointUserAuthenticate.Path, rtr)
+	mux.Handle("/"+arvados.EndpointStorageUsageGet.Path, rtr)
 
 	if !h.Cluster.ForceLegacyAPI14 {
 		mux.Handle("/arvados/v1/collections", rtr)
@@ -10,6 +10,7 @@ import (
 	"git.arvados.org/arvados.git/lib/controller/railsproxy"
 	"git.arvados.org/arvados.git/lib/controller/rpc"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/auth"
 )
 
 type railsProxy = rpc.Conn
@@ -18,6 +19,7 @@ type Conn struct {
 	cluster     *arvados.Cluster
 	*railsProxy // handles API methods that aren't defined on Conn itself
 	loginController
+	quotas *storageQuotas
 }
 
 func NewConn(cluster *arvados.Cluster) *Conn {
@@ -27,10 +29,26 @@ func NewConn(cluster *arvados.Cluster) *Conn {
 		cluster:         cluster,
 		railsProxy:      railsProxy,
 		loginController: chooseLoginController(cluster, railsProxy),
+		quotas:          newStorageQuotas(cluster),
 	}
+	conn.quotas.getParent = conn.projectParent
 	return &conn
 }
 
+// projectParent returns the owner UUID of the given project, or "" if
+// the given group is not a project.
+func (conn *Conn) projectParent(ctx context.Context, uuid string) (string, error) {
+	ctxRoot := auth.NewContext(ctx, &auth.Credentials{Tokens: []string{conn.cluster.SystemRootToken}})
+	group, err := conn.railsProxy.GroupGet(ctxRoot, arvados.GetOptions{UUID: uuid, Select: []string{"owner_uuid", "group_class"}, IncludeTrash: true})
+	if err != nil {
+		return "", err
+	}
+	if group.GroupClass != "project" {
+		return "", nil
+	}
+	return group.OwnerUUID, nil
+}
+
 func (conn *Conn) Logout(ctx context.Context, opts arvados.LogoutOptions) (arvados.LogoutResponse, error) {
 	return conn.loginController.Logout(ctx, opts)
 }
@@ -0,0 +1,394 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package localdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+)
+
+// How often to retrieve the latest usage report from keep-balance.
+const storageUsageRefresh = time.Minute
+
+// storageQuotas tracks the storage used by each owner, using the
+// usage reported by keep-balance plus the data added by collection
+// updates since then.
+//
+// The usage of a user or project includes the collections in its
+// subprojects, so data added to a project counts toward the quotas
+// of the projects and user above it as well.
+type storageQuotas struct {
+	cluster *arvados.Cluster
+	client  *http.Client
+
+	// getParent returns the owner UUID of the given project, or
+	// "" if the given UUID is a group but not a project. It is
+	// used for projects created since the last usage report.
+	getParent func(ctx context.Context, uuid string) (string, error)
+
+	mtx      sync.Mutex
+	report   *arvados.StorageUsageReport // nil if not retrieved yet
+	fetched  time.Time                   // last attempt to retrieve report
+	fetching bool
+	pending  map[string][]pendingUsage // owner UUID => changes since report
+	parents  map[string]string         // getParent results since report
+}
+
+type pendingUsage struct {
+	bytes int64
+	time  time.Time
+}
+
+func newStorageQuotas(cluster *arvados.Cluster) *storageQuotas {
+	return &storageQuotas{
+		cluster: cluster,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		pending: map[string][]pendingUsage{},
+		parents: map[string]string{},
+	}
+}
+
+// refreshInBackground starts retrieving a new usage report from
+// keep-balance if the current one is stale, without waiting for it.
+func (sq *storageQuotas) refreshInBackground() {
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+	if sq.fetching || time.Since(sq.fetched) < storageUsageRefresh {
+		return
+	}
+	sq.fetching = true
+	go sq.refresh(context.Background())
+}
+
+// refresh retrieves a new usage report from keep-balance. Errors are
+// logged: until a report is available, usage is unknown and quotas
+// are not enforced.
+func (sq *storageQuotas) refresh(ctx context.Context) {
+	report, err := sq.fetchReport(ctx)
+
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+	sq.fetching = false
+	sq.fetched = time.Now()
+	if err != nil {
+		ctxlog.FromContext(ctx).WithError(err).Warn("error retrieving storage usage report from keep-balance")
+		return
+	}
+	sq.report = report
+	sq.parents = map[string]string{}
+	// Discard pending changes that were already counted by
+	// keep-balance.
+	for owner, changes := range sq.pending {
+		var keep []pendingUsage
+		for _, pu := range changes {
+			if pu.time.After(report.UpdatedAt) {
+				keep = append(keep, pu)
+			}
+		}
+		if len(keep) == 0 {
+			delete(sq.pending, owner)
+		} else {
+			sq.pending[owner] = keep
+		}
+	}
+}
+
+func (sq *storageQuotas) fetchReport(ctx context.Context) (*arvados.StorageUsageReport, error) {
+	var errs []string
+	for u := range sq.cluster.Services.Keepbalance.InternalURLs {
+		base := url.URL(u)
+		target, err := base.Parse("storage_usage")
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		req, err := http.NewRequest("GET", target.String(), nil)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		req.Header.Set("Authorization", "Bearer "+sq.cluster.ManagementToken)
+		resp, err := sq.client.Do(req.WithContext(ctx))
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		var report arvados.StorageUsageReport
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s: %s", target, resp.Status)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&report)
+		}
+		resp.Body.Close()
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		return &report, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("Services.Keepbalance.InternalURLs is empty")
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// usage returns the current storage usage of the given owner. If no
+// usage report is available, UpdatedAt is zero.
+func (sq *storageQuotas) usage(owner string) arvados.StorageUsage {
+	sq.refreshInBackground()
+	su := arvados.StorageUsage{
+		OwnerUUID:  owner,
+		QuotaBytes: sq.cluster.StorageQuota(owner),
+	}
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+	if sq.report == nil {
+		return su
+	}
+	su.UsedBytes = sq.report.Owners[owner]
+	su.UpdatedAt = sq.report.UpdatedAt
+	for _, pu := range sq.pending[owner] {
+		su.UsedBytes += pu.bytes
+	}
+	return su
+}
+
+// Maximum depth of the project tree above a collection's owner.
+// Projects nested more deeply don't count toward the quotas of the
+// projects and user above them.
+const maxProjectDepth = 100
+
+// owners returns the given owner followed by the projects and user
+// above it, nearest first: i.e., the owners whose usage includes the
+// given owner's collections.
+func (sq *storageQuotas) owners(ctx context.Context, owner string) ([]string, error) {
+	owners := []string{owner}
+	for len(owners) < maxProjectDepth && len(owner) == 27 && owner[6:11] == "j7d0g" {
+		sq.mtx.Lock()
+		parent, ok := sq.parents[owner]
+		if !ok && sq.report != nil {
+			parent, ok = sq.report.Parents[owner]
+		}
+		sq.mtx.Unlock()
+		if !ok && sq.getParent != nil {
+			var err error
+			parent, err = sq.getParent(ctx, owner)
+			if err != nil {
+				return nil, err
+			}
+			sq.mtx.Lock()
+			sq.parents[owner] = parent
+			sq.mtx.Unlock()
+		}
+		if parent == "" {
+			break
+		}
+		owners = append(owners, parent)
+		owner = parent
+	}
+	return owners, nil
+}
+
+// check returns an error if adding the given number of bytes would
+// take any of the given owners over quota.
+func (sq *storageQuotas) check(owners []string, added int64) error {
+	if added <= 0 {
+		return nil
+	}
+	for _, owner := range owners {
+		if sq.cluster.StorageQuota(owner) <= 0 {
+			continue
+		}
+		su := sq.usage(owner)
+		if su.UpdatedAt.IsZero() {
+			// Usage is unknown.
+			return nil
+		}
+		if su.UsedBytes+added > su.QuotaBytes {
+			return httpserver.ErrorWithStatus(fmt.Errorf("storage quota exceeded: owner %s is using %d of %d bytes, and this change would add %d bytes", owner, su.UsedBytes, su.QuotaBytes, added), http.StatusForbidden)
+		}
+	}
+	return nil
+}
+
+// add records that the given number of bytes were added to the
+// given owners' usage since the last usage report.
+func (sq *storageQuotas) add(owners []string, added int64) {
+	if added <= 0 {
+		return
+	}
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+	now := time.Now()
+	for _, owner := range owners {
+		sq.pending[owner] = append(sq.pending[owner], pendingUsage{bytes: added, time: now})
+	}
+}
+
+// manifestBlocks returns the size of each distinct block referenced
+// by the given manifest text.
+func manifestBlocks(manifestText string) (map[arvados.SizedDigest]int64, error) {
+	blocks := map[arvados.SizedDigest]int64{}
+	if manifestText == "" {
+		return blocks, nil
+	}
+	sds, err := (&arvados.Collection{ManifestText: manifestText}).SizedDigests()
+	if err != nil {
+		return nil, err
+	}
+	for _, sd := range sds {
+		size, err := strconv.ParseInt(string(sd[33:]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block locator %q", sd)
+		}
+		blocks[sd] = size
+	}
+	return blocks, nil
+}
+
+func sumBlockSizes(blocks map[arvados.SizedDigest]int64) int64 {
+	var total int64
+	for _, size := range blocks {
+		total += size
+	}
+	return total
+}
+
+// CollectionCreate checks the storage quotas of the owner and the
+// projects and user above it before creating the collection. The new
+// collection is assumed to add all of its blocks to the owner's
+// usage, even if some of them are already referenced by other
+// collections with the same owner.
+func (conn *Conn) CollectionCreate(ctx context.Context, opts arvados.CreateOptions) (arvados.Collection, error) {
+	if !conn.cluster.StorageQuotasEnabled() {
+		return conn.railsProxy.CollectionCreate(ctx, opts)
+	}
+	manifestText, _ := opts.Attrs["manifest_text"].(string)
+	blocks, err := manifestBlocks(manifestText)
+	if err != nil {
+		// Let RailsAPI report the invalid manifest.
+		return conn.railsProxy.CollectionCreate(ctx, opts)
+	}
+	added := sumBlockSizes(blocks)
+	if added == 0 {
+		return conn.railsProxy.CollectionCreate(ctx, opts)
+	}
+	owner, _ := opts.Attrs["owner_uuid"].(string)
+	if owner == "" {
+		user, err := conn.railsProxy.UserGetCurrent(ctx, arvados.GetOptions{})
+		if err != nil {
+			return arvados.Collection{}, err
+		}
+		owner = user.UUID
+	}
+	owners, err := conn.quotas.owners(ctx, owner)
+	if err != nil {
+		return arvados.Collection{}, err
+	}
+	err = conn.quotas.check(owners, added)
+	if err != nil {
+		return arvados.Collection{}, err
+	}
+	coll, err := conn.railsProxy.CollectionCreate(ctx, opts)
+	if err == nil {
+		conn.quotas.add(owners, added)
+	}
+	return coll, err
+}
+
+// CollectionUpdate checks the storage quotas of the owner and the
+// projects and user above it before updating the collection. Only
+// blocks that were not already referenced by the collection count
+// toward the owner's usage -- unless the collection is being moved
+// to a different owner, in which case all of its blocks count toward
+// the new owner's usage.
+func (conn *Conn) CollectionUpdate(ctx context.Context, opts arvados.UpdateOptions) (arvados.Collection, error) {
+	manifestText, setManifest := opts.Attrs["manifest_text"].(string)
+	owner, setOwner := opts.Attrs["owner_uuid"].(string)
+	if !conn.cluster.StorageQuotasEnabled() || (!setManifest && !setOwner) {
+		return conn.railsProxy.CollectionUpdate(ctx, opts)
+	}
+	old, err := conn.railsProxy.CollectionGet(ctx, arvados.GetOptions{
+		UUID:   opts.UUID,
+		Select: []string{"uuid", "owner_uuid", "manifest_text"},
+	})
+	if err != nil {
+		return arvados.Collection{}, err
+	}
+	if !setOwner || owner == "" {
+		owner = old.OwnerUUID
+	}
+	if !setManifest {
+		manifestText = old.ManifestText
+	}
+	blocks, err := manifestBlocks(manifestText)
+	if err != nil {
+		// Let RailsAPI report the invalid manifest.
+		return conn.railsProxy.CollectionUpdate(ctx, opts)
+	}
+	if owner == old.OwnerUUID {
+		oldBlocks, err := manifestBlocks(old.ManifestText)
+		if err == nil {
+			for sd := range oldBlocks {
+				delete(blocks, sd)
+			}
+		}
+	}
+	added := sumBlockSizes(blocks)
+	if added == 0 {
+		return conn.railsProxy.CollectionUpdate(ctx, opts)
+	}
+	owners, err := conn.quotas.owners(ctx, owner)
+	if err != nil {
+		return arvados.Collection{}, err
+	}
+	err = conn.quotas.check(owners, added)
+	if err != nil {
+		return arvados.Collection{}, err
+	}
+	coll, err := conn.railsProxy.CollectionUpdate(ctx, opts)
+	if err == nil {
+		conn.quotas.add(owners, added)
+	}
+	return coll, err
+}
+
+// StorageUsageGet returns the storage usage of the given owner (by
+// default, the current user). Users can retrieve their own usage and
+// the usage of projects they can read. Admins can retrieve the usage
+// of any owner.
+func (conn *Conn) StorageUsageGet(ctx context.Context, opts arvados.StorageUsageGetOptions) (arvados.StorageUsage, error) {
+	user, err := conn.railsProxy.UserGetCurrent(ctx, arvados.GetOptions{})
+	if err != nil {
+		return arvados.StorageUsage{}, err
+	}
+	owner := opts.OwnerUUID
+	if owner == "" {
+		owner = user.UUID
+	}
+	if owner != user.UUID && !user.IsAdmin {
+		if len(owner) != 27 || owner[6:11] != "j7d0g" {
+			return arvados.StorageUsage{}, httpserver.ErrorWithStatus(errors.New("permission denied"), http.StatusForbidden)
+		}
+		// Check that the current user can read the project.
+		_, err := conn.railsProxy.GroupGet(ctx, arvados.GetOptions{UUID: owner, Select: []string{"uuid"}})
+		if err != nil {
+			return arvados.StorageUsage{}, err
+		}
+	}
+	return conn.quotas.usage(owner), nil
+}
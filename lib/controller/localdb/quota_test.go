@@ -0,0 +1,206 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package localdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&QuotaSuite{})
+
+type QuotaSuite struct {
+	cluster *arvados.Cluster
+	ctx     context.Context
+	server  *httptest.Server
+
+	mtx      sync.Mutex
+	report   *arvados.StorageUsageReport
+	requests int
+}
+
+func (s *QuotaSuite) SetUpTest(c *check.C) {
+	s.ctx = ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	s.report = nil
+	s.requests = 0
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.requests++
+		if req.URL.Path != "/storage_usage" || req.Header.Get("Authorization") != "Bearer "+arvadostest.ManagementToken {
+			w.WriteHeader(http.StatusForbidden)
+		} else if s.report == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			json.NewEncoder(w).Encode(s.report)
+		}
+	}))
+	s.cluster = &arvados.Cluster{ManagementToken: arvadostest.ManagementToken}
+	s.cluster.Collections.DefaultStorageQuota = 1000
+	s.cluster.Collections.StorageQuotas = map[string]arvados.ByteSize{
+		"zzzzz-j7d0g-ggggggggggggggg": 0,
+	}
+	arvadostest.SetServiceURL(&s.cluster.Services.Keepbalance, s.server.URL+"/")
+}
+
+func (s *QuotaSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+func (s *QuotaSuite) setReport(updatedAt time.Time, owners map[string]int64, parents map[string]string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.report = &arvados.StorageUsageReport{UpdatedAt: updatedAt, Owners: owners, Parents: parents}
+}
+
+func (s *QuotaSuite) getRequests() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.requests
+}
+
+func (s *QuotaSuite) TestUsage(c *check.C) {
+	sq := newStorageQuotas(s.cluster)
+	owner := "zzzzz-tpzed-xurymjxw79nv3jz"
+	owners := []string{owner}
+
+	// Until keep-balance reports usage, quotas are not
+	// enforced.
+	sq.refresh(s.ctx)
+	c.Check(sq.usage(owner).UpdatedAt.IsZero(), check.Equals, true)
+	c.Check(sq.check(owners, 2000), check.IsNil)
+	c.Check(s.getRequests(), check.Equals, 1)
+
+	t0 := time.Now().Add(-time.Minute)
+	s.setReport(t0, map[string]int64{owner: 900}, nil)
+	sq.refresh(s.ctx)
+	su := sq.usage(owner)
+	c.Check(su.UsedBytes, check.Equals, int64(900))
+	c.Check(su.QuotaBytes, check.Equals, int64(1000))
+	c.Check(su.UpdatedAt.Equal(t0), check.Equals, true)
+	c.Check(su.Exceeded(), check.Equals, false)
+	c.Check(sq.check(owners, 100), check.IsNil)
+	c.Check(sq.check(owners, 101), check.ErrorMatches, `storage quota exceeded: .*`)
+	c.Check(sq.check(owners, 0), check.IsNil)
+	c.Check(sq.check([]string{"zzzzz-j7d0g-ggggggggggggggg"}, 1e9), check.IsNil)
+
+	// Usage report is cached.
+	c.Check(s.getRequests(), check.Equals, 2)
+
+	// Data added since the report is counted.
+	sq.add(owners, 100)
+	su = sq.usage(owner)
+	c.Check(su.UsedBytes, check.Equals, int64(1000))
+	c.Check(su.Exceeded(), check.Equals, true)
+	c.Check(sq.check(owners, 1), check.ErrorMatches, `storage quota exceeded: .*`)
+
+	// ...until keep-balance reports usage that includes it.
+	s.setReport(time.Now(), map[string]int64{owner: 950}, nil)
+	sq.refresh(s.ctx)
+	su = sq.usage(owner)
+	c.Check(su.UsedBytes, check.Equals, int64(950))
+	c.Check(sq.pending, check.HasLen, 0)
+
+	// If keep-balance becomes unreachable, the last report is
+	// still used.
+	s.server.Close()
+	sq.refresh(s.ctx)
+	c.Check(sq.usage(owner).UsedBytes, check.Equals, int64(950))
+}
+
+func (s *QuotaSuite) TestRefreshInBackground(c *check.C) {
+	sq := newStorageQuotas(s.cluster)
+	owner := "zzzzz-tpzed-xurymjxw79nv3jz"
+	s.setReport(time.Now(), map[string]int64{owner: 900}, nil)
+
+	// The first call doesn't wait for the report.
+	sq.usage(owner)
+	for deadline := time.Now().Add(5 * time.Second); sq.usage(owner).UpdatedAt.IsZero() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(sq.usage(owner).UsedBytes, check.Equals, int64(900))
+	c.Check(s.getRequests(), check.Equals, 1)
+}
+
+func (s *QuotaSuite) TestProjectTree(c *check.C) {
+	sq := newStorageQuotas(s.cluster)
+	user := "zzzzz-tpzed-xurymjxw79nv3jz"
+	project := "zzzzz-j7d0g-aaaaaaaaaaaaaaa"
+	subproject := "zzzzz-j7d0g-bbbbbbbbbbbbbbb"
+	newproject := "zzzzz-j7d0g-ccccccccccccccc"
+	s.cluster.Collections.StorageQuotas[project] = 500
+	s.setReport(time.Now(), map[string]int64{user: 900, project: 400, subproject: 400}, map[string]string{
+		project:    user,
+		subproject: project,
+	})
+	sq.refresh(s.ctx)
+
+	// Projects created since the report are looked up.
+	var lookups []string
+	sq.getParent = func(ctx context.Context, uuid string) (string, error) {
+		lookups = append(lookups, uuid)
+		if uuid == newproject {
+			return subproject, nil
+		}
+		return "", errors.New("not found")
+	}
+
+	owners, err := sq.owners(s.ctx, newproject)
+	c.Check(err, check.IsNil)
+	c.Check(owners, check.DeepEquals, []string{newproject, subproject, project, user})
+	owners, err = sq.owners(s.ctx, newproject)
+	c.Check(err, check.IsNil)
+	c.Check(owners, check.DeepEquals, []string{newproject, subproject, project, user})
+	c.Check(lookups, check.DeepEquals, []string{newproject})
+
+	// Data added to a subproject counts toward the quotas of the
+	// projects and user above it.
+	c.Check(sq.check(owners, 100), check.IsNil)
+	c.Check(sq.check(owners, 101), check.ErrorMatches, `storage quota exceeded: owner `+project+` .*`)
+	sq.add(owners, 50)
+	c.Check(sq.usage(user).UsedBytes, check.Equals, int64(950))
+	c.Check(sq.usage(project).UsedBytes, check.Equals, int64(450))
+	c.Check(sq.check(owners, 51), check.ErrorMatches, `storage quota exceeded: owner `+project+` .*`)
+	c.Check(sq.check([]string{user}, 51), check.ErrorMatches, `storage quota exceeded: owner `+user+` .*`)
+
+	// A parent cycle doesn't loop forever.
+	s.setReport(time.Now(), nil, map[string]string{project: subproject, subproject: project})
+	sq.refresh(s.ctx)
+	owners, err = sq.owners(s.ctx, project)
+	c.Check(err, check.IsNil)
+	c.Check(owners, check.HasLen, maxProjectDepth)
+
+	_, err = sq.owners(s.ctx, "zzzzz-j7d0g-ddddddddddddddd")
+	c.Check(err, check.ErrorMatches, `not found`)
+}
+
+func (s *QuotaSuite) TestManifestBlocks(c *check.C) {
+	blocks, err := manifestBlocks("")
+	c.Check(err, check.IsNil)
+	c.Check(blocks, check.HasLen, 0)
+
+	blocks, err = manifestBlocks(". acbd18db4cc2f85cedef654fccc4a4d8+3+Aabcdef@12345678 37b51d194a7513e45b56f6524f2d51f2+3 0:6:foobar\n" +
+		"./dir acbd18db4cc2f85cedef654fccc4a4d8+3 d41d8cd98f00b204e9800998ecf8427e+0 0:3:foo\n")
+	c.Check(err, check.IsNil)
+	c.Check(blocks, check.DeepEquals, map[arvados.SizedDigest]int64{
+		"acbd18db4cc2f85cedef654fccc4a4d8+3": 3,
+		"37b51d194a7513e45b56f6524f2d51f2+3": 3,
+		"d41d8cd98f00b204e9800998ecf8427e+0": 0,
+	})
+	c.Check(sumBlockSizes(blocks), check.Equals, int64(6))
+
+	_, err = manifestBlocks("bogus\n")
+	c.Check(err, check.NotNil)
+}
@@ -319,6 +319,13 @@ func (rtr *router) addRoutes() {
 				return rtr.backend.UserAuthenticate(ctx, *opts.(*arvados.UserAuthenticateOptions))
 			},
 		},
+		{
+			arvados.EndpointStorageUsageGet,
+			func() interface{} { return &arvados.StorageUsageGetOptions{} },
+			func(ctx context.Context, opts interface{}) (interface{}, error) {
+				return rtr.backend.StorageUsageGet(ctx, *opts.(*arvados.StorageUsageGetOptions))
+			},
+		},
 	} {
 		exec := route.exec
 		if rtr.wrapCalls != nil {
@@ -401,6 +401,23 @@ func (conn *Conn) APIClientAuthorizationCurrent(ctx context.Context, options arv
 	return resp, err
 }
 
+func (conn *Conn) StorageUsageGet(ctx context.Context, options arvados.StorageUsageGetOptions) (arvados.StorageUsage, error) {
+	ep := arvados.EndpointStorageUsageGet
+	var resp arvados.StorageUsage
+	err := conn.requestAndDecode(ctx, &resp, ep, nil, options)
+	return resp, err
+}
+
+// GroupGet retrieves a group. It is not (yet) part of the
+// arvados.API interface; it is used by localdb to check whether the
+// caller can read a project.
+func (conn *Conn) GroupGet(ctx context.Context, options arvados.GetOptions) (arvados.Group, error) {
+	ep := arvados.APIEndpoint{Method: "GET", Path: "arvados/v1/groups/{uuid}"}
+	var resp arvados.Group
+	err := conn.requestAndDecode(ctx, &resp, ep, nil, options)
+	return resp, err
+}
+
 type UserSessionAuthInfo struct {
 	Email           string   `json:"email"`
 	AlternateEmails []string `json:"alternate_emails"`
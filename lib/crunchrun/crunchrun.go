@@ -1782,6 +1782,8 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		`Set networking mode for container.  Corresponds to Docker network mode (--net).
     	`)
 	memprofile := flags.String("memprofile", "", "write memory profile to `file` after running container")
+	diskCacheDir := flags.String("disk-cache-dir", "", "cache Keep blocks on disk in this `directory`, which can be shared with other processes on the node")
+	diskCacheSize := flags.Int64("disk-cache-size", 1<<30, "maximum size of disk cache (bytes)")
 	flags.Duration("check-containerd", 0, "Ignored. Exists for compatibility with older versions.")
 
 	ignoreDetachFlag := false
@@ -1851,6 +1853,13 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 	}
 	kc.BlockCache = &keepclient.BlockCache{MaxBlocks: 2}
 	kc.Retries = 4
+	if *diskCacheDir != "" {
+		dc := &keepclient.DiskCache{Dir: *diskCacheDir, MaxBytes: *diskCacheSize}
+		kc.BlockCache.Disk = dc
+		// Keep clients created with the container's token
+		// (see MkArvClient) use the default block cache.
+		keepclient.DefaultBlockCache.Disk = dc
+	}
 
 	// API version 1.21 corresponds to Docker 1.9, which is currently the
 	// minimum version we want to support.
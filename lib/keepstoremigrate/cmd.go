@@ -0,0 +1,122 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstoremigrate
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/config"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/sirupsen/logrus"
+)
+
+var Command command
+
+type command struct{}
+
+func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	logger := ctxlog.New(stderr, "text", "info")
+	defer func() {
+		if err != nil {
+			logger.WithError(err).Error("fatal")
+		}
+		logger.Info("exiting")
+	}()
+
+	loader := config.NewLoader(stdin, logger)
+	loader.SkipLegacy = true
+
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage:
+	%s [options ...] -from volume-uuid -to volume-uuid[,volume-uuid...]
+
+	This program copies every block stored on one keepstore
+	volume to one or more other volumes, e.g., to drain a volume
+	before retiring it. Each block is written to one of the target
+	volumes, and read back to verify its hash.
+
+	All of the target volumes must offer every storage class
+	offered by the source volume, and must be writable.
+
+	If a checkpoint file is given, each block is recorded there
+	after it has been copied and verified, and blocks listed there
+	are skipped the next time the program runs. An interrupted
+	migration can be resumed by running the program again with the
+	same checkpoint file.
+
+	The source copies are not trashed: keep-balance trashes
+	surplus replicas as usual. To retire the source volume,
+	remove it from the cluster configuration after the migration
+	is complete.
+
+	Exit status will be zero if all blocks were copied
+	successfully.
+Options:
+`, prog)
+		flags.PrintDefaults()
+	}
+	loader.SetupFlags(flags)
+	from := flags.String("from", "", "UUID of the volume to copy blocks from")
+	to := flags.String("to", "", "comma-separated UUIDs of the volumes to copy blocks to")
+	checkpoint := flags.String("checkpoint", "", "file to record progress in, and resume from")
+	concurrency := flags.Int("concurrency", 4, "number of blocks to copy at a time")
+	progressInterval := flags.Duration("progress-interval", 30*time.Second, "time between progress reports")
+	loglevel := flags.String("log-level", "info", "logging level (debug, info, ...)")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	if *from == "" || *to == "" || len(flags.Args()) > 0 || *concurrency < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	lvl, err := logrus.ParseLevel(*loglevel)
+	if err != nil {
+		return 2
+	}
+	logger.SetLevel(lvl)
+
+	cfg, err := loader.Load()
+	if err != nil {
+		return 1
+	}
+	cluster, err := cfg.GetCluster("")
+	if err != nil {
+		return 1
+	}
+	client, err := arvados.NewClientFromConfig(cluster)
+	if err != nil {
+		return 1
+	}
+	client.AuthToken = cluster.SystemRootToken
+	mgr := migrator{
+		client:           client,
+		logger:           logger,
+		from:             *from,
+		to:               strings.Split(*to, ","),
+		checkpoint:       *checkpoint,
+		concurrency:      *concurrency,
+		progressInterval: *progressInterval,
+	}
+	err = mgr.Run(context.Background())
+	if err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,344 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstoremigrate
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+type migrator struct {
+	client           *arvados.Client
+	logger           logrus.FieldLogger
+	from             string
+	to               []string
+	checkpoint       string
+	concurrency      int
+	progressInterval time.Duration
+
+	// Keep services to look for volumes on. If nil, Run uses
+	// all non-proxy services listed by the API server.
+	services []arvados.KeepService
+
+	srcSvc  *arvados.KeepService
+	dstSvcs []*arvados.KeepService
+	next    uint32
+
+	// Progress counters (updated atomically)
+	copiedBlocks  int64
+	skippedBlocks int64
+	failedBlocks  int64
+	copiedBytes   int64
+}
+
+// Run copies all blocks from m.from to m.to.
+//
+// The source copies are left in place. Trashing them is left to
+// keep-balance, which also knows whether each block is referenced
+// and how many replicas it needs.
+func (m *migrator) Run(ctx context.Context) error {
+	if err := m.findMounts(); err != nil {
+		return err
+	}
+
+	done, err := loadCheckpoint(m.checkpoint)
+	if err != nil {
+		return err
+	}
+	var ckpt *os.File
+	if m.checkpoint != "" {
+		ckpt, err = os.OpenFile(m.checkpoint, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+		defer ckpt.Close()
+	}
+
+	srcIndex, err := m.srcSvc.IndexMount(ctx, m.client, m.from, "")
+	if err != nil {
+		return fmt.Errorf("error getting index of source volume: %s", err)
+	}
+	// existing[hash] is the index (in m.to) of a target volume
+	// that already has a copy of the block.
+	existing := map[string]int{}
+	for i, uuid := range m.to {
+		idx, err := m.dstSvcs[i].IndexMount(ctx, m.client, uuid, "")
+		if err != nil {
+			return fmt.Errorf("error getting index of target volume %s: %s", uuid, err)
+		}
+		for _, ent := range idx {
+			existing[string(ent.SizedDigest[:32])] = i
+		}
+	}
+
+	var todo []arvados.KeepServiceIndexEntry
+	for _, ent := range srcIndex {
+		if !done[string(ent.SizedDigest[:32])] {
+			todo = append(todo, ent)
+		}
+	}
+	m.logger.WithFields(logrus.Fields{
+		"SourceBlocks":    len(srcIndex),
+		"AlreadyMigrated": len(srcIndex) - len(todo),
+	}).Info("starting migration")
+
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		m.reportProgress(len(todo), stopProgress)
+	}()
+
+	var ckptMtx sync.Mutex
+	todoChan := make(chan arvados.KeepServiceIndexEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < m.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ent := range todoChan {
+				hash := string(ent.SizedDigest[:32])
+				logger := m.logger.WithField("Block", hash)
+				dst, copied, err := m.migrateBlock(ctx, hash, existing)
+				if err != nil {
+					logger.WithError(err).Error("migration failed")
+					atomic.AddInt64(&m.failedBlocks, 1)
+					continue
+				}
+				if copied > 0 {
+					logger.WithField("Target", dst).Debug("copied")
+					atomic.AddInt64(&m.copiedBlocks, 1)
+					atomic.AddInt64(&m.copiedBytes, int64(copied))
+				} else {
+					logger.WithField("Target", dst).Debug("already on target")
+					atomic.AddInt64(&m.skippedBlocks, 1)
+				}
+				ckptMtx.Lock()
+				done[hash] = true
+				if ckpt != nil {
+					_, err = fmt.Fprintln(ckpt, hash)
+				}
+				ckptMtx.Unlock()
+				if err != nil {
+					logger.WithError(err).Error("error writing checkpoint file")
+				}
+			}
+		}()
+	}
+	for _, ent := range todo {
+		todoChan <- ent
+	}
+	close(todoChan)
+	wg.Wait()
+	close(stopProgress)
+	<-progressDone
+
+	if n := atomic.LoadInt64(&m.failedBlocks); n > 0 {
+		return fmt.Errorf("failed to migrate %d of %d blocks", n, len(todo))
+	}
+	return nil
+}
+
+// findMounts finds the keep services that provide access to the
+// source and target volumes, and checks that the target volumes are
+// suitable.
+func (m *migrator) findMounts() error {
+	if m.services == nil {
+		err := m.client.EachKeepService(func(svc arvados.KeepService) error {
+			if svc.ServiceType != "proxy" {
+				m.services = append(m.services, svc)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error getting list of keep services: %s", err)
+		}
+	}
+	type found struct {
+		svc *arvados.KeepService
+		mnt arvados.KeepMount
+	}
+	mounts := map[string]found{}
+	for i := range m.services {
+		svc := &m.services[i]
+		mnts, err := svc.Mounts(m.client)
+		if err != nil {
+			return err
+		}
+		for _, mnt := range mnts {
+			// Prefer a service that can write to the
+			// volume.
+			if f, ok := mounts[mnt.UUID]; !ok || f.mnt.ReadOnly && !mnt.ReadOnly {
+				mounts[mnt.UUID] = found{svc, mnt}
+			}
+		}
+	}
+
+	src, ok := mounts[m.from]
+	if !ok {
+		return fmt.Errorf("source volume %s not found on any keep service", m.from)
+	}
+	m.srcSvc = src.svc
+	m.dstSvcs = nil
+	for _, uuid := range m.to {
+		dst, ok := mounts[uuid]
+		if !ok {
+			return fmt.Errorf("target volume %s not found on any keep service", uuid)
+		} else if uuid == m.from {
+			return fmt.Errorf("target volume %s is the same as the source volume", uuid)
+		} else if dst.mnt.ReadOnly {
+			return fmt.Errorf("target volume %s is read-only", uuid)
+		}
+		for class, ok := range src.mnt.StorageClasses {
+			if ok && !dst.mnt.StorageClasses[class] {
+				return fmt.Errorf("target volume %s does not offer storage class %q, which is offered by source volume %s", uuid, class, m.from)
+			}
+		}
+		if dst.mnt.Degraded {
+			m.logger.Warnf("target volume %s is degraded", uuid)
+		}
+		m.dstSvcs = append(m.dstSvcs, dst.svc)
+	}
+	return nil
+}
+
+// migrateBlock ensures the given block is stored on one of the
+// target volumes, and returns the target volume's UUID and the number
+// of bytes copied (zero if the block was already there).
+func (m *migrator) migrateBlock(ctx context.Context, hash string, existing map[string]int) (string, int, error) {
+	var dst int
+	if i, ok := existing[hash]; ok {
+		dst = i
+		err := m.verify(ctx, m.dstSvcs[dst], m.to[dst], hash)
+		if err == nil {
+			return m.to[dst], 0, nil
+		}
+		m.logger.WithField("Block", hash).WithError(err).Warn("existing copy on target volume is not usable, copying again")
+	} else {
+		dst = int(atomic.AddUint32(&m.next, 1)-1) % len(m.to)
+	}
+	// Stream the block from the source to the target. The
+	// target keepstore checks the hash before storing it; the
+	// hash is also computed here so a corrupt source copy can be
+	// reported as such.
+	rdr, size, err := m.srcSvc.GetMountBlockReader(ctx, m.client, m.from, hash)
+	if err != nil {
+		return "", 0, fmt.Errorf("error reading source: %s", err)
+	}
+	defer rdr.Close()
+	hasher := md5.New()
+	counter := &countingWriter{}
+	err = m.dstSvcs[dst].PutMountBlockReader(ctx, m.client, m.to[dst], hash, io.TeeReader(rdr, io.MultiWriter(hasher, counter)), size)
+	if h := fmt.Sprintf("%x", hasher.Sum(nil)); counter.n == size && h != hash {
+		return "", 0, fmt.Errorf("source data is corrupt (hash %s)", h)
+	} else if err != nil {
+		return "", 0, fmt.Errorf("error writing to %s: %s", m.to[dst], err)
+	}
+	err = m.verify(ctx, m.dstSvcs[dst], m.to[dst], hash)
+	if err != nil {
+		return "", 0, err
+	}
+	return m.to[dst], int(size), nil
+}
+
+// verify reads back the given block from the given volume and checks
+// its hash.
+func (m *migrator) verify(ctx context.Context, svc *arvados.KeepService, uuid, hash string) error {
+	rdr, _, err := svc.GetMountBlockReader(ctx, m.client, uuid, hash)
+	if err != nil {
+		return fmt.Errorf("error reading back from %s: %s", uuid, err)
+	}
+	defer rdr.Close()
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, rdr); err != nil {
+		return fmt.Errorf("error reading back from %s: %s", uuid, err)
+	}
+	if h := fmt.Sprintf("%x", hasher.Sum(nil)); h != hash {
+		return fmt.Errorf("data read back from %s is corrupt (hash %s)", uuid, h)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+func (m *migrator) reportProgress(total int, stop <-chan struct{}) {
+	t0 := time.Now()
+	report := func(msg string) {
+		copied := atomic.LoadInt64(&m.copiedBlocks)
+		skipped := atomic.LoadInt64(&m.skippedBlocks)
+		failed := atomic.LoadInt64(&m.failedBlocks)
+		bytes := atomic.LoadInt64(&m.copiedBytes)
+		elapsed := time.Since(t0)
+		m.logger.WithFields(logrus.Fields{
+			"Blocks":        total,
+			"CopiedBlocks":  copied,
+			"SkippedBlocks": skipped,
+			"FailedBlocks":  failed,
+			"CopiedBytes":   bytes,
+			"Elapsed":       elapsed.Round(time.Second).String(),
+			"MiBPerSecond":  fmt.Sprintf("%.1f", float64(bytes)/elapsed.Seconds()/(1<<20)),
+		}).Info(msg)
+	}
+	var tick <-chan time.Time
+	if m.progressInterval > 0 {
+		ticker := time.NewTicker(m.progressInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			report("progress")
+		case <-stop:
+			report("finished copying")
+			return
+		}
+	}
+}
+
+// loadCheckpoint returns the set of block hashes listed in the given
+// checkpoint file. A missing file is equivalent to an empty one.
+func loadCheckpoint(path string) (map[string]bool, error) {
+	done := map[string]bool{}
+	if path == "" {
+		return done, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); len(line) == 32 {
+			done[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading checkpoint file %s: %s", path, err)
+	}
+	return done, nil
+}
@@ -0,0 +1,228 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstoremigrate
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&MigrateSuite{})
+
+type MigrateSuite struct {
+	servers []*httptest.Server
+	stubs   []*stubKeepstore
+	m       *migrator
+}
+
+// stubKeepstore implements the parts of the keepstore API used by
+// the migrator.
+type stubKeepstore struct {
+	mounts []arvados.KeepMount
+	blocks map[string]map[string][]byte // mount UUID -> hash -> data
+	puts   int
+	mtx    sync.Mutex
+}
+
+func (ks *stubKeepstore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/mounts":
+		json.NewEncoder(w).Encode(ks.mounts)
+	case len(parts) == 3 && parts[0] == "mounts" && parts[2] == "blocks":
+		for hash, data := range ks.blocks[parts[1]] {
+			fmt.Fprintf(w, "%s+%d 1234567890123456789\n", hash, len(data))
+		}
+		w.Write([]byte("\n"))
+	case len(parts) == 4 && parts[0] == "mounts" && r.Method == "GET":
+		data, ok := ks.blocks[parts[1]][parts[3]]
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case len(parts) == 4 && parts[0] == "mounts" && r.Method == "PUT":
+		// Like keepstore, require a Content-Length and
+		// check the hash.
+		if r.ContentLength < 0 {
+			http.Error(w, "Length Required", http.StatusLengthRequired)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		if fmt.Sprintf("%x", md5.Sum(data)) != parts[3] {
+			http.Error(w, "Hash verification failed", http.StatusUnprocessableEntity)
+			return
+		}
+		ks.blocks[parts[1]][parts[3]] = data
+		ks.puts++
+	default:
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}
+}
+
+func (s *MigrateSuite) SetUpTest(c *check.C) {
+	s.stubs = []*stubKeepstore{
+		{
+			mounts: []arvados.KeepMount{
+				{UUID: "zzzzz-nyw5e-000000000000000", StorageClasses: map[string]bool{"default": true}},
+				{UUID: "zzzzz-nyw5e-000000000000001", StorageClasses: map[string]bool{"default": true, "archival": true}},
+			},
+			blocks: map[string]map[string][]byte{
+				"zzzzz-nyw5e-000000000000000": {},
+				"zzzzz-nyw5e-000000000000001": {},
+			},
+		},
+		{
+			mounts: []arvados.KeepMount{
+				{UUID: "zzzzz-nyw5e-000000000000002", StorageClasses: map[string]bool{"default": true}},
+				{UUID: "zzzzz-nyw5e-000000000000003", StorageClasses: map[string]bool{"default": true}, ReadOnly: true},
+			},
+			blocks: map[string]map[string][]byte{
+				"zzzzz-nyw5e-000000000000002": {},
+				"zzzzz-nyw5e-000000000000003": {},
+			},
+		},
+	}
+	var services []arvados.KeepService
+	s.servers = nil
+	for i, stub := range s.stubs {
+		srv := httptest.NewServer(stub)
+		s.servers = append(s.servers, srv)
+		host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+		c.Assert(err, check.IsNil)
+		portnum, _ := strconv.Atoi(port)
+		services = append(services, arvados.KeepService{
+			UUID:        fmt.Sprintf("zzzzz-bi6l4-00000000000000%d", i),
+			ServiceHost: host,
+			ServicePort: portnum,
+			ServiceType: "disk",
+		})
+	}
+	for i := 0; i < 10; i++ {
+		data := []byte(fmt.Sprintf("block %d", i))
+		s.stubs[0].blocks["zzzzz-nyw5e-000000000000000"][fmt.Sprintf("%x", md5.Sum(data))] = data
+	}
+	s.m = &migrator{
+		client:      &arvados.Client{AuthToken: "test-token"},
+		logger:      ctxlog.TestLogger(c),
+		from:        "zzzzz-nyw5e-000000000000000",
+		to:          []string{"zzzzz-nyw5e-000000000000001", "zzzzz-nyw5e-000000000000002"},
+		concurrency: 3,
+		services:    services,
+	}
+}
+
+func (s *MigrateSuite) TearDownTest(c *check.C) {
+	for _, srv := range s.servers {
+		srv.Close()
+	}
+}
+
+func (s *MigrateSuite) TestMigrate(c *check.C) {
+	// One block is already on a target volume.
+	for hash, data := range s.stubs[0].blocks[s.m.from] {
+		s.stubs[1].blocks["zzzzz-nyw5e-000000000000002"][hash] = data
+		break
+	}
+	s.m.checkpoint = c.MkDir() + "/checkpoint"
+	err := s.m.Run(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Check(s.m.copiedBlocks, check.Equals, int64(9))
+	c.Check(s.m.skippedBlocks, check.Equals, int64(1))
+	c.Check(s.stubs[0].blocks["zzzzz-nyw5e-000000000000001"], check.Not(check.HasLen), 0)
+	c.Check(s.stubs[1].blocks["zzzzz-nyw5e-000000000000002"], check.Not(check.HasLen), 1)
+	c.Check(len(s.stubs[0].blocks["zzzzz-nyw5e-000000000000001"])+len(s.stubs[1].blocks["zzzzz-nyw5e-000000000000002"]), check.Equals, 10)
+	c.Check(s.stubs[0].blocks[s.m.from], check.HasLen, 10)
+
+	buf, err := ioutil.ReadFile(s.m.checkpoint)
+	c.Assert(err, check.IsNil)
+	c.Check(strings.Split(strings.TrimSpace(string(buf)), "\n"), check.HasLen, 10)
+
+	// Resume from checkpoint: nothing left to do.
+	puts := s.stubs[0].puts + s.stubs[1].puts
+	s.m.copiedBlocks, s.m.skippedBlocks = 0, 0
+	err = s.m.Run(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Check(s.m.copiedBlocks+s.m.skippedBlocks, check.Equals, int64(0))
+	c.Check(s.stubs[0].puts+s.stubs[1].puts, check.Equals, puts)
+}
+
+func (s *MigrateSuite) TestCorruptSource(c *check.C) {
+	for hash := range s.stubs[0].blocks[s.m.from] {
+		s.stubs[0].blocks[s.m.from][hash] = []byte("corrupt")
+		break
+	}
+	err := s.m.Run(context.Background())
+	c.Check(err, check.ErrorMatches, `failed to migrate 1 of 10 blocks`)
+	c.Check(s.m.copiedBlocks, check.Equals, int64(9))
+	c.Check(s.stubs[0].puts+s.stubs[1].puts, check.Equals, 9)
+}
+
+func (s *MigrateSuite) TestUnsuitableTarget(c *check.C) {
+	for _, trial := range []struct {
+		from string
+		to   string
+		err  string
+	}{
+		{"zzzzz-nyw5e-00000000000000x", "zzzzz-nyw5e-000000000000002", `source volume .* not found.*`},
+		{"zzzzz-nyw5e-000000000000000", "zzzzz-nyw5e-00000000000000x", `target volume .* not found.*`},
+		{"zzzzz-nyw5e-000000000000000", "zzzzz-nyw5e-000000000000000", `.* same as the source volume`},
+		{"zzzzz-nyw5e-000000000000000", "zzzzz-nyw5e-000000000000003", `.* is read-only`},
+		{"zzzzz-nyw5e-000000000000001", "zzzzz-nyw5e-000000000000002", `.* does not offer storage class "archival".*`},
+	} {
+		s.m.from = trial.from
+		s.m.to = []string{trial.to}
+		c.Check(s.m.Run(context.Background()), check.ErrorMatches, trial.err)
+	}
+	c.Check(s.stubs[0].puts+s.stubs[1].puts, check.Equals, 0)
+}
+
+func (s *MigrateSuite) TestLoadCheckpoint(c *check.C) {
+	done, err := loadCheckpoint("")
+	c.Check(err, check.IsNil)
+	c.Check(done, check.HasLen, 0)
+
+	fnm := c.MkDir() + "/checkpoint"
+	done, err = loadCheckpoint(fnm)
+	c.Check(err, check.IsNil)
+	c.Check(done, check.HasLen, 0)
+
+	// A truncated last line (e.g., after a crash) is ignored.
+	err = ioutil.WriteFile(fnm, []byte("d41d8cd98f00b204e9800998ecf8427e\nacbd18db4cc2f85cedef654fccc4a4d8\nacbd18db"), 0666)
+	c.Assert(err, check.IsNil)
+	done, err = loadCheckpoint(fnm)
+	c.Check(err, check.IsNil)
+	c.Check(done, check.DeepEquals, map[string]bool{
+		"d41d8cd98f00b204e9800998ecf8427e": true,
+		"acbd18db4cc2f85cedef654fccc4a4d8": true,
+	})
+
+	os.Chmod(fnm, 0)
+	if os.Getuid() != 0 {
+		_, err = loadCheckpoint(fnm)
+		c.Check(err, check.NotNil)
+	}
+}
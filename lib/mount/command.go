@@ -41,6 +41,8 @@ func (c *cmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, st
 	ro := flags.Bool("ro", false, "read-only")
 	experimental := flags.Bool("experimental", false, "acknowledge this is an experimental command, and should not be used in production (required)")
 	blockCache := flags.Int("block-cache", 4, "read cache size (number of 64MiB blocks)")
+	diskCacheDir := flags.String("disk-cache-dir", "", "also cache blocks on disk in this `directory`, which can be shared with other processes")
+	diskCacheSize := flags.Int64("disk-cache-size", 1<<30, "maximum size of disk cache (bytes)")
 	pprof := flags.String("pprof", "", "serve Go profile data at `[addr]:port`")
 	err := flags.Parse(args)
 	if err != nil {
@@ -69,6 +71,9 @@ func (c *cmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, st
 		return 1
 	}
 	kc.BlockCache = &keepclient.BlockCache{MaxBlocks: *blockCache}
+	if *diskCacheDir != "" {
+		kc.BlockCache.Disk = &keepclient.DiskCache{Dir: *diskCacheDir, MaxBytes: *diskCacheSize}
+	}
 	host := fuse.NewFileSystemHost(&keepFS{
 		Client:     client,
 		KeepClient: kc,
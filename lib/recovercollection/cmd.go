@@ -256,6 +256,53 @@ func (rcvr recoverer) ensureSafe(ctx context.Context, logger logrus.FieldLogger,
 	}
 }
 
+// Finds blk on one of the given services, untrashing it if it is
+// only found in the trash, and ensures it won't be eligible for
+// trashing until after blobsigexp. Returns false if the block can't
+// be found or protected.
+func (rcvr recoverer) recoverBlock(ctx context.Context, logger logrus.FieldLogger, blk string, services []arvados.KeepService, blobsigttl time.Duration, blobsigexp time.Time) bool {
+	for _, untrashing := range []bool{false, true} {
+		for _, svc := range services {
+			logger := logger.WithField("service", fmt.Sprintf("%s:%d", svc.ServiceHost, svc.ServicePort))
+			if untrashing {
+				if err := svc.Untrash(ctx, rcvr.client, blk); err != nil {
+					logger.WithError(err).Debug("untrash failed")
+					continue
+				}
+				logger.Info("untrashed")
+			}
+			err := rcvr.ensureSafe(ctx, logger, blk, svc, blobsigttl, blobsigexp)
+			if err == errNotFound {
+				logger.Debug(err)
+			} else if err != nil {
+				logger.Error(err)
+			} else {
+				return true
+			}
+		}
+	}
+	logger.Debug("unrecoverable")
+	return false
+}
+
+// RecoverBlock finds the given block (a bare hash) on one of the
+// given keepstore services, untrashing it if it is only found in the
+// trash, and updates its timestamp if needed so it won't be eligible
+// for garbage collection for at least BlobSigningTTL/2. It returns
+// false if the block can't be found or protected.
+//
+// The client must be authorized to untrash blocks, i.e., use the
+// cluster's SystemRootToken.
+func RecoverBlock(ctx context.Context, client *arvados.Client, cluster *arvados.Cluster, logger logrus.FieldLogger, services []arvados.KeepService, blk string) bool {
+	rcvr := recoverer{
+		client:  client,
+		cluster: cluster,
+		logger:  logger,
+	}
+	blobsigttl := cluster.Collections.BlobSigningTTL.Duration()
+	return rcvr.recoverBlock(ctx, logger.WithField("block", blk), blk, services, blobsigttl, time.Now().Add(blobsigttl/2))
+}
+
 // Untrash and update GC timestamps (as needed) on blocks referenced
 // by the given manifest, save a new collection and return the new
 // collection's UUID.
@@ -317,32 +364,10 @@ func (rcvr recoverer) RecoverManifest(mtxt string) (string, error) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-		nextblk:
 			for idx := range todo {
 				blk := strings.SplitN(string(blks[idx]), "+", 2)[0]
 				logger := rcvr.logger.WithField("block", blk)
-				for _, untrashing := range []bool{false, true} {
-					for _, svc := range services {
-						logger := logger.WithField("service", fmt.Sprintf("%s:%d", svc.ServiceHost, svc.ServicePort))
-						if untrashing {
-							if err := svc.Untrash(ctx, rcvr.client, blk); err != nil {
-								logger.WithError(err).Debug("untrash failed")
-								continue
-							}
-							logger.Info("untrashed")
-						}
-						err := rcvr.ensureSafe(ctx, logger, blk, svc, blobsigttl, blobsigexp)
-						if err == errNotFound {
-							logger.Debug(err)
-						} else if err != nil {
-							logger.Error(err)
-						} else {
-							blkFound[idx] = true
-							continue nextblk
-						}
-					}
-				}
-				logger.Debug("unrecoverable")
+				blkFound[idx] = rcvr.recoverBlock(ctx, logger, blk, services, blobsigttl, blobsigexp)
 			}
 		}()
 	}
@@ -0,0 +1,425 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package upload
+
+import (
+	"context"
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/sirupsen/logrus"
+)
+
+var Command = command{}
+
+type command struct{}
+
+// RunCommand implements the subcommand "upload [options] path [...]".
+func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	logger := logrus.New()
+	logger.Out = stderr
+	flags := flag.NewFlagSet(prog, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage:
+	%s [options ...] path [...]
+
+	Upload the given files and directories to Keep, and save them
+	in a new collection. The UUID of the new collection is printed
+	on stdout.
+
+	Each file is uploaded in blocks, several blocks at a time.
+	Files smaller than one block are packed together into shared
+	blocks. The blocks written so far are recorded in checkpoint
+	files, so if the upload is interrupted, running the same
+	command again resumes where it left off.
+
+Options:
+`, prog)
+		flags.PrintDefaults()
+	}
+	name := flags.String("name", "", "name of the new collection (default \"Saved at {time} by {prog}\")")
+	projectUUID := flags.String("project-uuid", "", "UUID of the project to save the collection in (default: home project)")
+	replication := flags.Int("replication", 0, "number of replicas to write (default: cluster default)")
+	concurrency := flags.Int("concurrency", 4, "maximum number of blocks to upload at once")
+	retries := flags.Int("retries", 3, "number of times to retry writing a block")
+	resume := flags.Bool("resume", true, "resume from checkpoints left by a previous interrupted upload")
+	checkpointDir := flags.String("checkpoint-dir", defaultCheckpointDir(), "directory for checkpoint files")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	files, err := listFiles(flags.Args())
+	if err != nil {
+		logger.Error(err)
+		return 1
+	}
+	err = os.MkdirAll(*checkpointDir, 0700)
+	if err != nil {
+		logger.Error(err)
+		return 1
+	}
+
+	client := arvados.NewClientFromEnv()
+	ac, err := arvadosclient.New(client)
+	if err != nil {
+		logger.Error(err)
+		return 1
+	}
+	kc, err := keepclient.MakeKeepClient(ac)
+	if err != nil {
+		logger.Error(err)
+		return 1
+	}
+	if *replication > 0 {
+		kc.Want_replicas = *replication
+	}
+
+	ctx := context.Background()
+	packs := packFiles(files)
+	for _, p := range packs {
+		ckptFile := filepath.Join(*checkpointDir, p.checkpointName())
+		if !*resume {
+			os.Remove(ckptFile)
+		}
+		up := &keepclient.Uploader{
+			KeepClient:     kc,
+			Concurrency:    *concurrency,
+			BlockRetries:   *retries,
+			CheckpointFile: ckptFile,
+		}
+		logger.Infof("uploading %s (%d bytes)", p, p.size())
+		err = p.upload(ctx, up)
+		if err != nil {
+			logger.Errorf("%s: %s", p, err)
+			logger.Info("run the same command again to resume the upload")
+			return 1
+		}
+	}
+
+	if *name == "" {
+		*name = fmt.Sprintf("Saved at %s by %s", time.Now().UTC().Format(time.RFC3339), prog)
+	}
+	mtxt, err := buildManifest(files)
+	if err != nil {
+		logger.Error(err)
+		return 1
+	}
+	attrs := map[string]interface{}{
+		"name":          *name,
+		"manifest_text": mtxt,
+	}
+	if *projectUUID != "" {
+		attrs["owner_uuid"] = *projectUUID
+	}
+	if *replication > 0 {
+		attrs["replication_desired"] = *replication
+	}
+	var coll arvados.Collection
+	err = client.RequestAndDecode(&coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"collection":         attrs,
+	})
+	if err != nil {
+		logger.Errorf("error saving collection: %s", err)
+		return 1
+	}
+	for _, p := range packs {
+		os.Remove(filepath.Join(*checkpointDir, p.checkpointName()))
+	}
+	fmt.Fprintln(stdout, coll.UUID)
+	return 0
+}
+
+func defaultCheckpointDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "arvados", "upload")
+	}
+	return filepath.Join(os.TempDir(), "arvados-upload")
+}
+
+// uploadFile is a local file to be uploaded.
+type uploadFile struct {
+	localPath string
+	collPath  string // path in the collection, e.g., "dir/subdir/file.txt"
+	size      int64
+	modTime   time.Time
+	segments  []segment // set when the file has been uploaded
+}
+
+// A segment is a range of bytes in a block.
+type segment struct {
+	locator string
+	offset  int64
+	length  int64
+}
+
+// checkpointName returns a checkpoint filename that identifies the
+// local file and its current size and modification time, so a
+// checkpoint isn't reused after the file changes.
+func (f *uploadFile) checkpointName() string {
+	abs, err := filepath.Abs(f.localPath)
+	if err != nil {
+		abs = f.localPath
+	}
+	return fmt.Sprintf("%x.json", md5.Sum([]byte(fmt.Sprintf("%s\x00%d\x00%d", abs, f.size, f.modTime.UnixNano()))))
+}
+
+// copyTo writes the file's content to w. It returns an error if the
+// file is shorter than it was when it was listed.
+func (f *uploadFile) copyTo(w io.Writer) error {
+	r, err := os.Open(f.localPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.CopyN(w, r, f.size)
+	if err == io.EOF {
+		return fmt.Errorf("%s: file was truncated during upload", f.localPath)
+	}
+	return err
+}
+
+// A pack is a sequence of files that are uploaded as a single stream
+// of data, so they share blocks: a file starts in the same block as
+// the end of the previous file. Packing small files avoids writing
+// an under-filled block for each one.
+type pack []*uploadFile
+
+// packFiles returns the packs to upload: one for each file that is
+// at least one block long, and one for all of the smaller files.
+func packFiles(files []*uploadFile) []pack {
+	var packs []pack
+	var small pack
+	for _, f := range files {
+		if f.size < keepclient.BLOCKSIZE {
+			small = append(small, f)
+		} else {
+			packs = append(packs, pack{f})
+		}
+	}
+	if len(small) > 0 {
+		packs = append(packs, small)
+	}
+	return packs
+}
+
+func (p pack) String() string {
+	if len(p) == 1 {
+		return p[0].localPath
+	}
+	return fmt.Sprintf("%d small files", len(p))
+}
+
+func (p pack) size() int64 {
+	var size int64
+	for _, f := range p {
+		size += f.size
+	}
+	return size
+}
+
+// checkpointName returns a checkpoint filename that identifies the
+// files in the pack (see uploadFile.checkpointName).
+func (p pack) checkpointName() string {
+	if len(p) == 1 {
+		return p[0].checkpointName()
+	}
+	h := md5.New()
+	for _, f := range p {
+		io.WriteString(h, f.checkpointName())
+	}
+	return fmt.Sprintf("%x.json", h.Sum(nil))
+}
+
+// upload writes the files in the pack to Keep, and sets each file's
+// segments.
+func (p pack) upload(ctx context.Context, up *keepclient.Uploader) error {
+	pr, pw := io.Pipe()
+	go func() {
+		for _, f := range p {
+			if err := f.copyTo(pw); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	locators, err := up.Upload(ctx, pr)
+	// Unblock the writer if Upload returned early.
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	return p.setSegments(locators)
+}
+
+// setSegments sets each file's segments, given the locators of the
+// blocks the pack was written to.
+func (p pack) setSegments(locators []string) error {
+	var blkoff int64 // offset of the next unused byte in locators[0]
+	for _, f := range p {
+		f.segments = nil
+		for todo := f.size; todo > 0; {
+			if len(locators) == 0 {
+				return fmt.Errorf("%s: uploaded blocks are shorter than files", p)
+			}
+			blksize, err := locatorSize(locators[0])
+			if err != nil {
+				return err
+			}
+			n := blksize - blkoff
+			if n > todo {
+				n = todo
+			}
+			f.segments = append(f.segments, segment{locator: locators[0], offset: blkoff, length: n})
+			todo -= n
+			blkoff += n
+			if blkoff == blksize {
+				locators, blkoff = locators[1:], 0
+			}
+		}
+	}
+	return nil
+}
+
+func locatorSize(locator string) (int64, error) {
+	parts := strings.SplitN(locator, "+", 3)
+	if len(parts) < 2 {
+		return 0, fmt.Errorf("locator has no size hint: %q", locator)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size hint in locator %q", locator)
+	}
+	return size, nil
+}
+
+// listFiles returns the regular files at the given paths, and in
+// the directories at the given paths. A file is stored at the top
+// level of the collection; a directory becomes a subdirectory of the
+// collection, with the same name.
+func listFiles(paths []string) ([]*uploadFile, error) {
+	var files []*uploadFile
+	for _, path := range paths {
+		base := filepath.Dir(filepath.Clean(path))
+		err := filepath.Walk(path, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(base, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, &uploadFile{
+				localPath: path,
+				collPath:  filepath.ToSlash(rel),
+				size:      fi.Size(),
+				modTime:   fi.ModTime(),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+var manifestEscapedChar = regexp.MustCompile(`[\000-\040:\s\\]`)
+
+func manifestEscape(s string) string {
+	return manifestEscapedChar.ReplaceAllStringFunc(s, func(seq string) string {
+		return fmt.Sprintf("\\%03o", seq[0])
+	})
+}
+
+// buildManifest returns a manifest with one stream for each
+// directory. Each block is listed once in each stream that has a file
+// stored in it, so files in the same directory that share a block
+// refer to the same copy.
+func buildManifest(files []*uploadFile) (string, error) {
+	type stream struct {
+		locators []string
+		offsets  map[string]int64 // position of each block in the stream
+		tokens   []string
+		size     int64
+	}
+	streams := map[string]*stream{}
+	var names []string
+	for _, f := range files {
+		dir, name := ".", f.collPath
+		if i := strings.LastIndex(f.collPath, "/"); i >= 0 {
+			dir, name = "./"+f.collPath[:i], f.collPath[i+1:]
+		}
+		s := streams[dir]
+		if s == nil {
+			s = &stream{offsets: map[string]int64{}}
+			streams[dir] = s
+			names = append(names, dir)
+		}
+		name = manifestEscape(name)
+		if len(f.segments) == 0 {
+			s.tokens = append(s.tokens, fmt.Sprintf("%d:0:%s", s.size, name))
+			continue
+		}
+		// Position and length of the file data that hasn't
+		// been added to tokens yet.
+		var pos, length int64
+		for _, seg := range f.segments {
+			blkpos, ok := s.offsets[seg.locator]
+			if !ok {
+				blksize, err := locatorSize(seg.locator)
+				if err != nil {
+					return "", err
+				}
+				blkpos = s.size
+				s.offsets[seg.locator] = blkpos
+				s.locators = append(s.locators, seg.locator)
+				s.size += blksize
+			}
+			if length > 0 && pos+length != blkpos+seg.offset {
+				s.tokens = append(s.tokens, fmt.Sprintf("%d:%d:%s", pos, length, name))
+				length = 0
+			}
+			if length == 0 {
+				pos = blkpos + seg.offset
+			}
+			length += seg.length
+		}
+		s.tokens = append(s.tokens, fmt.Sprintf("%d:%d:%s", pos, length, name))
+	}
+	sort.Strings(names)
+	var buf strings.Builder
+	for _, dir := range names {
+		s := streams[dir]
+		if len(s.locators) == 0 {
+			s.locators = []string{"d41d8cd98f00b204e9800998ecf8427e+0"}
+		}
+		fmt.Fprintf(&buf, "%s %s %s\n", manifestEscape(dir), strings.Join(s.locators, " "), strings.Join(s.tokens, " "))
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,97 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&CmdSuite{})
+
+type CmdSuite struct{}
+
+func (s *CmdSuite) TestListFiles(c *check.C) {
+	tmpdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+	c.Assert(os.MkdirAll(filepath.Join(tmpdir, "dir", "sub"), 0755), check.IsNil)
+	for _, fn := range []string{"top.txt", "dir/a.txt", "dir/sub/b.txt"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(tmpdir, fn), []byte(fn), 0644), check.IsNil)
+	}
+
+	files, err := listFiles([]string{filepath.Join(tmpdir, "top.txt"), filepath.Join(tmpdir, "dir") + "/"})
+	c.Assert(err, check.IsNil)
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.collPath)
+	}
+	c.Check(paths, check.DeepEquals, []string{"top.txt", "dir/a.txt", "dir/sub/b.txt"})
+	c.Check(files[1].size, check.Equals, int64(9))
+
+	// Checkpoint name changes when the file is modified.
+	name := files[0].checkpointName()
+	c.Check(name, check.Matches, `[0-9a-f]{32}\.json`)
+	files[0].modTime = files[0].modTime.Add(time.Second)
+	c.Check(files[0].checkpointName(), check.Not(check.Equals), name)
+}
+
+func (s *CmdSuite) TestBuildManifest(c *check.C) {
+	files := []*uploadFile{
+		{collPath: "foo", size: 3, segments: []segment{{"acbd18db4cc2f85cedef654fccc4a4d8+3+Afoo@ffffffff", 0, 3}}},
+		{collPath: "empty file", size: 0},
+		{collPath: "dir/bar:baz", size: 3, segments: []segment{{"37b51d194a7513e45b56f6524f2d51f2+3", 0, 3}}},
+		{collPath: "dir/sub/empty", size: 0},
+	}
+	mtxt, err := buildManifest(files)
+	c.Check(err, check.IsNil)
+	c.Check(mtxt, check.Equals, ""+
+		". acbd18db4cc2f85cedef654fccc4a4d8+3+Afoo@ffffffff 0:3:foo 3:0:empty\\040file\n"+
+		"./dir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\\072baz\n"+
+		"./dir/sub d41d8cd98f00b204e9800998ecf8427e+0 0:0:empty\n")
+}
+
+func (s *CmdSuite) TestPackSmallFiles(c *check.C) {
+	big := &uploadFile{collPath: "big", size: keepclient.BLOCKSIZE}
+	files := []*uploadFile{
+		{collPath: "a", size: 2},
+		big,
+		{collPath: "dir/b", size: 5},
+		{collPath: "dir/empty", size: 0},
+		{collPath: "c", size: 4},
+	}
+	packs := packFiles(files)
+	c.Assert(packs, check.HasLen, 2)
+	c.Check(packs[0], check.DeepEquals, pack{big})
+	c.Check(packs[0].checkpointName(), check.Equals, big.checkpointName())
+	small := packs[1]
+	c.Check(small, check.HasLen, 4)
+	c.Check(small.size(), check.Equals, int64(11))
+
+	// The small files share blocks. "dir/b" spans two blocks,
+	// and the second block is listed in both streams.
+	c.Assert(small.setSegments([]string{
+		"00000000000000000000000000000000+4",
+		"11111111111111111111111111111111+7",
+	}), check.IsNil)
+	big.segments = []segment{{"22222222222222222222222222222222+67108864", 0, keepclient.BLOCKSIZE}}
+	mtxt, err := buildManifest(files)
+	c.Check(err, check.IsNil)
+	c.Check(mtxt, check.Equals, ""+
+		". 00000000000000000000000000000000+4 22222222222222222222222222222222+67108864 11111111111111111111111111111111+7 0:2:a 4:67108864:big 67108871:4:c\n"+
+		"./dir 00000000000000000000000000000000+4 11111111111111111111111111111111+7 2:5:b 11:0:empty\n")
+
+	c.Check(small.setSegments([]string{"00000000000000000000000000000000+4"}), check.ErrorMatches, `.*shorter than files`)
+}
@@ -58,6 +58,7 @@ var (
 	EndpointUserBatchUpdate               = APIEndpoint{"PATCH", "arvados/v1/users/batch_update", ""}
 	EndpointUserAuthenticate              = APIEndpoint{"POST", "arvados/v1/users/authenticate", ""}
 	EndpointAPIClientAuthorizationCurrent = APIEndpoint{"GET", "arvados/v1/api_client_authorizations/current", ""}
+	EndpointStorageUsageGet               = APIEndpoint{"GET", "arvados/v1/storage_usage", ""}
 )
 
 type GetOptions struct {
@@ -151,6 +152,10 @@ type UserAuthenticateOptions struct {
 	Password string `json:"password,omitempty"` // PAM password
 }
 
+type StorageUsageGetOptions struct {
+	OwnerUUID string `json:"owner_uuid"` // User or project UUID (default current user)
+}
+
 type LogoutOptions struct {
 	ReturnTo string `json:"return_to"` // Redirect to this URL after logging out
 }
@@ -195,4 +200,5 @@ type API interface {
 	UserBatchUpdate(context.Context, UserBatchUpdateOptions) (UserList, error)
 	UserAuthenticate(ctx context.Context, options UserAuthenticateOptions) (APIClientAuthorization, error)
 	APIClientAuthorizationCurrent(ctx context.Context, options GetOptions) (APIClientAuthorization, error)
+	StorageUsageGet(ctx context.Context, options StorageUsageGetOptions) (StorageUsage, error)
 }
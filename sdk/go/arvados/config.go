@@ -57,6 +57,13 @@ func (sc *Config) GetCluster(clusterID string) (*Cluster, error) {
 	}
 }
 
+type VolumeHealthConfig struct {
+	ErrorRateThreshold float64
+	LatencyThreshold   Duration
+	MinOperations      int
+	ProbeInterval      Duration
+}
+
 type WebDAVCacheConfig struct {
 	TTL                  Duration
 	UUIDTTL              Duration
@@ -65,6 +72,8 @@ type WebDAVCacheConfig struct {
 	MaxCollectionBytes   int64
 	MaxPermissionEntries int
 	MaxUUIDEntries       int
+	DiskCacheDir         string
+	DiskCacheSize        ByteSize
 }
 
 type Cluster struct {
@@ -102,12 +111,19 @@ type Cluster struct {
 		BlobSigning              bool
 		BlobSigningKey           string
 		BlobSigningTTL           Duration
+		BlobEncryptionKeys       map[string]string
+		BlobEncryptionKeyID      string
 		BlobTrash                bool
 		BlobTrashLifetime        Duration
 		BlobTrashCheckInterval   Duration
 		BlobTrashConcurrency     int
 		BlobDeleteConcurrency    int
 		BlobReplicateConcurrency int
+		BlobPullRate             ByteSize
+		VolumeHealth             VolumeHealthConfig
+		BlobScrubRate            ByteSize
+		BlobScrubStateDir        string
+		BlobChangeLogSize        int
 		CollectionVersioning     bool
 		DefaultTrashLifetime     Duration
 		DefaultReplication       int
@@ -121,14 +137,29 @@ type Cluster struct {
 		TrustAllContent              bool
 		ForwardSlashNameSubstitution string
 		S3FolderObjects              bool
-
-		BlobMissingReport        string
-		BalancePeriod            Duration
-		BalanceCollectionBatch   int
-		BalanceCollectionBuffers int
-		BalanceTimeout           Duration
+		S3MultipartUploadTTL         Duration
+
+		BlobMissingReport          string
+		BlobMissingFileReport      string
+		BlobMissingProperty        string
+		BlobMissingUntrash         bool
+		BlobMissingRecoverySources map[string]BlobRecoverySource
+		BalancePeriod              Duration
+		BalanceCollectionBatch     int
+		BalanceCollectionBuffers   int
+		BalanceTimeout             Duration
+		BalanceFullScanPeriod      Duration
+		BalancePullRate            ByteSize
+		BalanceMaintenanceWindows  []string
+		BalanceMaintenanceTimeZone string
 
 		WebDAVCache WebDAVCacheConfig
+
+		KeepproxyCacheDir  string
+		KeepproxyCacheSize ByteSize
+
+		DefaultStorageQuota ByteSize
+		StorageQuotas       map[string]ByteSize
 	}
 	Git struct {
 		GitCommand   string
@@ -220,8 +251,9 @@ type Cluster struct {
 		UserProfileNotificationAddress        string
 		PreferDomainForUsername               string
 	}
-	Volumes   map[string]Volume
-	Workbench struct {
+	StorageClasses map[string]StorageClassConfig
+	Volumes        map[string]Volume
+	Workbench      struct {
 		ActivationContactLink            string
 		APIClientConnectTimeout          Duration
 		APIClientReceiveTimeout          Duration
@@ -265,11 +297,34 @@ type Cluster struct {
 	ForceLegacyAPI14 bool
 }
 
+// A BlobRecoverySource is a place keep-balance can copy lost blocks
+// from: either a cluster listed in RemoteClusters, or a keepproxy
+// (or keepstore) server.
+type BlobRecoverySource struct {
+	RemoteCluster  string
+	KeepproxyURL   URL
+	Insecure       bool
+	Token          string
+	BlobSigningKey string
+}
+
+type StorageClassConfig struct {
+	DataShards   int
+	ParityShards int
+}
+
+// ErasureCoded returns true if blocks in the storage class are stored
+// as erasure-coded shards instead of full replicas.
+func (sc StorageClassConfig) ErasureCoded() bool {
+	return sc.DataShards > 0
+}
+
 type Volume struct {
 	AccessViaHosts   map[URL]VolumeAccess
 	ReadOnly         bool
 	Replication      int
 	StorageClasses   map[string]bool
+	Compression      string
 	Driver           string
 	DriverParameters json.RawMessage
 }
@@ -301,6 +356,30 @@ type AzureVolumeDriverParameters struct {
 	ListBlobsMaxAttempts int
 }
 
+type GCSVolumeDriverParameters struct {
+	Bucket          string
+	CredentialsFile string
+	Endpoint        string
+	IndexPageSize   int
+	RequestTimeout  Duration
+	RaceWindow      Duration
+	UnsafeDelete    bool
+}
+
+type EncryptedVolumeDriverParameters struct {
+	Driver           string
+	DriverParameters json.RawMessage
+}
+
+type CachedVolumeDriverParameters struct {
+	CacheRoot        string
+	CacheSize        ByteSize
+	CacheMaxAge      Duration
+	WriteThrough     bool
+	Driver           string
+	DriverParameters json.RawMessage
+}
+
 type DirectoryVolumeDriverParameters struct {
 	Root      string
 	Serialize bool
@@ -24,6 +24,20 @@ type keepClient interface {
 	LocalLocator(locator string) (string, error)
 }
 
+// A blockPrefetcher can start retrieving a block in the background,
+// so a subsequent ReadAt doesn't have to wait for it.
+// keepclient.KeepClient is a blockPrefetcher.
+type blockPrefetcher interface {
+	Prefetch(locator string)
+}
+
+// Prefetch calls the keepClient's Prefetch method, if it has one.
+func (kb keepBackend) Prefetch(locator string) {
+	if p, ok := kb.keepClient.(blockPrefetcher); ok {
+		p.Prefetch(locator)
+	}
+}
+
 type apiClient interface {
 	RequestAndDecode(dst interface{}, method, path string, body io.Reader, params interface{}) error
 }
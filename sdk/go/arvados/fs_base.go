@@ -153,6 +153,16 @@ type inode interface {
 	// Caller must have lock (or rlock if replace is nil).
 	Child(name string, replace func(inode) (inode, error)) (inode, error)
 
+	// Snapshot returns a copy of the node (and its descendants,
+	// if any) that is not attached to any filesystem. Subsequent
+	// changes to the node do not affect the copy.
+	Snapshot() (inode, error)
+
+	// Splice replaces the node's content with the content of the
+	// given snapshot, which must be the same kind of node (file
+	// or directory). Caller must have lock.
+	Splice(snapshot inode) error
+
 	sync.Locker
 	RLock()
 	RUnlock()
@@ -163,6 +173,11 @@ type fileinfo struct {
 	mode    os.FileMode
 	size    int64
 	modTime time.Time
+	// If not nil, sys() returns the source data structure. It is
+	// populated only for the top-level directory of a
+	// collection, where it returns the *Collection as it was
+	// when the filesystem was loaded.
+	sys func() interface{}
 }
 
 // Name implements os.FileInfo.
@@ -190,9 +205,14 @@ func (fi fileinfo) Size() int64 {
 	return fi.size
 }
 
-// Sys implements os.FileInfo.
+// Sys implements os.FileInfo. For the top-level directory of a
+// collection, it returns the *Collection the directory was loaded
+// from. Otherwise it returns nil.
 func (fi fileinfo) Sys() interface{} {
-	return nil
+	if fi.sys == nil {
+		return nil
+	}
+	return fi.sys()
 }
 
 type nullnode struct{}
@@ -229,6 +249,14 @@ func (*nullnode) Child(name string, replace func(inode) (inode, error)) (inode,
 	return nil, ErrNotADirectory
 }
 
+func (*nullnode) Snapshot() (inode, error) {
+	return nil, ErrInvalidOperation
+}
+
+func (*nullnode) Splice(inode) error {
+	return ErrInvalidOperation
+}
+
 type treenode struct {
 	fs       FileSystem
 	parent   inode
@@ -422,6 +450,13 @@ func (fs *fileSystem) openFile(name string, flag int, perm os.FileMode) (*fileha
 	}, nil
 }
 
+// Prefetch calls the backend's Prefetch method, if it has one.
+func (fs *fileSystem) Prefetch(locator string) {
+	if p, ok := fs.fsBackend.(blockPrefetcher); ok {
+		p.Prefetch(locator)
+	}
+}
+
 func (fs *fileSystem) Open(name string) (http.File, error) {
 	return fs.OpenFile(name, os.O_RDONLY, 0)
 }
@@ -638,6 +673,95 @@ func rlookup(start inode, path string) (node inode, err error) {
 	return
 }
 
+// A Subtree is a detached copy of a file or directory from a
+// collection, returned by Snapshot. It can be inserted into a
+// collection with Splice.
+type Subtree struct {
+	inode inode
+}
+
+// IsDir returns true if the subtree is a directory.
+func (st *Subtree) IsDir() bool {
+	return st.inode.IsDir()
+}
+
+// Size returns the size of the subtree: the file size if it is a
+// file, otherwise the number of entries in the top-level directory.
+func (st *Subtree) Size() int64 {
+	return st.inode.Size()
+}
+
+// Snapshot returns a Subtree that is a copy of the file or directory
+// at the given path. The file data itself is not copied, so taking a
+// snapshot is cheap even if the subtree is large.
+//
+// Snapshot returns an error if the path is not inside a collection.
+func Snapshot(fs FileSystem, path string) (*Subtree, error) {
+	node, err := rlookup(fs.rootnode(), path)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := node.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Subtree{inode: snap}, nil
+}
+
+// Splice inserts a copy of the given Subtree at the target path,
+// replacing the existing file or directory (if any) at that path.
+// The parent directory must already exist. A Subtree can be spliced
+// multiple times, and into different filesystems.
+//
+// Splice returns an error if the target is not inside a collection,
+// or the target is the root directory of a collection and the
+// Subtree is a file.
+//
+// Like other changes, spliced data is not saved until the next
+// Sync().
+func Splice(fs FileSystem, target string, subtree *Subtree) error {
+	dirname, name := path.Split(strings.TrimSuffix(target, "/"))
+	if name == "" || name == "." {
+		// Replace the content of an existing directory,
+		// which might be the root of a collection.
+		node, err := rlookup(fs.rootnode(), target)
+		if err != nil {
+			return err
+		}
+		node.Lock()
+		defer node.Unlock()
+		return node.Splice(subtree.inode)
+	}
+	parent, err := rlookup(fs.rootnode(), dirname)
+	if err != nil {
+		return err
+	}
+	parent.Lock()
+	defer parent.Unlock()
+	_, err = parent.Child(name, func(existing inode) (inode, error) {
+		node := existing
+		if node == nil || node.IsDir() != subtree.inode.IsDir() {
+			perm := os.FileMode(0755)
+			if subtree.inode.IsDir() {
+				perm |= os.ModeDir
+			}
+			var err error
+			node, err = parent.FS().newNode(name, perm, time.Now())
+			if err != nil {
+				return existing, err
+			}
+			node.SetParent(parent, name)
+		}
+		node.Lock()
+		defer node.Unlock()
+		if err := node.Splice(subtree.inode); err != nil {
+			return existing, err
+		}
+		return node, nil
+	})
+	return err
+}
+
 func permittedName(name string) bool {
 	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
 }
@@ -68,6 +68,7 @@ func (c *Collection) FileSystem(client apiClient, kc keepClient) (CollectionFile
 				name:    ".",
 				mode:    os.ModeDir | 0755,
 				modTime: modTime,
+				sys:     func() interface{} { return c },
 			},
 			inodes: make(map[string]inode),
 		},
@@ -129,6 +130,14 @@ func (fs *collectionFileSystem) FS() FileSystem {
 	return fs
 }
 
+func (fs *collectionFileSystem) Snapshot() (inode, error) {
+	return fs.fileSystem.root.Snapshot()
+}
+
+func (fs *collectionFileSystem) Splice(r inode) error {
+	return fs.fileSystem.root.Splice(r)
+}
+
 func (fs *collectionFileSystem) FileInfo() os.FileInfo {
 	return fs.rootnode().FileInfo()
 }
@@ -355,6 +364,49 @@ func (fn *filenode) Parent() inode {
 	return fn.parent
 }
 
+func (fn *filenode) Snapshot() (inode, error) {
+	fn.RLock()
+	defer fn.RUnlock()
+	segments := make([]segment, 0, len(fn.segments))
+	for _, seg := range fn.segments {
+		// Slice makes a copy of any buffered data.
+		segments = append(segments, seg.Slice(0, seg.Len()))
+	}
+	return &filenode{
+		fileinfo: fn.fileinfo,
+		segments: segments,
+	}, nil
+}
+
+// Splice replaces fn's data with a copy of the snapshot's data.
+// Caller must have lock.
+func (fn *filenode) Splice(snapshot inode) error {
+	src, ok := snapshot.(*filenode)
+	if !ok {
+		return ErrIsDirectory
+	}
+	src.RLock()
+	defer src.RUnlock()
+	fn.segments = make([]segment, 0, len(src.segments))
+	fn.memsize = 0
+	for _, seg := range src.segments {
+		switch seg := seg.(type) {
+		case storedSegment:
+			// Read blocks through this filesystem's
+			// backend from now on.
+			seg.kc = fn.fs
+			fn.segments = append(fn.segments, seg)
+		default:
+			fn.segments = append(fn.segments, seg.Slice(0, seg.Len()))
+			fn.memsize += int64(seg.Len())
+		}
+	}
+	fn.fileinfo.size = src.fileinfo.size
+	fn.fileinfo.modTime = time.Now()
+	fn.repacked++
+	return nil
+}
+
 func (fn *filenode) FS() FileSystem {
 	return fn.fs
 }
@@ -387,6 +439,32 @@ func (fn *filenode) Read(p []byte, startPtr filenodePtr) (n int, ptr filenodePtr
 	return
 }
 
+// Maximum number of blocks to prefetch ahead of a sequential
+// reader. The backend may prefetch fewer, depending on the memory
+// available in its block cache.
+const readAheadBlocks = 8
+
+// prefetch asks the backend to start retrieving the blocks of the
+// segments starting at ptr (which must be up to date), so a
+// sequential reader doesn't have to wait for each block in turn.
+// Caller must have RLock or Lock.
+func (fn *filenode) prefetch(ptr filenodePtr) {
+	var prev string
+	for i, n := ptr.segmentIdx, 0; i < len(fn.segments) && n < readAheadBlocks; i++ {
+		seg, ok := fn.segments[i].(storedSegment)
+		if !ok || seg.locator == prev {
+			continue
+		}
+		p, ok := seg.kc.(blockPrefetcher)
+		if !ok {
+			return
+		}
+		p.Prefetch(seg.locator)
+		prev = seg.locator
+		n++
+	}
+}
+
 func (fn *filenode) Size() int64 {
 	fn.RLock()
 	defer fn.RUnlock()
@@ -690,6 +768,71 @@ func (dn *dirnode) Child(name string, replace func(inode) (inode, error)) (inode
 	return dn.treenode.Child(name, replace)
 }
 
+func (dn *dirnode) Snapshot() (inode, error) {
+	dn.RLock()
+	defer dn.RUnlock()
+	snap := &dirnode{
+		treenode: treenode{
+			fileinfo: dn.fileinfo,
+			inodes:   make(map[string]inode, len(dn.inodes)),
+		},
+	}
+	for name, child := range dn.inodes {
+		childsnap, err := child.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		snap.inodes[name] = childsnap
+	}
+	return snap, nil
+}
+
+// Splice replaces dn's content with a copy of the snapshot's
+// content. Caller must have lock.
+func (dn *dirnode) Splice(snapshot inode) error {
+	if _, ok := snapshot.(*dirnode); !ok {
+		return ErrNotADirectory
+	}
+	// Copy the snapshot, so it can be spliced again later.
+	snap, err := snapshot.Snapshot()
+	if err != nil {
+		return err
+	}
+	err = dn.adopt(snap.(*dirnode))
+	if err != nil {
+		return err
+	}
+	dn.fileinfo.modTime = time.Now()
+	return nil
+}
+
+// adopt replaces dn's children with nodes belonging to dn's
+// filesystem, containing the data from snap's children. Caller must
+// have lock.
+func (dn *dirnode) adopt(snap *dirnode) error {
+	dn.inodes = make(map[string]inode, len(snap.inodes))
+	for name, child := range snap.inodes {
+		fi := child.FileInfo()
+		node, err := dn.fs.newNode(name, fi.Mode(), fi.ModTime())
+		if err != nil {
+			return err
+		}
+		node.SetParent(dn, name)
+		switch node := node.(type) {
+		case *dirnode:
+			err = node.adopt(child.(*dirnode))
+		case *filenode:
+			err = node.Splice(child)
+			node.fileinfo.modTime = fi.ModTime()
+		}
+		if err != nil {
+			return err
+		}
+		dn.inodes[name] = node
+	}
+	return nil
+}
+
 type fnSegmentRef struct {
 	fn  *filenode
 	idx int
@@ -1468,6 +1468,163 @@ func (s *CollectionFSUnitSuite) TestLargeManifest(c *check.C) {
 	c.Logf("%s Alloc=%d Sys=%d", time.Now(), memstats.Alloc, memstats.Sys)
 }
 
+func (s *CollectionFSUnitSuite) TestSnapshotSplice(c *check.C) {
+	blocks := map[string][]byte{}
+	manifest := "./dir1"
+	for _, data := range []string{"foo", "bar"} {
+		hash := fmt.Sprintf("%x", md5.Sum([]byte(data)))
+		blocks[hash] = []byte(data)
+		manifest += " " + hash + "+3"
+	}
+	manifest += " 0:3:foo 3:3:bar\n"
+	kc1 := &keepClientStub{blocks: map[string][]byte{}}
+	kc2 := &keepClientStub{blocks: map[string][]byte{}}
+	for hash, data := range blocks {
+		kc1.blocks[hash] = data
+		kc2.blocks[hash] = data
+	}
+	fs1, err := (&Collection{ManifestText: manifest}).FileSystem(nil, kc1)
+	c.Assert(err, check.IsNil)
+	fs2, err := (&Collection{}).FileSystem(nil, kc2)
+	c.Assert(err, check.IsNil)
+
+	readFile := func(fs FileSystem, name string) string {
+		f, err := fs.Open(name)
+		c.Assert(err, check.IsNil)
+		defer f.Close()
+		buf, err := ioutil.ReadAll(f)
+		c.Check(err, check.IsNil)
+		return string(buf)
+	}
+	writeFile := func(fs FileSystem, name, data string) {
+		f, err := fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		c.Assert(err, check.IsNil)
+		_, err = f.Write([]byte(data))
+		c.Check(err, check.IsNil)
+		c.Check(f.Close(), check.IsNil)
+	}
+
+	// Unflushed data is included in snapshots, too.
+	writeFile(fs1, "dir1/buffered", "buffered data")
+
+	dir1, err := Snapshot(fs1, "dir1")
+	c.Assert(err, check.IsNil)
+	c.Check(dir1.IsDir(), check.Equals, true)
+	foo, err := Snapshot(fs1, "dir1/foo")
+	c.Assert(err, check.IsNil)
+	c.Check(foo.IsDir(), check.Equals, false)
+	c.Check(foo.Size(), check.Equals, int64(3))
+	_, err = Snapshot(fs1, "dir1/missing")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	// Changes made after the snapshot don't affect it.
+	writeFile(fs1, "dir1/foo", "changed")
+	writeFile(fs1, "dir1/buffered", "changed")
+
+	c.Check(Splice(fs2, "dir2", dir1), check.IsNil)
+	c.Check(Splice(fs2, "foo", foo), check.IsNil)
+	// Replace an existing file.
+	c.Check(Splice(fs2, "dir2/bar", foo), check.IsNil)
+	// Replace an existing file with a directory.
+	c.Check(Splice(fs2, "dir2/foo", dir1), check.IsNil)
+	// Parent directory must exist.
+	c.Check(os.IsNotExist(Splice(fs2, "dir3/foo", foo)), check.Equals, true)
+	// Can't replace the root directory with a file.
+	c.Check(Splice(fs2, ".", foo), check.NotNil)
+
+	// Spliced data is read through fs2's backend.
+	kc1.blocks = map[string][]byte{}
+	c.Check(readFile(fs2, "foo"), check.Equals, "foo")
+	c.Check(readFile(fs2, "dir2/foo/foo"), check.Equals, "foo")
+	c.Check(readFile(fs2, "dir2/bar"), check.Equals, "foo")
+	c.Check(readFile(fs2, "dir2/buffered"), check.Equals, "buffered data")
+	c.Check(readFile(fs2, "dir2/foo/bar"), check.Equals, "bar")
+
+	// Changes made in fs2 don't affect fs1 or the snapshot.
+	writeFile(fs2, "dir2/buffered", "fs2 data")
+	c.Check(readFile(fs1, "dir1/buffered"), check.Equals, "changed")
+	c.Check(Splice(fs2, "baz", foo), check.IsNil)
+	c.Check(readFile(fs2, "baz"), check.Equals, "foo")
+
+	manifest, err = fs2.MarshalManifest(".")
+	c.Check(err, check.IsNil)
+	c.Check(manifest, check.Matches, `\. \S+ 0:3:baz 0:3:foo\n\./dir2 .*\n\./dir2/foo .*\n`)
+	c.Check(fs2.Size(), check.Equals, int64(3+3+3+8+3+3+13))
+
+	// Replace the root directory.
+	c.Check(Splice(fs2, "", dir1), check.IsNil)
+	fis, err := fs2.Open("/")
+	c.Assert(err, check.IsNil)
+	ents, err := fis.Readdir(-1)
+	c.Check(err, check.IsNil)
+	c.Check(ents, check.HasLen, 3)
+	c.Check(readFile(fs2, "bar"), check.Equals, "bar")
+}
+
+// prefetchingKeepClientStub is a keepClientStub that records calls
+// to Prefetch.
+type prefetchingKeepClientStub struct {
+	*keepClientStub
+	prefetched []string
+}
+
+func (kcs *prefetchingKeepClientStub) Prefetch(locator string) {
+	kcs.prefetched = append(kcs.prefetched, locator[:32])
+}
+
+func (s *CollectionFSUnitSuite) TestReadAhead(c *check.C) {
+	kc := &prefetchingKeepClientStub{keepClientStub: &keepClientStub{blocks: map[string][]byte{}}}
+	var hashes []string
+	var manifest string
+	for _, data := range []string{"aaa", "bbb", "ccc", "ddd"} {
+		hash := fmt.Sprintf("%x", md5.Sum([]byte(data)))
+		kc.blocks[hash] = []byte(data)
+		hashes = append(hashes, hash)
+		manifest += " " + hash + "+3"
+	}
+	fs, err := (&Collection{ManifestText: "." + manifest + " 0:12:file\n"}).FileSystem(nil, kc)
+	c.Assert(err, check.IsNil)
+	f, err := fs.Open("file")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+
+	buf := make([]byte, 2)
+	read := func(expect string) {
+		n, err := f.Read(buf)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf[:n]), check.Equals, expect)
+	}
+
+	// The first read doesn't trigger read-ahead.
+	read("aa")
+	c.Check(kc.prefetched, check.HasLen, 0)
+
+	// The second sequential read ends at the start of the
+	// second segment, and triggers read-ahead from there.
+	read("a")
+	c.Check(kc.prefetched, check.DeepEquals, hashes[1:])
+
+	// Read-ahead is triggered again when the reader reaches
+	// the next segment.
+	kc.prefetched = nil
+	read("bb")
+	c.Check(kc.prefetched, check.HasLen, 0)
+	read("b")
+	c.Check(kc.prefetched, check.DeepEquals, hashes[2:])
+
+	// After a seek, read-ahead is triggered again when two
+	// more reads have followed the first read from the new
+	// position.
+	kc.prefetched = nil
+	_, err = f.Seek(4, io.SeekStart)
+	c.Assert(err, check.IsNil)
+	read("bb")
+	read("cc")
+	c.Check(kc.prefetched, check.HasLen, 0)
+	read("c")
+	c.Check(kc.prefetched, check.DeepEquals, hashes[3:])
+}
+
 // Gocheck boilerplate
 func Test(t *testing.T) {
 	check.TestingT(t)
@@ -100,6 +100,14 @@ func (dn *deferrednode) Sync() error {
 	}
 }
 
+func (dn *deferrednode) Snapshot() (inode, error) {
+	return dn.realinode().Snapshot()
+}
+
+func (dn *deferrednode) Splice(snapshot inode) error {
+	return dn.realinode().Splice(snapshot)
+}
+
 func (dn *deferrednode) Truncate(size int64) error       { return dn.realinode().Truncate(size) }
 func (dn *deferrednode) SetParent(p inode, name string)  { dn.realinode().SetParent(p, name) }
 func (dn *deferrednode) IsDir() bool                     { return dn.currentinode().IsDir() }
@@ -16,15 +16,37 @@ type filehandle struct {
 	readable   bool
 	writable   bool
 	unreaddirs []os.FileInfo
+
+	// Offset where the previous Read ended, and the number of
+	// consecutive Reads that started there.
+	readEnd  int64
+	seqReads int
 }
 
+// Number of consecutive sequential reads from a filehandle that
+// trigger read-ahead.
+const readAheadAfter = 2
+
 func (f *filehandle) Read(p []byte) (n int, err error) {
 	if !f.readable {
 		return 0, ErrWriteOnlyMode
 	}
 	f.inode.RLock()
 	defer f.inode.RUnlock()
+	if f.ptr.off == f.readEnd {
+		f.seqReads++
+	} else {
+		f.seqReads = 0
+	}
 	n, f.ptr, err = f.inode.Read(p, f.ptr)
+	f.readEnd = f.ptr.off
+	// When the reader appears to be reading sequentially, start
+	// retrieving the following blocks -- first when sequential
+	// access is detected, then each time the reader reaches the
+	// start of a new segment.
+	if fn, ok := f.inode.(*filenode); ok && n > 0 && (f.seqReads == readAheadAfter || (f.seqReads > readAheadAfter && f.ptr.segmentOff == 0)) {
+		fn.prefetch(f.ptr)
+	}
 	return
 }
 
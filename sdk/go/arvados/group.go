@@ -4,12 +4,17 @@
 
 package arvados
 
+import "time"
+
 // Group is an arvados#group record
 type Group struct {
-	UUID       string `json:"uuid"`
-	Name       string `json:"name"`
-	OwnerUUID  string `json:"owner_uuid"`
-	GroupClass string `json:"group_class"`
+	UUID       string                 `json:"uuid"`
+	Name       string                 `json:"name"`
+	OwnerUUID  string                 `json:"owner_uuid"`
+	GroupClass string                 `json:"group_class"`
+	CreatedAt  time.Time              `json:"created_at"`
+	TrashAt    *time.Time             `json:"trash_at"`
+	Properties map[string]interface{} `json:"properties"`
 }
 
 // GroupList is an arvados#groupList resource.
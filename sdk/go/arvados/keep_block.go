@@ -12,8 +12,13 @@ import (
 // SizedDigest is a minimal Keep block locator: hash+size
 type SizedDigest string
 
-// Size returns the size of the data block, in bytes.
+// Size returns the size of the data block, in bytes, or 0 if sd is a
+// bare hash with no size.
 func (sd SizedDigest) Size() int64 {
-	n, _ := strconv.ParseInt(strings.Split(string(sd), "+")[1], 10, 64)
+	parts := strings.Split(string(sd), "+")
+	if len(parts) < 2 {
+		return 0
+	}
+	n, _ := strconv.ParseInt(parts[1], 10, 64)
 	return n
 }
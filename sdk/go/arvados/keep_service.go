@@ -6,8 +6,11 @@ package arvados
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -33,6 +36,17 @@ type KeepMount struct {
 	ReadOnly       bool            `json:"read_only"`
 	Replication    int             `json:"replication"`
 	StorageClasses map[string]bool `json:"storage_classes"`
+
+	// Degraded is true if keepstore has stopped writing new
+	// blocks to the mount because of recent errors or slow
+	// responses.
+	Degraded bool `json:"degraded"`
+
+	// Quarantined lists the blocks on the mount that keepstore
+	// found to be corrupt, with the time each was found. They
+	// still appear in the mount's index, so keep-balance can
+	// trash and replace them.
+	Quarantined map[string]time.Time `json:"quarantined,omitempty"`
 }
 
 // KeepServiceList is an arvados#keepServiceList record
@@ -140,6 +154,62 @@ func (s *KeepService) Untrash(ctx context.Context, c *Client, blk string) error
 	return nil
 }
 
+// GetMountBlock returns the content of the given block as stored on
+// the given mount. The caller is responsible for checking the hash.
+func (s *KeepService) GetMountBlock(ctx context.Context, c *Client, mountUUID string, hash string) ([]byte, error) {
+	rdr, _, err := s.GetMountBlockReader(ctx, c, mountUUID, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	return ioutil.ReadAll(rdr)
+}
+
+// GetMountBlockReader is like GetMountBlock, but returns a reader
+// and the block size instead of reading the whole block into
+// memory. The caller must close the reader.
+func (s *KeepService) GetMountBlockReader(ctx context.Context, c *Client, mountUUID string, hash string) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url("mounts/"+mountUUID+"/blocks/"+hash), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("%s %s: %s", resp.Proto, resp.Status, body)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// PutMountBlock stores the given block on the given mount.
+func (s *KeepService) PutMountBlock(ctx context.Context, c *Client, mountUUID string, hash string, data []byte) error {
+	return s.PutMountBlockReader(ctx, c, mountUUID, hash, bytes.NewReader(data), int64(len(data)))
+}
+
+// PutMountBlockReader is like PutMountBlock, but reads the block
+// content from rdr. size must be the exact size of the block.
+func (s *KeepService) PutMountBlockReader(ctx context.Context, c *Client, mountUUID string, hash string, rdr io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", s.url("mounts/"+mountUUID+"/blocks/"+hash), rdr)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s", resp.Proto, resp.Status, body)
+	}
+	return nil
+}
+
 // IndexMount returns an unsorted list of blocks at the given mount point.
 func (s *KeepService) IndexMount(ctx context.Context, c *Client, mountUUID string, prefix string) ([]KeepServiceIndexEntry, error) {
 	return s.index(ctx, c, s.url("mounts/"+mountUUID+"/blocks?prefix="+prefix))
@@ -151,6 +221,54 @@ func (s *KeepService) Index(ctx context.Context, c *Client, prefix string) ([]Ke
 	return s.index(ctx, c, s.url("index/"+prefix))
 }
 
+// ErrChangesUnavailable is returned by IndexMountChanges when the
+// keep service cannot report all changes since the given cursor, and
+// the caller needs to retrieve the full index instead.
+var ErrChangesUnavailable = errors.New("changes since the given cursor are not available")
+
+// IndexMountChanges returns the blocks that have been written,
+// touched, or removed on the given mount since the given cursor was
+// issued, along with a new cursor to use in the next call.
+//
+// Each entry reports the state of a block at the time the change was
+// recorded. An entry with Mtime == 0 means the block is no longer
+// stored on the mount. The SizedDigest of an entry may be a bare hash
+// without a size hint, if the size was not known when the change was
+// recorded. Entries are returned in the order the changes happened.
+//
+// If since is "", no entries are returned, and the returned cursor
+// can be used to retrieve all subsequent changes.
+//
+// If the service has not recorded all changes since the given cursor
+// (for example, because it has been restarted, or has discarded old
+// changes), IndexMountChanges returns ErrChangesUnavailable.
+func (s *KeepService) IndexMountChanges(ctx context.Context, c *Client, mountUUID string, since string) ([]KeepServiceIndexEntry, string, error) {
+	url := s.url("mounts/" + mountUUID + "/changes?since=" + since)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("NewRequestWithContext(%v): %v", url, err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("Do(%v): %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return nil, "", ErrChangesUnavailable
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%v: %d %v", url, resp.StatusCode, resp.Status)
+	}
+	cursor := resp.Header.Get("X-Keep-Change-Cursor")
+	if cursor == "" {
+		return nil, "", fmt.Errorf("%v: response has no X-Keep-Change-Cursor header", url)
+	}
+	entries, err := parseIndex(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, cursor, nil
+}
+
 func (s *KeepService) index(ctx context.Context, c *Client, url string) ([]KeepServiceIndexEntry, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
@@ -163,9 +281,14 @@ func (s *KeepService) index(ctx context.Context, c *Client, url string) ([]KeepS
 		return nil, fmt.Errorf("%v: %d %v", url, resp.StatusCode, resp.Status)
 	}
 	defer resp.Body.Close()
+	return parseIndex(resp.Body)
+}
 
+// parseIndex parses an index response body, which must end with a
+// blank line.
+func parseIndex(r io.Reader) ([]KeepServiceIndexEntry, error) {
 	var entries []KeepServiceIndexEntry
-	scanner := bufio.NewScanner(resp.Body)
+	scanner := bufio.NewScanner(r)
 	sawEOF := false
 	for scanner.Scan() {
 		if scanner.Err() != nil {
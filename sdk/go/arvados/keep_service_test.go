@@ -7,6 +7,9 @@ package arvados
 import (
 	"context"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
 
 	check "gopkg.in/check.v1"
 )
@@ -26,3 +29,42 @@ func (*KeepServiceSuite) TestIndexTimeout(c *check.C) {
 	_, err := (&KeepService{}).IndexMount(context.Background(), client, "fake", "")
 	c.Check(err, check.ErrorMatches, `.*timeout.*`)
 }
+
+func (*KeepServiceSuite) TestIndexMountChanges(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/mounts/zzzzz-ivpuk-000000000000000/changes")
+		switch r.FormValue("since") {
+		case "":
+			w.Header().Set("X-Keep-Change-Cursor", "abc-1")
+			w.Write([]byte("\n"))
+		case "abc-1":
+			w.Header().Set("X-Keep-Change-Cursor", "abc-3")
+			w.Write([]byte("acbd18db4cc2f85cedef654fccc4a4d8+3 1600000000000000000\n37b51d194a7513e45b56f6524f2d51f2 0\n\n"))
+		default:
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, check.IsNil)
+	port, err := strconv.Atoi(u.Port())
+	c.Assert(err, check.IsNil)
+	ks := &KeepService{ServiceHost: u.Hostname(), ServicePort: port}
+	client := &Client{Client: http.DefaultClient, APIHost: "zzzzz.arvadosapi.com", AuthToken: "xyzzy"}
+
+	ents, cursor, err := ks.IndexMountChanges(context.Background(), client, "zzzzz-ivpuk-000000000000000", "")
+	c.Check(err, check.IsNil)
+	c.Check(ents, check.HasLen, 0)
+	c.Check(cursor, check.Equals, "abc-1")
+
+	ents, cursor, err = ks.IndexMountChanges(context.Background(), client, "zzzzz-ivpuk-000000000000000", cursor)
+	c.Check(err, check.IsNil)
+	c.Check(cursor, check.Equals, "abc-3")
+	c.Check(ents, check.DeepEquals, []KeepServiceIndexEntry{
+		{SizedDigest: "acbd18db4cc2f85cedef654fccc4a4d8+3", Mtime: 1600000000000000000},
+		{SizedDigest: "37b51d194a7513e45b56f6524f2d51f2", Mtime: 0},
+	})
+
+	_, _, err = ks.IndexMountChanges(context.Background(), client, "zzzzz-ivpuk-000000000000000", "def-1")
+	c.Check(err, check.Equals, ErrChangesUnavailable)
+}
@@ -0,0 +1,166 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A MaintenanceSchedule is a set of weekly time windows during which
+// keep-balance may trash blocks, and blocks may be pulled without the
+// usual rate limits (see Collections.BalanceMaintenanceWindows).
+//
+// A nil or empty *MaintenanceSchedule has no windows.
+type MaintenanceSchedule struct {
+	windows  []maintenanceWindow
+	location *time.Location
+}
+
+type maintenanceWindow struct {
+	days  [7]bool       // indexed by time.Weekday
+	start time.Duration // since midnight
+	end   time.Duration // since midnight; if end <= start, the window ends on the next day
+}
+
+var weekdayNames = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// NewMaintenanceSchedule returns a schedule with the given windows in
+// the given time zone ("" means UTC).
+//
+// Each window has the form "[days] [HH:MM-HH:MM]", e.g., "Mon-Fri
+// 20:00-06:00", "Sat,Sun", or "02:00-04:00". Days can be separated by
+// commas and can include ranges; if omitted, the window applies to
+// every day. If the time range is omitted, the window lasts all
+// day. A window whose end time is earlier than its start time ends on
+// the following day.
+func NewMaintenanceSchedule(windows []string, timezone string) (*MaintenanceSchedule, error) {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	ms := &MaintenanceSchedule{location: loc}
+	for _, s := range windows {
+		w, err := parseMaintenanceWindow(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q: %v", s, err)
+		}
+		ms.windows = append(ms.windows, w)
+	}
+	return ms, nil
+}
+
+func parseMaintenanceWindow(s string) (w maintenanceWindow, err error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		err = fmt.Errorf("expected \"[days] [HH:MM-HH:MM]\"")
+		return
+	}
+	if !strings.Contains(fields[0], ":") {
+		err = w.parseDays(fields[0])
+		if err != nil {
+			return
+		}
+		fields = fields[1:]
+	} else {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	if len(fields) == 0 {
+		w.end = 24 * time.Hour
+		return
+	}
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		err = fmt.Errorf("invalid time range %q", fields[0])
+		return
+	}
+	if w.start, err = parseTimeOfDay(times[0]); err != nil {
+		return
+	}
+	if w.end, err = parseTimeOfDay(times[1]); err != nil {
+		return
+	}
+	if w.start == 24*time.Hour {
+		err = fmt.Errorf("invalid start time %q", times[0])
+	}
+	return
+}
+
+func (w *maintenanceWindow) parseDays(s string) error {
+	for _, dayrange := range strings.Split(s, ",") {
+		ends := strings.Split(dayrange, "-")
+		if len(ends) > 2 {
+			return fmt.Errorf("invalid day range %q", dayrange)
+		}
+		var days []int
+		for _, name := range ends {
+			day, err := parseWeekday(name)
+			if err != nil {
+				return err
+			}
+			days = append(days, day)
+		}
+		// A range like "Fri-Mon" wraps around the end of the
+		// week.
+		for day := days[0]; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == days[len(days)-1] {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseWeekday(name string) (int, error) {
+	lower := strings.ToLower(name)
+	if len(lower) >= 3 {
+		for day, full := range weekdayNames {
+			if strings.HasPrefix(full, lower) {
+				return day, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", name)
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m > 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// Empty returns true if the schedule has no windows.
+func (ms *MaintenanceSchedule) Empty() bool {
+	return ms == nil || len(ms.windows) == 0
+}
+
+// Active returns true if t is in one of the maintenance windows.
+func (ms *MaintenanceSchedule) Active(t time.Time) bool {
+	if ms.Empty() {
+		return false
+	}
+	t = t.In(ms.location)
+	h, m, s := t.Clock()
+	tod := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second + time.Duration(t.Nanosecond())
+	today := int(t.Weekday())
+	yesterday := (today + 6) % 7
+	for _, w := range ms.windows {
+		if w.start < w.end {
+			if w.days[today] && tod >= w.start && tod < w.end {
+				return true
+			}
+		} else if (w.days[today] && tod >= w.start) || (w.days[yesterday] && tod < w.end) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&MaintenanceScheduleSuite{})
+
+type MaintenanceScheduleSuite struct{}
+
+func (s *MaintenanceScheduleSuite) TestParseErrors(c *check.C) {
+	for _, window := range []string{
+		"",
+		"Mon 01:00-02:00 extra",
+		"Mo 01:00-02:00",
+		"Mon-Tue-Wed",
+		"Funday",
+		"Mon 1:00-2:00",
+		"Mon 01:00",
+		"Mon 01:00-25:00",
+		"Mon 01:60-02:00",
+		"Mon 24:00-02:00",
+	} {
+		_, err := NewMaintenanceSchedule([]string{window}, "")
+		c.Check(err, check.NotNil, check.Commentf("%s", window))
+	}
+	_, err := NewMaintenanceSchedule(nil, "Nowhere/Special")
+	c.Check(err, check.NotNil)
+}
+
+func (s *MaintenanceScheduleSuite) TestActive(c *check.C) {
+	ms, err := NewMaintenanceSchedule([]string{
+		"Mon-Fri 20:00-06:00",
+		"sat,SUNDAY",
+		"Wed 12:00-13:00",
+	}, "UTC")
+	c.Assert(err, check.IsNil)
+	c.Check(ms.Empty(), check.Equals, false)
+	for _, trial := range []struct {
+		t      string
+		active bool
+	}{
+		{"2020-06-01T05:59:59Z", false}, // Monday early, but window starts Monday evening
+		{"2020-06-01T19:59:59Z", false},
+		{"2020-06-01T20:00:00Z", true},
+		{"2020-06-02T05:59:59Z", true}, // Tuesday, continuing from Monday
+		{"2020-06-02T06:00:00Z", false},
+		{"2020-06-03T12:30:00Z", true},
+		{"2020-06-03T13:00:00Z", false},
+		{"2020-06-06T06:30:00Z", true}, // Saturday
+		{"2020-06-07T23:59:59Z", true}, // Sunday
+		{"2020-06-08T00:00:00Z", false},
+	} {
+		t, err := time.Parse(time.RFC3339, trial.t)
+		c.Assert(err, check.IsNil)
+		c.Check(ms.Active(t), check.Equals, trial.active, check.Commentf("%s", trial.t))
+	}
+}
+
+func (s *MaintenanceScheduleSuite) TestTimeZone(c *check.C) {
+	ms, err := NewMaintenanceSchedule([]string{"Fri-Mon 01:00-03:00"}, "America/New_York")
+	c.Assert(err, check.IsNil)
+	c.Check(ms.Active(time.Date(2020, 6, 1, 1, 30, 0, 0, time.UTC)), check.Equals, false)
+	c.Check(ms.Active(time.Date(2020, 6, 1, 5, 30, 0, 0, time.UTC)), check.Equals, true)
+	c.Check(ms.Active(time.Date(2020, 6, 2, 5, 30, 0, 0, time.UTC)), check.Equals, false)
+}
+
+func (s *MaintenanceScheduleSuite) TestEmpty(c *check.C) {
+	var ms *MaintenanceSchedule
+	c.Check(ms.Empty(), check.Equals, true)
+	c.Check(ms.Active(time.Now()), check.Equals, false)
+	ms, err := NewMaintenanceSchedule(nil, "")
+	c.Assert(err, check.IsNil)
+	c.Check(ms.Empty(), check.Equals, true)
+	c.Check(ms.Active(time.Now()), check.Equals, false)
+}
@@ -0,0 +1,64 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import "time"
+
+// StorageUsage is the amount of Keep storage used by the collections
+// owned by a user or project (including the collections in its
+// subprojects), and the applicable quota.
+type StorageUsage struct {
+	OwnerUUID string `json:"owner_uuid"`
+
+	// Total size of the distinct blocks referenced by the owner's
+	// collections, counting one replica of each block.
+	UsedBytes int64 `json:"used_bytes"`
+
+	// Maximum permitted UsedBytes, or 0 if there is no quota.
+	QuotaBytes int64 `json:"quota_bytes"`
+
+	// Time when UsedBytes was computed by keep-balance, plus
+	// changes made through the controller since then. Zero if
+	// usage is not known.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Exceeded returns true if the owner has used all of its quota.
+func (su StorageUsage) Exceeded() bool {
+	return su.QuotaBytes > 0 && su.UsedBytes >= su.QuotaBytes
+}
+
+// StorageUsageReport is the per-owner usage published by
+// keep-balance after each balancing operation.
+type StorageUsageReport struct {
+	UpdatedAt time.Time        `json:"updated_at"`
+	Owners    map[string]int64 `json:"owners"` // owner UUID => bytes used, including subprojects
+	// project UUID => owner UUID, for every project that
+	// existed at UpdatedAt
+	Parents map[string]string `json:"parents"`
+}
+
+// StorageQuota returns the quota (in bytes) for collections owned by
+// the given user or project, or 0 if there is no quota.
+func (cc *Cluster) StorageQuota(ownerUUID string) int64 {
+	if q, ok := cc.Collections.StorageQuotas[ownerUUID]; ok {
+		return int64(q)
+	}
+	return int64(cc.Collections.DefaultStorageQuota)
+}
+
+// StorageQuotasEnabled returns true if any storage quotas are
+// configured.
+func (cc *Cluster) StorageQuotasEnabled() bool {
+	if cc.Collections.DefaultStorageQuota > 0 {
+		return true
+	}
+	for _, q := range cc.Collections.StorageQuotas {
+		if q > 0 {
+			return true
+		}
+	}
+	return false
+}
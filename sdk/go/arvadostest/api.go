@@ -185,6 +185,10 @@ func (as *APIStub) APIClientAuthorizationCurrent(ctx context.Context, options ar
 	as.appendCall(as.APIClientAuthorizationCurrent, ctx, options)
 	return arvados.APIClientAuthorization{}, as.Error
 }
+func (as *APIStub) StorageUsageGet(ctx context.Context, options arvados.StorageUsageGetOptions) (arvados.StorageUsage, error) {
+	as.appendCall(as.StorageUsageGet, ctx, options)
+	return arvados.StorageUsage{}, as.Error
+}
 
 func (as *APIStub) appendCall(method interface{}, ctx context.Context, options interface{}) {
 	as.mtx.Lock()
@@ -0,0 +1,165 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package erasure implements the Reed-Solomon code used to store
+// blocks in erasure-coded storage classes, and the format of the
+// shards that keepstore stores in place of full block replicas.
+//
+// A block is split into k data shards, and m parity shards are
+// computed from them. The block can be rebuilt from any k of the k+m
+// shards.
+package erasure
+
+import "fmt"
+
+// MaxShards is the largest supported number of data+parity shards.
+const MaxShards = 256
+
+// A Codec encodes and decodes data using a particular number of data
+// and parity shards. It is safe for concurrent use.
+type Codec struct {
+	dataShards   int
+	parityShards int
+	// Rows of the encoding matrix, one per shard. The first
+	// dataShards rows are the identity matrix; the rest form a
+	// Cauchy matrix, which guarantees that any dataShards rows
+	// are linearly independent.
+	matrix [][]byte
+}
+
+// NewCodec returns a Codec with the given number of data and parity
+// shards.
+func NewCodec(dataShards, parityShards int) (*Codec, error) {
+	if dataShards < 1 || parityShards < 1 {
+		return nil, fmt.Errorf("invalid erasure code parameters (data shards %d, parity shards %d): both must be at least 1", dataShards, parityShards)
+	}
+	if dataShards+parityShards > MaxShards {
+		return nil, fmt.Errorf("invalid erasure code parameters (data shards %d, parity shards %d): total must not exceed %d", dataShards, parityShards, MaxShards)
+	}
+	c := &Codec{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		matrix:       make([][]byte, dataShards+parityShards),
+	}
+	for i := range c.matrix {
+		c.matrix[i] = make([]byte, dataShards)
+		if i < dataShards {
+			c.matrix[i][i] = 1
+			continue
+		}
+		for j := range c.matrix[i] {
+			c.matrix[i][j] = gfInv(byte(i) ^ byte(j))
+		}
+	}
+	return c, nil
+}
+
+// DataShards returns the number of data shards.
+func (c *Codec) DataShards() int { return c.dataShards }
+
+// ParityShards returns the number of parity shards.
+func (c *Codec) ParityShards() int { return c.parityShards }
+
+// PayloadSize returns the size of each shard's payload when encoding
+// a block of the given size.
+func (c *Codec) PayloadSize(size int64) int64 {
+	return (size + int64(c.dataShards) - 1) / int64(c.dataShards)
+}
+
+// Encode splits data into data shards (zero-padding the last one as
+// needed) and computes the parity shards. The returned slice has
+// DataShards()+ParityShards() entries of equal length. The data
+// shards share memory with a copy of data, not with data itself.
+func (c *Codec) Encode(data []byte) [][]byte {
+	size := int(c.PayloadSize(int64(len(data))))
+	all := make([]byte, size*(c.dataShards+c.parityShards))
+	copy(all, data)
+	shards := make([][]byte, c.dataShards+c.parityShards)
+	for i := range shards {
+		shards[i] = all[i*size : (i+1)*size]
+	}
+	for i := c.dataShards; i < len(shards); i++ {
+		for j := 0; j < c.dataShards; j++ {
+			mulAdd(shards[i], shards[j], c.matrix[i][j])
+		}
+	}
+	return shards
+}
+
+// Reconstruct fills in the missing (nil) entries of shards, which
+// must have DataShards()+ParityShards() entries, at least
+// DataShards() of them non-nil and of equal length.
+func (c *Codec) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.dataShards+c.parityShards {
+		return fmt.Errorf("wrong number of shards: %d != %d", len(shards), c.dataShards+c.parityShards)
+	}
+	size := -1
+	var have []int
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size < 0 {
+			size = len(shard)
+		} else if len(shard) != size {
+			return fmt.Errorf("shard %d has size %d, expected %d", i, len(shard), size)
+		}
+		have = append(have, i)
+	}
+	if len(have) < c.dataShards {
+		return fmt.Errorf("too few shards to reconstruct data: have %d, need %d", len(have), c.dataShards)
+	}
+	if len(have) == len(shards) {
+		return nil
+	}
+	have = have[:c.dataShards]
+
+	// Each available shard is the product of its encoding
+	// matrix row and the data shards, so the data shards are
+	// the product of the inverted submatrix and the available
+	// shards.
+	sub := make([][]byte, c.dataShards)
+	for i, idx := range have {
+		sub[i] = c.matrix[idx]
+	}
+	dec, err := invertMatrix(sub)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < c.dataShards; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		shards[i] = make([]byte, size)
+		for j, idx := range have {
+			mulAdd(shards[i], shards[idx], dec[i][j])
+		}
+	}
+	for i := c.dataShards; i < len(shards); i++ {
+		if shards[i] != nil {
+			continue
+		}
+		shards[i] = make([]byte, size)
+		for j := 0; j < c.dataShards; j++ {
+			mulAdd(shards[i], shards[j], c.matrix[i][j])
+		}
+	}
+	return nil
+}
+
+// Join concatenates the data shards and returns the first size
+// bytes. All data shards must be present.
+func (c *Codec) Join(shards [][]byte, size int64) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for i := 0; i < c.dataShards && int64(len(data)) < size; i++ {
+		if shards[i] == nil {
+			return nil, fmt.Errorf("data shard %d is missing", i)
+		}
+		data = append(data, shards[i]...)
+	}
+	if int64(len(data)) < size {
+		return nil, fmt.Errorf("shards contain %d bytes, expected %d", len(data), size)
+	}
+	return data[:size], nil
+}
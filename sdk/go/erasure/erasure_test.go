@@ -0,0 +1,158 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package erasure
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&Suite{})
+
+type Suite struct{}
+
+func (s *Suite) TestGalois(c *check.C) {
+	for a := 1; a < 256; a++ {
+		c.Check(gfMul[a][gfInv(byte(a))], check.Equals, byte(1))
+		c.Check(gfMul[a][1], check.Equals, byte(a))
+		c.Check(gfMul[a][0], check.Equals, byte(0))
+	}
+	m := [][]byte{{1, 2, 3}, {4, 5, 6}, {7, 8, 10}}
+	inv, err := invertMatrix(m)
+	c.Assert(err, check.IsNil)
+	for i := range m {
+		for j := range m {
+			var x byte
+			for k := range m {
+				x ^= gfMul[m[i][k]][inv[k][j]]
+			}
+			if i == j {
+				c.Check(x, check.Equals, byte(1))
+			} else {
+				c.Check(x, check.Equals, byte(0))
+			}
+		}
+	}
+	_, err = invertMatrix([][]byte{{1, 2}, {1, 2}})
+	c.Check(err, check.Equals, errSingular)
+}
+
+func (s *Suite) TestReconstructAnySubset(c *check.C) {
+	codec, err := NewCodec(4, 3)
+	c.Assert(err, check.IsNil)
+	data := make([]byte, 1001)
+	rand.Read(data)
+	orig := codec.Encode(data)
+	c.Check(orig, check.HasLen, 7)
+	c.Check(orig[0], check.HasLen, 251)
+
+	// Try every combination of 0-3 missing shards.
+	for mask := 0; mask < 1<<7; mask++ {
+		shards := make([][]byte, 7)
+		missing := 0
+		for i := range shards {
+			if mask&(1<<uint(i)) != 0 {
+				missing++
+			} else {
+				shards[i] = append([]byte(nil), orig[i]...)
+			}
+		}
+		err := codec.Reconstruct(shards)
+		if missing > 3 {
+			c.Check(err, check.ErrorMatches, `too few shards.*`)
+			continue
+		}
+		c.Assert(err, check.IsNil, check.Commentf("mask %b", mask))
+		c.Check(shards, check.DeepEquals, orig, check.Commentf("mask %b", mask))
+		joined, err := codec.Join(shards, int64(len(data)))
+		c.Check(err, check.IsNil)
+		c.Check(joined, check.DeepEquals, data)
+	}
+}
+
+func (s *Suite) TestBadParameters(c *check.C) {
+	for _, trial := range [][2]int{{0, 1}, {1, 0}, {200, 57}} {
+		_, err := NewCodec(trial[0], trial[1])
+		c.Check(err, check.NotNil)
+	}
+	_, err := NewCodec(200, 56)
+	c.Check(err, check.IsNil)
+}
+
+func (s *Suite) TestShards(c *check.C) {
+	codec, err := NewCodec(3, 2)
+	c.Assert(err, check.IsNil)
+	for _, size := range []int{0, 1, 2, 3, 4, 1 << 20} {
+		data := make([]byte, size)
+		rand.Read(data)
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		var stored [][]byte
+		for i, shard := range Split(codec, hash, data) {
+			buf := shard.Marshal()
+			c.Check(int64(len(buf)), check.Equals, ShardSize(int64(size), 3))
+			c.Check(VerifyShard(ShardLocator(hash, i), buf), check.Equals, true)
+			c.Check(VerifyShard(ShardLocator(hash, i+1), buf), check.Equals, false)
+			stored = append(stored, buf)
+		}
+
+		// Rebuild from the last 3 shards.
+		var shards []*Shard
+		for _, buf := range stored[2:] {
+			shard, err := ParseShard(buf)
+			c.Assert(err, check.IsNil)
+			shards = append(shards, shard)
+		}
+		rebuilt, err := Rebuild(shards)
+		c.Check(err, check.IsNil)
+		c.Check(rebuilt, check.HasLen, size)
+		c.Check(fmt.Sprintf("%x", md5.Sum(rebuilt)), check.Equals, hash)
+
+		_, err = Rebuild(shards[1:])
+		c.Check(err, check.ErrorMatches, `too few shards.*`)
+	}
+}
+
+func (s *Suite) TestCorruptShard(c *check.C) {
+	codec, err := NewCodec(2, 1)
+	c.Assert(err, check.IsNil)
+	data := []byte("foobarbaz")
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	buf := Split(codec, hash, data)[1].Marshal()
+	_, err = ParseShard(buf)
+	c.Check(err, check.IsNil)
+
+	for _, trial := range []struct {
+		corrupt func([]byte) []byte
+		err     string
+	}{
+		{func(b []byte) []byte { b[0] = 'x'; return b }, `not an erasure-coded shard`},
+		{func(b []byte) []byte { return b[:10] }, `not an erasure-coded shard`},
+		{func(b []byte) []byte { b[20] = 'x'; return b }, `invalid block hash.*`},
+		{func(b []byte) []byte { b[4] = 3; return b }, `invalid shard index.*`},
+		{func(b []byte) []byte { return b[:len(b)-1] }, `shard payload size.*`},
+		{func(b []byte) []byte { b[len(b)-1]++; return b }, `shard payload checksum mismatch`},
+	} {
+		_, err := ParseShard(trial.corrupt(append([]byte(nil), buf...)))
+		c.Check(err, check.ErrorMatches, trial.err)
+	}
+
+	// Shards that parse correctly but don't add up to the right
+	// block are detected by Rebuild.
+	shards := Split(codec, hash, data)
+	shards[0].Payload[0]++
+	_, err = Rebuild(shards[:2])
+	c.Check(err, check.ErrorMatches, `rebuilt block does not match.*`)
+	shards[1].Hash = "d41d8cd98f00b204e9800998ecf8427e"
+	_, err = Rebuild(shards[:2])
+	c.Check(err, check.ErrorMatches, `shard 1 does not match shard 0.*`)
+}
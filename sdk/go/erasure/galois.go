@@ -0,0 +1,106 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package erasure
+
+import "errors"
+
+// Arithmetic in GF(2^8) using the reducing polynomial
+// x^8+x^4+x^3+x^2+1 (0x11d), as in most Reed-Solomon
+// implementations.
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+// gfInv returns the multiplicative inverse of a, which must not be
+// zero.
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+var errSingular = errors.New("matrix is singular")
+
+// invertMatrix returns the inverse of the given square matrix, using
+// Gauss-Jordan elimination. The argument is not modified.
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i := range m {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errSingular
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		if v := work[col][col]; v != 1 {
+			inv := gfInv(v)
+			for j := range work[col] {
+				work[col][j] = gfMul[inv][work[col][j]]
+			}
+		}
+		for row := 0; row < n; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			f := &gfMul[work[row][col]]
+			for j := range work[row] {
+				work[row][j] ^= f[work[col][j]]
+			}
+		}
+	}
+	inv := make([][]byte, n)
+	for i := range work {
+		inv[i] = work[i][n:]
+	}
+	return inv, nil
+}
+
+// mulAdd sets dst[i] ^= c*src[i] for each i.
+func mulAdd(dst, src []byte, c byte) {
+	switch c {
+	case 0:
+		return
+	case 1:
+		for i, b := range src {
+			dst[i] ^= b
+		}
+	default:
+		f := &gfMul[c]
+		for i, b := range src {
+			dst[i] ^= f[b]
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package erasure
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// HeaderSize is the size of the header at the start of each stored
+// shard.
+//
+// Header layout:
+//
+//   0-3    magic "AEC1"
+//   4      shard index
+//   5      number of data shards minus 1
+//   6      number of parity shards minus 1
+//   7      reserved (0)
+//   8-15   size of the original block (big-endian)
+//   16-47  MD5 hash of the original block (hex)
+//   48-63  MD5 hash of the payload
+//
+// The header is followed by the payload.
+const HeaderSize = 64
+
+var shardMagic = []byte("AEC1")
+
+var hashRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// A Shard is one of the pieces an erasure-coded block is stored as.
+type Shard struct {
+	Hash         string // MD5 hash of the original block
+	BlockSize    int64  // size of the original block
+	Index        int
+	DataShards   int
+	ParityShards int
+	Payload      []byte
+}
+
+// Locator returns the locator hash under which the shard is stored.
+func (s *Shard) Locator() string {
+	return ShardLocator(s.Hash, s.Index)
+}
+
+// Marshal returns the shard in its stored form.
+func (s *Shard) Marshal() []byte {
+	buf := make([]byte, HeaderSize+len(s.Payload))
+	copy(buf, shardMagic)
+	buf[4] = byte(s.Index)
+	buf[5] = byte(s.DataShards - 1)
+	buf[6] = byte(s.ParityShards - 1)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(s.BlockSize))
+	copy(buf[16:48], s.Hash)
+	sum := md5.Sum(s.Payload)
+	copy(buf[48:64], sum[:])
+	copy(buf[HeaderSize:], s.Payload)
+	return buf
+}
+
+// ParseShard decodes and checks a stored shard. The returned Shard's
+// Payload shares memory with buf.
+func ParseShard(buf []byte) (*Shard, error) {
+	if len(buf) < HeaderSize || !bytes.Equal(buf[:4], shardMagic) {
+		return nil, errors.New("not an erasure-coded shard")
+	}
+	s := &Shard{
+		Hash:         string(buf[16:48]),
+		BlockSize:    int64(binary.BigEndian.Uint64(buf[8:16])),
+		Index:        int(buf[4]),
+		DataShards:   int(buf[5]) + 1,
+		ParityShards: int(buf[6]) + 1,
+		Payload:      buf[HeaderSize:],
+	}
+	if !hashRegexp.MatchString(s.Hash) {
+		return nil, errors.New("invalid block hash in shard header")
+	}
+	if s.DataShards+s.ParityShards > MaxShards || s.Index >= s.DataShards+s.ParityShards {
+		return nil, fmt.Errorf("invalid shard index %d for %d+%d shards", s.Index, s.DataShards, s.ParityShards)
+	}
+	if want := (s.BlockSize + int64(s.DataShards) - 1) / int64(s.DataShards); s.BlockSize < 0 || int64(len(s.Payload)) != want {
+		return nil, fmt.Errorf("shard payload size %d does not match block size %d", len(s.Payload), s.BlockSize)
+	}
+	if sum := md5.Sum(s.Payload); !bytes.Equal(sum[:], buf[48:64]) {
+		return nil, errors.New("shard payload checksum mismatch")
+	}
+	return s, nil
+}
+
+// VerifyShard returns true if buf is an intact shard that belongs
+// under the given locator hash.
+func VerifyShard(locator string, buf []byte) bool {
+	s, err := ParseShard(buf)
+	return err == nil && s.Locator() == locator
+}
+
+// ShardLocator returns the locator hash under which the given shard
+// of a block is stored. It depends only on the block hash and shard
+// index, so readers can find shards without knowing how many data
+// and parity shards were used.
+func ShardLocator(hash string, index int) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s+shard%d", hash, index))))
+}
+
+// ShardSize returns the stored size of each shard of a block with the
+// given size, when split into the given number of data shards.
+func ShardSize(blockSize int64, dataShards int) int64 {
+	return HeaderSize + (blockSize+int64(dataShards)-1)/int64(dataShards)
+}
+
+// Split encodes a block as data and parity shards.
+func Split(c *Codec, hash string, data []byte) []*Shard {
+	payloads := c.Encode(data)
+	shards := make([]*Shard, len(payloads))
+	for i, p := range payloads {
+		shards[i] = &Shard{
+			Hash:         hash,
+			BlockSize:    int64(len(data)),
+			Index:        i,
+			DataShards:   c.DataShards(),
+			ParityShards: c.ParityShards(),
+			Payload:      p,
+		}
+	}
+	return shards
+}
+
+// Rebuild reconstructs a block from some of its shards, and checks
+// the result against the block hash. At least DataShards of the
+// given shards must be distinct. All shards must belong to the same
+// block and use the same parameters.
+func Rebuild(shards []*Shard) ([]byte, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shards")
+	}
+	first := shards[0]
+	c, err := NewCodec(first.DataShards, first.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	payloads := make([][]byte, first.DataShards+first.ParityShards)
+	for _, s := range shards {
+		if s.Hash != first.Hash || s.BlockSize != first.BlockSize || s.DataShards != first.DataShards || s.ParityShards != first.ParityShards {
+			return nil, fmt.Errorf("shard %d does not match shard %d (block %s+%d, %d+%d shards)", s.Index, first.Index, first.Hash, first.BlockSize, first.DataShards, first.ParityShards)
+		}
+		payloads[s.Index] = s.Payload
+	}
+	if err := c.Reconstruct(payloads); err != nil {
+		return nil, err
+	}
+	data, err := c.Join(payloads, first.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	if fmt.Sprintf("%x", md5.Sum(data)) != first.Hash {
+		return nil, fmt.Errorf("rebuilt block does not match hash %s", first.Hash)
+	}
+	return data, nil
+}
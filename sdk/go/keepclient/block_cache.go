@@ -6,6 +6,7 @@ package keepclient
 
 import (
 	"io"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -20,12 +21,35 @@ type BlockCache struct {
 	// default size (currently 4) is used instead.
 	MaxBlocks int
 
+	// If not nil, blocks are also stored on disk, and blocks
+	// that aren't in memory are read from disk before trying
+	// Keep.
+	Disk *DiskCache
+
 	cache map[string]*cacheBlock
 	mtx   sync.Mutex
+
+	// Blocks that have been partly retrieved with a Range
+	// request instead of being added to the cache.
+	ranged map[string]bool
+
+	// Number of blocks in the cache that were added by Prefetch
+	// and haven't been used yet.
+	prefetched int
 }
 
 const defaultMaxBlocks = 4
 
+// Maximum number of blocks that Prefetch adds to the cache before
+// they are used. Prefetched blocks push the least recently used
+// blocks out of the cache, so this is kept small to avoid evicting
+// blocks that other readers are still using.
+const maxPrefetchedBlocks = 2
+
+// Maximum number of blocks to remember in BlockCache.ranged. When the
+// limit is reached, the list is cleared.
+const maxRangedBlocks = 1000
+
 // Sweep deletes the least recently used blocks from the cache until
 // there are no more than MaxBlocks left.
 func (c *BlockCache) Sweep() {
@@ -46,14 +70,76 @@ func (c *BlockCache) Sweep() {
 	threshold := lru[max]
 	for loc, b := range c.cache {
 		if !b.lastUse.After(threshold) {
+			if b.prefetched {
+				b.prefetched = false
+				c.prefetched--
+			}
 			delete(c.cache, loc)
 		}
 	}
 }
 
+// Prefetch starts retrieving the given block into the cache, unless
+// it is already cached. To avoid evicting blocks that are in use,
+// the number of prefetched blocks that haven't been used yet is
+// limited to maxPrefetchedBlocks, and to half of MaxBlocks.
+func (c *BlockCache) Prefetch(kc *KeepClient, locator string) {
+	max := c.MaxBlocks
+	if max == 0 {
+		max = defaultMaxBlocks
+	}
+	max /= 2
+	if max > maxPrefetchedBlocks {
+		max = maxPrefetchedBlocks
+	}
+	cacheKey := locator[:32]
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	b, ok := c.cache[cacheKey]
+	if (ok && b.err == nil) || c.prefetched >= max {
+		return
+	}
+	if ok && b.prefetched {
+		b.prefetched = false
+		c.prefetched--
+	}
+	if c.cache == nil {
+		c.cache = make(map[string]*cacheBlock)
+	}
+	b = &cacheBlock{
+		fetched:    make(chan struct{}),
+		lastUse:    time.Now(),
+		prefetched: true,
+	}
+	c.cache[cacheKey] = b
+	c.prefetched++
+	go c.fetch(kc, locator, b)
+}
+
 // ReadAt returns data from the cache, first retrieving it from Keep if
 // necessary.
+//
+// The first time part of an uncached block is requested, only the
+// requested range is retrieved, using a Range request. Subsequent
+// reads from the same block retrieve and cache the whole block. If
+// the server ignores the Range header and sends the whole block
+// anyway, it is cached right away.
 func (c *BlockCache) ReadAt(kc *KeepClient, locator string, p []byte, off int) (int, error) {
+	if size := sizeHint(locator); size > 0 && off < size && (off > 0 || len(p) < size) && c.firstRangedRead(locator[:32]) && !c.onDisk(locator[:32]) {
+		length := len(p)
+		if off+length > size {
+			length = size - off
+		}
+		data, whole, err := kc.getRange(locator, off, length)
+		if err != nil {
+			return 0, err
+		}
+		if whole {
+			c.add(locator, data)
+			data = data[off : off+length]
+		}
+		return copy(p, data), nil
+	}
 	buf, err := c.Get(kc, locator)
 	if err != nil {
 		return 0, err
@@ -64,45 +150,94 @@ func (c *BlockCache) ReadAt(kc *KeepClient, locator string, p []byte, off int) (
 	return copy(p, buf[off:]), nil
 }
 
-// Get returns data from the cache, first retrieving it from Keep if
-// necessary.
-func (c *BlockCache) Get(kc *KeepClient, locator string) ([]byte, error) {
+// firstRangedRead returns true if the given block is not in the
+// cache and has not already been partly retrieved with a Range
+// request. In that case, it records that the block has now been
+// partly retrieved.
+func (c *BlockCache) firstRangedRead(cacheKey string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.cache[cacheKey]; ok || c.ranged[cacheKey] {
+		return false
+	}
+	if c.ranged == nil || len(c.ranged) >= maxRangedBlocks {
+		c.ranged = make(map[string]bool)
+	}
+	c.ranged[cacheKey] = true
+	return true
+}
+
+// add stores a block that was retrieved (and verified) without
+// using the cache, unless the cache already has it or is already
+// retrieving it.
+func (c *BlockCache) add(locator string, data []byte) {
 	cacheKey := locator[:32]
-	bufsize := BLOCKSIZE
+	b := &cacheBlock{
+		data:    data,
+		fetched: make(chan struct{}),
+		lastUse: time.Now(),
+	}
+	close(b.fetched)
+	c.mtx.Lock()
+	if c.cache == nil {
+		c.cache = make(map[string]*cacheBlock)
+	}
+	if old, ok := c.cache[cacheKey]; ok && old.err == nil {
+		c.mtx.Unlock()
+		return
+	} else if ok && old.prefetched {
+		old.prefetched = false
+		c.prefetched--
+	}
+	c.cache[cacheKey] = b
+	c.mtx.Unlock()
+	if c.Disk != nil {
+		c.Disk.Put(cacheKey, data)
+	}
+	go c.Sweep()
+}
+
+// onDisk returns true if the given block is in the disk cache.
+func (c *BlockCache) onDisk(hash string) bool {
+	if c.Disk == nil {
+		return false
+	}
+	_, err := os.Stat(c.Disk.blockPath(hash))
+	return err == nil
+}
+
+// sizeHint returns the size hint from the given locator, or -1 if it
+// doesn't have one.
+func sizeHint(locator string) int {
 	if parts := strings.SplitN(locator, "+", 3); len(parts) >= 2 {
 		datasize, err := strconv.ParseInt(parts[1], 10, 32)
 		if err == nil && datasize >= 0 {
-			bufsize = int(datasize)
+			return int(datasize)
 		}
 	}
+	return -1
+}
+
+// Get returns data from the cache, first retrieving it from Keep if
+// necessary.
+func (c *BlockCache) Get(kc *KeepClient, locator string) ([]byte, error) {
+	cacheKey := locator[:32]
 	c.mtx.Lock()
 	if c.cache == nil {
 		c.cache = make(map[string]*cacheBlock)
 	}
 	b, ok := c.cache[cacheKey]
 	if !ok || b.err != nil {
+		if ok && b.prefetched {
+			b.prefetched = false
+			c.prefetched--
+		}
 		b = &cacheBlock{
 			fetched: make(chan struct{}),
 			lastUse: time.Now(),
 		}
 		c.cache[cacheKey] = b
-		go func() {
-			rdr, size, _, err := kc.Get(locator)
-			var data []byte
-			if err == nil {
-				data = make([]byte, size, bufsize)
-				_, err = io.ReadFull(rdr, data)
-				err2 := rdr.Close()
-				if err == nil {
-					err = err2
-				}
-			}
-			c.mtx.Lock()
-			b.data, b.err = data, err
-			c.mtx.Unlock()
-			close(b.fetched)
-			go c.Sweep()
-		}()
+		go c.fetch(kc, locator, b)
 	}
 	c.mtx.Unlock()
 
@@ -112,13 +247,68 @@ func (c *BlockCache) Get(kc *KeepClient, locator string) ([]byte, error) {
 
 	c.mtx.Lock()
 	b.lastUse = time.Now()
+	if b.prefetched {
+		b.prefetched = false
+		c.prefetched--
+	}
 	c.mtx.Unlock()
 	return b.data, b.err
 }
 
+// fetch retrieves a block from the disk cache or Keep, and stores
+// the result in b.
+func (c *BlockCache) fetch(kc *KeepClient, locator string, b *cacheBlock) {
+	cacheKey := locator[:32]
+	bufsize := BLOCKSIZE
+	if datasize := sizeHint(locator); datasize >= 0 {
+		bufsize = datasize
+	}
+	var data []byte
+	var err error
+	if c.Disk != nil {
+		data = c.Disk.Get(cacheKey)
+		if data != nil {
+			// The disk cache is shared with other
+			// processes, so having the data doesn't
+			// mean the caller is allowed to read it.
+			// Check the locator's permission signature
+			// with a HEAD request before using it.
+			if _, _, err := kc.Ask(locator); err != nil {
+				data = nil
+			}
+		}
+	}
+	if data == nil {
+		var rdr io.ReadCloser
+		var size int64
+		rdr, size, _, err = kc.Get(locator)
+		if err == nil {
+			data = make([]byte, size, bufsize)
+			_, err = io.ReadFull(rdr, data)
+			err2 := rdr.Close()
+			if err == nil {
+				err = err2
+			}
+		}
+		if err == nil && c.Disk != nil {
+			c.Disk.Put(cacheKey, data)
+		}
+	}
+	c.mtx.Lock()
+	b.data, b.err = data, err
+	c.mtx.Unlock()
+	close(b.fetched)
+	go c.Sweep()
+}
+
 func (c *BlockCache) Clear() {
 	c.mtx.Lock()
+	for _, b := range c.cache {
+		b.prefetched = false
+	}
 	c.cache = nil
+	c.ranged = nil
+	c.prefetched = 0
 	c.mtx.Unlock()
 }
 
@@ -135,4 +325,7 @@ type cacheBlock struct {
 	err     error
 	fetched chan struct{}
 	lastUse time.Time
+
+	// Added by Prefetch, and not used yet.
+	prefetched bool
 }
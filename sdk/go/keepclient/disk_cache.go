@@ -0,0 +1,318 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A DiskCache stores blocks in files in a local directory, so they
+// survive after the process exits and can be reused by later
+// processes on the same host. Several processes (and several
+// DiskCaches in one process) can share the same directory.
+//
+// Each block is stored in Dir/{hash[0:3]}/{hash}. New files are
+// written under a temporary name and renamed into place, so readers
+// never see a partially written block. Eviction is done by one
+// process at a time, holding an exclusive lock on Dir/lock. The
+// content of each file is checked against its hash when it is read;
+// a corrupt file is deleted and treated as a cache miss.
+//
+// A DiskCache does not check permissions: anyone who knows a block's
+// hash can get its content with Get. BlockCache checks the permission
+// signature on the caller's locator with Keep before using data from
+// its DiskCache.
+type DiskCache struct {
+	// Directory to store cached blocks in. It is created if
+	// needed.
+	Dir string
+
+	// Maximum total size of the cached blocks, in bytes. If 0, a
+	// default size (currently 1 GiB) is used instead. The limit
+	// can be exceeded briefly, until the next sweep.
+	MaxBytes int64
+
+	mtx      sync.Mutex
+	written  int64 // bytes written since last sweep
+	swept    bool
+	sweeping bool
+}
+
+const defaultDiskCacheMaxBytes = 1 << 30
+
+// Don't update a cached file's modification time when it's read
+// more than once in this interval.
+const diskCacheTouchInterval = time.Minute
+
+// Temporary files older than this are assumed to have been left
+// behind by a process that crashed while writing them.
+const diskCacheTempFileTTL = time.Hour
+
+func (dc *DiskCache) maxBytes() int64 {
+	if dc.MaxBytes > 0 {
+		return dc.MaxBytes
+	}
+	return defaultDiskCacheMaxBytes
+}
+
+func (dc *DiskCache) blockPath(hash string) string {
+	return filepath.Join(dc.Dir, hash[:3], hash)
+}
+
+// Get returns the content of the block with the given hash, or nil
+// if it's not in the cache.
+func (dc *DiskCache) Get(hash string) []byte {
+	if len(hash) != 32 {
+		return nil
+	}
+	path := dc.blockPath(hash)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			DebugPrintf("DEBUG: disk cache: %s", err)
+		}
+		return nil
+	}
+	if fmt.Sprintf("%x", md5.Sum(data)) != hash {
+		DebugPrintf("DEBUG: disk cache: %s: hash mismatch, deleting", path)
+		os.Remove(path)
+		return nil
+	}
+	// Update the modification time, which is used to choose
+	// the least recently used blocks when evicting.
+	now := time.Now()
+	if fi, err := os.Stat(path); err == nil && now.Sub(fi.ModTime()) > diskCacheTouchInterval {
+		os.Chtimes(path, now, now)
+	}
+	return data
+}
+
+// Put stores a block in the cache. Errors are not reported to the
+// caller: a failure to cache a block only means it will have to be
+// retrieved from Keep again.
+func (dc *DiskCache) Put(hash string, data []byte) {
+	if len(hash) != 32 || int64(len(data)) > dc.maxBytes() {
+		return
+	}
+	path := dc.blockPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	err := dc.writeFile(path, data)
+	if err != nil {
+		DebugPrintf("DEBUG: disk cache: %s", err)
+		return
+	}
+	dc.added(int64(len(data)))
+}
+
+// added records that a block of the given size has been added to the
+// cache, and starts a sweep in the background if needed.
+func (dc *DiskCache) added(size int64) {
+	dc.mtx.Lock()
+	dc.written += size
+	needSweep := !dc.sweeping && (!dc.swept || dc.written > dc.maxBytes()/16)
+	if needSweep {
+		dc.sweeping = true
+	}
+	dc.mtx.Unlock()
+	if needSweep {
+		go func() {
+			err := dc.Sweep()
+			if err != nil {
+				DebugPrintf("DEBUG: disk cache: sweep: %s", err)
+			}
+			dc.mtx.Lock()
+			dc.sweeping = false
+			dc.mtx.Unlock()
+		}()
+	}
+}
+
+func (dc *DiskCache) writeFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// A DiskCacheWriter adds a block to a DiskCache as its content is
+// written, so the caller doesn't need to hold the whole block in
+// memory. The data is written to a temporary file, which becomes
+// visible to readers when Commit is called.
+//
+// Write never returns an error, so a DiskCacheWriter can be used
+// with io.TeeReader without interrupting the caller's own copy when
+// the cache fails. Errors are returned by Commit instead.
+type DiskCacheWriter struct {
+	dc   *DiskCache
+	path string
+	f    *os.File
+	size int64
+	err  error
+}
+
+// NewWriter returns a DiskCacheWriter for the block with the given
+// hash, or nil if the block is already cached or cannot be added.
+func (dc *DiskCache) NewWriter(hash string) *DiskCacheWriter {
+	if len(hash) != 32 {
+		return nil
+	}
+	path := dc.blockPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		DebugPrintf("DEBUG: disk cache: %s", err)
+		return nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "tmp-")
+	if err != nil {
+		DebugPrintf("DEBUG: disk cache: %s", err)
+		return nil
+	}
+	return &DiskCacheWriter{dc: dc, path: path, f: f}
+}
+
+// Write implements io.Writer.
+func (w *DiskCacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		w.size += int64(len(p))
+		if w.size > w.dc.maxBytes() {
+			w.err = fmt.Errorf("block is larger than cache size %d", w.dc.maxBytes())
+		} else {
+			_, w.err = w.f.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Commit adds the data written so far to the cache. The caller must
+// have verified that it matches the block's hash.
+func (w *DiskCacheWriter) Commit() error {
+	defer os.Remove(w.f.Name())
+	err := w.f.Close()
+	if w.err != nil {
+		return w.err
+	} else if err != nil {
+		return err
+	}
+	err = os.Rename(w.f.Name(), w.path)
+	if err != nil {
+		return err
+	}
+	w.dc.added(w.size)
+	return nil
+}
+
+// Abort discards the data written so far.
+func (w *DiskCacheWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// Sweep deletes the least recently used blocks until the total size
+// of the cache is no more than MaxBytes, and deletes stale temporary
+// files.
+//
+// If another process is already sweeping the same directory, Sweep
+// returns without doing anything.
+func (dc *DiskCache) Sweep() error {
+	lockfile, err := os.OpenFile(filepath.Join(dc.Dir, "lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockfile.Close()
+	err = syscall.Flock(int(lockfile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lockfile.Fd()), syscall.LOCK_UN)
+
+	dc.mtx.Lock()
+	dc.written = 0
+	dc.swept = true
+	dc.mtx.Unlock()
+
+	type cachedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cachedFile
+	var total int64
+	now := time.Now()
+	subdirs, err := ioutil.ReadDir(dc.Dir)
+	if err != nil {
+		return err
+	}
+	for _, subdir := range subdirs {
+		if !subdir.IsDir() || len(subdir.Name()) != 3 {
+			continue
+		}
+		dir := filepath.Join(dc.Dir, subdir.Name())
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			path := filepath.Join(dir, fi.Name())
+			if strings.HasPrefix(fi.Name(), "tmp-") {
+				if now.Sub(fi.ModTime()) > diskCacheTempFileTTL {
+					os.Remove(path)
+				}
+				continue
+			}
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			files = append(files, cachedFile{path: path, size: fi.Size(), modTime: fi.ModTime()})
+			total += fi.Size()
+		}
+	}
+	if total <= dc.maxBytes() {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		if total <= dc.maxBytes() {
+			break
+		}
+		err := os.Remove(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= f.size
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StandaloneSuite) TestDiskCache(c *C) {
+	tmpdir, err := ioutil.TempDir("", "keepclient-test-")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tmpdir)
+	dc := &DiskCache{Dir: tmpdir, MaxBytes: 2500}
+
+	var hashes []string
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 1000)
+		data[0] = byte(i)
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		hashes = append(hashes, hash)
+		c.Check(dc.Get(hash), IsNil)
+		// Use writeFile instead of Put, to avoid starting a
+		// sweep in the background.
+		c.Assert(dc.writeFile(dc.blockPath(hash), data), IsNil)
+		c.Check(dc.Get(hash), DeepEquals, data)
+		// Make the blocks appear to have been used at
+		// different times, oldest first.
+		t := time.Now().Add(time.Duration(i-10) * time.Minute)
+		c.Assert(os.Chtimes(dc.blockPath(hash), t, t), IsNil)
+	}
+
+	// Reading a block makes it the most recently used.
+	c.Check(dc.Get(hashes[0]), NotNil)
+
+	// While another process holds the lock, Sweep does nothing.
+	lockfile, err := os.OpenFile(filepath.Join(tmpdir, "lock"), os.O_CREATE|os.O_RDWR, 0600)
+	c.Assert(err, IsNil)
+	defer lockfile.Close()
+	c.Assert(syscall.Flock(int(lockfile.Fd()), syscall.LOCK_EX), IsNil)
+	c.Check(dc.Sweep(), IsNil)
+	_, err = os.Stat(dc.blockPath(hashes[1]))
+	c.Check(err, IsNil)
+	c.Assert(syscall.Flock(int(lockfile.Fd()), syscall.LOCK_UN), IsNil)
+
+	// Sweep evicts the least recently used block.
+	c.Check(dc.Sweep(), IsNil)
+	c.Check(dc.Get(hashes[0]), NotNil)
+	c.Check(dc.Get(hashes[1]), IsNil)
+	c.Check(dc.Get(hashes[2]), NotNil)
+
+	// A corrupt block is deleted instead of being returned.
+	c.Assert(ioutil.WriteFile(dc.blockPath(hashes[2]), []byte("corrupt"), 0600), IsNil)
+	c.Check(dc.Get(hashes[2]), IsNil)
+	_, err = os.Stat(dc.blockPath(hashes[2]))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *StandaloneSuite) TestBlockCacheDisk(c *C) {
+	tmpdir, err := ioutil.TempDir("", "keepclient-test-")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tmpdir)
+
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	locator := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+	st := StubRangeHandler{body: data, ranges: make(chan string, 10)}
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+
+	kc.BlockCache = &BlockCache{Disk: &DiskCache{Dir: tmpdir}}
+	buf, err := kc.BlockCache.Get(kc, locator)
+	c.Check(err, IsNil)
+	c.Check(buf, DeepEquals, data)
+	c.Check(<-st.ranges, Equals, "")
+
+	// A new BlockCache (e.g., in a different process) using the
+	// same directory reads the block from disk, even when only
+	// part of the block is requested. Only a HEAD request is
+	// sent, to check the caller's permission.
+	kc.BlockCache = &BlockCache{Disk: &DiskCache{Dir: tmpdir}}
+	buf = make([]byte, 5)
+	n, err := kc.ReadAt(locator, buf, 4)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "quick")
+	c.Check(<-st.ranges, Equals, "")
+	c.Check(st.ranges, HasLen, 0)
+
+	// A caller that isn't allowed to read the block doesn't get
+	// it from the disk cache.
+	ks403 := RunFakeKeepServer(StubGetHandler{c, locator, "abc123", http.StatusForbidden, nil})
+	defer ks403.listener.Close()
+	kc.Arvados.ApiToken = "abc123"
+	kc.SetServiceRoots(map[string]string{"x": ks403.url}, nil, nil)
+	kc.BlockCache = &BlockCache{Disk: &DiskCache{Dir: tmpdir}}
+	_, err = kc.BlockCache.Get(kc, locator)
+	c.Check(err, NotNil)
+}
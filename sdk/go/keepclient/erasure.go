@@ -0,0 +1,118 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"git.arvados.org/arvados.git/sdk/go/erasure"
+)
+
+// getFromShards rebuilds a block from its erasure-coded shards. It is
+// used when no keep service has a full replica of the block.
+//
+// Shards are requested from the keep services in the rendezvous
+// order of each shard's own locator, which is where keep-balance
+// prefers to put them. Until the first shard is found, every shard
+// index used by the cluster's storage classes is tried; after that,
+// the shard header tells us how many shards exist.
+func (kc *KeepClient) getFromShards(locator, reqid string) ([]byte, error) {
+	var shards []*erasure.Shard
+	total := kc.maxErasureShards()
+	for i := 0; i < total; i++ {
+		shard, err := kc.getShard(locator, i, reqid)
+		if err != nil {
+			DebugPrintf("DEBUG: GET %s shard %d failed: %v", locator, i, err)
+			continue
+		}
+		if len(shards) == 0 {
+			total = shard.DataShards + shard.ParityShards
+		}
+		shards = append(shards, shard)
+		if len(shards) >= shard.DataShards {
+			break
+		}
+	}
+	if len(shards) == 0 {
+		return nil, BlockNotFound
+	}
+	return erasure.Rebuild(shards)
+}
+
+// maxErasureShards returns the largest number of shards
+// (DataShards+ParityShards) used by any of the cluster's storage
+// classes, or 0 if none of them use erasure coding. The cluster's
+// exported configuration is retrieved the first time it is needed.
+func (kc *KeepClient) maxErasureShards() int {
+	kc.erasureMtx.Lock()
+	defer kc.erasureMtx.Unlock()
+	if kc.erasureShardsKnown {
+		return kc.erasureShards
+	}
+	var cfg struct {
+		StorageClasses map[string]struct {
+			DataShards   int
+			ParityShards int
+		}
+	}
+	err := kc.Arvados.Call("GET", "config", "", "", nil, &cfg)
+	if err != nil {
+		// Try again next time.
+		DebugPrintf("DEBUG: error retrieving cluster config: %v", err)
+		return 0
+	}
+	for _, sc := range cfg.StorageClasses {
+		if n := sc.DataShards + sc.ParityShards; sc.DataShards > 0 && n > kc.erasureShards {
+			kc.erasureShards = n
+		}
+	}
+	kc.erasureShardsKnown = true
+	return kc.erasureShards
+}
+
+// getShard retrieves shard number idx of the given block from the
+// first keep service that has an intact copy.
+func (kc *KeepClient) getShard(locator string, idx int, reqid string) (*erasure.Shard, error) {
+	hash := locator[:32]
+	var errs []string
+	for _, host := range kc.getSortedRoots(erasure.ShardLocator(hash, idx) + locator[32:]) {
+		url := host + "/" + locator
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "OAuth2 "+kc.Arvados.ApiToken)
+		req.Header.Set("X-Request-Id", reqid)
+		req.Header.Set("X-Keep-Erasure-Shard", fmt.Sprintf("%d", idx))
+		resp, err := kc.httpClient().Do(req)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", url, err))
+			continue
+		}
+		buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, BLOCKSIZE+erasure.HeaderSize))
+		resp.Body.Close()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", url, err))
+			continue
+		} else if resp.StatusCode != http.StatusOK {
+			errs = append(errs, fmt.Sprintf("%s: HTTP %d", url, resp.StatusCode))
+			continue
+		}
+		shard, err := erasure.ParseShard(buf)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", url, err))
+			continue
+		}
+		if shard.Hash != hash || shard.Index != idx {
+			errs = append(errs, fmt.Sprintf("%s: got shard %d of %s", url, shard.Index, shard.Hash))
+			continue
+		}
+		return shard, nil
+	}
+	return nil, fmt.Errorf("%v", errs)
+}
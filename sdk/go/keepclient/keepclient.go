@@ -84,6 +84,8 @@ var ErrIncompleteIndex = errors.New("Got incomplete index")
 
 const X_Keep_Desired_Replicas = "X-Keep-Desired-Replicas"
 const X_Keep_Replicas_Stored = "X-Keep-Replicas-Stored"
+const X_Keep_Storage_Classes = "X-Keep-Storage-Classes"
+const X_Keep_Storage_Classes_Confirmed = "X-Keep-Storage-Classes-Confirmed"
 
 type HTTPClient interface {
 	Do(*http.Request) (*http.Response, error)
@@ -111,6 +113,13 @@ type KeepClient struct {
 
 	// Disable automatic discovery of keep services
 	disableDiscovery bool
+
+	// Largest number of erasure-coded shards per block in any of
+	// the cluster's storage classes (0 if none), and whether it
+	// has been retrieved yet. See maxErasureShards.
+	erasureShards      int
+	erasureShardsKnown bool
+	erasureMtx         sync.Mutex
 }
 
 // MakeKeepClient creates a new KeepClient, calls
@@ -254,7 +263,8 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 				retryList = append(retryList, host)
 				continue
 			}
-			if resp.StatusCode != http.StatusOK {
+			partial := resp.StatusCode == http.StatusPartialContent && req.Header.Get("Range") != ""
+			if resp.StatusCode != http.StatusOK && !partial {
 				var respbody []byte
 				respbody, _ = ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 4096})
 				resp.Body.Close()
@@ -273,6 +283,16 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 				}
 				continue
 			}
+			if partial {
+				// The caller asked for part of the
+				// block, so the size hint and the
+				// hash don't apply.
+				if method != "GET" {
+					resp.Body.Close()
+					return nil, resp.ContentLength, url, resp.Header, nil
+				}
+				return resp.Body, resp.ContentLength, url, resp.Header, nil
+			}
 			if expectLength < 0 {
 				if resp.ContentLength < 0 {
 					resp.Body.Close()
@@ -299,6 +319,20 @@ func (kc *KeepClient) getOrHead(method string, locator string, header http.Heade
 	}
 	DebugPrintf("DEBUG: %s %s failed: %v", method, locator, errs)
 
+	if count404 == numServers && method == "GET" && numServers > 0 && !kc.foundNonDiskSvc {
+		// No full replicas, but the block might be stored
+		// as erasure-coded shards. (A keepproxy server does
+		// this itself, so we only do it when talking to
+		// keepstore servers directly.) getFromShards returns
+		// BlockNotFound right away if the cluster has no
+		// erasure-coded storage classes.
+		if data, err := kc.getFromShards(locator, reqid); err == nil {
+			return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), "", http.Header{}, nil
+		} else if err != BlockNotFound {
+			DebugPrintf("DEBUG: %s %s: rebuild from shards failed: %v", method, locator, err)
+		}
+	}
+
 	var err error
 	if count404 == numServers {
 		err = BlockNotFound
@@ -351,6 +385,52 @@ func (kc *KeepClient) ReadAt(locator string, p []byte, off int) (int, error) {
 	return kc.cache().ReadAt(kc, locator, p, off)
 }
 
+// Prefetch starts retrieving a block into the cache in the
+// background, if it isn't already cached, so a subsequent ReadAt
+// doesn't have to wait for it. It returns without doing anything if
+// the cache doesn't have room for more prefetched blocks.
+func (kc *KeepClient) Prefetch(locator string) {
+	kc.cache().Prefetch(kc, locator)
+}
+
+// getRange retrieves length bytes of a block, starting at offset
+// off. The caller must ensure the requested range is within the
+// block.
+//
+// Data returned by a server that supports Range requests cannot be
+// checked against the block's hash. If the server ignores the Range
+// header and returns the whole block, the whole block is checked
+// against the locator and returned with whole=true, so the caller
+// can cache it instead of retrieving it again.
+func (kc *KeepClient) getRange(locator string, off, length int) (data []byte, whole bool, err error) {
+	rdr, _, url, hdr, err := kc.getOrHead("GET", locator, http.Header{
+		"Range": {fmt.Sprintf("bytes=%d-%d", off, off+length-1)},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	defer rdr.Close()
+	if hdr.Get("Content-Range") == "" {
+		data, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			return nil, false, err
+		}
+		if fmt.Sprintf("%x", md5.Sum(data)) != locator[:32] {
+			return nil, false, fmt.Errorf("error reading %q from %s: %s", locator, url, BadChecksum)
+		}
+		if off+length > len(data) {
+			return nil, false, fmt.Errorf("error reading %q from %s: block is shorter than expected", locator, url)
+		}
+		return data, true, nil
+	}
+	data = make([]byte, length)
+	_, err = io.ReadFull(rdr, data)
+	if err != nil {
+		return nil, false, fmt.Errorf("error reading %q from %s: %s", locator, url, err)
+	}
+	return data, false, nil
+}
+
 // Ask() verifies that a block with the given hash is available and
 // readable, according to at least one Keep service. Unlike Get, it
 // does not retrieve the data or verify that the data content matches
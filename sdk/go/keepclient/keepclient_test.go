@@ -16,11 +16,13 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
 	. "gopkg.in/check.v1"
 )
 
@@ -165,7 +167,7 @@ func (s *StandaloneSuite) TestUploadToStubKeepServer(c *C) {
 
 			<-st.handled
 			status := <-upload_status
-			c.Check(status, DeepEquals, uploadStatus{nil, fmt.Sprintf("%s/%s", url, st.expectPath), 200, 1, ""})
+			c.Check(status, DeepEquals, uploadStatus{nil, fmt.Sprintf("%s/%s", url, st.expectPath), 200, 1, nil, ""})
 		})
 }
 
@@ -185,7 +187,7 @@ func (s *StandaloneSuite) TestUploadToStubKeepServerBufferReader(c *C) {
 			<-st.handled
 
 			status := <-upload_status
-			c.Check(status, DeepEquals, uploadStatus{nil, fmt.Sprintf("%s/%s", url, st.expectPath), 200, 1, ""})
+			c.Check(status, DeepEquals, uploadStatus{nil, fmt.Sprintf("%s/%s", url, st.expectPath), 200, 1, nil, ""})
 		})
 }
 
@@ -222,7 +224,12 @@ type Error404Handler struct {
 
 func (fh Error404Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	resp.WriteHeader(404)
-	fh.handled <- fmt.Sprintf("http://%s", req.Host)
+	select {
+	case fh.handled <- fmt.Sprintf("http://%s", req.Host):
+	default:
+		// After the first 404, the client might also ask
+		// for erasure-coded shards.
+	}
 }
 
 func (s *StandaloneSuite) TestFailedUploadToStubKeepServer(c *C) {
@@ -305,6 +312,67 @@ func (s *StandaloneSuite) TestPutB(c *C) {
 		true)
 }
 
+type storageClassesStubPutHandler struct {
+	confirm string
+	handled chan string
+}
+
+func (h storageClassesStubPutHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	io.Copy(ioutil.Discard, req.Body)
+	resp.Header().Set("X-Keep-Replicas-Stored", "1")
+	resp.Header().Set("X-Keep-Storage-Classes-Confirmed", h.confirm)
+	resp.WriteHeader(http.StatusOK)
+	resp.Write([]byte(Md5String("foo") + "+3"))
+	h.handled <- h.confirm
+}
+
+func (s *StandaloneSuite) TestPutWithStorageClasses(c *C) {
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(arv)
+	kc.Want_replicas = 1
+	kc.Retries = 0
+	arv.ApiToken = "abc123"
+
+	handled := make(chan string, 10)
+	localRoots := make(map[string]string)
+	for i, confirm := range []string{"default=1", "default=1", "archive=1", "default=1"} {
+		ks := RunFakeKeepServer(storageClassesStubPutHandler{confirm, handled})
+		defer ks.listener.Close()
+		localRoots[fmt.Sprintf("zzzzz-bi6l4-fakefakefake%03d", i)] = ks.url
+	}
+	kc.SetServiceRoots(localRoots, localRoots, nil)
+
+	kc.StorageClasses = []string{"archive"}
+	_, replicas, err := kc.PutB([]byte("foo"))
+	c.Check(err, IsNil)
+	c.Check(replicas >= 1, Equals, true)
+	archive := 0
+	for len(handled) > 0 {
+		if <-handled == "archive=1" {
+			archive++
+		}
+	}
+	c.Check(archive, Equals, 1)
+
+	kc.StorageClasses = []string{"nonexistent"}
+	_, replicas, err = kc.PutB([]byte("foo"))
+	c.Check(err, FitsTypeOf, InsufficientReplicasError(errors.New("")))
+	c.Check(replicas, Equals, 4)
+	c.Check(len(handled), Equals, 4)
+}
+
+func (s *StandaloneSuite) TestParseStorageClassesConfirmed(c *C) {
+	for hdr, expect := range map[string]map[string]int{
+		"":                      nil,
+		"default=1":             {"default": 1},
+		" default=2, archive=1": {"default": 2, "archive": 1},
+		"default=1, bogus":      nil,
+		"default=x":             nil,
+	} {
+		c.Check(parseStorageClassesConfirmed(hdr), DeepEquals, expect, Commentf("%q", hdr))
+	}
+}
+
 func (s *StandaloneSuite) TestPutHR(c *C) {
 	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
 
@@ -507,6 +575,179 @@ func (s *StandaloneSuite) TestGet(c *C) {
 	c.Check(content, DeepEquals, []byte("foo"))
 }
 
+// StubRangeHandler serves a single block, honoring Range headers
+// unless ignoreRange is true, and records the Range header of each
+// request.
+type StubRangeHandler struct {
+	body        []byte
+	ignoreRange bool
+	ranges      chan string
+}
+
+func (srh StubRangeHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	srh.ranges <- req.Header.Get("Range")
+	if srh.ignoreRange {
+		req.Header.Del("Range")
+	}
+	http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(srh.body))
+}
+
+func (s *StandaloneSuite) TestReadAtRange(c *C) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	locator := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+
+	st := StubRangeHandler{body: data, ranges: make(chan string, 10)}
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	kc.BlockCache = &BlockCache{}
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+
+	// The first read uses a Range request.
+	buf := make([]byte, 5)
+	n, err := kc.ReadAt(locator, buf, 4)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "quick")
+	c.Check(<-st.ranges, Equals, "bytes=4-8")
+
+	// Ranges are truncated at the end of the block.
+	c.Check(kc.BlockCache.firstRangedRead(locator[:32]), Equals, false)
+	kc.BlockCache.ranged = nil
+	buf = make([]byte, 10)
+	n, err = kc.ReadAt(locator, buf, len(data)-3)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "dog")
+	c.Check(<-st.ranges, Equals, fmt.Sprintf("bytes=%d-%d", len(data)-3, len(data)-1))
+
+	// The second read retrieves and caches the whole block.
+	n, err = kc.ReadAt(locator, buf, 10)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "brown fox ")
+	c.Check(<-st.ranges, Equals, "")
+
+	n, err = kc.ReadAt(locator, buf, 16)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "fox jumps ")
+	c.Check(st.ranges, HasLen, 0)
+}
+
+// If the server ignores the Range header and sends the whole block,
+// the block is verified and cached, so it isn't retrieved again.
+func (s *StandaloneSuite) TestReadAtRangeIgnored(c *C) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	locator := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+
+	st := StubRangeHandler{body: data, ignoreRange: true, ranges: make(chan string, 10)}
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	kc.BlockCache = &BlockCache{}
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+
+	buf := make([]byte, 5)
+	n, err := kc.ReadAt(locator, buf, 4)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "quick")
+	c.Check(<-st.ranges, Equals, "bytes=4-8")
+
+	buf = make([]byte, 10)
+	n, err = kc.ReadAt(locator, buf, 10)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "brown fox ")
+	n, err = kc.ReadAt(locator, buf, len(data)-3)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "dog")
+	c.Check(st.ranges, HasLen, 0)
+
+	// A block that doesn't match its locator is not returned or
+	// cached.
+	bad := []byte("the quick brown fox jumps over the lazy cat")
+	st = StubRangeHandler{body: bad, ignoreRange: true, ranges: make(chan string, 10)}
+	ks2 := RunFakeKeepServer(st)
+	defer ks2.listener.Close()
+	kc.BlockCache = &BlockCache{}
+	kc.SetServiceRoots(map[string]string{"x": ks2.url}, nil, nil)
+	_, err = kc.ReadAt(locator, buf, 4)
+	c.Check(err, ErrorMatches, ".*"+BadChecksum.Error()+".*")
+	c.Check(kc.BlockCache.cache, HasLen, 0)
+}
+
+// StubBlocksHandler serves the given blocks, and records the hash of
+// each block requested.
+type StubBlocksHandler struct {
+	blocks   map[string][]byte
+	requests chan string
+}
+
+func (sbh StubBlocksHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	hash := req.URL.Path[1:33]
+	sbh.requests <- hash
+	if data, ok := sbh.blocks[hash]; ok {
+		resp.Write(data)
+	} else {
+		resp.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *StandaloneSuite) TestPrefetch(c *C) {
+	st := StubBlocksHandler{blocks: map[string][]byte{}, requests: make(chan string, 10)}
+	var locators []string
+	for i := 0; i < 4; i++ {
+		data := []byte(fmt.Sprintf("block %d", i))
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		st.blocks[hash] = data
+		locators = append(locators, fmt.Sprintf("%s+%d", hash, len(data)))
+	}
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	kc.BlockCache = &BlockCache{MaxBlocks: 4}
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+
+	// With MaxBlocks=4, only 2 blocks can be prefetched until
+	// they are used.
+	for _, locator := range locators {
+		kc.Prefetch(locator)
+	}
+	got := map[string]bool{<-st.requests: true, <-st.requests: true}
+	c.Check(got, DeepEquals, map[string]bool{locators[0][:32]: true, locators[1][:32]: true})
+
+	// Reading a prefetched block doesn't retrieve it again,
+	// even if only part of the block is requested, and makes
+	// room for another prefetched block.
+	buf := make([]byte, 5)
+	n, err := kc.ReadAt(locators[0], buf, 2)
+	c.Check(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "ock 0")
+	c.Check(st.requests, HasLen, 0)
+	kc.Prefetch(locators[1])
+	kc.Prefetch(locators[2])
+	c.Check(<-st.requests, Equals, locators[2][:32])
+	kc.Prefetch(locators[3])
+	time.Sleep(10 * time.Millisecond)
+	c.Check(st.requests, HasLen, 0)
+
+	// A bigger cache doesn't allow more blocks to be
+	// prefetched.
+	kc.BlockCache = &BlockCache{MaxBlocks: 20}
+	for _, locator := range locators {
+		kc.Prefetch(locator)
+	}
+	<-st.requests
+	<-st.requests
+	time.Sleep(10 * time.Millisecond)
+	c.Check(st.requests, HasLen, 0)
+}
+
 func (s *StandaloneSuite) TestGet404(c *C) {
 	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
 
@@ -528,6 +769,118 @@ func (s *StandaloneSuite) TestGet404(c *C) {
 	c.Check(r, Equals, nil)
 }
 
+// StubShardHandler serves erasure-coded shards of a block, but no
+// full replicas.
+type StubShardHandler struct {
+	shards map[string][]byte // shard index -> stored shard
+	mtx    sync.Mutex
+	reqs   []string
+}
+
+func (ssh *StubShardHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	idx := req.Header.Get("X-Keep-Erasure-Shard")
+	ssh.mtx.Lock()
+	ssh.reqs = append(ssh.reqs, idx)
+	ssh.mtx.Unlock()
+	if buf, ok := ssh.shards[idx]; ok {
+		resp.Write(buf)
+	} else {
+		resp.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *StandaloneSuite) TestGetFromShards(c *C) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	locator := fmt.Sprintf("%s+%d", hash, len(data))
+	codec, err := erasure.NewCodec(3, 2)
+	c.Assert(err, IsNil)
+	shards := erasure.Split(codec, hash, data)
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Check(err, IsNil)
+	kc, _ := MakeKeepClient(arv)
+	kc.BlockCache = &BlockCache{}
+	// Pretend the cluster config has an erasure-coded storage
+	// class with up to 8 shards.
+	kc.erasureShards, kc.erasureShardsKnown = 8, true
+
+	// With more than 4 data shards, and the first few shards
+	// missing, all shard indexes need to be probed.
+	codec8, err := erasure.NewCodec(5, 3)
+	c.Assert(err, IsNil)
+	shards8 := erasure.Split(codec8, hash, data)
+
+	for _, trial := range []struct {
+		shards []*erasure.Shard
+		have   []int
+		expect string
+	}{
+		{shards, []int{0, 1, 2, 3, 4}, "the quick"},
+		{shards, []int{1, 3, 4}, "the quick"},
+		{shards, []int{4, 3}, ""},
+		{shards, nil, ""},
+		{shards8, []int{3, 4, 5, 6, 7}, "the quick"},
+		{shards8, []int{0, 2, 4, 6}, ""},
+	} {
+		st := &StubShardHandler{shards: map[string][]byte{}}
+		for _, i := range trial.have {
+			st.shards[fmt.Sprint(i)] = trial.shards[i].Marshal()
+		}
+		ks := RunFakeKeepServer(st)
+		defer ks.listener.Close()
+		kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+		kc.ClearBlockCache()
+
+		buf := make([]byte, 9)
+		n, err := kc.ReadAt(locator, buf, 0)
+		if trial.expect == "" {
+			c.Check(err, NotNil)
+			continue
+		}
+		c.Check(err, IsNil)
+		c.Check(string(buf[:n]), Equals, trial.expect)
+	}
+
+	// Once enough shards have been found, the rest are not
+	// requested.
+	st := &StubShardHandler{shards: map[string][]byte{}}
+	for i := range shards {
+		st.shards[fmt.Sprint(i)] = shards[i].Marshal()
+	}
+	ks := RunFakeKeepServer(st)
+	defer ks.listener.Close()
+	kc.SetServiceRoots(map[string]string{"x": ks.url}, nil, nil)
+	rdr, n, _, err := kc.Get(locator)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, int64(len(data)))
+	got, err := ioutil.ReadAll(rdr)
+	c.Check(err, IsNil)
+	c.Check(got, DeepEquals, data)
+	c.Check(st.reqs, DeepEquals, []string{"", "0", "1", "2"})
+
+	// Shards of some other block are not used.
+	other := []byte("a different block of about the same length")
+	st.shards = map[string][]byte{}
+	for i, shard := range erasure.Split(codec, fmt.Sprintf("%x", md5.Sum(other)), other) {
+		st.shards[fmt.Sprint(i)] = shard.Marshal()
+	}
+	_, _, _, err = kc.Get(locator)
+	c.Check(err, Equals, BlockNotFound)
+
+	// Shards are not requested if the cluster has no
+	// erasure-coded storage classes.
+	kc.erasureShards = 0
+	st.shards = map[string][]byte{}
+	for i := range shards {
+		st.shards[fmt.Sprint(i)] = shards[i].Marshal()
+	}
+	st.reqs = nil
+	_, _, _, err = kc.Get(locator)
+	c.Check(err, Equals, BlockNotFound)
+	c.Check(st.reqs, DeepEquals, []string{""})
+}
+
 func (s *StandaloneSuite) TestGetEmptyBlock(c *C) {
 	st := Error404Handler{make(chan string, 1)}
 
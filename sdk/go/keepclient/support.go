@@ -13,6 +13,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
@@ -52,6 +53,7 @@ type uploadStatus struct {
 	url             string
 	statusCode      int
 	replicas_stored int
+	classes_stored  map[string]int
 	response        string
 }
 
@@ -63,7 +65,7 @@ func (this *KeepClient) uploadToKeepServer(host string, hash string, body io.Rea
 	var url = fmt.Sprintf("%s/%s", host, hash)
 	if req, err = http.NewRequest("PUT", url, nil); err != nil {
 		DebugPrintf("DEBUG: [%s] Error creating request PUT %v error: %v", reqid, url, err.Error())
-		upload_status <- uploadStatus{err, url, 0, 0, ""}
+		upload_status <- uploadStatus{err, url, 0, 0, nil, ""}
 		return
 	}
 
@@ -81,13 +83,13 @@ func (this *KeepClient) uploadToKeepServer(host string, hash string, body io.Rea
 	req.Header.Add("Content-Type", "application/octet-stream")
 	req.Header.Add(X_Keep_Desired_Replicas, fmt.Sprint(this.Want_replicas))
 	if len(this.StorageClasses) > 0 {
-		req.Header.Add("X-Keep-Storage-Classes", strings.Join(this.StorageClasses, ", "))
+		req.Header.Add(X_Keep_Storage_Classes, strings.Join(this.StorageClasses, ", "))
 	}
 
 	var resp *http.Response
 	if resp, err = this.httpClient().Do(req); err != nil {
 		DebugPrintf("DEBUG: [%s] Upload failed %v error: %v", reqid, url, err.Error())
-		upload_status <- uploadStatus{err, url, 0, 0, err.Error()}
+		upload_status <- uploadStatus{err, url, 0, 0, nil, err.Error()}
 		return
 	}
 
@@ -95,6 +97,7 @@ func (this *KeepClient) uploadToKeepServer(host string, hash string, body io.Rea
 	if xr := resp.Header.Get(X_Keep_Replicas_Stored); xr != "" {
 		fmt.Sscanf(xr, "%d", &rep)
 	}
+	classes := parseStorageClassesConfirmed(resp.Header.Get(X_Keep_Storage_Classes_Confirmed))
 
 	defer resp.Body.Close()
 	defer io.Copy(ioutil.Discard, resp.Body)
@@ -103,16 +106,16 @@ func (this *KeepClient) uploadToKeepServer(host string, hash string, body io.Rea
 	response := strings.TrimSpace(string(respbody))
 	if err2 != nil && err2 != io.EOF {
 		DebugPrintf("DEBUG: [%s] Upload %v error: %v response: %v", reqid, url, err2.Error(), response)
-		upload_status <- uploadStatus{err2, url, resp.StatusCode, rep, response}
+		upload_status <- uploadStatus{err2, url, resp.StatusCode, rep, classes, response}
 	} else if resp.StatusCode == http.StatusOK {
 		DebugPrintf("DEBUG: [%s] Upload %v success", reqid, url)
-		upload_status <- uploadStatus{nil, url, resp.StatusCode, rep, response}
+		upload_status <- uploadStatus{nil, url, resp.StatusCode, rep, classes, response}
 	} else {
 		if resp.StatusCode >= 300 && response == "" {
 			response = resp.Status
 		}
 		DebugPrintf("DEBUG: [%s] Upload %v error: %v response: %v", reqid, url, resp.StatusCode, response)
-		upload_status <- uploadStatus{errors.New(resp.Status), url, resp.StatusCode, rep, response}
+		upload_status <- uploadStatus{errors.New(resp.Status), url, resp.StatusCode, rep, classes, response}
 	}
 }
 
@@ -149,6 +152,28 @@ func (this *KeepClient) putReplicas(
 	replicasDone := 0
 	replicasTodo := this.Want_replicas
 
+	// Replicas still needed in each requested storage class. If
+	// a server doesn't report which classes it stored, we can't
+	// track this, so we fall back to counting total replicas
+	// (classesTodo = nil).
+	classesTodo := make(map[string]int, len(this.StorageClasses))
+	for _, class := range this.StorageClasses {
+		if class != "" {
+			classesTodo[class] = this.Want_replicas
+		}
+	}
+	// todo returns the largest number of replicas still needed
+	// to satisfy the total replication and each storage class.
+	todo := func() int {
+		n := replicasTodo
+		for _, want := range classesTodo {
+			if want > n {
+				n = want
+			}
+		}
+		return n
+	}
+
 	replicasPerThread := this.replicasPerService
 	if replicasPerThread < 1 {
 		// unlimited or unknown
@@ -164,8 +189,8 @@ func (this *KeepClient) putReplicas(
 		retriesRemaining -= 1
 		nextServer = 0
 		retryServers = []string{}
-		for replicasTodo > 0 {
-			for active*replicasPerThread < replicasTodo {
+		for todo() > 0 {
+			for active*replicasPerThread < todo() {
 				// Start some upload requests
 				if nextServer < len(sv) {
 					DebugPrintf("DEBUG: [%s] Begin upload %s to %s", reqid, hash, sv[nextServer])
@@ -184,8 +209,8 @@ func (this *KeepClient) putReplicas(
 					break
 				}
 			}
-			DebugPrintf("DEBUG: [%s] Replicas remaining to write: %v active uploads: %v",
-				reqid, replicasTodo, active)
+			DebugPrintf("DEBUG: [%s] Replicas remaining to write: %v (by storage class: %v) active uploads: %v",
+				reqid, replicasTodo, classesTodo, active)
 
 			// Now wait for something to happen.
 			if active > 0 {
@@ -196,6 +221,16 @@ func (this *KeepClient) putReplicas(
 					// good news!
 					replicasDone += status.replicas_stored
 					replicasTodo -= status.replicas_stored
+					if status.classes_stored == nil {
+						classesTodo = nil
+					}
+					for class, n := range status.classes_stored {
+						if classesTodo[class] > n {
+							classesTodo[class] -= n
+						} else {
+							delete(classesTodo, class)
+						}
+					}
 					locator = status.response
 					delete(lastError, status.url)
 				} else {
@@ -222,3 +257,31 @@ func (this *KeepClient) putReplicas(
 
 	return locator, replicasDone, nil
 }
+
+// parseStorageClassesConfirmed parses the value of an
+// X-Keep-Storage-Classes-Confirmed response header, like
+// "default=2, archive=1", into a map of storage class names to
+// replica counts. It returns nil if the header is empty or
+// malformed.
+func parseStorageClassesConfirmed(hdr string) map[string]int {
+	if hdr == "" {
+		return nil
+	}
+	classes := map[string]int{}
+	for _, cr := range strings.Split(hdr, ",") {
+		cr = strings.TrimSpace(cr)
+		if cr == "" {
+			continue
+		}
+		eq := strings.Index(cr, "=")
+		if eq < 1 {
+			return nil
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(cr[eq+1:]))
+		if err != nil || n < 0 {
+			return nil
+		}
+		classes[strings.TrimSpace(cr[:eq])] += n
+	}
+	return classes
+}
@@ -0,0 +1,291 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Uploader writes a stream of data to Keep as a sequence of
+// blocks, with several blocks in flight at once.
+//
+// Each block is retried independently: a failure writing one block
+// doesn't cause other blocks to be written again. If CheckpointFile
+// is set, the locators of the blocks written so far are saved there,
+// so an interrupted upload can be resumed by a new Uploader -- even
+// in a different process -- without writing those blocks again.
+type Uploader struct {
+	KeepClient *KeepClient
+
+	// Maximum number of blocks to write concurrently. Memory
+	// use is limited to Concurrency+1 blocks. Default 4.
+	Concurrency int
+
+	// Size of each block except the last. Default BLOCKSIZE.
+	BlockSize int
+
+	// Number of times to retry writing a block, after the
+	// retries done by KeepClient itself, before giving up on the
+	// whole upload. Default 0.
+	BlockRetries int
+
+	// Delay before the first retry of a block. The delay doubles
+	// with each subsequent retry. Default 1s.
+	RetryDelay time.Duration
+
+	// If non-empty, resume from the checkpoint saved in this
+	// file (if it exists), and save a checkpoint after each block
+	// is written.
+	CheckpointFile string
+
+	// Minimum remaining lifetime of a signed locator from the
+	// checkpoint file. A block whose signature expires sooner is
+	// written again. Default 1h.
+	MinSignatureTTL time.Duration
+}
+
+// UploadCheckpoint is the content of an Uploader's checkpoint file.
+type UploadCheckpoint struct {
+	BlockSize int `json:"block_size"`
+	// Locators of the blocks written so far, in stream order. An
+	// empty string means the block at that position has not been
+	// written.
+	Locators []string `json:"locators"`
+}
+
+// LoadUploadCheckpoint reads a checkpoint file saved by an Uploader.
+// If the file does not exist, it returns an empty checkpoint.
+func LoadUploadCheckpoint(path string) (*UploadCheckpoint, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &UploadCheckpoint{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ckpt UploadCheckpoint
+	err = json.Unmarshal(buf, &ckpt)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &ckpt, nil
+}
+
+// Save writes the checkpoint to the given file. The file is replaced
+// atomically.
+func (ckpt *UploadCheckpoint) Save(path string) error {
+	buf, err := json.Marshal(ckpt)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write(buf)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Upload reads r until EOF, writes the data to Keep, and returns
+// the locators of the written blocks in stream order. An empty
+// stream results in an empty list.
+//
+// When resuming from a checkpoint, each block is still read from r,
+// but it is only written to Keep if its content differs from the
+// checkpoint, or its signature is about to expire.
+//
+// If a block can't be written, Upload stops reading, waits for the
+// blocks already in flight, saves the checkpoint, and returns an
+// error.
+func (up *Uploader) Upload(ctx context.Context, r io.Reader) ([]string, error) {
+	concurrency := up.Concurrency
+	if concurrency < 1 {
+		concurrency = 4
+	}
+	blocksize := up.BlockSize
+	if blocksize < 1 || blocksize > BLOCKSIZE {
+		blocksize = BLOCKSIZE
+	}
+
+	ckpt := &UploadCheckpoint{}
+	if up.CheckpointFile != "" {
+		var err error
+		ckpt, err = LoadUploadCheckpoint(up.CheckpointFile)
+		if err != nil {
+			return nil, err
+		}
+		if ckpt.BlockSize != blocksize {
+			// Can't reuse blocks of a different size.
+			ckpt = &UploadCheckpoint{}
+		}
+	}
+	ckpt.BlockSize = blocksize
+	previous := ckpt.Locators
+	ckpt.Locators = nil
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mtx      sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	// Free buffers. A buffer is taken before reading each block
+	// and returned when the block is written.
+	bufs := make(chan []byte, concurrency+1)
+	for i := 0; i < concurrency+1; i++ {
+		bufs <- nil
+	}
+	// Limits the number of writes in flight.
+	writing := make(chan struct{}, concurrency)
+
+	fail := func(err error) {
+		mtx.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mtx.Unlock()
+		cancel()
+	}
+	done := func(idx int, locator string) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		ckpt.Locators[idx] = locator
+		if up.CheckpointFile != "" {
+			if err := ckpt.Save(up.CheckpointFile); err != nil && firstErr == nil {
+				firstErr = err
+				cancel()
+			}
+		}
+	}
+
+	for idx := 0; ctx.Err() == nil; idx++ {
+		var buf []byte
+		select {
+		case buf = <-bufs:
+		case <-ctx.Done():
+			continue
+		}
+		if buf == nil {
+			buf = make([]byte, blocksize)
+		}
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			fail(err)
+			break
+		}
+		data := buf[:n]
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		mtx.Lock()
+		ckpt.Locators = append(ckpt.Locators, "")
+		mtx.Unlock()
+		if idx < len(previous) && up.reusable(previous[idx], hash, n) {
+			done(idx, previous[idx])
+			bufs <- buf
+		} else {
+			select {
+			case writing <- struct{}{}:
+			case <-ctx.Done():
+				bufs <- buf
+				continue
+			}
+			wg.Add(1)
+			go func(idx int, buf []byte) {
+				defer wg.Done()
+				defer func() { bufs <- buf }()
+				defer func() { <-writing }()
+				locator, err := up.putBlock(ctx, hash, data)
+				if err != nil {
+					fail(fmt.Errorf("block %d at offset %d: %v", idx, int64(idx)*int64(blocksize), err))
+					return
+				}
+				done(idx, locator)
+			}(idx, buf)
+		}
+		if n < blocksize {
+			break
+		}
+	}
+	wg.Wait()
+	mtx.Lock()
+	defer mtx.Unlock()
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return ckpt.Locators, nil
+}
+
+// putBlock writes a block, retrying up to BlockRetries times.
+func (up *Uploader) putBlock(ctx context.Context, hash string, data []byte) (string, error) {
+	delay := up.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		locator, _, err := up.KeepClient.PutHB(hash, data)
+		if err == nil || attempt >= up.BlockRetries {
+			return locator, err
+		}
+		DebugPrintf("DEBUG: retrying block %s in %v after error: %v", hash, delay, err)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// reusable returns true if the given locator from a checkpoint
+// refers to a block with the given hash and size, and its signature
+// (if any) won't expire too soon to use it in a collection.
+func (up *Uploader) reusable(locator, hash string, size int) bool {
+	prefix := hash + "+" + strconv.Itoa(size)
+	if locator != prefix && !strings.HasPrefix(locator, prefix+"+") {
+		return false
+	}
+	if !strings.Contains(locator, "+A") {
+		// Permission signatures are not enabled.
+		return true
+	}
+	m := SignedLocatorRe.FindStringSubmatch(locator)
+	if m == nil {
+		return false
+	}
+	expiry, err := strconv.ParseInt(m[7], 16, 64)
+	if err != nil {
+		return false
+	}
+	ttl := up.MinSignatureTTL
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	return time.Unix(expiry, 0).After(time.Now().Add(ttl))
+}
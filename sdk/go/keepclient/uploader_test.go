@@ -0,0 +1,189 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+// uploaderStubHandler is a fake keepstore server that accepts PUT
+// requests, optionally failing some of them.
+type uploaderStubHandler struct {
+	delay  time.Duration
+	expiry time.Time
+
+	mtx         sync.Mutex
+	puts        int
+	failures    map[string]int // hash => number of PUTs to fail
+	inflight    int
+	maxInflight int
+}
+
+func (h *uploaderStubHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	hash := strings.TrimPrefix(req.URL.Path, "/")
+	body, _ := ioutil.ReadAll(req.Body)
+	h.mtx.Lock()
+	h.puts++
+	h.inflight++
+	if h.inflight > h.maxInflight {
+		h.maxInflight = h.inflight
+	}
+	fail := h.failures[hash] > 0
+	if fail {
+		h.failures[hash]--
+	}
+	h.mtx.Unlock()
+	time.Sleep(h.delay)
+	h.mtx.Lock()
+	h.inflight--
+	h.mtx.Unlock()
+	if fail {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(resp, "%s+%d+A%040x@%08x", hash, len(body), 0, h.expiry.Unix())
+}
+
+func (s *StandaloneSuite) setupUploader(c *C, h *uploaderStubHandler) (*Uploader, func()) {
+	ks := RunFakeKeepServer(h)
+	kc := &KeepClient{
+		Arvados:       &arvadosclient.ArvadosClient{ApiToken: "abc123"},
+		Want_replicas: 1,
+	}
+	roots := map[string]string{"zzzzz-bi6l4-fakefakefake000": ks.url}
+	kc.SetServiceRoots(roots, roots, nil)
+	return &Uploader{
+		KeepClient: kc,
+		BlockSize:  1000,
+		RetryDelay: time.Millisecond,
+	}, func() { ks.listener.Close() }
+}
+
+func uploaderTestData(size int) ([]byte, []string) {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7 / 1000)
+	}
+	return data, blockLocators(data)
+}
+
+// blockLocators returns the unsigned locators of the 1000-byte
+// blocks in data.
+func blockLocators(data []byte) []string {
+	var locators []string
+	for off := 0; off < len(data); off += 1000 {
+		end := off + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		locators = append(locators, fmt.Sprintf("%x+%d", md5.Sum(data[off:end]), end-off))
+	}
+	return locators
+}
+
+func checkUploadedLocators(c *C, locators, expect []string) {
+	c.Assert(locators, HasLen, len(expect))
+	for i, loc := range locators {
+		c.Check(strings.HasPrefix(loc, expect[i]+"+A"), Equals, true, Commentf("%d: %s", i, loc))
+	}
+}
+
+func (s *StandaloneSuite) TestUploaderConcurrency(c *C) {
+	h := &uploaderStubHandler{delay: 20 * time.Millisecond, expiry: time.Now().Add(time.Hour * 24)}
+	up, cleanup := s.setupUploader(c, h)
+	defer cleanup()
+	up.Concurrency = 3
+	data, expect := uploaderTestData(10500)
+	locators, err := up.Upload(context.Background(), bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	checkUploadedLocators(c, locators, expect)
+	c.Check(h.puts, Equals, 11)
+	c.Check(h.maxInflight, Equals, 3)
+
+	// Empty stream
+	locators, err = up.Upload(context.Background(), bytes.NewReader(nil))
+	c.Check(err, IsNil)
+	c.Check(locators, HasLen, 0)
+}
+
+func (s *StandaloneSuite) TestUploaderRetry(c *C) {
+	data, expect := uploaderTestData(5000)
+	h := &uploaderStubHandler{
+		expiry:   time.Now().Add(time.Hour * 24),
+		failures: map[string]int{expect[2][:32]: 2},
+	}
+	up, cleanup := s.setupUploader(c, h)
+	defer cleanup()
+	up.BlockRetries = 2
+	locators, err := up.Upload(context.Background(), bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	checkUploadedLocators(c, locators, expect)
+	c.Check(h.puts, Equals, 7)
+}
+
+func (s *StandaloneSuite) TestUploaderResume(c *C) {
+	tmpdir, err := ioutil.TempDir("", "keepclient-test-")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tmpdir)
+
+	data, expect := uploaderTestData(8000)
+	h := &uploaderStubHandler{
+		expiry:   time.Now().Add(time.Hour * 24),
+		failures: map[string]int{expect[5][:32]: 1},
+	}
+	up, cleanup := s.setupUploader(c, h)
+	defer cleanup()
+	up.Concurrency = 1
+	up.CheckpointFile = filepath.Join(tmpdir, "checkpoint")
+	_, err = up.Upload(context.Background(), bytes.NewReader(data))
+	c.Check(err, ErrorMatches, `block 5 at offset 5000: .*`)
+
+	ckpt, err := LoadUploadCheckpoint(up.CheckpointFile)
+	c.Assert(err, IsNil)
+	c.Check(ckpt.BlockSize, Equals, 1000)
+	// Block 6 might have been read, but not written, before the
+	// upload was canceled.
+	c.Assert(len(ckpt.Locators) >= 6, Equals, true)
+	checkUploadedLocators(c, ckpt.Locators[:5], expect[:5])
+	for _, loc := range ckpt.Locators[5:] {
+		c.Check(loc, Equals, "")
+	}
+
+	// Resume, with different data in block 1: only blocks 1 and
+	// 5 and later are written.
+	data[1000]++
+	expect = blockLocators(data)
+	h.puts = 0
+	locators, err := up.Upload(context.Background(), bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	checkUploadedLocators(c, locators, expect)
+	c.Check(h.puts, Equals, 4)
+
+	ckpt, err = LoadUploadCheckpoint(up.CheckpointFile)
+	c.Assert(err, IsNil)
+	c.Check(ckpt.Locators, DeepEquals, locators)
+
+	// Locators whose signatures are about to expire are not
+	// reused.
+	up.MinSignatureTTL = 48 * time.Hour
+	h.puts = 0
+	locators, err = up.Upload(context.Background(), bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	checkUploadedLocators(c, locators, expect)
+	c.Check(h.puts, Equals, 8)
+}
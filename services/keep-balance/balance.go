@@ -9,8 +9,6 @@ import (
 	"context"
 	"crypto/md5"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"math"
 	"os"
@@ -22,6 +20,7 @@ import (
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
 	"github.com/sirupsen/logrus"
 )
@@ -42,20 +41,51 @@ type Balancer struct {
 
 	LostBlocksFile string
 
+	// If ReportFile is non-empty, write a machine-readable report
+	// of the statistics computed in each run to the given file
+	// ("-" for stdout) in ReportFormat ("json" or "csv").
+	ReportFile   string
+	ReportFormat string
+
+	// If TrackStorageUsage is true, compute the storage used by
+	// each owner (see StorageUsageReport) even if no report file
+	// is being written.
+	TrackStorageUsage bool
+
 	*BlockStateMap
 	KeepServices       map[string]*KeepService
 	DefaultReplication int
 	MinMtime           int64
 
-	classes       []string
-	mounts        int
-	mountsByClass map[string]map[*KeepMount]bool
-	collScanned   int
-	serviceRoots  map[string]string
-	errors        []error
-	stats         balancerStats
-	mutex         sync.Mutex
-	lostBlocks    io.Writer
+	classes        []string
+	mounts         int
+	mountsByClass  map[string]map[*KeepMount]bool
+	quarantined    map[string]map[string]bool // device ID => hash => true
+	erasureClasses map[string]*erasure.Codec
+	stripes        []*Stripe
+	collScanned    int
+	serviceRoots   map[string]string
+	errors         []error
+	stats          balancerStats
+	mutex          sync.Mutex
+	lost           []lostBlock
+	trackRefs      bool // track PDHs of collections that reference lost blocks
+
+	// Incremental mode (see UpdateState)
+	trackChanges   bool              // retain state for the next run
+	incremental    bool              // this run started from a previous state
+	startTime      time.Time         // start time of this run
+	changeCursors  map[string]string // mount UUID => change log cursor
+	lastModifiedAt time.Time         // latest modified_at of collections seen
+	// UUID => modified_at of collections counted so far whose
+	// modified_at is within collectionsOverlap of lastModifiedAt
+	recentCollections map[string]time.Time
+
+	// per-owner usage computed in this run (if TrackStorageUsage
+	// and this is a full scan)
+	storageUsage *arvados.StorageUsageReport
+	// project UUID => owner UUID (if TrackStorageUsage)
+	projectParents map[string]string
 }
 
 // Run performs a balance operation using the given config and
@@ -69,12 +99,23 @@ type Balancer struct {
 //   runOptions, err = (&Balancer{}).Run(config, runOptions)
 func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOptions RunOptions) (nextRunOptions RunOptions, err error) {
 	nextRunOptions = runOptions
+	// The block state is only retained if this run gets far
+	// enough to update it successfully.
+	nextRunOptions.incrementalState = nil
+	bal.startTime = time.Now()
 
 	defer bal.time("sweep", "wall clock time to run one full sweep")()
 
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(cluster.Collections.BalanceTimeout.Duration()))
 	defer cancel()
 
+	switch bal.ReportFormat {
+	case "", "json", "csv":
+	default:
+		err = fmt.Errorf("unsupported report format %q (must be \"json\" or \"csv\")", bal.ReportFormat)
+		return
+	}
+
 	var lbFile *os.File
 	if bal.LostBlocksFile != "" {
 		tmpfn := bal.LostBlocksFile + ".tmp"
@@ -94,9 +135,18 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 				os.Remove(tmpfn)
 			}
 		}()
-		bal.lostBlocks = lbFile
-	} else {
-		bal.lostBlocks = ioutil.Discard
+	}
+	schedule, err := arvados.NewMaintenanceSchedule(cluster.Collections.BalanceMaintenanceWindows, cluster.Collections.BalanceMaintenanceTimeZone)
+	if err != nil {
+		err = fmt.Errorf("Collections.BalanceMaintenanceWindows: %v", err)
+		return
+	}
+	cc := cluster.Collections
+	bal.trackRefs = bal.LostBlocksFile != "" || cc.BlobMissingFileReport != "" || cc.BlobMissingProperty != "" || len(cc.BlobMissingRecoverySources) > 0
+
+	err = bal.setupErasureCoding(cluster.StorageClasses)
+	if err != nil {
+		return
 	}
 
 	err = bal.DiscoverKeepServices(client)
@@ -139,15 +189,30 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 		nextRunOptions.SafeRendezvousState = rs
 	}
 
-	if err = bal.GetCurrentState(ctx, client, cluster.Collections.BalanceCollectionBatch, cluster.Collections.BalanceCollectionBuffers); err != nil {
+	fullScanPeriod := cluster.Collections.BalanceFullScanPeriod.Duration()
+	bal.trackChanges = fullScanPeriod > 0
+	if state := bal.prepareIncremental(runOptions.incrementalState, fullScanPeriod, rs); state != nil {
+		err = bal.UpdateState(ctx, client, state, cluster.Collections.BalanceCollectionBatch)
+	} else {
+		err = bal.GetCurrentState(ctx, client, cluster.Collections.BalanceCollectionBatch, cluster.Collections.BalanceCollectionBuffers)
+	}
+	if err != nil {
 		return
 	}
 	bal.ComputeChangeSets()
+	bal.ThrottleChanges(cluster, schedule, bal.startTime)
 	bal.PrintStatistics()
 	if err = bal.CheckSanityLate(); err != nil {
 		return
 	}
+	if bal.trackChanges {
+		nextRunOptions.incrementalState = bal.nextIncrementalState(runOptions.incrementalState, rs)
+	}
+	if runOptions.CommitPulls {
+		bal.RecoverLostBlocks(ctx, client, cluster)
+	}
 	if lbFile != nil {
+		bal.writeLostBlocks(lbFile)
 		err = lbFile.Sync()
 		if err != nil {
 			return
@@ -158,12 +223,37 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 		}
 		lbFile = nil
 	}
+	if err := bal.ReportLostFiles(ctx, client, cluster, runOptions.CommitPulls); err != nil {
+		// Balancing doesn't depend on this, so don't let an
+		// API error here prevent committing changes.
+		bal.logf("error reporting files affected by lost blocks: %s", err)
+	}
+	if bal.ReportFile != "" {
+		err = bal.WriteReport()
+		if err != nil {
+			return
+		}
+	}
+	if bal.TrackStorageUsage && !bal.incremental {
+		// Usage from an incremental run would still count
+		// blocks that are no longer referenced, so it is
+		// only reported after a full scan.
+		usage := bal.StorageUsageReport()
+		bal.storageUsage = &usage
+	}
 	if runOptions.CommitPulls {
 		err = bal.CommitPulls(ctx, client)
 		if err != nil {
 			// Skip trash if we can't pull. (Too cautious?)
 			return
 		}
+		if err := bal.CommitStripes(ctx, client); err != nil {
+			// Trash lists never depend on shards written
+			// in the current run, so it's still safe to
+			// send them. Failed stripes will be retried
+			// on the next run.
+			bal.logf("%v", err)
+		}
 	}
 	if runOptions.CommitTrash {
 		err = bal.CommitTrash(ctx, client)
@@ -331,6 +421,13 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 	bal.DefaultReplication = dd.DefaultCollectionReplication
 	bal.MinMtime = time.Now().UnixNano() - dd.BlobSignatureTTL*1e9
 
+	if bal.TrackStorageUsage {
+		bal.projectParents, err = getProjectParents(ctx, c, pageSize)
+		if err != nil {
+			return fmt.Errorf("retrieving project list: %v", err)
+		}
+	}
+
 	errs := make(chan error, 1)
 	wg := sync.WaitGroup{}
 
@@ -363,6 +460,12 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 		wg.Add(1)
 		go func(mounts []*KeepMount) {
 			defer wg.Done()
+			if bal.trackChanges && len(mounts) == 1 {
+				// Get the cursor before the index,
+				// so the next run sees all changes
+				// made while we retrieve the index.
+				bal.setChangeCursor(mounts[0], bal.getChangeCursor(ctx, c, mounts[0]))
+			}
 			bal.logf("mount %s: retrieve index from %s", mounts[0], mounts[0].KeepService)
 			idx, err := mounts[0].KeepService.IndexMount(ctx, c, mounts[0].UUID, "")
 			if err != nil {
@@ -448,6 +551,7 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 	if len(errs) > 0 {
 		return <-errs
 	}
+	bal.BlockStateMap.ResolveUnsized()
 	return nil
 }
 
@@ -461,13 +565,33 @@ func (bal *Balancer) addCollection(coll arvados.Collection) error {
 		repl = *coll.ReplicationDesired
 	}
 	bal.Logger.Debugf("%v: %d block x%d", coll.UUID, len(blkids), repl)
-	// Pass pdh to IncreaseDesired only if LostBlocksFile is being
-	// written -- otherwise it's just a waste of memory.
+	// Pass pdh to IncreaseDesired only if lost blocks are being
+	// reported or recovered -- otherwise it's just a waste of
+	// memory.
 	pdh := ""
-	if bal.LostBlocksFile != "" {
+	if bal.trackRefs {
 		pdh = coll.PortableDataHash
 	}
 	bal.BlockStateMap.IncreaseDesired(pdh, coll.StorageClassesDesired, repl, blkids)
+	if bal.ReportFile != "" || bal.TrackStorageUsage {
+		// Owners are only needed for the per-owner section
+		// of the report and the storage usage report.
+		bal.BlockStateMap.AddOwner(coll.OwnerUUID, blkids)
+		// Blocks in a subproject also count toward the
+		// usage of the projects and user above it.
+		for _, owner := range ownerAncestors(bal.projectParents, coll.OwnerUUID) {
+			bal.BlockStateMap.AddOwner(owner, blkids)
+		}
+	}
+	if coll.ModifiedAt.After(bal.lastModifiedAt) {
+		bal.lastModifiedAt = coll.ModifiedAt
+	}
+	if bal.trackChanges && !coll.ModifiedAt.Before(bal.lastModifiedAt.Add(-collectionsOverlap)) {
+		if bal.recentCollections == nil {
+			bal.recentCollections = map[string]time.Time{}
+		}
+		bal.recentCollections[coll.UUID] = coll.ModifiedAt
+	}
 	return nil
 }
 
@@ -482,6 +606,7 @@ func (bal *Balancer) ComputeChangeSets() {
 	// pool of worker goroutines.
 	defer bal.time("changeset_compute", "wall clock time to compute changesets")()
 	bal.setupLookupTables()
+	bal.claimShards()
 
 	type balanceTask struct {
 		blkid arvados.SizedDigest
@@ -520,15 +645,29 @@ func (bal *Balancer) setupLookupTables() {
 	bal.serviceRoots = make(map[string]string)
 	bal.classes = defaultClasses
 	bal.mountsByClass = map[string]map[*KeepMount]bool{"default": {}}
+	bal.quarantined = map[string]map[string]bool{}
 	bal.mounts = 0
 	for _, srv := range bal.KeepServices {
 		bal.serviceRoots[srv.UUID] = srv.UUID
 		for _, mnt := range srv.mounts {
 			bal.mounts++
 
+			// A block quarantined by any keepstore that
+			// has the device mounted is corrupt on all of
+			// them.
+			for hash := range mnt.Quarantined {
+				dev := mnt.deviceKey()
+				if bal.quarantined[dev] == nil {
+					bal.quarantined[dev] = map[string]bool{}
+				}
+				bal.quarantined[dev][hash] = true
+			}
+
 			// All mounts on a read-only service are
-			// effectively read-only.
-			mnt.ReadOnly = mnt.ReadOnly || srv.ReadOnly
+			// effectively read-only. Degraded mounts are
+			// still readable, but keepstore won't write
+			// to them.
+			mnt.ReadOnly = mnt.ReadOnly || srv.ReadOnly || mnt.Degraded
 
 			if len(mnt.StorageClasses) == 0 {
 				bal.mountsByClass["default"][mnt] = true
@@ -566,6 +705,35 @@ var changeName = map[int]string{
 	changeNone:  "none",
 }
 
+// withoutCorrupt returns blk, or (if any of its replicas are on
+// mounts where keepstore has quarantined the block) a copy of blk
+// without those replicas, along with the corrupt replicas.
+func (bal *Balancer) withoutCorrupt(blkid arvados.SizedDigest, blk *BlockState) (*BlockState, []Replica) {
+	if len(bal.quarantined) == 0 {
+		return blk, nil
+	}
+	hash := string(blkid[:32])
+	var good, corrupt []Replica
+	for i, r := range blk.Replicas {
+		if !bal.quarantined[r.KeepMount.deviceKey()][hash] {
+			if corrupt != nil {
+				good = append(good, r)
+			}
+			continue
+		}
+		if corrupt == nil {
+			good = append([]Replica(nil), blk.Replicas[:i]...)
+		}
+		corrupt = append(corrupt, r)
+	}
+	if corrupt == nil {
+		return blk, nil
+	}
+	b := *blk
+	b.Replicas = good
+	return &b, corrupt
+}
+
 type balancedBlockState struct {
 	needed       int
 	unneeded     int
@@ -592,6 +760,10 @@ type slot struct {
 func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) balanceResult {
 	bal.Logger.Debugf("balanceBlock: %v %+v", blkid, blk)
 
+	// Corrupt replicas don't count. They are trashed below, or
+	// overwritten by a pull to the same mount.
+	blk, corrupt := bal.withoutCorrupt(blkid, blk)
+
 	// Build a list of all slots (one per mounted volume).
 	slots := make([]slot, 0, bal.mounts)
 	for _, srv := range bal.KeepServices {
@@ -630,7 +802,9 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 	unsafeToDelete := make(map[int64]bool, len(slots))
 	for _, class := range bal.classes {
 		desired := blk.Desired[class]
-		if desired == 0 {
+		if desired == 0 || bal.erasureClasses[class] != nil {
+			// Erasure-coded classes are handled by
+			// balanceShards below.
 			continue
 		}
 
@@ -753,6 +927,22 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		}
 	}
 
+	// If the block belongs in an erasure-coded class, its full
+	// replicas must be kept until all of its shards are stored.
+	ecClass, codec := bal.erasureClass(blk)
+	stripe := &Stripe{SizedDigest: blkid, Codec: codec}
+	if codec == nil {
+		stripe.Codec = blk.ShardCodec
+	}
+	var ecState balancedBlockState
+	if codec != nil {
+		var striped bool
+		ecState, striped = bal.balanceShards(blkid, blk, ecClass, codec, stripe)
+		if !striped {
+			underreplicated = true
+		}
+	}
+
 	// TODO: If multiple replicas are trashable, prefer the oldest
 	// replica that doesn't have a timestamp collision with
 	// others.
@@ -770,11 +960,19 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 
 	classState := make(map[string]balancedBlockState, len(bal.classes))
 	for _, class := range bal.classes {
+		if bal.erasureClasses[class] != nil {
+			if class == ecClass {
+				classState[class] = ecState
+			}
+			continue
+		}
 		classState[class] = computeBlockState(slots, bal.mountsByClass[class], len(blk.Replicas), blk.Desired[class])
 	}
 	blockState := computeBlockState(slots, nil, len(blk.Replicas), 0)
 
-	var lost bool
+	// Without full replicas, a block is lost unless it can be
+	// rebuilt from shards.
+	lost := len(blk.Replicas) == 0 && codec != nil && !blk.canRebuild()
 	var changes []string
 	for _, slot := range slots {
 		// TODO: request a Touch if Mtime is duplicated.
@@ -787,14 +985,20 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 				From:        slot.mnt,
 			})
 			change = changeTrash
+		case slot.repl == nil && slot.want && len(blk.Replicas) == 0 && blk.canRebuild() && !slot.mnt.ReadOnly:
+			// Rebuild a full replica from shards.
+			stripe.Writes = append(stripe.Writes, StripeWrite{Shard: -1, To: slot.mnt})
+			change = changePull
 		case slot.repl == nil && slot.want && len(blk.Replicas) == 0:
-			lost = true
+			lost = lost || !blk.canRebuild()
 			change = changeNone
 		case slot.repl == nil && slot.want && !slot.mnt.ReadOnly:
 			slot.mnt.KeepService.AddPull(Pull{
-				SizedDigest: blkid,
-				From:        blk.Replicas[0].KeepMount.KeepService,
-				To:          slot.mnt,
+				SizedDigest:     blkid,
+				From:            blk.Replicas[0].KeepMount.KeepService,
+				To:              slot.mnt,
+				underreplicated: underreplicated,
+				replicas:        len(blk.Replicas),
 			})
 			change = changePull
 		case slot.repl != nil:
@@ -802,6 +1006,14 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		default:
 			change = changeNone
 		}
+		if change == changePull {
+			for i, r := range corrupt {
+				if r.KeepMount == slot.mnt {
+					corrupt = append(corrupt[:i], corrupt[i+1:]...)
+					break
+				}
+			}
+		}
 		if bal.Dumper != nil {
 			var mtime int64
 			if slot.repl != nil {
@@ -811,6 +1023,40 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 			changes = append(changes, fmt.Sprintf("%s:%d/%s=%s,%d", srv.ServiceHost, srv.ServicePort, slot.mnt.UUID, changeName[change], mtime))
 		}
 	}
+	for _, r := range corrupt {
+		if r.KeepMount.ReadOnly || r.Mtime >= bal.MinMtime {
+			continue
+		}
+		r.KeepMount.KeepService.AddTrash(Trash{
+			SizedDigest: blkid,
+			Mtime:       r.Mtime,
+			From:        r.KeepMount,
+		})
+		if bal.Dumper != nil {
+			srv := r.KeepMount.KeepService
+			changes = append(changes, fmt.Sprintf("%s:%d/%s=%s,%d", srv.ServiceHost, srv.ServicePort, r.KeepMount.UUID, "trash-corrupt", r.Mtime))
+		}
+	}
+	if len(stripe.Writes) > 0 {
+		for _, repl := range blk.Replicas {
+			stripe.From = append(stripe.From, repl.KeepMount)
+		}
+		if blk.ShardCodec == stripe.Codec {
+			stripe.Shards = make([][]*KeepMount, len(blk.Shards))
+			for i, copies := range blk.Shards {
+				for _, repl := range copies {
+					stripe.Shards[i] = append(stripe.Shards[i], repl.KeepMount)
+				}
+			}
+		}
+		bal.addStripe(stripe)
+		if bal.Dumper != nil {
+			for _, w := range stripe.Writes {
+				srv := w.To.KeepService
+				changes = append(changes, fmt.Sprintf("%s:%d/%s=stripe,%d", srv.ServiceHost, srv.ServicePort, w.To.UUID, w.Shard))
+			}
+		}
+	}
 	if bal.Dumper != nil {
 		bal.Dumper.Printf("%s refs=%d needed=%d unneeded=%d pulling=%v %v %v", blkid, blk.RefCount, blockState.needed, blockState.unneeded, blockState.pulling, blk.Desired, changes)
 	}
@@ -864,6 +1110,19 @@ func (bb blocksNBytes) String() string {
 	return fmt.Sprintf("%d replicas (%d blocks, %d bytes)", bb.replicas, bb.blocks, bb.bytes)
 }
 
+// addBlock adds n replicas of a block with the given size.
+func (bb *blocksNBytes) addBlock(n int, size int64) {
+	bb.replicas += n
+	bb.blocks++
+	bb.bytes += size * int64(n)
+}
+
+func (bb *blocksNBytes) add(other blocksNBytes) {
+	bb.replicas += other.replicas
+	bb.blocks += other.blocks
+	bb.bytes += other.bytes
+}
+
 type replicationStats struct {
 	needed       blocksNBytes
 	unneeded     blocksNBytes
@@ -871,6 +1130,33 @@ type replicationStats struct {
 	unachievable blocksNBytes
 }
 
+// mountStats are the statistics reported for each mount.
+type mountStats struct {
+	stored  blocksNBytes // replicas (and erasure-coded shards) stored on the mount
+	pulls   int
+	trashes int
+}
+
+// ownerStats are the statistics reported for each owner (user or
+// project) of the collections that reference a block. A block
+// referenced by collections with different owners is counted in
+// full for each of them.
+type ownerStats struct {
+	referenced blocksNBytes // one replica of each block
+	desired    blocksNBytes
+	current    blocksNBytes
+	underrep   blocksNBytes
+	lost       blocksNBytes
+}
+
+func (st *ownerStats) add(other ownerStats) {
+	st.referenced.add(other.referenced)
+	st.desired.add(other.desired)
+	st.current.add(other.current)
+	st.underrep.add(other.underrep)
+	st.lost.add(other.lost)
+}
+
 type balancerStats struct {
 	lost          blocksNBytes
 	overrep       blocksNBytes
@@ -881,10 +1167,20 @@ type balancerStats struct {
 	justright     blocksNBytes
 	desired       blocksNBytes
 	current       blocksNBytes
+	striped       blocksNBytes
 	pulls         int
 	trashes       int
+	stripes       int
 	replHistogram []int
 	classStats    map[string]replicationStats
+	mountStats    map[*KeepMount]*mountStats
+	ownerStats    []ownerStats // indexed like BlockStateMap.owners
+
+	// pulls and trashes computed but not committed in this run
+	// (see ThrottleChanges)
+	deferredPulls     int
+	deferredPullBytes int64
+	deferredTrashes   int
 
 	// collectionBytes / collectionBlockBytes = deduplication ratio
 	collectionBytes      int64 // sum(bytes in referenced blocks) across all collections
@@ -911,9 +1207,32 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 	var s balancerStats
 	s.replHistogram = make([]int, 2)
 	s.classStats = make(map[string]replicationStats, len(bal.classes))
+	s.mountStats = make(map[*KeepMount]*mountStats, bal.mounts)
+	bal.lost = nil
+	for _, srv := range bal.KeepServices {
+		for _, mnt := range srv.mounts {
+			s.mountStats[mnt] = &mountStats{}
+		}
+	}
 	for result := range results {
 		bytes := result.blkid.Size()
 
+		for _, r := range result.blk.Replicas {
+			if ms := s.mountStats[r.KeepMount]; ms != nil {
+				ms.stored.addBlock(r.KeepMount.Replication, bytes)
+			}
+		}
+		if codec := result.blk.ShardCodec; codec != nil {
+			shardSize := erasure.ShardSize(bytes, codec.DataShards())
+			for _, shard := range result.blk.Shards {
+				for _, r := range shard {
+					if ms := s.mountStats[r.KeepMount]; ms != nil {
+						ms.stored.addBlock(r.KeepMount.Replication, shardSize)
+					}
+				}
+			}
+		}
+
 		if rc := int64(result.blk.RefCount); rc > 0 {
 			s.collectionBytes += rc * bytes
 			s.collectionBlockBytes += bytes
@@ -922,6 +1241,16 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 		}
 
 		for class, state := range result.classState {
+			bytes := bytes
+			if codec := bal.erasureClasses[class]; codec != nil {
+				// Counts are shards, not replicas.
+				bytes = erasure.ShardSize(bytes, codec.DataShards())
+				if state.needed > 0 && !state.unachievable && state.pulling == 0 {
+					s.striped.replicas += state.needed
+					s.striped.blocks++
+					s.striped.bytes += bytes * int64(state.needed)
+				}
+			}
 			cs := s.classStats[class]
 			if state.unachievable {
 				cs.unachievable.replicas++
@@ -952,11 +1281,7 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 			s.lost.replicas++
 			s.lost.blocks++
 			s.lost.bytes += bytes
-			fmt.Fprintf(bal.lostBlocks, "%s", strings.SplitN(string(result.blkid), "+", 2)[0])
-			for pdh := range result.blk.Refs {
-				fmt.Fprintf(bal.lostBlocks, " %s", pdh)
-			}
-			fmt.Fprint(bal.lostBlocks, "\n")
+			bal.lost = append(bal.lost, lostBlock{blkid: result.blkid, blk: result.blk})
 		case bs.pulling > 0:
 			s.underrep.replicas += bs.pulling
 			s.underrep.blocks++
@@ -1000,6 +1325,31 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 			s.current.bytes += bytes * int64(bs.needed+bs.unneeded)
 		}
 
+		if len(result.blk.Owners) > 0 {
+			var blkStats ownerStats
+			blkStats.referenced.addBlock(1, bytes)
+			switch {
+			case result.lost:
+				blkStats.lost.addBlock(1, bytes)
+			case bs.pulling > 0:
+				blkStats.underrep.addBlock(bs.pulling, bytes)
+			case bs.unachievable:
+				blkStats.underrep.addBlock(1, bytes)
+			}
+			if bs.needed > 0 {
+				blkStats.desired.addBlock(bs.needed, bytes)
+			}
+			if bs.needed+bs.unneeded > 0 {
+				blkStats.current.addBlock(bs.needed+bs.unneeded, bytes)
+			}
+			for _, owner := range result.blk.Owners {
+				for len(s.ownerStats) <= int(owner) {
+					s.ownerStats = append(s.ownerStats, ownerStats{})
+				}
+				s.ownerStats[owner].add(blkStats)
+			}
+		}
+
 		for len(s.replHistogram) <= bs.needed+bs.unneeded {
 			s.replHistogram = append(s.replHistogram, 0)
 		}
@@ -1008,7 +1358,18 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 	for _, srv := range bal.KeepServices {
 		s.pulls += len(srv.ChangeSet.Pulls)
 		s.trashes += len(srv.ChangeSet.Trashes)
+		for _, p := range srv.ChangeSet.Pulls {
+			if ms := s.mountStats[p.To]; ms != nil {
+				ms.pulls++
+			}
+		}
+		for _, t := range srv.ChangeSet.Trashes {
+			if ms := s.mountStats[t.From]; ms != nil {
+				ms.trashes++
+			}
+		}
 	}
+	s.stripes = len(bal.stripes)
 	bal.stats = s
 	bal.Metrics.UpdateStats(s)
 }
@@ -1024,6 +1385,10 @@ func (bal *Balancer) PrintStatistics() {
 	bal.logf("%s overreplicated (have>want>0)", bal.stats.overrep)
 	bal.logf("%s unreferenced (have>want=0, new)", bal.stats.unref)
 	bal.logf("%s garbage (have>want=0, old)", bal.stats.garbage)
+	if len(bal.erasureClasses) > 0 {
+		bal.logf("%s erasure-coded (shards, all stored)", bal.stats.striped)
+		bal.logf("%d blocks with shards or replicas to write from shards", bal.stats.stripes)
+	}
 	for _, class := range bal.classes {
 		cs := bal.stats.classStats[class]
 		bal.logf("===")
@@ -1039,6 +1404,9 @@ func (bal *Balancer) PrintStatistics() {
 	for _, srv := range bal.KeepServices {
 		bal.logf("%s: %v\n", srv, srv.ChangeSet)
 	}
+	if bal.stats.deferredPulls > 0 || bal.stats.deferredTrashes > 0 {
+		bal.logf("%d pulls (%d bytes) and %d trashes deferred to a later run", bal.stats.deferredPulls, bal.stats.deferredPullBytes, bal.stats.deferredTrashes)
+	}
 	bal.logf("===")
 	bal.printHistogram(60)
 	bal.logf("===")
@@ -1073,7 +1441,7 @@ func (bal *Balancer) CheckSanityLate() error {
 		return fmt.Errorf("cannot proceed safely after deferred errors")
 	}
 
-	if bal.collScanned == 0 {
+	if bal.collScanned == 0 && !bal.incremental {
 		return fmt.Errorf("received zero collections")
 	}
 
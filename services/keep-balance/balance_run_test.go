@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
@@ -176,23 +177,50 @@ func (s *stubServer) serveDiscoveryDoc() *reqTracker {
 		`{"defaultCollectionReplication":2}`)
 }
 
+// serveProjects serves a project tree in which
+// zzzzz-j7d0g-aaaaaaaaaaaaaaa is a subproject of a project owned by
+// zzzzz-tpzed-bbbbbbbbbbbbbbb.
+func (s *stubServer) serveProjects() *reqTracker {
+	rt := &reqTracker{}
+	s.mux.HandleFunc("/arvados/v1/groups", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		rt.Add(r)
+		if strings.Contains(r.Form.Get("filters"), `"uuid"`) {
+			io.WriteString(w, `{"items":[]}`)
+		} else {
+			io.WriteString(w, `{"items":[
+				{"uuid":"zzzzz-j7d0g-aaaaaaaaaaaaaaa","owner_uuid":"zzzzz-j7d0g-ccccccccccccccc"},
+				{"uuid":"zzzzz-j7d0g-ccccccccccccccc","owner_uuid":"zzzzz-tpzed-bbbbbbbbbbbbbbb"}]}`)
+		}
+	})
+	return rt
+}
+
 func (s *stubServer) serveZeroCollections() *reqTracker {
 	return s.serveStatic("/arvados/v1/collections",
 		`{"items":[],"items_available":0}`)
 }
 
 func (s *stubServer) serveFooBarFileCollections() *reqTracker {
+	return s.serveFooBarFileCollectionsSince(false)
+}
+
+// serveFooBarFileCollectionsSince is like serveFooBarFileCollections,
+// but if since is true, it also returns the collections when asked
+// for collections modified at or after a given time, as in an
+// incremental run.
+func (s *stubServer) serveFooBarFileCollectionsSince(since bool) *reqTracker {
 	rt := &reqTracker{}
 	s.mux.HandleFunc("/arvados/v1/collections", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		rt.Add(r)
-		if strings.Contains(r.Form.Get("filters"), `modified_at`) {
+		if filters := r.Form.Get("filters"); strings.Contains(filters, `modified_at`) && !(since && strings.Contains(filters, `"modified_at","\u003e="`)) {
 			io.WriteString(w, `{"items_available":0,"items":[]}`)
 		} else {
 			io.WriteString(w, `{"items_available":3,"items":[
-				{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"},
-				{"uuid":"zzzzz-4zz18-ehbhgtheo8909or","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"},
-				{"uuid":"zzzzz-4zz18-znfnqtbbv4spc3w","portable_data_hash":"1f4b0bc7583c2a7f9102c395f4ffc5e3+45","manifest_text":". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n","modified_at":"2014-02-03T17:22:54Z"}]}`)
+				{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa","owner_uuid":"zzzzz-j7d0g-aaaaaaaaaaaaaaa","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"},
+				{"uuid":"zzzzz-4zz18-ehbhgtheo8909or","owner_uuid":"zzzzz-j7d0g-aaaaaaaaaaaaaaa","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"},
+				{"uuid":"zzzzz-4zz18-znfnqtbbv4spc3w","owner_uuid":"zzzzz-tpzed-bbbbbbbbbbbbbbb","portable_data_hash":"1f4b0bc7583c2a7f9102c395f4ffc5e3+45","manifest_text":". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n","modified_at":"2014-02-03T17:22:54Z"}]}`)
 		}
 	})
 	return rt
@@ -298,6 +326,33 @@ func (s *stubServer) serveKeepstoreIndexFoo1() *reqTracker {
 	return rt
 }
 
+// serveKeepstoreChanges serves each mount's change log. changes
+// returns the response body for the given mount and cursor, or ""
+// if the changes are not available.
+func (s *stubServer) serveKeepstoreChanges(changes func(mountUUID, since string) string) *reqTracker {
+	rt := &reqTracker{}
+	for _, mounts := range stubMounts {
+		for _, mnt := range mounts {
+			mnt := mnt
+			s.mux.HandleFunc(fmt.Sprintf("/mounts/%s/changes", mnt.UUID), func(w http.ResponseWriter, r *http.Request) {
+				count := rt.Add(r)
+				since := r.FormValue("since")
+				body := "\n"
+				if since != "" {
+					body = changes(mnt.UUID, since)
+				}
+				if body == "" {
+					w.WriteHeader(http.StatusGone)
+					return
+				}
+				w.Header().Set("X-Keep-Change-Cursor", fmt.Sprintf("cursor-%d", count))
+				io.WriteString(w, body)
+			})
+		}
+	}
+	return rt
+}
+
 func (s *stubServer) serveKeepstoreTrash() *reqTracker {
 	return s.serveStatic("/trash", `{}`)
 }
@@ -431,6 +486,353 @@ func (s *runSuite) TestWriteLostBlocks(c *check.C) {
 	c.Check(string(lost), check.Equals, "37b51d194a7513e45b56f6524f2d51f2 fa7aeb5140e2848d39b416daeef4ffc5+45\n")
 }
 
+// serveKeepstoreMountWrites accepts writes to all mounts, and
+// returns the written data, keyed by "mountUUID/hash".
+func (s *stubServer) serveKeepstoreMountWrites() (*reqTracker, map[string]string) {
+	rt := &reqTracker{}
+	written := map[string]string{}
+	for _, mounts := range stubMounts {
+		for _, mnt := range mounts {
+			mnt := mnt
+			s.mux.HandleFunc(fmt.Sprintf("/mounts/%s/blocks/", mnt.UUID), func(w http.ResponseWriter, r *http.Request) {
+				rt.Add(r)
+				data, _ := ioutil.ReadAll(r.Body)
+				s.mutex.Lock()
+				written[mnt.UUID+"/"+r.URL.Path[len(r.URL.Path)-32:]] = string(data)
+				s.mutex.Unlock()
+			})
+		}
+	}
+	return rt, written
+}
+
+func (s *runSuite) TestRecoverLostBlocksUntrash(c *check.C) {
+	lostf, err := ioutil.TempFile("", "keep-balance-lost-blocks-test-")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(lostf.Name())
+	s.config.Collections.BlobMissingReport = lostf.Name()
+	s.config.Collections.BlobMissingUntrash = true
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+
+	// Foo is on the first mount, bar is in the trash on keep2.
+	untrashed := false
+	untrashReqs := &reqTracker{}
+	s.stub.mux.HandleFunc("/untrash/", func(w http.ResponseWriter, r *http.Request) {
+		untrashReqs.Add(r)
+		c.Check(r.Method, check.Equals, "PUT")
+		if r.Host != "keep2.zzzzz.arvadosapi.com:25107" || r.URL.Path != "/untrash/37b51d194a7513e45b56f6524f2d51f2" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		s.stub.mutex.Lock()
+		untrashed = true
+		s.stub.mutex.Unlock()
+	})
+	s.stub.mux.HandleFunc("/index/", func(w http.ResponseWriter, r *http.Request) {
+		s.stub.mutex.Lock()
+		defer s.stub.mutex.Unlock()
+		if untrashed && r.Host == "keep2.zzzzz.arvadosapi.com:25107" && r.URL.Path == "/index/37b51d194a7513e45b56f6524f2d51f2" {
+			fmt.Fprintf(w, "37b51d194a7513e45b56f6524f2d51f2+3 %d\n", time.Now().UnixNano())
+		}
+		io.WriteString(w, "\n")
+	})
+	for _, mounts := range stubMounts {
+		for i, mnt := range mounts {
+			i := i
+			s.stub.mux.HandleFunc(fmt.Sprintf("/mounts/%s/blocks", mnt.UUID), func(w http.ResponseWriter, r *http.Request) {
+				if i == 0 {
+					io.WriteString(w, "acbd18db4cc2f85cedef654fccc4a4d8+3 12345678\n")
+				}
+				io.WriteString(w, "\n")
+			})
+		}
+	}
+
+	bal, err := s.newServer(&opts).runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.stats.lost.blocks, check.Equals, 1)
+	c.Check(untrashReqs.Count(), check.Not(check.Equals), 0)
+	c.Check(untrashed, check.Equals, true)
+	lost, err := ioutil.ReadFile(lostf.Name())
+	c.Assert(err, check.IsNil)
+	c.Check(string(lost), check.Equals, "")
+}
+
+func (s *runSuite) TestRecoverLostBlocksFromKeepproxy(c *check.C) {
+	lostf, err := ioutil.TempFile("", "keep-balance-lost-blocks-test-")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(lostf.Name())
+	backupReqs := &reqTracker{}
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backupReqs.Add(r)
+		if r.Header.Get("Authorization") != "OAuth2 backuptoken" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		} else if !strings.HasPrefix(r.URL.Path, "/37b51d194a7513e45b56f6524f2d51f2+3+A") {
+			http.Error(w, "not found", http.StatusNotFound)
+		} else {
+			io.WriteString(w, "bar")
+		}
+	}))
+	defer backup.Close()
+	backupURL, err := url.Parse(backup.URL)
+	c.Assert(err, check.IsNil)
+	s.config.Collections.BlobMissingReport = lostf.Name()
+	s.config.Collections.BlobMissingRecoverySources = map[string]arvados.BlobRecoverySource{
+		"backup": {
+			KeepproxyURL:   arvados.URL(*backupURL),
+			Token:          "backuptoken",
+			BlobSigningKey: "backupkey",
+		},
+	}
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	writeReqs, written := s.stub.serveKeepstoreMountWrites()
+
+	_, err = s.newServer(&opts).runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(backupReqs.Count(), check.Equals, 1)
+	c.Check(writeReqs.Count(), check.Equals, 1)
+	for key, data := range written {
+		c.Check(key, check.Matches, `zzzzz-ivpuk-.*/37b51d194a7513e45b56f6524f2d51f2`)
+		c.Check(data, check.Equals, "bar")
+	}
+	lost, err := ioutil.ReadFile(lostf.Name())
+	c.Assert(err, check.IsNil)
+	c.Check(string(lost), check.Equals, "")
+}
+
+func (s *runSuite) TestReportLostFiles(c *check.C) {
+	tmpdir, err := ioutil.TempDir("", "keep-balance-lost-files-test-")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+	s.config.Collections.BlobMissingFileReport = tmpdir + "/lost-files.json"
+	s.config.Collections.BlobMissingProperty = "lost_blocks"
+	s.stub.serveCurrentUserAdmin()
+	collReqs := s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	updateReqs := &reqTracker{}
+	s.stub.mux.HandleFunc("/arvados/v1/collections/", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		updateReqs.Add(r)
+		io.WriteString(w, `{}`)
+	})
+
+	// Without -commit-pulls, the file report is written but
+	// collections are not updated.
+	opts := RunOptions{
+		Logger: ctxlog.TestLogger(c),
+	}
+	_, err = s.newServer(&opts).runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(updateReqs.Count(), check.Equals, 0)
+	var files []lostFile
+	buf, err := ioutil.ReadFile(tmpdir + "/lost-files.json")
+	c.Assert(err, check.IsNil)
+	c.Check(json.Unmarshal(buf, &files), check.IsNil)
+	c.Check(files, check.DeepEquals, []lostFile{
+		{CollectionUUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa", Path: "bar", Locator: "37b51d194a7513e45b56f6524f2d51f2+3"},
+		{CollectionUUID: "zzzzz-4zz18-ehbhgtheo8909or", Path: "bar", Locator: "37b51d194a7513e45b56f6524f2d51f2+3"},
+	})
+	var sawPDHFilter bool
+	for _, req := range collReqs.reqs {
+		if strings.Contains(req.Form.Get("filters"), `["portable_data_hash","in",["fa7aeb5140e2848d39b416daeef4ffc5+45"]]`) {
+			sawPDHFilter = true
+			c.Check(req.Form.Get("include_trash"), check.Equals, "")
+		}
+	}
+	c.Check(sawPDHFilter, check.Equals, true)
+
+	opts.CommitPulls = true
+	_, err = s.newServer(&opts).runOnce()
+	c.Assert(err, check.IsNil)
+	c.Assert(updateReqs.Count(), check.Equals, 2)
+	for _, req := range updateReqs.reqs {
+		c.Check(req.Method, check.Equals, "PATCH")
+		c.Check(req.URL.Path, check.Matches, `/arvados/v1/collections/zzzzz-4zz18-(aaaaaaaaaaaaaaa|ehbhgtheo8909or)`)
+		c.Check(req.Form.Get("collection"), check.Equals, `{"properties":{"lost_blocks":["37b51d194a7513e45b56f6524f2d51f2"]}}`)
+	}
+}
+
+func (s *runSuite) TestReport(c *check.C) {
+	tmpdir, err := ioutil.TempDir("", "keep-balance-report-test-")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+
+	opts := RunOptions{
+		Logger:       ctxlog.TestLogger(c),
+		ReportFile:   tmpdir + "/report.json",
+		ReportFormat: "json",
+	}
+	bal, err := s.newServer(&opts).runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(trashReqs.Count(), check.Equals, 0)
+	c.Check(pullReqs.Count(), check.Equals, 0)
+
+	type counts struct {
+		Replicas int
+		Blocks   int
+		Bytes    int64
+	}
+	var rpt struct {
+		Summary struct {
+			Underreplicated counts
+			Overreplicated  counts
+			Pulls           int
+			Trashes         int
+		}
+		StorageClasses []struct {
+			Class  string
+			Needed counts
+		} `json:"storage_classes"`
+		Mounts []struct {
+			UUID    string
+			Stored  counts
+			Pulls   int
+			Trashes int
+		}
+		Owners []struct {
+			OwnerUUID       string `json:"owner_uuid"`
+			Referenced      counts
+			Desired         counts
+			Current         counts
+			Underreplicated counts
+			Lost            counts
+		}
+	}
+	buf, err := ioutil.ReadFile(tmpdir + "/report.json")
+	c.Assert(err, check.IsNil)
+	c.Assert(json.Unmarshal(buf, &rpt), check.IsNil)
+	c.Check(rpt.Summary.Underreplicated, check.Equals, counts{2, 1, 6})
+	c.Check(rpt.Summary.Overreplicated, check.Equals, counts{2, 1, 6})
+	c.Check(rpt.Summary.Pulls, check.Equals, bal.stats.pulls)
+	c.Check(rpt.Summary.Trashes, check.Equals, bal.stats.trashes)
+	c.Assert(rpt.StorageClasses, check.HasLen, 1)
+	c.Check(rpt.StorageClasses[0].Class, check.Equals, "default")
+	c.Check(rpt.StorageClasses[0].Needed, check.Equals, counts{3, 2, 9})
+
+	// Each mount has foo, and only keep0 has bar.
+	c.Assert(rpt.Mounts, check.HasLen, 4)
+	pulls, trashes := 0, 0
+	for _, mnt := range rpt.Mounts {
+		if mnt.UUID == "zzzzz-ivpuk-000000000000000" {
+			c.Check(mnt.Stored, check.Equals, counts{2, 2, 6})
+		} else {
+			c.Check(mnt.Stored, check.Equals, counts{1, 1, 3})
+		}
+		pulls += mnt.Pulls
+		trashes += mnt.Trashes
+	}
+	c.Check(pulls, check.Equals, bal.stats.pulls)
+	c.Check(trashes, check.Equals, bal.stats.trashes)
+
+	// Both collections referencing bar belong to the same
+	// project, so bar is only counted once for that project.
+	c.Assert(rpt.Owners, check.HasLen, 2)
+	c.Check(rpt.Owners[0].OwnerUUID, check.Equals, "zzzzz-j7d0g-aaaaaaaaaaaaaaa")
+	c.Check(rpt.Owners[0].Referenced, check.Equals, counts{1, 1, 3})
+	c.Check(rpt.Owners[0].Desired, check.Equals, counts{1, 1, 3})
+	c.Check(rpt.Owners[0].Current, check.Equals, counts{1, 1, 3})
+	c.Check(rpt.Owners[0].Underreplicated, check.Equals, counts{2, 1, 6})
+	c.Check(rpt.Owners[1].OwnerUUID, check.Equals, "zzzzz-tpzed-bbbbbbbbbbbbbbb")
+	c.Check(rpt.Owners[1].Desired, check.Equals, counts{2, 1, 6})
+	c.Check(rpt.Owners[1].Current, check.Equals, counts{4, 1, 12})
+	c.Check(rpt.Owners[1].Underreplicated, check.Equals, counts{})
+
+	opts.ReportFile = tmpdir + "/report.csv"
+	opts.ReportFormat = "csv"
+	_, err = s.newServer(&opts).runOnce()
+	c.Assert(err, check.IsNil)
+	buf, err = ioutil.ReadFile(tmpdir + "/report.csv")
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Matches, `(?ms)^section,name,metric,value\n.*^summary,,underreplicated.bytes,6\n.*`)
+	c.Check(string(buf), check.Matches, `(?ms).*^owners,zzzzz-tpzed-bbbbbbbbbbbbbbb,current.replicas,4\n.*`)
+	c.Check(string(buf), check.Matches, `(?ms).*^mounts,zzzzz-ivpuk-000000000000000,stored.blocks,2\n.*`)
+
+	opts.ReportFormat = "xml"
+	_, err = s.newServer(&opts).runOnce()
+	c.Check(err, check.ErrorMatches, `unsupported report format "xml".*`)
+}
+
+func (s *runSuite) TestStorageUsage(c *check.C) {
+	s.config.ManagementToken = "xyzzy"
+	s.config.Collections.DefaultStorageQuota = 1 << 30
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveProjects()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+
+	srv := s.newServer(&RunOptions{Logger: ctxlog.TestLogger(c)})
+	srv.setupHandler()
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/storage_usage", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		srv.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Usage is not available before the first run.
+	c.Check(get("xyzzy").Code, check.Equals, http.StatusServiceUnavailable)
+
+	bal, err := srv.runOnce()
+	c.Assert(err, check.IsNil)
+
+	c.Check(get("wrongtoken").Code, check.Equals, http.StatusForbidden)
+	resp := get("xyzzy")
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	var usage arvados.StorageUsageReport
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &usage), check.IsNil)
+	c.Check(usage.UpdatedAt.Equal(bal.startTime), check.Equals, true)
+	// Two collections owned by the same project reference bar,
+	// which is only counted once. The usage of the projects and
+	// user above that project includes bar.
+	c.Check(usage.Owners, check.DeepEquals, map[string]int64{
+		"zzzzz-j7d0g-aaaaaaaaaaaaaaa": 3,
+		"zzzzz-j7d0g-ccccccccccccccc": 3,
+		"zzzzz-tpzed-bbbbbbbbbbbbbbb": 6,
+	})
+	c.Check(usage.Parents, check.DeepEquals, map[string]string{
+		"zzzzz-j7d0g-aaaaaaaaaaaaaaa": "zzzzz-j7d0g-ccccccccccccccc",
+		"zzzzz-j7d0g-ccccccccccccccc": "zzzzz-tpzed-bbbbbbbbbbbbbbb",
+	})
+}
+
 func (s *runSuite) TestDryRun(c *check.C) {
 	opts := RunOptions{
 		CommitPulls: false,
@@ -502,6 +904,159 @@ func (s *runSuite) TestCommit(c *check.C) {
 	c.Check(buf, check.Matches, `(?ms).*\narvados_keep_dedup_block_ratio 1\.5\n.*`)
 }
 
+func (s *runSuite) TestThrottle(c *check.C) {
+	// A maintenance window that doesn't include today
+	tomorrow := time.Now().UTC().Add(24 * time.Hour).Weekday().String()
+	s.config.Collections.BalanceMaintenanceWindows = []string{tomorrow}
+	s.config.Collections.BalancePullRate = 1
+	s.config.ManagementToken = "xyzzy"
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+		Dumper:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+	srv := s.newServer(&opts)
+	bal, err := srv.runOnce()
+	c.Check(err, check.IsNil)
+	// Empty trash lists are still sent, replacing any lists sent
+	// during a previous maintenance window.
+	c.Check(trashReqs.Count(), check.Equals, 8)
+	c.Check(pullReqs.Count(), check.Equals, 4)
+	c.Check(bal.stats.trashes, check.Equals, 2)
+	c.Check(bal.stats.deferredTrashes, check.Equals, 2)
+	// Only one of the two "bar" pulls fits in the budget.
+	c.Check(bal.stats.pulls, check.Equals, 2)
+	c.Check(bal.stats.deferredPulls, check.Equals, 1)
+	c.Check(bal.stats.deferredPullBytes, check.Equals, int64(3))
+	npulls, ntrashes := 0, 0
+	for _, srv := range bal.KeepServices {
+		npulls += len(srv.ChangeSet.Pulls)
+		ntrashes += len(srv.ChangeSet.Trashes)
+	}
+	c.Check(npulls, check.Equals, 1)
+	c.Check(ntrashes, check.Equals, 0)
+
+	buf, err := s.getMetrics(c, srv)
+	c.Check(err, check.IsNil)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keep_deferred_pulls 1\n.*`)
+	c.Check(buf, check.Matches, `(?ms).*\narvados_keep_deferred_trashes 2\n.*`)
+
+	// During a maintenance window, nothing is deferred.
+	s.config.Collections.BalanceMaintenanceWindows = []string{time.Now().UTC().Weekday().String(), tomorrow}
+	bal, err = srv.runOnce()
+	c.Check(err, check.IsNil)
+	c.Check(bal.stats.deferredTrashes, check.Equals, 0)
+	c.Check(bal.stats.deferredPulls, check.Equals, 0)
+}
+
+func (s *runSuite) TestIncremental(c *check.C) {
+	s.config.Collections.BalanceFullScanPeriod = arvados.Duration(time.Hour)
+	s.config.Collections.DefaultStorageQuota = 1 << 30
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveProjects()
+	collReqs := s.stub.serveFooBarFileCollectionsSince(true)
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	indexReqs := s.stub.serveKeepstoreIndexFoo4Bar1()
+	changeReqs := s.stub.serveKeepstoreChanges(func(mountUUID, since string) string {
+		switch mountUUID {
+		case "zzzzz-ivpuk-000000000000000":
+			// "bar" was trashed (size not reported)
+			return "37b51d194a7513e45b56f6524f2d51f2 0\n\n"
+		case "zzzzz-ivpuk-100000000000000":
+			// "bar" was written
+			return "37b51d194a7513e45b56f6524f2d51f2+3 1600000000000000000\n\n"
+		case "zzzzz-ivpuk-200000000000000":
+			// changes not available (e.g., keepstore
+			// restarted)
+			return ""
+		default:
+			return "\n"
+		}
+	})
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	srv := s.newServer(&opts)
+
+	// First run is a full scan.
+	bal, err := srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.incremental, check.Equals, false)
+	c.Check(indexReqs.Count(), check.Equals, 4)
+	c.Check(changeReqs.Count(), check.Equals, 4)
+	c.Assert(srv.RunOptions.incrementalState, check.NotNil)
+	c.Check(srv.RunOptions.incrementalState.cursors, check.HasLen, 4)
+	c.Check(srv.RunOptions.incrementalState.counted, check.Not(check.HasLen), 0)
+	refCount := bal.BlockStateMap.get("37b51d194a7513e45b56f6524f2d51f2+3").RefCount
+	usage := srv.storageUsage
+	c.Check(usage, check.NotNil)
+
+	// Second run applies changes, reindexes the mount whose
+	// changes are not available, and retrieves only recently
+	// modified collections.
+	collReqs.reqs = nil
+	bal, err = srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.incremental, check.Equals, true)
+	c.Check(indexReqs.Count(), check.Equals, 5)
+	c.Check(changeReqs.Count(), check.Equals, 9)
+	var sinceReqs int
+	for _, req := range collReqs.reqs {
+		if filters := req.Form.Get("filters"); filters != `[["modified_at","=",null]]` && sinceReqs < 2 {
+			// Count and first page start at the latest
+			// modified_at seen in the first run, minus
+			// collectionsOverlap
+			c.Check(filters, check.Matches, `.*\["modified_at","\\u003e=","2014-02-03T17:21:54Z"\].*`)
+			sinceReqs++
+		}
+	}
+	c.Check(sinceReqs, check.Equals, 2)
+	bar := bal.BlockStateMap.get("37b51d194a7513e45b56f6524f2d51f2+3")
+	c.Assert(bar.Replicas, check.HasLen, 1)
+	c.Check(bar.Replicas[0].KeepMount.UUID, check.Equals, "zzzzz-ivpuk-100000000000000")
+	c.Check(bar.Replicas[0].Mtime, check.Equals, int64(1600000000000000000))
+	c.Check(bar.Desired["default"], check.Equals, 2)
+	// Collections retrieved again because of collectionsOverlap
+	// are not counted twice.
+	c.Check(bar.RefCount, check.Equals, refCount)
+	// Storage usage is only reported after a full scan.
+	c.Check(srv.storageUsage, check.Equals, usage)
+	// Mount objects from the previous run are replaced.
+	for _, srv := range bal.KeepServices {
+		for _, mnt := range srv.mounts {
+			if mnt.UUID == "zzzzz-ivpuk-100000000000000" {
+				c.Check(bar.Replicas[0].KeepMount, check.Equals, mnt)
+			}
+		}
+	}
+
+	// After BalanceFullScanPeriod, the next run is a full scan.
+	srv.RunOptions.incrementalState.fullScan = time.Now().Add(-2 * time.Hour)
+	bal, err = srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.incremental, check.Equals, false)
+	c.Check(indexReqs.Count(), check.Equals, 9)
+
+	// After a failed run, the next run is a full scan.
+	srv.RunOptions.incrementalState = nil
+	bal, err = srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.incremental, check.Equals, false)
+}
+
 func (s *runSuite) TestRunForever(c *check.C) {
 	s.config.ManagementToken = "xyzzy"
 	opts := RunOptions{
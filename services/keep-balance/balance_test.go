@@ -152,6 +152,38 @@ func (bal *balancerSuite) TestSkipReadonly(c *check.C) {
 		}})
 }
 
+// Replicas quarantined by keepstore don't count toward replication,
+// and are trashed unless a pull will overwrite them.
+func (bal *balancerSuite) TestCorruptReplicas(c *check.C) {
+	quarantine := func(slot int) {
+		bal.srvList(0, slots{slot})[0].mounts[0].Quarantined = map[string]time.Time{string(knownBlkid(0)[:32]): time.Now()}
+	}
+	quarantine(1)
+	bal.try(c, tester{
+		desired:     map[string]int{"default": 2},
+		current:     slots{0, 1},
+		shouldPull:  slots{1},
+		shouldTrash: nil,
+		expectBlockState: &balancedBlockState{
+			needed:  1,
+			pulling: 1,
+		}})
+	quarantine(3)
+	bal.try(c, tester{
+		desired:     map[string]int{"default": 2},
+		current:     slots{0, 3},
+		shouldPull:  slots{1},
+		shouldTrash: slots{3},
+	})
+	// Too new to trash.
+	bal.try(c, tester{
+		desired:    map[string]int{"default": 2},
+		current:    slots{0, 3},
+		timestamps: []int64{12345678, time.Now().UnixNano()},
+		shouldPull: slots{1},
+	})
+}
+
 func (bal *balancerSuite) TestMultipleViewsReadOnly(c *check.C) {
 	bal.testMultipleViews(c, true)
 }
@@ -660,6 +692,41 @@ func (bal *balancerSuite) TestChangeStorageClasses(c *check.C) {
 // Clear all servers' changesets, balance a single block, and verify
 // the appropriate changes for that block have been added to the
 // changesets.
+func (bal *balancerSuite) TestThrottlePulls(c *check.C) {
+	bal.stats = balancerStats{}
+	blk := func(i, size int) arvados.SizedDigest {
+		return arvados.SizedDigest(fmt.Sprintf("%x+%d", md5.Sum([]byte{byte(i)}), size))
+	}
+	for _, srv := range bal.srvs {
+		srv.ChangeSet = &ChangeSet{}
+	}
+	// Four pulls to srvs[0], one to srvs[1]
+	bal.srvs[0].AddPull(Pull{SizedDigest: blk(1, 1000), To: bal.srvs[0].mounts[0], replicas: 2})
+	bal.srvs[0].AddPull(Pull{SizedDigest: blk(2, 1000), To: bal.srvs[0].mounts[0], replicas: 1})
+	bal.srvs[0].AddPull(Pull{SizedDigest: blk(3, 1000), To: bal.srvs[0].mounts[0], replicas: 2, underreplicated: true})
+	bal.srvs[0].AddPull(Pull{SizedDigest: blk(4, 3000), To: bal.srvs[0].mounts[0], replicas: 1})
+	bal.srvs[1].AddPull(Pull{SizedDigest: blk(5, 1000), To: bal.srvs[1].mounts[0], replicas: 2})
+
+	// Per-service budget fits two of the 1000-byte pulls to
+	// srvs[0]: the underreplicated block first, then the one
+	// with fewer replicas.
+	bal.throttlePulls(0, 2500)
+	c.Check(bal.srvs[0].Pulls, check.HasLen, 2)
+	c.Check(bal.srvs[0].Pulls[0].SizedDigest, check.Equals, blk(3, 1000))
+	c.Check(bal.srvs[0].Pulls[1].SizedDigest, check.Equals, blk(2, 1000))
+	c.Check(bal.srvs[1].Pulls, check.HasLen, 1)
+	c.Check(bal.stats.deferredPulls, check.Equals, 2)
+	c.Check(bal.stats.deferredPullBytes, check.Equals, int64(4000))
+
+	// Cluster-wide budget is smaller than the first block, which
+	// is sent anyway.
+	bal.stats = balancerStats{}
+	bal.throttlePulls(500, 0)
+	c.Check(bal.srvs[0].Pulls, check.HasLen, 1)
+	c.Check(bal.srvs[1].Pulls, check.HasLen, 0)
+	c.Check(bal.stats.deferredPulls, check.Equals, 2)
+}
+
 func (bal *balancerSuite) try(c *check.C, t tester) {
 	bal.setupLookupTables()
 	blk := &BlockState{
@@ -743,8 +810,44 @@ func (bal *balancerSuite) replList(knownBlockID int, order slots) (repls []Repli
 	return
 }
 
+func (bal *balancerSuite) TestLostFiles(c *check.C) {
+	coll := arvados.Collection{
+		UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+		ManifestText: ". 37b51d194a7513e45b56f6524f2d51f2+3 acbd18db4cc2f85cedef654fccc4a4d8+3 0:2:a 2:2:b 4:2:c 6:0:empty\n" +
+			"./dir\\040name acbd18db4cc2f85cedef654fccc4a4d8+3+Asignature@12345678 0:3:d\n",
+	}
+	lost := map[string]bool{"acbd18db4cc2f85cedef654fccc4a4d8": true}
+	c.Check(lostFiles(coll, lost), check.DeepEquals, []lostFile{
+		{coll.UUID, "b", "acbd18db4cc2f85cedef654fccc4a4d8+3"},
+		{coll.UUID, "c", "acbd18db4cc2f85cedef654fccc4a4d8+3"},
+		{coll.UUID, "dir name/d", "acbd18db4cc2f85cedef654fccc4a4d8+3"},
+	})
+}
+
 // generate the same data hashes that are tested in
 // sdk/go/keepclient/root_sorter_test.go
 func knownBlkid(i int) arvados.SizedDigest {
 	return arvados.SizedDigest(fmt.Sprintf("%x+64", md5.Sum([]byte(fmt.Sprintf("%064x", i)))))
 }
+
+func (bal *balancerSuite) TestResolveUnsized(c *check.C) {
+	bsm := NewBlockStateMap()
+	referenced, garbage := knownBlkid(0), knownBlkid(1)
+	bsm.IncreaseDesired("", []string{"default"}, 2, []arvados.SizedDigest{referenced})
+	mnt0, mnt1 := bal.srvs[0].mounts[0], bal.srvs[1].mounts[0]
+	bsm.AddReplicas(mnt0, []arvados.KeepServiceIndexEntry{
+		{SizedDigest: referenced[:32], Mtime: 12345},
+		{SizedDigest: garbage[:32], Mtime: 12345},
+	})
+	bsm.AddReplicas(mnt1, []arvados.KeepServiceIndexEntry{
+		{SizedDigest: referenced, Mtime: 23456},
+	})
+	bsm.ResolveUnsized()
+
+	c.Check(bsm.entries[referenced].Replicas, check.DeepEquals, []Replica{{mnt1, 23456}, {mnt0, 12345}})
+	c.Check(bsm.entries[referenced[:32]], check.IsNil)
+	// Unreferenced blocks keep their unsized entries, so they
+	// can still be trashed.
+	c.Check(bsm.entries[garbage[:32]].Replicas, check.DeepEquals, []Replica{{mnt0, 12345}})
+	c.Check(garbage[:32].Size(), check.Equals, int64(0))
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
 )
 
 // Replica is a file on disk (or object in an S3 bucket, or blob in an
@@ -27,6 +28,16 @@ type BlockState struct {
 	RefCount int
 	Replicas []Replica
 	Desired  map[string]int
+	// Owners lists the owners of the collections that reference
+	// this block, as indexes into BlockStateMap.owners (only
+	// tracked when writing a report).
+	Owners []int32
+	// Shards[i] lists the stored copies of erasure-coded shard i,
+	// and ShardCodec is the codec the shards were written
+	// with. These are only populated for blocks that have
+	// shards (see claimShards).
+	Shards     [][]Replica
+	ShardCodec *erasure.Codec
 	// TODO: Support combinations of classes ("private + durable")
 	// by replacing the map[string]int with a map[*[]string]int
 	// here, where the map keys come from a pool of semantically
@@ -46,6 +57,37 @@ func (bs *BlockState) addReplica(r Replica) {
 	bs.Refs = nil
 }
 
+// setReplica records that mnt has a replica with the given mtime,
+// replacing any replica on mnt that was recorded previously.
+func (bs *BlockState) setReplica(mnt *KeepMount, mtime int64) {
+	for i := range bs.Replicas {
+		if bs.Replicas[i].KeepMount == mnt {
+			bs.Replicas[i].Mtime = mtime
+			return
+		}
+	}
+	bs.addReplica(Replica{KeepMount: mnt, Mtime: mtime})
+}
+
+// removeReplica forgets the replica on mnt, if any.
+func (bs *BlockState) removeReplica(mnt *KeepMount) {
+	for i, r := range bs.Replicas {
+		if r.KeepMount == mnt {
+			bs.Replicas = append(bs.Replicas[:i], bs.Replicas[i+1:]...)
+			return
+		}
+	}
+}
+
+func (bs *BlockState) addOwner(owner int32) {
+	for _, o := range bs.Owners {
+		if o == owner {
+			return
+		}
+	}
+	bs.Owners = append(bs.Owners, owner)
+}
+
 func (bs *BlockState) increaseDesired(pdh string, classes []string, n int) {
 	if pdh != "" && len(bs.Replicas) == 0 {
 		// Note we only track PDHs if there's a possibility
@@ -74,6 +116,10 @@ func (bs *BlockState) increaseDesired(pdh string, classes []string, n int) {
 type BlockStateMap struct {
 	entries map[arvados.SizedDigest]*BlockState
 	mutex   sync.Mutex
+
+	// owner UUIDs referenced by BlockState.Owners
+	owners   []string
+	ownerIdx map[string]int32
 }
 
 // NewBlockStateMap returns a newly allocated BlockStateMap.
@@ -120,6 +166,46 @@ func (bsm *BlockStateMap) AddReplicas(mnt *KeepMount, idx []arvados.KeepServiceI
 	}
 }
 
+// ResolveUnsized moves replicas that were reported without a size
+// (keepstore lists a compressed block that way if it doesn't know the
+// block's size) to the entries with the same hash and a known size.
+//
+// Entries that can't be resolved are left alone: no collection
+// references their hash, so they are garbage, and only the hash is
+// needed to trash them.
+func (bsm *BlockStateMap) ResolveUnsized() {
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+
+	sized := map[arvados.SizedDigest][]arvados.SizedDigest{}
+	for blkid := range bsm.entries {
+		if len(blkid) == 32 {
+			sized[blkid] = nil
+		}
+	}
+	if len(sized) == 0 {
+		return
+	}
+	for blkid := range bsm.entries {
+		if hash := blkid[:32]; len(blkid) > 32 {
+			if found, ok := sized[hash]; ok {
+				sized[hash] = append(found, blkid)
+			}
+		}
+	}
+	for hash, blkids := range sized {
+		if len(blkids) == 0 {
+			continue
+		}
+		for _, r := range bsm.entries[hash].Replicas {
+			for _, blkid := range blkids {
+				bsm.entries[blkid].setReplica(r.KeepMount, r.Mtime)
+			}
+		}
+		delete(bsm.entries, hash)
+	}
+}
+
 // IncreaseDesired updates the map to indicate the desired replication
 // for the given blocks in the given storage class is at least n.
 //
@@ -133,3 +219,23 @@ func (bsm *BlockStateMap) IncreaseDesired(pdh string, classes []string, n int, b
 		bsm.get(blkid).increaseDesired(pdh, classes, n)
 	}
 }
+
+// AddOwner records that the given blocks are referenced by a
+// collection with the given owner UUID.
+func (bsm *BlockStateMap) AddOwner(owner string, blocks []arvados.SizedDigest) {
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+
+	idx, ok := bsm.ownerIdx[owner]
+	if !ok {
+		if bsm.ownerIdx == nil {
+			bsm.ownerIdx = map[string]int32{}
+		}
+		idx = int32(len(bsm.owners))
+		bsm.owners = append(bsm.owners, owner)
+		bsm.ownerIdx[owner] = idx
+	}
+	for _, blkid := range blocks {
+		bsm.get(blkid).addOwner(idx)
+	}
+}
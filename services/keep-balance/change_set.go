@@ -18,6 +18,11 @@ type Pull struct {
 	arvados.SizedDigest
 	From *KeepService
 	To   *KeepMount
+
+	// Used to decide which pulls to send first when pulls are
+	// throttled (see ThrottleChanges).
+	underreplicated bool // block is underreplicated in some storage class
+	replicas        int  // current number of replicas
 }
 
 // MarshalJSON formats a pull request the way keepstore wants to see
@@ -32,11 +32,28 @@ func countCollections(c *arvados.Client, params arvados.ResourceListParams) (int
 // If pageSize > 0 it is used as the maximum page size in each API
 // call; otherwise the maximum allowed page size is requested.
 func EachCollection(ctx context.Context, c *arvados.Client, pageSize int, f func(arvados.Collection) error, progress func(done, total int)) error {
+	return EachCollectionSince(ctx, c, pageSize, time.Time{}, f, progress)
+}
+
+// EachCollectionSince is like EachCollection, but only calls f for
+// collections whose modified_at time is at or after the given
+// time. If since is zero, all collections are included.
+func EachCollectionSince(ctx context.Context, c *arvados.Client, pageSize int, since time.Time, f func(arvados.Collection) error, progress func(done, total int)) error {
 	if progress == nil {
 		progress = func(_, _ int) {}
 	}
 
+	var sinceFilters []arvados.Filter
+	if !since.IsZero() {
+		sinceFilters = []arvados.Filter{{
+			Attr:     "modified_at",
+			Operator: ">=",
+			Operand:  since,
+		}}
+	}
+
 	expectCount, err := countCollections(c, arvados.ResourceListParams{
+		Filters:            sinceFilters,
 		IncludeTrash:       true,
 		IncludeOldVersions: true,
 	})
@@ -65,12 +82,13 @@ func EachCollection(ctx context.Context, c *arvados.Client, pageSize int, f func
 		Limit:              &limit,
 		Order:              "modified_at, uuid",
 		Count:              "none",
-		Select:             []string{"uuid", "unsigned_manifest_text", "modified_at", "portable_data_hash", "replication_desired"},
+		Select:             []string{"uuid", "owner_uuid", "unsigned_manifest_text", "modified_at", "portable_data_hash", "replication_desired"},
+		Filters:            sinceFilters,
 		IncludeTrash:       true,
 		IncludeOldVersions: true,
 	}
 	var last arvados.Collection
-	var filterTime time.Time
+	filterTime := since
 	callCount := 0
 	gettingExactTimestamp := false
 	for {
@@ -151,10 +169,10 @@ func EachCollection(ctx context.Context, c *arvados.Client, pageSize int, f func
 	progress(callCount, expectCount)
 
 	if checkCount, err := countCollections(c, arvados.ResourceListParams{
-		Filters: []arvados.Filter{{
+		Filters: append([]arvados.Filter{{
 			Attr:     "modified_at",
 			Operator: "<=",
-			Operand:  filterTime}},
+			Operand:  filterTime}}, sinceFilters...),
 		IncludeTrash:       true,
 		IncludeOldVersions: true,
 	}); err != nil {
@@ -0,0 +1,421 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+)
+
+// Number of stripes to read/encode/write concurrently in
+// CommitStripes.
+const stripeConcurrency = 4
+
+// Stripe is a request to write erasure-coded shards of a block (or
+// full replicas of a block rebuilt from its shards) to specific
+// mounts. Unlike pulls, stripes are written by keep-balance itself.
+type Stripe struct {
+	arvados.SizedDigest
+	Codec  *erasure.Codec
+	From   []*KeepMount   // mounts with a full replica
+	Shards [][]*KeepMount // mounts with a copy of each shard
+	Writes []StripeWrite
+}
+
+// StripeWrite is one shard (or full replica) to be written as part
+// of a Stripe.
+type StripeWrite struct {
+	Shard int // shard index, or -1 for a full replica
+	To    *KeepMount
+}
+
+// setupErasureCoding prepares codecs for the erasure-coded storage
+// classes in the given cluster config.
+func (bal *Balancer) setupErasureCoding(classes map[string]arvados.StorageClassConfig) error {
+	bal.erasureClasses = map[string]*erasure.Codec{}
+	for name, sc := range classes {
+		if !sc.ErasureCoded() {
+			continue
+		}
+		codec, err := erasure.NewCodec(sc.DataShards, sc.ParityShards)
+		if err != nil {
+			return fmt.Errorf("storage class %q: %s", name, err)
+		}
+		bal.erasureClasses[name] = codec
+	}
+	return nil
+}
+
+// erasureClass returns the erasure-coded storage class (and its
+// codec) that blk should be striped in, if any. If a block is
+// desired in more than one erasure-coded class, the first one in
+// lexicographic order is used.
+func (bal *Balancer) erasureClass(blk *BlockState) (string, *erasure.Codec) {
+	var class string
+	for c, desired := range blk.Desired {
+		if desired > 0 && bal.erasureClasses[c] != nil && (class == "" || c < class) {
+			class = c
+		}
+	}
+	return class, bal.erasureClasses[class]
+}
+
+// shardDigest returns the locator+size of the given shard of a block.
+func shardDigest(blkid arvados.SizedDigest, idx int, codec *erasure.Codec) arvados.SizedDigest {
+	return arvados.SizedDigest(fmt.Sprintf("%s+%d", erasure.ShardLocator(string(blkid[:32]), idx), erasure.ShardSize(blkid.Size(), codec.DataShards())))
+}
+
+// claimShards finds the shards of erasure-coded blocks among the
+// index entries in the block state map, and moves them from their
+// own (unreferenced) entries to the Shards field of the blocks they
+// belong to.
+//
+// Shards are looked up for blocks in erasure-coded storage classes,
+// and for blocks that have no full replicas (e.g., a block that was
+// striped and then moved out of its erasure-coded class). Shards of
+// other blocks are left alone, and are trashed like any other
+// unreferenced data.
+func (bal *Balancer) claimShards() {
+	if len(bal.erasureClasses) == 0 {
+		return
+	}
+	var codecs []*erasure.Codec
+	seen := map[int]bool{}
+	for _, codec := range bal.erasureClasses {
+		if !seen[codec.DataShards()] {
+			seen[codec.DataShards()] = true
+			codecs = append(codecs, codec)
+		}
+	}
+
+	bsm := bal.BlockStateMap
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+	type todo struct {
+		blkid  arvados.SizedDigest
+		blk    *BlockState
+		codecs []*erasure.Codec
+	}
+	var todos []todo
+	for blkid, blk := range bsm.entries {
+		if blk.RefCount == 0 || blkid.Size() == 0 {
+			continue
+		}
+		if _, codec := bal.erasureClass(blk); codec != nil {
+			todos = append(todos, todo{blkid, blk, []*erasure.Codec{codec}})
+		} else if len(blk.Replicas) == 0 {
+			todos = append(todos, todo{blkid, blk, codecs})
+		}
+	}
+	claimed := 0
+	for _, t := range todos {
+		for _, codec := range t.codecs {
+			n := codec.DataShards() + codec.ParityShards()
+			var shards [][]Replica
+			for i := 0; i < n; i++ {
+				sd := shardDigest(t.blkid, i, codec)
+				ent := bsm.entries[sd]
+				if ent == nil || len(ent.Replicas) == 0 {
+					continue
+				}
+				if shards == nil {
+					shards = make([][]Replica, n)
+				}
+				shards[i] = ent.Replicas
+				delete(bsm.entries, sd)
+				claimed++
+			}
+			if shards != nil {
+				t.blk.Shards = shards
+				t.blk.ShardCodec = codec
+				break
+			}
+		}
+	}
+	bal.logf("found %d erasure-coded shards belonging to %d candidate blocks", claimed, len(todos))
+}
+
+// unclaimShards reverses claimShards, moving shards back to their own
+// entries in the block state map. This lets an incremental run apply
+// keepstore index changes to shards the same way as other blocks,
+// before the next ComputeChangeSets claims them again.
+func (bal *Balancer) unclaimShards() {
+	bsm := bal.BlockStateMap
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+	shards := map[arvados.SizedDigest][]Replica{}
+	for blkid, blk := range bsm.entries {
+		for i, replicas := range blk.Shards {
+			if len(replicas) > 0 {
+				shards[shardDigest(blkid, i, blk.ShardCodec)] = replicas
+			}
+		}
+		blk.Shards = nil
+		blk.ShardCodec = nil
+	}
+	for sd, replicas := range shards {
+		bsm.entries[sd] = &BlockState{Replicas: replicas}
+	}
+}
+
+// shardsAvailable returns the number of distinct shards of blk that
+// have at least one stored copy.
+func (blk *BlockState) shardsAvailable() int {
+	n := 0
+	for _, copies := range blk.Shards {
+		if len(copies) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// canRebuild returns true if blk has enough shards to rebuild the
+// block.
+func (blk *BlockState) canRebuild() bool {
+	return blk.ShardCodec != nil && blk.shardsAvailable() >= blk.ShardCodec.DataShards()
+}
+
+// balanceShards decides where the shards of a block in an
+// erasure-coded storage class should be stored, and adds the
+// resulting shard writes to stripe and shard trash requests to the
+// relevant ChangeSets.
+//
+// Each shard must be on a distinct device that offers the storage
+// class, and shards are spread across as many servers as possible.
+// It returns the class state (in units of shards) and whether all
+// shards are already stored.
+func (bal *Balancer) balanceShards(blkid arvados.SizedDigest, blk *BlockState, class string, codec *erasure.Codec, stripe *Stripe) (balancedBlockState, bool) {
+	var bbs balancedBlockState
+	n := codec.DataShards() + codec.ParityShards()
+	inClass := bal.mountsByClass[class]
+	usedMnt := map[*KeepMount]bool{}
+	usedDev := map[string]bool{}
+	usedSrv := map[*KeepService]int{}
+	use := func(mnt *KeepMount) {
+		usedMnt[mnt] = true
+		if mnt.DeviceID != "" {
+			usedDev[mnt.DeviceID] = true
+		}
+		usedSrv[mnt.KeepService]++
+	}
+	var shards [][]Replica
+	if blk.ShardCodec == codec {
+		shards = blk.Shards
+	}
+
+	// Keep one existing copy of each shard, if possible.
+	keep := make([]*Replica, n)
+	for i := range shards {
+		for r := range shards[i] {
+			repl := &shards[i][r]
+			if inClass[repl.KeepMount] && !usedMnt[repl.KeepMount] && !usedDev[repl.KeepMount.DeviceID] {
+				keep[i] = repl
+				use(repl.KeepMount)
+				break
+			}
+		}
+	}
+
+	// Find places for the missing shards.
+	sources := len(blk.Replicas) > 0 || blk.canRebuild()
+	for i := range keep {
+		if keep[i] != nil {
+			bbs.needed++
+			continue
+		}
+		mnt := bal.shardMount(blkid, i, inClass, usedMnt, usedDev, usedSrv)
+		if mnt == nil || !sources {
+			bbs.unachievable = true
+			continue
+		}
+		stripe.Writes = append(stripe.Writes, StripeWrite{Shard: i, To: mnt})
+		use(mnt)
+		bbs.pulling++
+	}
+	complete := bbs.needed == n
+
+	// Once all shards are stored, remove extra copies.
+	for i := range shards {
+		for _, repl := range shards[i] {
+			if keep[i] == nil || repl.KeepMount == keep[i].KeepMount {
+				continue
+			}
+			bbs.unneeded++
+			if !complete || repl.ReadOnly || repl.Mtime >= bal.MinMtime || repl.Mtime == keep[i].Mtime || (repl.DeviceID != "" && repl.DeviceID == keep[i].DeviceID) {
+				// Not safe to delete yet, or might be the
+				// same copy seen via a different mount.
+				continue
+			}
+			repl.KeepService.AddTrash(Trash{
+				SizedDigest: shardDigest(blkid, i, codec),
+				Mtime:       repl.Mtime,
+				From:        repl.KeepMount,
+			})
+		}
+	}
+	return bbs, complete
+}
+
+// shardMount returns the best writable mount for the given shard that
+// offers the storage class and isn't already used for another shard
+// (or nil if there is none). It prefers servers with fewer shards of
+// the same block, then the shard's rendezvous order.
+func (bal *Balancer) shardMount(blkid arvados.SizedDigest, idx int, inClass, usedMnt map[*KeepMount]bool, usedDev map[string]bool, usedSrv map[*KeepService]int) *KeepMount {
+	var candidates []*KeepMount
+	for mnt := range inClass {
+		if !mnt.ReadOnly && !usedMnt[mnt] && !usedDev[mnt.DeviceID] {
+			candidates = append(candidates, mnt)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	loc := erasure.ShardLocator(string(blkid[:32]), idx)
+	rank := map[*KeepService]int{}
+	for i, uuid := range keepclient.NewRootSorter(bal.serviceRoots, loc).GetSortedRoots() {
+		rank[bal.KeepServices[uuid]] = i
+	}
+	shardid := arvados.SizedDigest(loc)
+	sort.Slice(candidates, func(i, j int) bool {
+		mi, mj := candidates[i], candidates[j]
+		if ui, uj := usedSrv[mi.KeepService], usedSrv[mj.KeepService]; ui != uj {
+			return ui < uj
+		} else if ri, rj := rank[mi.KeepService], rank[mj.KeepService]; ri != rj {
+			return ri < rj
+		} else {
+			return rendezvousLess(mi.DeviceID, mj.DeviceID, shardid)
+		}
+	})
+	return candidates[0]
+}
+
+func (bal *Balancer) addStripe(st *Stripe) {
+	bal.mutex.Lock()
+	bal.stripes = append(bal.stripes, st)
+	bal.mutex.Unlock()
+}
+
+// CommitStripes writes the erasure-coded shards, and the full
+// replicas rebuilt from shards, that were requested by
+// ComputeChangeSets. For each stripe, it reads the block from a
+// mount that has a full replica (or rebuilds it from shards), then
+// writes the requested shards/replicas to their assigned mounts.
+//
+// Failed stripes are logged and counted in the returned error, and
+// will be retried on the next run.
+func (bal *Balancer) CommitStripes(ctx context.Context, c *arvados.Client) error {
+	defer bal.time("write_stripes", "wall clock time to write erasure-coded shards")()
+	todo := make(chan *Stripe)
+	var failed int64
+	var wg sync.WaitGroup
+	for i := 0; i < stripeConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for st := range todo {
+				if err := bal.writeStripe(ctx, c, st); err != nil {
+					bal.logf("%s: %s", st.SizedDigest, err)
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+	for _, st := range bal.stripes {
+		if ctx.Err() != nil {
+			break
+		}
+		todo <- st
+	}
+	close(todo)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to write %d of %d stripes", failed, len(bal.stripes))
+	}
+	return nil
+}
+
+func (bal *Balancer) writeStripe(ctx context.Context, c *arvados.Client, st *Stripe) error {
+	hash := string(st.SizedDigest[:32])
+	data, err := bal.readStripeSource(ctx, c, st)
+	if err != nil {
+		return err
+	}
+	var shards []*erasure.Shard
+	var errs []error
+	for _, w := range st.Writes {
+		loc, buf := hash, data
+		if w.Shard >= 0 {
+			if shards == nil {
+				shards = erasure.Split(st.Codec, hash, data)
+			}
+			loc, buf = shards[w.Shard].Locator(), shards[w.Shard].Marshal()
+		}
+		err := w.To.KeepService.PutMountBlock(ctx, c, w.To.UUID, loc, buf)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("write shard %d to %s: %s", w.Shard, w.To, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// readStripeSource returns the content of the block, read from a full
+// replica if possible, otherwise rebuilt from shards.
+func (bal *Balancer) readStripeSource(ctx context.Context, c *arvados.Client, st *Stripe) ([]byte, error) {
+	hash := string(st.SizedDigest[:32])
+	var errs []error
+	for _, mnt := range st.From {
+		data, err := mnt.KeepService.GetMountBlock(ctx, c, mnt.UUID, hash)
+		if err == nil && fmt.Sprintf("%x", md5.Sum(data)) != hash {
+			err = fmt.Errorf("checksum mismatch")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("read from %s: %s", mnt, err))
+			continue
+		}
+		return data, nil
+	}
+	var shards []*erasure.Shard
+	for i, mnts := range st.Shards {
+		for _, mnt := range mnts {
+			buf, err := mnt.KeepService.GetMountBlock(ctx, c, mnt.UUID, erasure.ShardLocator(hash, i))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("read shard %d from %s: %s", i, mnt, err))
+				continue
+			}
+			shard, err := erasure.ParseShard(buf)
+			if err == nil && (shard.Hash != hash || shard.Index != i) {
+				err = fmt.Errorf("wrong shard")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("read shard %d from %s: %s", i, mnt, err))
+				continue
+			}
+			shards = append(shards, shard)
+			break
+		}
+		if st.Codec != nil && len(shards) >= st.Codec.DataShards() {
+			return erasure.Rebuild(shards)
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no sources")
+	}
+	return nil, fmt.Errorf("no usable sources: %v", errs)
+}
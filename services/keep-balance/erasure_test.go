@@ -0,0 +1,309 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+// setupErasureTest puts the mounts on servers 0-7 in an
+// erasure-coded class "archive" (4 data + 2 parity shards), and
+// leaves servers 8-15 in the default class.
+func (bal *balancerSuite) setupErasureTest(c *check.C) *erasure.Codec {
+	for _, srv := range bal.srvs[:8] {
+		srv.mounts[0].StorageClasses = map[string]bool{"archive": true}
+	}
+	c.Assert(bal.setupErasureCoding(map[string]arvados.StorageClassConfig{
+		"archive": {DataShards: 4, ParityShards: 2},
+		"default": {},
+	}), check.IsNil)
+	bal.setupLookupTables()
+	for _, srv := range bal.srvs {
+		srv.ChangeSet = &ChangeSet{}
+	}
+	bal.stripes = nil
+	return bal.erasureClasses["archive"]
+}
+
+// shardCopies returns a Shards slice with one old copy of shard i on
+// server srvs[i], or no copies where srvs[i] < 0.
+func (bal *balancerSuite) shardCopies(srvs ...int) [][]Replica {
+	mtime := time.Now().UnixNano() - (bal.signatureTTL+86400)*1e9
+	shards := make([][]Replica, len(srvs))
+	for i, srv := range srvs {
+		if srv >= 0 {
+			shards[i] = []Replica{{bal.srvs[srv].mounts[0], mtime + int64(i)}}
+		}
+	}
+	return shards
+}
+
+func (bal *balancerSuite) TestStripeNewBlock(c *check.C) {
+	bal.setupErasureTest(c)
+	blk := &BlockState{
+		Replicas: bal.replList(0, slots{0, 1}),
+		Desired:  map[string]int{"archive": 2},
+	}
+	result := bal.balanceBlock(knownBlkid(0), blk)
+	c.Check(result.lost, check.Equals, false)
+	c.Check(result.classState["archive"], check.Equals, balancedBlockState{pulling: 6})
+	c.Assert(bal.stripes, check.HasLen, 1)
+	st := bal.stripes[0]
+	c.Check(st.From, check.HasLen, 2)
+	c.Assert(st.Writes, check.HasLen, 6)
+	usedSrv := map[*KeepService]bool{}
+	for i, w := range st.Writes {
+		c.Check(w.Shard, check.Equals, i)
+		c.Check(w.To.StorageClasses["archive"], check.Equals, true)
+		c.Check(usedSrv[w.To.KeepService], check.Equals, false)
+		usedSrv[w.To.KeepService] = true
+	}
+	// Full replicas are kept until the shards are stored.
+	for _, srv := range bal.srvs {
+		c.Check(srv.Trashes, check.HasLen, 0)
+	}
+}
+
+func (bal *balancerSuite) TestStripeComplete(c *check.C) {
+	codec := bal.setupErasureTest(c)
+	blk := &BlockState{
+		Replicas:   bal.replList(0, slots{0, 1}),
+		Desired:    map[string]int{"archive": 2},
+		Shards:     bal.shardCopies(0, 1, 2, 3, 4, 5),
+		ShardCodec: codec,
+	}
+	// An extra copy of shard 2, and a copy of shard 3 on the
+	// same server as shard 0.
+	blk.Shards[2] = append(blk.Shards[2], Replica{bal.srvs[6].mounts[0], blk.Shards[2][0].Mtime - 1})
+	blk.Shards[3] = append([]Replica{{bal.srvs[0].mounts[0], blk.Shards[3][0].Mtime - 1}}, blk.Shards[3]...)
+	result := bal.balanceBlock(knownBlkid(0), blk)
+	c.Check(result.lost, check.Equals, false)
+	c.Check(result.classState["archive"], check.Equals, balancedBlockState{needed: 6, unneeded: 2})
+	c.Check(bal.stripes, check.HasLen, 0)
+
+	// Full replicas and extra shard copies are trashed.
+	var trashed []string
+	for _, srv := range bal.srvs {
+		for _, t := range srv.Trashes {
+			trashed = append(trashed, fmt.Sprintf("%s@%s", t.SizedDigest, t.From.UUID))
+		}
+	}
+	var expect []string
+	for _, repl := range blk.Replicas {
+		expect = append(expect, fmt.Sprintf("%s@%s", knownBlkid(0), repl.UUID))
+	}
+	expect = append(expect,
+		fmt.Sprintf("%s@%s", shardDigest(knownBlkid(0), 2, codec), bal.srvs[6].mounts[0].UUID),
+		fmt.Sprintf("%s@%s", shardDigest(knownBlkid(0), 3, codec), bal.srvs[0].mounts[0].UUID))
+	sort.Strings(trashed)
+	sort.Strings(expect)
+	c.Check(trashed, check.DeepEquals, expect)
+}
+
+func (bal *balancerSuite) TestStripeFromShards(c *check.C) {
+	codec := bal.setupErasureTest(c)
+
+	// Two shards missing, no full replicas: rebuild from shards.
+	blk := &BlockState{
+		Desired:    map[string]int{"archive": 2},
+		Shards:     bal.shardCopies(0, -1, 2, 3, -1, 5),
+		ShardCodec: codec,
+	}
+	result := bal.balanceBlock(knownBlkid(0), blk)
+	c.Check(result.lost, check.Equals, false)
+	c.Check(result.classState["archive"], check.Equals, balancedBlockState{needed: 4, pulling: 2})
+	c.Assert(bal.stripes, check.HasLen, 1)
+	st := bal.stripes[0]
+	c.Check(st.From, check.HasLen, 0)
+	c.Check(st.Shards, check.HasLen, 6)
+	c.Assert(st.Writes, check.HasLen, 2)
+	c.Check(st.Writes[0].Shard, check.Equals, 1)
+	c.Check(st.Writes[1].Shard, check.Equals, 4)
+	for _, w := range st.Writes {
+		for _, srv := range []int{0, 2, 3, 5} {
+			c.Check(w.To.KeepService, check.Not(check.Equals), bal.srvs[srv])
+		}
+	}
+
+	// Too few shards: lost.
+	bal.stripes = nil
+	blk.Shards = bal.shardCopies(0, -1, 2, -1, -1, 5)
+	result = bal.balanceBlock(knownBlkid(0), blk)
+	c.Check(result.lost, check.Equals, true)
+	c.Check(result.classState["archive"].unachievable, check.Equals, true)
+	c.Check(bal.stripes, check.HasLen, 0)
+}
+
+func (bal *balancerSuite) TestRestoreFromShards(c *check.C) {
+	codec := bal.setupErasureTest(c)
+
+	// The block was striped, then moved back to a replicated
+	// class. Full replicas are rebuilt from shards.
+	blk := &BlockState{
+		Desired:    map[string]int{"default": 2},
+		Shards:     bal.shardCopies(0, 1, 2, -1, 4, -1),
+		ShardCodec: codec,
+	}
+	result := bal.balanceBlock(knownBlkid(0), blk)
+	c.Check(result.lost, check.Equals, false)
+	c.Assert(bal.stripes, check.HasLen, 1)
+	st := bal.stripes[0]
+	c.Check(st.Codec, check.Equals, codec)
+	c.Assert(st.Writes, check.HasLen, 2)
+	for _, w := range st.Writes {
+		c.Check(w.Shard, check.Equals, -1)
+		c.Check(w.To.StorageClasses["archive"], check.Equals, false)
+	}
+	for _, srv := range bal.srvs {
+		c.Check(srv.Pulls, check.HasLen, 0)
+		c.Check(srv.Trashes, check.HasLen, 0)
+	}
+}
+
+func (bal *balancerSuite) TestClaimShards(c *check.C) {
+	codec := bal.setupErasureTest(c)
+	bal.Logger = ctxlog.TestLogger(c)
+	bal.BlockStateMap = NewBlockStateMap()
+	archived, lostRepl, other := knownBlkid(0), knownBlkid(1), knownBlkid(2)
+	bal.BlockStateMap.IncreaseDesired("", []string{"archive"}, 2, []arvados.SizedDigest{archived})
+	bal.BlockStateMap.IncreaseDesired("", []string{"default"}, 2, []arvados.SizedDigest{lostRepl, other})
+	mnt := bal.srvs[0].mounts[0]
+	var idx []arvados.KeepServiceIndexEntry
+	for _, blkid := range []arvados.SizedDigest{archived, lostRepl, other} {
+		for i := 0; i < 6; i++ {
+			idx = append(idx, arvados.KeepServiceIndexEntry{SizedDigest: shardDigest(blkid, i, codec), Mtime: 12345})
+		}
+	}
+	idx = append(idx, arvados.KeepServiceIndexEntry{SizedDigest: other, Mtime: 12345})
+	bal.BlockStateMap.AddReplicas(mnt, idx)
+	bal.claimShards()
+
+	for _, blkid := range []arvados.SizedDigest{archived, lostRepl} {
+		blk := bal.BlockStateMap.get(blkid)
+		c.Check(blk.ShardCodec, check.Equals, codec)
+		c.Assert(blk.Shards, check.HasLen, 6)
+		for i := range blk.Shards {
+			c.Check(blk.Shards[i], check.DeepEquals, []Replica{{mnt, 12345}})
+			c.Check(bal.BlockStateMap.entries[shardDigest(blkid, i, codec)], check.IsNil)
+		}
+	}
+	// Shards of a block that has full replicas and isn't in an
+	// erasure-coded class are left alone (and will be trashed).
+	c.Check(bal.BlockStateMap.get(other).Shards, check.IsNil)
+	c.Check(bal.BlockStateMap.entries[shardDigest(other, 0, codec)], check.NotNil)
+
+	// unclaimShards restores the shards' own entries, so they
+	// can be updated in an incremental run and claimed again.
+	bal.unclaimShards()
+	for _, blkid := range []arvados.SizedDigest{archived, lostRepl} {
+		c.Check(bal.BlockStateMap.get(blkid).Shards, check.IsNil)
+		for i := 0; i < 6; i++ {
+			c.Check(bal.BlockStateMap.get(shardDigest(blkid, i, codec)).Replicas, check.DeepEquals, []Replica{{mnt, 12345}})
+		}
+	}
+	bal.claimShards()
+	c.Check(bal.BlockStateMap.get(archived).Shards, check.HasLen, 6)
+}
+
+// stubKeepstore implements the mount block API used by
+// CommitStripes.
+type stubKeepstore struct {
+	blocks map[string][]byte // "{mount}/{hash}" -> data
+	mtx    sync.Mutex
+}
+
+func (ks *stubKeepstore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "mounts" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	key := parts[1] + "/" + parts[3]
+	switch r.Method {
+	case "GET":
+		if data, ok := ks.blocks[key]; ok {
+			w.Write(data)
+		} else {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	case "PUT":
+		ks.blocks[key], _ = ioutil.ReadAll(r.Body)
+	}
+}
+
+func (bal *balancerSuite) TestCommitStripes(c *check.C) {
+	codec := bal.setupErasureTest(c)
+	bal.Metrics = newMetrics(prometheus.NewRegistry())
+	stub := &stubKeepstore{blocks: map[string][]byte{}}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	for _, ks := range bal.srvs {
+		ks.ServiceHost = host
+		ks.ServicePort, _ = strconv.Atoi(port)
+	}
+	mnt := func(i int) *KeepMount { return bal.srvs[i].mounts[0] }
+
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	blkid := arvados.SizedDigest(fmt.Sprintf("%s+%d", hash, len(data)))
+	stub.blocks[mnt(8).UUID+"/"+hash] = []byte("corrupt")
+	stub.blocks[mnt(9).UUID+"/"+hash] = data
+	var writes []StripeWrite
+	for i := 0; i < 6; i++ {
+		writes = append(writes, StripeWrite{Shard: i, To: mnt(i)})
+	}
+	bal.stripes = []*Stripe{{
+		SizedDigest: blkid,
+		Codec:       codec,
+		From:        []*KeepMount{mnt(8), mnt(9)},
+		Writes:      writes,
+	}}
+	c.Assert(bal.CommitStripes(context.Background(), &arvados.Client{AuthToken: "x"}), check.IsNil)
+	for i := 0; i < 6; i++ {
+		loc := erasure.ShardLocator(hash, i)
+		c.Check(erasure.VerifyShard(loc, stub.blocks[mnt(i).UUID+"/"+loc]), check.Equals, true)
+	}
+
+	// Rebuild a full replica from shards 1-4, after shard 0
+	// turns out to be corrupt.
+	stub.blocks[mnt(0).UUID+"/"+erasure.ShardLocator(hash, 0)] = []byte("corrupt")
+	shards := make([][]*KeepMount, 6)
+	for i := range shards {
+		shards[i] = []*KeepMount{mnt(i)}
+	}
+	bal.stripes = []*Stripe{{
+		SizedDigest: blkid,
+		Codec:       codec,
+		Shards:      shards,
+		Writes:      []StripeWrite{{Shard: -1, To: mnt(10)}},
+	}}
+	c.Assert(bal.CommitStripes(context.Background(), &arvados.Client{AuthToken: "x"}), check.IsNil)
+	c.Check(stub.blocks[mnt(10).UUID+"/"+hash], check.DeepEquals, data)
+
+	// No usable source.
+	bal.stripes[0].Shards = shards[:3]
+	err := bal.CommitStripes(context.Background(), &arvados.Client{AuthToken: "x"})
+	c.Check(err, check.ErrorMatches, `failed to write 1 of 1 stripes`)
+}
@@ -0,0 +1,328 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// When retrieving collections modified since the previous run, start
+// this long before the latest modified_at seen in the previous run,
+// in case an update with an earlier modified_at timestamp was still
+// being committed when we looked.
+const collectionsOverlap = time.Minute
+
+// incrementalState is the block state retained from one balance
+// operation to the next in incremental mode (see
+// Collections.BalanceFullScanPeriod).
+type incrementalState struct {
+	blocks *BlockStateMap
+	// mounts referenced by Replicas in blocks, by UUID
+	mounts map[string]*KeepMount
+	// keepstore change log cursor for each mount UUID, for
+	// mounts whose changes can be retrieved incrementally
+	cursors map[string]string
+	// rendezvous state (see rendezvousState) at the time of the
+	// last full scan
+	rendezvous string
+	// start time of the last full scan
+	fullScan time.Time
+	// retrieve collections modified at or after this time
+	collectionsSince time.Time
+	// UUID => modified_at of collections modified at or after
+	// collectionsSince that have already been counted, so they
+	// aren't counted again when retrieved in the next run
+	counted map[string]time.Time
+}
+
+// prepareIncremental returns the given state if it can be used for
+// an incremental run, or nil if a full scan is needed.
+func (bal *Balancer) prepareIncremental(state *incrementalState, period time.Duration, rs string) *incrementalState {
+	switch {
+	case period <= 0:
+		return nil
+	case state == nil:
+		bal.logf("full scan: no previous state")
+		return nil
+	case state.rendezvous != rs:
+		bal.logf("full scan: KeepServices list has changed since last full scan")
+		return nil
+	case time.Since(state.fullScan) >= period:
+		bal.logf("full scan: last full scan was at %v", state.fullScan)
+		return nil
+	default:
+		return state
+	}
+}
+
+// nextIncrementalState returns the state to retain for the next
+// balance operation.
+func (bal *Balancer) nextIncrementalState(prev *incrementalState, rs string) *incrementalState {
+	state := &incrementalState{
+		blocks:           bal.BlockStateMap,
+		mounts:           map[string]*KeepMount{},
+		cursors:          bal.changeCursors,
+		rendezvous:       rs,
+		fullScan:         bal.startTime,
+		collectionsSince: bal.lastModifiedAt.Add(-collectionsOverlap),
+	}
+	if prev != nil {
+		state.rendezvous = prev.rendezvous
+		state.fullScan = prev.fullScan
+		if bal.lastModifiedAt.IsZero() {
+			// No collections were modified since the
+			// previous run.
+			state.collectionsSince = prev.collectionsSince
+		}
+	}
+	state.counted = map[string]time.Time{}
+	for uuid, t := range bal.recentCollections {
+		if !t.Before(state.collectionsSince) {
+			state.counted[uuid] = t
+		}
+	}
+	for _, srv := range bal.KeepServices {
+		for _, mnt := range srv.mounts {
+			state.mounts[mnt.UUID] = mnt
+		}
+	}
+	return state
+}
+
+// getChangeCursor returns the current change log cursor for the given
+// mount, or "" if its changes can't be retrieved incrementally.
+func (bal *Balancer) getChangeCursor(ctx context.Context, c *arvados.Client, mnt *KeepMount) string {
+	_, cursor, err := mnt.KeepService.IndexMountChanges(ctx, c, mnt.UUID, "")
+	if err != nil {
+		bal.logf("mount %s: cannot get change log cursor, next run will retrieve full index: %v", mnt, err)
+		return ""
+	}
+	return cursor
+}
+
+func (bal *Balancer) setChangeCursor(mnt *KeepMount, cursor string) {
+	if cursor == "" {
+		return
+	}
+	bal.mutex.Lock()
+	defer bal.mutex.Unlock()
+	if bal.changeCursors == nil {
+		bal.changeCursors = map[string]string{}
+	}
+	bal.changeCursors[mnt.UUID] = cursor
+}
+
+// UpdateState brings the block state from a previous run up to date,
+// by retrieving the recent changes on each keepstore mount and the
+// collections modified since the previous run. It is used instead of
+// GetCurrentState in incremental mode.
+//
+// Mounts whose changes are not available (e.g., because keepstore
+// was restarted) and mounts whose device is attached to more than
+// one keepstore server are fully indexed, as in GetCurrentState.
+//
+// Block replication requirements can only increase in an incremental
+// run: references from collections that have been modified or
+// deleted since the last full scan are still counted. Collections
+// retrieved again only because of collectionsOverlap, and not
+// modified since they were counted, are skipped.
+func (bal *Balancer) UpdateState(ctx context.Context, c *arvados.Client, state *incrementalState, pageSize int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	defer bal.time("get_state", "wall clock time to get current state")()
+	bal.incremental = true
+	bal.BlockStateMap = state.blocks
+	bal.unclaimShards()
+
+	dd, err := c.DiscoveryDocument()
+	if err != nil {
+		return err
+	}
+	bal.DefaultReplication = dd.DefaultCollectionReplication
+	bal.MinMtime = time.Now().UnixNano() - dd.BlobSignatureTTL*1e9
+
+	// Map the mounts referenced by the previous state to the
+	// corresponding mounts in the current run (nil if the mount
+	// no longer exists), and group the current mounts by device
+	// as in GetCurrentState.
+	mountMap := map[*KeepMount]*KeepMount{}
+	byUUID := map[string]*KeepMount{}
+	deviceMounts := map[string][]*KeepMount{}
+	var groups [][]*KeepMount
+	for _, srv := range bal.KeepServices {
+		for _, mnt := range srv.mounts {
+			byUUID[mnt.UUID] = mnt
+			if mnt.DeviceID == "" {
+				groups = append(groups, []*KeepMount{mnt})
+			} else {
+				deviceMounts[mnt.DeviceID] = append(deviceMounts[mnt.DeviceID], mnt)
+			}
+		}
+	}
+	for _, mounts := range deviceMounts {
+		groups = append(groups, mounts)
+	}
+	for uuid, mnt := range state.mounts {
+		mountMap[mnt] = byUUID[uuid]
+	}
+
+	type result struct {
+		mounts  []*KeepMount
+		changes []arvados.KeepServiceIndexEntry // if incremental
+		index   []arvados.KeepServiceIndexEntry // if reindexed
+	}
+	results := make([]result, len(groups))
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for i, mounts := range groups {
+		wg.Add(1)
+		go func(res *result, mounts []*KeepMount) {
+			defer wg.Done()
+			res.mounts = mounts
+			if len(mounts) == 1 {
+				mnt := mounts[0]
+				if since := state.cursors[mnt.UUID]; since != "" {
+					changes, cursor, err := mnt.KeepService.IndexMountChanges(ctx, c, mnt.UUID, since)
+					if err == nil {
+						bal.logf("mount %s: retrieved %d changes", mnt, len(changes))
+						res.changes = changes
+						bal.setChangeCursor(mnt, cursor)
+						return
+					}
+					bal.logf("mount %s: cannot get changes, retrieving full index: %v", mnt, err)
+				}
+				bal.setChangeCursor(mnt, bal.getChangeCursor(ctx, c, mnt))
+			}
+			bal.logf("mount %s: retrieve index from %s", mounts[0], mounts[0].KeepService)
+			idx, err := mounts[0].KeepService.IndexMount(ctx, c, mounts[0].UUID, "")
+			if err != nil {
+				select {
+				case errs <- fmt.Errorf("%s: retrieve index: %v", mounts[0], err):
+				default:
+				}
+				cancel()
+				return
+			}
+			res.index = idx
+		}(&results[i], mounts)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return <-errs
+	}
+
+	reindexed := map[*KeepMount]bool{}
+	needSize := map[string]bool{}
+	for _, res := range results {
+		if res.changes == nil {
+			for _, mnt := range res.mounts {
+				reindexed[mnt] = true
+			}
+		}
+		for _, ent := range res.changes {
+			if len(ent.SizedDigest) == 32 {
+				needSize[string(ent.SizedDigest)] = true
+			}
+		}
+	}
+
+	bsm := bal.BlockStateMap
+	bsm.mutex.Lock()
+	// Update replicas to refer to current mounts, and drop
+	// replicas on mounts that are gone or about to be
+	// reindexed. Meanwhile, find the sizes of blocks whose
+	// changes were reported without one.
+	sizes := map[string][]arvados.SizedDigest{}
+	for blkid, blk := range bsm.entries {
+		replicas := blk.Replicas[:0]
+		for _, r := range blk.Replicas {
+			if mnt := mountMap[r.KeepMount]; mnt != nil && !reindexed[mnt] {
+				r.KeepMount = mnt
+				replicas = append(replicas, r)
+			}
+		}
+		blk.Replicas = replicas
+		if len(replicas) == 0 && blk.RefCount == 0 {
+			delete(bsm.entries, blkid)
+			continue
+		}
+		if hash := string(blkid[:32]); needSize[hash] {
+			sizes[hash] = append(sizes[hash], blkid)
+		}
+	}
+	nchanges := 0
+	for _, res := range results {
+		mnt := res.mounts[0]
+		for _, ent := range res.changes {
+			nchanges++
+			blkids := []arvados.SizedDigest{ent.SizedDigest}
+			if hash := string(ent.SizedDigest[:32]); len(ent.SizedDigest) == 32 {
+				// If we don't know of any block with
+				// this hash, it is either being
+				// removed (nothing to do) or an
+				// unreferenced block that was
+				// untrashed (we'll find out its size
+				// in the next full scan).
+				blkids = sizes[hash]
+			} else if needSize[hash] {
+				sizes[hash] = append(sizes[hash], ent.SizedDigest)
+			}
+			for _, blkid := range blkids {
+				if ent.Mtime == 0 {
+					if blk := bsm.entries[blkid]; blk != nil {
+						blk.removeReplica(mnt)
+					}
+				} else {
+					bsm.get(blkid).setReplica(mnt, ent.Mtime)
+				}
+			}
+		}
+	}
+	bsm.mutex.Unlock()
+
+	for _, res := range results {
+		if res.changes != nil {
+			continue
+		}
+		for _, mnt := range res.mounts {
+			bsm.AddReplicas(mnt, res.index)
+			bal.logf("%s: added %d entries to map at %dx (%d replicas)", mnt, len(res.index), mnt.Replication, len(res.index)*mnt.Replication)
+		}
+	}
+	bal.logf("applied %d changes from keepstore change logs, retrieved full index from %d mounts", nchanges, len(reindexed))
+
+	bal.recentCollections = map[string]time.Time{}
+	for uuid, t := range state.counted {
+		bal.recentCollections[uuid] = t
+	}
+	bal.logf("retrieving collections modified since %v", state.collectionsSince)
+	err = EachCollectionSince(ctx, c, pageSize, state.collectionsSince,
+		func(coll arvados.Collection) error {
+			if t, ok := state.counted[coll.UUID]; ok && t.Equal(coll.ModifiedAt) {
+				// Already counted in a previous
+				// run, and not modified since.
+				return nil
+			}
+			err := bal.addCollection(coll)
+			if err != nil {
+				return err
+			}
+			bal.collScanned++
+			return nil
+		}, func(done, total int) {
+			bal.logf("collections: %d/%d", done, total)
+		})
+	if err != nil {
+		return err
+	}
+	bsm.ResolveUnsized()
+	return nil
+}
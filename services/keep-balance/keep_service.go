@@ -101,6 +101,15 @@ type KeepMount struct {
 	KeepService *KeepService
 }
 
+// deviceKey returns the mount's device ID, or its UUID if the device
+// ID is unknown.
+func (mnt *KeepMount) deviceKey() string {
+	if mnt.DeviceID != "" {
+		return mnt.DeviceID
+	}
+	return mnt.UUID
+}
+
 // String implements fmt.Stringer.
 func (mnt *KeepMount) String() string {
 	return fmt.Sprintf("%s (%s) on %s", mnt.UUID, mnt.DeviceID, mnt.KeepService)
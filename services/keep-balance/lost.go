@@ -0,0 +1,527 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/recovercollection"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"git.arvados.org/arvados.git/sdk/go/manifest"
+)
+
+const (
+	// number of lost blocks to recover concurrently
+	recoverConcurrency = 4
+	// number of portable data hashes per collections API request
+	// when looking up the collections affected by lost blocks
+	lostCollectionsBatch = 100
+)
+
+// lostBlock is a block that is referenced by collections but has no
+// replicas.
+type lostBlock struct {
+	blkid arvados.SizedDigest
+	blk   *BlockState
+}
+
+func (lb lostBlock) hash() string {
+	return string(lb.blkid[:32])
+}
+
+// pdhs returns the portable data hashes of the collections that
+// reference the block. These are only known if the block had no
+// replicas when the collections were loaded, and the Balancer was
+// tracking references (see trackRefs).
+func (lb lostBlock) pdhs() []string {
+	var pdhs []string
+	for pdh := range lb.blk.Refs {
+		pdhs = append(pdhs, pdh)
+	}
+	sort.Strings(pdhs)
+	return pdhs
+}
+
+// writeLostBlocks writes the lost block list in the
+// Collections.BlobMissingReport format: one line per block, with the
+// block hash followed by the PDHs of the collections that reference
+// it.
+func (bal *Balancer) writeLostBlocks(w io.Writer) {
+	for _, lb := range bal.lost {
+		fmt.Fprintf(w, "%s", lb.hash())
+		for pdh := range lb.blk.Refs {
+			fmt.Fprintf(w, " %s", pdh)
+		}
+		fmt.Fprint(w, "\n")
+	}
+}
+
+// RecoverLostBlocks tries to recover each lost block by untrashing it
+// on a keepstore server (if Collections.BlobMissingUntrash is
+// enabled) or copying it from one of the configured
+// Collections.BlobMissingRecoverySources. Recovered blocks are
+// removed from the lost block list, so they are not reported as lost.
+//
+// Failures are logged, and the affected blocks are reported as lost.
+func (bal *Balancer) RecoverLostBlocks(ctx context.Context, c *arvados.Client, cluster *arvados.Cluster) {
+	cc := cluster.Collections
+	if len(bal.lost) == 0 || (!cc.BlobMissingUntrash && len(cc.BlobMissingRecoverySources) == 0) {
+		return
+	}
+	defer bal.time("recover_lost", "wall clock time to recover lost blocks")()
+
+	var services []arvados.KeepService
+	for _, srv := range bal.KeepServices {
+		services = append(services, srv.KeepService)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].UUID < services[j].UUID })
+	sources := bal.recoverySources(cluster)
+
+	recovered := make([]bool, len(bal.lost))
+	todo := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < recoverConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range todo {
+				lb := bal.lost[idx]
+				if cc.BlobMissingUntrash && recovercollection.RecoverBlock(ctx, c, cluster, bal.Logger, services, lb.hash()) {
+					bal.logf("%s: recovered lost block from keepstore trash", lb.blkid)
+					recovered[idx] = true
+					continue
+				}
+				for _, src := range sources {
+					err := bal.recoverFromSource(ctx, c, src, lb)
+					if err != nil {
+						bal.logf("%s: cannot recover lost block from %s: %s", lb.blkid, src.name, err)
+						continue
+					}
+					bal.logf("%s: recovered lost block from %s", lb.blkid, src.name)
+					recovered[idx] = true
+					break
+				}
+			}
+		}()
+	}
+	for idx := range bal.lost {
+		if ctx.Err() != nil {
+			break
+		}
+		todo <- idx
+	}
+	close(todo)
+	wg.Wait()
+
+	stillLost := bal.lost[:0]
+	for idx, lb := range bal.lost {
+		if !recovered[idx] {
+			stillLost = append(stillLost, lb)
+		}
+	}
+	bal.logf("recovered %d of %d lost blocks", len(recovered)-len(stillLost), len(recovered))
+	bal.lost = stillLost
+}
+
+// recoverySource is a place to copy lost blocks from (see
+// Collections.BlobMissingRecoverySources).
+type recoverySource struct {
+	name string
+	kc   *keepclient.KeepClient
+	// API client for looking up signed locators, if the source
+	// is a remote cluster
+	client *arvados.Client
+	// key for signing locators, if the source is a keepproxy
+	// that requires signatures
+	signingKey []byte
+}
+
+// recoverySources returns the configured recovery sources, sorted by
+// name. Invalid sources are logged and skipped.
+func (bal *Balancer) recoverySources(cluster *arvados.Cluster) []*recoverySource {
+	var sources []*recoverySource
+	for name, cfg := range cluster.Collections.BlobMissingRecoverySources {
+		src := &recoverySource{name: name}
+		client := &arvados.Client{
+			AuthToken: cfg.Token,
+			Insecure:  cfg.Insecure,
+		}
+		if cfg.RemoteCluster != "" {
+			rc, ok := cluster.RemoteClusters[cfg.RemoteCluster]
+			if !ok || rc.Host == "" {
+				bal.logf("recovery source %s: remote cluster %q is not configured in RemoteClusters, skipping", name, cfg.RemoteCluster)
+				continue
+			}
+			client.APIHost = rc.Host
+			client.Insecure = client.Insecure || rc.Insecure
+			src.client = client
+		} else if cfg.KeepproxyURL.Host != "" {
+			client.KeepServiceURIs = []string{cfg.KeepproxyURL.String()}
+			if cfg.BlobSigningKey != "" {
+				src.signingKey = []byte(cfg.BlobSigningKey)
+			}
+		} else {
+			bal.logf("recovery source %s: neither RemoteCluster nor KeepproxyURL is configured, skipping", name)
+			continue
+		}
+		ac, err := arvadosclient.New(client)
+		if err != nil {
+			bal.logf("recovery source %s: %s, skipping", name, err)
+			continue
+		}
+		if src.client != nil {
+			src.kc, err = keepclient.MakeKeepClient(ac)
+			if err != nil {
+				bal.logf("recovery source %s: %s, skipping", name, err)
+				continue
+			}
+		} else {
+			// Avoid keepclient.New, which would try to
+			// get a discovery document from a
+			// nonexistent API server.
+			src.kc = &keepclient.KeepClient{
+				Arvados:       ac,
+				Want_replicas: 1,
+				Retries:       2,
+			}
+		}
+		sources = append(sources, src)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].name < sources[j].name })
+	return sources
+}
+
+// recoverFromSource copies a lost block from the given source to a
+// local keepstore mount.
+func (bal *Balancer) recoverFromSource(ctx context.Context, c *arvados.Client, src *recoverySource, lb lostBlock) error {
+	loc := string(lb.blkid)
+	if src.client != nil {
+		var err error
+		loc, err = src.signedLocator(ctx, lb)
+		if err != nil {
+			return err
+		}
+	} else if src.signingKey != nil {
+		loc = arvados.SignLocator(loc, src.kc.Arvados.ApiToken, time.Now().Add(time.Hour), time.Hour, src.signingKey)
+	}
+	rdr, _, _, err := src.kc.Get(loc)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	// keepclient verifies the hash of the data it returns.
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return err
+	}
+	mnt := bal.recoveryMount(lb)
+	if mnt == nil {
+		return errors.New("no writable mount")
+	}
+	return mnt.KeepService.PutMountBlock(ctx, c, mnt.UUID, lb.hash(), data)
+}
+
+// signedLocator returns a locator for the given block, signed by the
+// source cluster, by looking up a collection on the source cluster
+// with the same PDH as a local collection that references the block.
+func (src *recoverySource) signedLocator(ctx context.Context, lb lostBlock) (string, error) {
+	pdhs := lb.pdhs()
+	if len(pdhs) == 0 {
+		return "", errors.New("portable data hashes of referring collections are unknown")
+	}
+	limit := 1
+	var cl arvados.CollectionList
+	err := src.client.RequestAndDecodeContext(ctx, &cl, "GET", "arvados/v1/collections", nil, arvados.ResourceListParams{
+		Limit:   &limit,
+		Select:  []string{"manifest_text"},
+		Filters: []arvados.Filter{{Attr: "portable_data_hash", Operator: "in", Operand: pdhs}},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(cl.Items) == 0 {
+		return "", errors.New("no collection found with a matching portable data hash")
+	}
+	mtext := cl.Items[0].ManifestText
+	i := strings.Index(mtext, string(lb.blkid)+"+")
+	if i < 0 {
+		return "", errors.New("signed locator not found in collection")
+	}
+	end := strings.IndexAny(mtext[i:], " \n")
+	if end < 0 {
+		end = len(mtext) - i
+	}
+	return mtext[i : i+end], nil
+}
+
+// recoveryMount returns the mount where a recovered block should be
+// written: the first writable mount, in rendezvous order, that has
+// one of the block's desired storage classes, or, failing that, the
+// first writable mount.
+func (bal *Balancer) recoveryMount(lb lostBlock) *KeepMount {
+	var fallback *KeepMount
+	for _, uuid := range keepclient.NewRootSorter(bal.serviceRoots, lb.hash()).GetSortedRoots() {
+		srv := bal.KeepServices[uuid]
+		if srv == nil {
+			continue
+		}
+		for _, mnt := range srv.mounts {
+			if mnt.ReadOnly {
+				continue
+			}
+			for class := range lb.blk.Desired {
+				if mnt.StorageClasses[class] {
+					return mnt
+				}
+			}
+			if fallback == nil {
+				fallback = mnt
+			}
+		}
+	}
+	return fallback
+}
+
+// lostFile is an entry in the Collections.BlobMissingFileReport
+// file.
+type lostFile struct {
+	CollectionUUID string `json:"collection_uuid"`
+	Path           string `json:"path"`
+	Locator        string `json:"locator"`
+}
+
+// ReportLostFiles finds the current collections that reference lost
+// blocks, writes the affected files to
+// Collections.BlobMissingFileReport, and (if commit is true) sets the
+// Collections.BlobMissingProperty property on the affected
+// collections.
+//
+// Only the collections whose PDHs are known (see lostBlock.pdhs) can
+// be found.
+func (bal *Balancer) ReportLostFiles(ctx context.Context, c *arvados.Client, cluster *arvados.Cluster, commit bool) error {
+	cc := cluster.Collections
+	prop := cc.BlobMissingProperty
+	if !commit {
+		prop = ""
+	}
+	if cc.BlobMissingFileReport == "" && prop == "" {
+		return nil
+	}
+	defer bal.time("report_lost", "wall clock time to find files affected by lost blocks")()
+
+	lostHashes := map[string]bool{}
+	pdhSet := map[string]bool{}
+	for _, lb := range bal.lost {
+		lostHashes[lb.hash()] = true
+		for pdh := range lb.blk.Refs {
+			pdhSet[pdh] = true
+		}
+	}
+	var pdhs []string
+	for pdh := range pdhSet {
+		pdhs = append(pdhs, pdh)
+	}
+	sort.Strings(pdhs)
+
+	files := []lostFile{}
+	flagged := map[string]bool{}
+	for len(pdhs) > 0 {
+		batch := pdhs
+		if len(batch) > lostCollectionsBatch {
+			batch = batch[:lostCollectionsBatch]
+		}
+		pdhs = pdhs[len(batch):]
+		err := eachCurrentCollection(ctx, c, []arvados.Filter{{Attr: "portable_data_hash", Operator: "in", Operand: batch}}, func(coll arvados.Collection) error {
+			collFiles := lostFiles(coll, lostHashes)
+			if len(collFiles) == 0 {
+				return nil
+			}
+			files = append(files, collFiles...)
+			if prop == "" {
+				return nil
+			}
+			flagged[coll.UUID] = true
+			hashSet := map[string]bool{}
+			for _, f := range collFiles {
+				hashSet[f.Locator[:32]] = true
+			}
+			var hashes []interface{}
+			for hash := range hashSet {
+				hashes = append(hashes, hash)
+			}
+			sort.Slice(hashes, func(i, j int) bool { return hashes[i].(string) < hashes[j].(string) })
+			return bal.setLostProperty(ctx, c, coll, prop, hashes)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if prop != "" {
+		// Remove the property from collections that no
+		// longer reference lost blocks. (Collect them first,
+		// because updating them while paging through the
+		// results would change the results.)
+		var unflag []arvados.Collection
+		err := eachCurrentCollection(ctx, c, []arvados.Filter{{Attr: "properties." + prop, Operator: "exists", Operand: true}}, func(coll arvados.Collection) error {
+			if !flagged[coll.UUID] {
+				unflag = append(unflag, coll)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, coll := range unflag {
+			err = bal.setLostProperty(ctx, c, coll, prop, nil)
+			if err != nil {
+				return err
+			}
+		}
+		bal.logf("flagged %d collections with lost blocks, unflagged %d", len(flagged), len(unflag))
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		fi, fj := files[i], files[j]
+		if fi.CollectionUUID != fj.CollectionUUID {
+			return fi.CollectionUUID < fj.CollectionUUID
+		} else if fi.Path != fj.Path {
+			return fi.Path < fj.Path
+		} else {
+			return fi.Locator < fj.Locator
+		}
+	})
+	if cc.BlobMissingFileReport != "" {
+		return writeFileAtomic(cc.BlobMissingFileReport, func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(files)
+		})
+	}
+	return nil
+}
+
+// setLostProperty sets the given property to the given list of lost
+// block hashes, or removes the property if hashes is empty. The
+// collection is not updated if the property already has the desired
+// value.
+func (bal *Balancer) setLostProperty(ctx context.Context, c *arvados.Client, coll arvados.Collection, prop string, hashes []interface{}) error {
+	props := map[string]interface{}{}
+	for k, v := range coll.Properties {
+		props[k] = v
+	}
+	if len(hashes) == 0 {
+		if _, ok := props[prop]; !ok {
+			return nil
+		}
+		delete(props, prop)
+	} else {
+		if reflect.DeepEqual(props[prop], hashes) {
+			return nil
+		}
+		props[prop] = hashes
+	}
+	err := c.RequestAndDecodeContext(ctx, nil, "PATCH", "arvados/v1/collections/"+coll.UUID, nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"properties": props,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%s: update properties: %s", coll.UUID, err)
+	}
+	return nil
+}
+
+// eachCurrentCollection calls f for each current (not trashed, not
+// old version) collection matching the given filters.
+func eachCurrentCollection(ctx context.Context, c *arvados.Client, filters []arvados.Filter, f func(arvados.Collection) error) error {
+	params := arvados.ResourceListParams{
+		Filters: filters,
+		Order:   "uuid",
+		Select:  []string{"uuid", "manifest_text", "properties"},
+	}
+	for {
+		var page arvados.CollectionList
+		err := c.RequestAndDecodeContext(ctx, &page, "GET", "arvados/v1/collections", nil, params)
+		if err != nil {
+			return err
+		}
+		for _, coll := range page.Items {
+			err = f(coll)
+			if err != nil {
+				return err
+			}
+		}
+		params.Offset += len(page.Items)
+		if len(page.Items) == 0 || params.Offset >= page.ItemsAvailable {
+			return nil
+		}
+	}
+}
+
+// lostFiles returns the files in the given collection that contain
+// data from any of the given blocks.
+func lostFiles(coll arvados.Collection, lostHashes map[string]bool) []lostFile {
+	var files []lostFile
+	seen := map[lostFile]bool{}
+	m := manifest.Manifest{Text: coll.ManifestText}
+	for stream := range m.StreamIter() {
+		if stream.Err != nil {
+			continue
+		}
+		type lostSegment struct {
+			locator    string
+			start, end uint64
+		}
+		var lost []lostSegment
+		var pos uint64
+		for _, tok := range stream.Blocks {
+			bl, err := manifest.ParseBlockLocator(tok)
+			if err != nil {
+				break
+			}
+			hash := bl.Digest.String()
+			if lostHashes[hash] {
+				lost = append(lost, lostSegment{
+					locator: fmt.Sprintf("%s+%d", hash, bl.Size),
+					start:   pos,
+					end:     pos + uint64(bl.Size),
+				})
+			}
+			pos += uint64(bl.Size)
+		}
+		if len(lost) == 0 {
+			continue
+		}
+		dir := strings.TrimPrefix(strings.TrimPrefix(stream.StreamName, "."), "/")
+		for _, seg := range stream.FileStreamSegments {
+			for _, ls := range lost {
+				if seg.SegPos < ls.end && seg.SegPos+seg.SegLen > ls.start {
+					lf := lostFile{
+						CollectionUUID: coll.UUID,
+						Path:           strings.TrimPrefix(dir+"/"+seg.Name, "/"),
+						Locator:        ls.locator,
+					}
+					if !seen[lf] {
+						seen[lf] = true
+						files = append(files, lf)
+					}
+				}
+			}
+		}
+	}
+	return files
+}
@@ -9,7 +9,6 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 
 	"git.arvados.org/arvados.git/lib/config"
@@ -32,11 +31,15 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 	flags.BoolVar(&options.Once, "once", false,
 		"balance once and then exit")
 	flags.BoolVar(&options.CommitPulls, "commit-pulls", false,
-		"send pull requests (make more replicas of blocks that are underreplicated or are not in optimal rendezvous probe order)")
+		"send pull requests (make more replicas of blocks that are underreplicated or are not in optimal rendezvous probe order), and recover and flag lost blocks as configured in Collections.BlobMissing*")
 	flags.BoolVar(&options.CommitTrash, "commit-trash", false,
 		"send trash requests (delete unreferenced old blocks, and excess replicas of overreplicated blocks)")
 	flags.Bool("version", false, "Write version information to stdout and exit 0")
 	dumpFlag := flags.Bool("dump", false, "dump details for each block to stdout")
+	flags.StringVar(&options.ReportFile, "report", "",
+		"write statistics, including per-mount and per-owner breakdowns, to `file` (\"-\" for stdout) after each run")
+	flags.StringVar(&options.ReportFormat, "report-format", "json",
+		"format of the -report file (json or csv)")
 
 	loader := config.NewLoader(os.Stdin, logger)
 	loader.SetupFlags(flags)
@@ -55,10 +58,12 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 	// service.Command
 	args = nil
 	dropFlag := map[string]bool{
-		"once":         true,
-		"commit-pulls": true,
-		"commit-trash": true,
-		"dump":         true,
+		"once":          true,
+		"commit-pulls":  true,
+		"commit-trash":  true,
+		"dump":          true,
+		"report":        true,
+		"report-format": true,
 	}
 	flags.Visit(func(f *flag.Flag) {
 		if !dropFlag[f.Name] {
@@ -83,7 +88,6 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 			}
 
 			srv := &Server{
-				Handler:    http.NotFoundHandler(),
 				Cluster:    cluster,
 				ArvClient:  ac,
 				RunOptions: options,
@@ -91,6 +95,7 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 				Logger:     options.Logger,
 				Dumper:     options.Dumper,
 			}
+			srv.setupHandler()
 
 			go srv.run()
 			return srv
@@ -64,6 +64,10 @@ func (m *metrics) UpdateStats(s balancerStats) {
 		"overreplicated":    {s.overrep, "overreplicated"},
 		"underreplicated":   {s.underrep, "underreplicated"},
 		"lost":              {s.lost, "lost"},
+		"erasure_coded":     {s.striped, "erasure-coded shards (all shards stored)"},
+		"stripes":           {s.stripes, "blocks with erasure-coded shards to write"},
+		"deferred_pulls":    {s.deferredPulls, "pulls deferred to a later run by rate limits"},
+		"deferred_trashes":  {s.deferredTrashes, "trashes deferred to a later run by maintenance windows"},
 		"dedup_byte_ratio":  {s.dedupByteRatio(), "deduplication ratio, bytes referenced / bytes stored"},
 		"dedup_block_ratio": {s.dedupBlockRatio(), "deduplication ratio, blocks referenced / blocks stored"},
 	}
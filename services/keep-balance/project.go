@@ -0,0 +1,66 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// getProjectParents returns the owner UUID of every project,
+// including trashed projects.
+//
+// If pageSize > 0 it is used as the maximum page size in each API
+// call; otherwise the maximum allowed page size is requested.
+func getProjectParents(ctx context.Context, c *arvados.Client, pageSize int) (map[string]string, error) {
+	limit := pageSize
+	if limit <= 0 {
+		limit = 1<<31 - 1
+	}
+	parents := map[string]string{}
+	params := arvados.ResourceListParams{
+		Limit:        &limit,
+		Order:        "uuid",
+		Count:        "none",
+		Select:       []string{"uuid", "owner_uuid"},
+		IncludeTrash: true,
+	}
+	filters := []arvados.Filter{{Attr: "group_class", Operator: "=", Operand: "project"}}
+	last := ""
+	for {
+		params.Filters = filters
+		if last != "" {
+			params.Filters = append(params.Filters, arvados.Filter{Attr: "uuid", Operator: ">", Operand: last})
+		}
+		var page arvados.GroupList
+		err := c.RequestAndDecodeContext(ctx, &page, "GET", "arvados/v1/groups", nil, params)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Items) == 0 {
+			return parents, nil
+		}
+		for _, g := range page.Items {
+			parents[g.UUID] = g.OwnerUUID
+		}
+		last = page.Items[len(page.Items)-1].UUID
+	}
+}
+
+// ownerAncestors returns the projects and user above the given
+// owner, nearest first, using the given project => owner map.
+func ownerAncestors(parents map[string]string, owner string) []string {
+	var ancestors []string
+	for len(ancestors) < len(parents) {
+		parent, ok := parents[owner]
+		if !ok {
+			break
+		}
+		ancestors = append(ancestors, parent)
+		owner = parent
+	}
+	return ancestors
+}
@@ -0,0 +1,282 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// A reportField is a named value in a balance report. The value is
+// an int, int64, float64, bool, string, []string, []int, or
+// blocksNBytes.
+type reportField struct {
+	name  string
+	value interface{}
+}
+
+// reportFields is a list of fields that is encoded as a JSON object
+// with the keys in the given order.
+type reportFields []reportField
+
+func (rf reportFields) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range rf {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(f.name)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (bb blocksNBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Replicas int   `json:"replicas"`
+		Blocks   int   `json:"blocks"`
+		Bytes    int64 `json:"bytes"`
+	}{bb.replicas, bb.blocks, bb.bytes})
+}
+
+// balanceReport is the machine-readable version of the statistics
+// logged by PrintStatistics, with additional per-mount and per-owner
+// breakdowns.
+//
+// In each row of StorageClasses, Mounts, and Owners, the first field
+// identifies the row (class name, mount UUID, or owner UUID).
+type balanceReport struct {
+	Time           time.Time      `json:"time"`
+	Incremental    bool           `json:"incremental"`
+	Summary        reportFields   `json:"summary"`
+	StorageClasses []reportFields `json:"storage_classes"`
+	Mounts         []reportFields `json:"mounts"`
+	Owners         []reportFields `json:"owners"`
+}
+
+func (bal *Balancer) report() *balanceReport {
+	s := &bal.stats
+	rpt := &balanceReport{
+		Time:        bal.startTime.UTC(),
+		Incremental: bal.incremental,
+		Summary: reportFields{
+			{"lost", s.lost},
+			{"underreplicated", s.underrep},
+			{"just_right", s.justright},
+			{"overreplicated", s.overrep},
+			{"unreferenced", s.unref},
+			{"garbage", s.garbage},
+			{"erasure_coded", s.striped},
+			{"desired", s.desired},
+			{"current", s.current},
+			{"pulls", s.pulls},
+			{"trashes", s.trashes},
+			{"stripes", s.stripes},
+			{"deferred_pulls", s.deferredPulls},
+			{"deferred_pull_bytes", s.deferredPullBytes},
+			{"deferred_trashes", s.deferredTrashes},
+			{"collection_bytes", s.collectionBytes},
+			{"collection_block_bytes", s.collectionBlockBytes},
+			{"collection_block_refs", s.collectionBlockRefs},
+			{"collection_blocks", s.collectionBlocks},
+			{"dedup_byte_ratio", s.dedupByteRatio()},
+			{"dedup_block_ratio", s.dedupBlockRatio()},
+			{"replication_histogram", s.replHistogram},
+		},
+		StorageClasses: []reportFields{},
+		Mounts:         []reportFields{},
+		Owners:         []reportFields{},
+	}
+	for _, class := range bal.classes {
+		cs := s.classStats[class]
+		rpt.StorageClasses = append(rpt.StorageClasses, reportFields{
+			{"class", class},
+			{"needed", cs.needed},
+			{"unneeded", cs.unneeded},
+			{"pulling", cs.pulling},
+			{"unachievable", cs.unachievable},
+		})
+	}
+	for mnt, ms := range s.mountStats {
+		var classes []string
+		for class := range mnt.StorageClasses {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		rpt.Mounts = append(rpt.Mounts, reportFields{
+			{"uuid", mnt.UUID},
+			{"keep_service", mnt.KeepService.UUID},
+			{"device_id", mnt.DeviceID},
+			{"storage_classes", classes},
+			{"read_only", mnt.ReadOnly},
+			{"replication", mnt.Replication},
+			{"stored", ms.stored},
+			{"pulls", ms.pulls},
+			{"trashes", ms.trashes},
+		})
+	}
+	sort.Slice(rpt.Mounts, func(i, j int) bool {
+		return rpt.Mounts[i][0].value.(string) < rpt.Mounts[j][0].value.(string)
+	})
+	if bsm := bal.BlockStateMap; bsm != nil {
+		bsm.mutex.Lock()
+		for idx, st := range s.ownerStats {
+			rpt.Owners = append(rpt.Owners, reportFields{
+				{"owner_uuid", bsm.owners[idx]},
+				{"referenced", st.referenced},
+				{"desired", st.desired},
+				{"current", st.current},
+				{"underreplicated", st.underrep},
+				{"lost", st.lost},
+			})
+		}
+		bsm.mutex.Unlock()
+	}
+	sort.Slice(rpt.Owners, func(i, j int) bool {
+		return rpt.Owners[i][0].value.(string) < rpt.Owners[j][0].value.(string)
+	})
+	return rpt
+}
+
+// StorageUsageReport returns the storage used by each owner of the
+// collections seen in this run: the total size of the distinct blocks
+// referenced by the owner's collections, counting one replica of
+// each block. If TrackStorageUsage is true, the usage of a user or
+// project includes the collections in its subprojects.
+//
+// In an incremental run, blocks referenced by collections that were
+// modified or deleted since the last full scan are still counted.
+func (bal *Balancer) StorageUsageReport() arvados.StorageUsageReport {
+	rpt := arvados.StorageUsageReport{
+		UpdatedAt: bal.startTime.UTC(),
+		Owners:    map[string]int64{},
+		Parents:   bal.projectParents,
+	}
+	if bsm := bal.BlockStateMap; bsm != nil {
+		bsm.mutex.Lock()
+		for idx, st := range bal.stats.ownerStats {
+			rpt.Owners[bsm.owners[idx]] = st.referenced.bytes
+		}
+		bsm.mutex.Unlock()
+	}
+	return rpt
+}
+
+// WriteJSON writes the report as a single JSON object.
+func (rpt *balanceReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rpt)
+}
+
+// WriteCSV writes the report as CSV with one value per row, in
+// columns "section", "name", "metric", and "value". Counts of
+// replicas, blocks, and bytes are written as three rows with metric
+// names like "lost.replicas", "lost.blocks", and "lost.bytes".
+func (rpt *balanceReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"section", "name", "metric", "value"})
+	writeFields := func(section, name string, fields reportFields) {
+		for _, f := range fields {
+			switch v := f.value.(type) {
+			case blocksNBytes:
+				cw.Write([]string{section, name, f.name + ".replicas", strconv.Itoa(v.replicas)})
+				cw.Write([]string{section, name, f.name + ".blocks", strconv.Itoa(v.blocks)})
+				cw.Write([]string{section, name, f.name + ".bytes", strconv.FormatInt(v.bytes, 10)})
+			case []int:
+				for i, n := range v {
+					cw.Write([]string{section, name, fmt.Sprintf("%s.%d", f.name, i), strconv.Itoa(n)})
+				}
+			case []string:
+				cw.Write([]string{section, name, f.name, strings.Join(v, " ")})
+			case float64:
+				cw.Write([]string{section, name, f.name, strconv.FormatFloat(v, 'g', -1, 64)})
+			default:
+				cw.Write([]string{section, name, f.name, fmt.Sprint(v)})
+			}
+		}
+	}
+	writeFields("summary", "", reportFields{
+		{"time", rpt.Time.Format(time.RFC3339Nano)},
+		{"incremental", rpt.Incremental},
+	})
+	writeFields("summary", "", rpt.Summary)
+	for _, section := range []struct {
+		name string
+		rows []reportFields
+	}{
+		{"storage_classes", rpt.StorageClasses},
+		{"mounts", rpt.Mounts},
+		{"owners", rpt.Owners},
+	} {
+		for _, row := range section.rows {
+			writeFields(section.name, row[0].value.(string), row[1:])
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteReport writes a report of the statistics computed by
+// ComputeChangeSets to bal.ReportFile. The file is replaced
+// atomically.
+func (bal *Balancer) WriteReport() error {
+	rpt := bal.report()
+	write := rpt.WriteJSON
+	if bal.ReportFormat == "csv" {
+		write = rpt.WriteCSV
+	}
+	if bal.ReportFile == "-" {
+		return write(os.Stdout)
+	}
+	err := writeFileAtomic(bal.ReportFile, write)
+	if err != nil {
+		return err
+	}
+	bal.logf("wrote report to %s", bal.ReportFile)
+	return nil
+}
+
+// writeFileAtomic calls write to write the content of the given
+// file, and replaces the file only if write succeeds, so readers
+// never see a partially written file.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	err = write(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.Name(), err)
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.Name(), err)
+	}
+	return os.Rename(f.Name(), path)
+}
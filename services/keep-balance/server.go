@@ -5,13 +5,16 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/auth"
 	"github.com/sirupsen/logrus"
 )
 
@@ -29,11 +32,23 @@ type RunOptions struct {
 	Logger      logrus.FieldLogger
 	Dumper      logrus.FieldLogger
 
+	// Write a report of each balance operation's statistics to
+	// ReportFile ("-" for stdout) in ReportFormat ("json" or
+	// "csv").
+	ReportFile   string
+	ReportFormat string
+
 	// SafeRendezvousState from the most recent balance operation,
 	// or "" if unknown. If this changes from one run to the next,
 	// we need to watch out for races. See
 	// (*Balancer)ClearTrashLists.
 	SafeRendezvousState string
+
+	// Block state from the most recent balance operation, to be
+	// updated by the next one instead of doing a full scan, or
+	// nil if the next operation must be a full scan. See
+	// (*Balancer)UpdateState.
+	incrementalState *incrementalState
 }
 
 type Server struct {
@@ -46,6 +61,37 @@ type Server struct {
 
 	Logger logrus.FieldLogger
 	Dumper logrus.FieldLogger
+
+	mtx          sync.Mutex
+	storageUsage *arvados.StorageUsageReport
+}
+
+// setupHandler sets srv.Handler to serve the storage usage computed
+// by the most recent balance operation at /storage_usage. Requests
+// must use the cluster's ManagementToken.
+func (srv *Server) setupHandler() {
+	mux := http.NewServeMux()
+	mux.Handle("/storage_usage", auth.RequireLiteralToken(srv.Cluster.ManagementToken, http.HandlerFunc(srv.serveStorageUsage)))
+	srv.Handler = mux
+}
+
+func (srv *Server) serveStorageUsage(w http.ResponseWriter, req *http.Request) {
+	if srv.Cluster.ManagementToken == "" {
+		http.Error(w, "disabled by config (ManagementToken is empty)", http.StatusNotFound)
+		return
+	} else if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	srv.mtx.Lock()
+	usage := srv.storageUsage
+	srv.mtx.Unlock()
+	if usage == nil {
+		http.Error(w, "storage usage has not been computed yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
 }
 
 // CheckHealth implements service.Handler.
@@ -79,9 +125,18 @@ func (srv *Server) runOnce() (*Balancer, error) {
 		Dumper:         srv.Dumper,
 		Metrics:        srv.Metrics,
 		LostBlocksFile: srv.Cluster.Collections.BlobMissingReport,
+		ReportFile:     srv.RunOptions.ReportFile,
+		ReportFormat:   srv.RunOptions.ReportFormat,
+
+		TrackStorageUsage: srv.Cluster.StorageQuotasEnabled(),
 	}
 	var err error
 	srv.RunOptions, err = bal.Run(srv.ArvClient, srv.Cluster, srv.RunOptions)
+	if bal.storageUsage != nil {
+		srv.mtx.Lock()
+		srv.storageUsage = bal.storageUsage
+		srv.mtx.Unlock()
+	}
 	return bal, err
 }
 
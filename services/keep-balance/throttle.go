@@ -0,0 +1,95 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// ThrottleChanges removes pulls and trashes from the computed change
+// sets so that the changes committed in this run respect the
+// configured bandwidth budgets and maintenance windows (see
+// Collections.BalancePullRate, Collections.BlobPullRate, and
+// Collections.BalanceMaintenanceWindows).
+//
+// Outside maintenance windows, the pulls sent in one run are limited
+// to the amount of data that can be transferred at the configured
+// rates before the next run starts. Pulls that restore the
+// replication of underreplicated blocks are kept in preference to
+// pulls that only improve the layout. If maintenance windows are
+// configured, trashes are only kept during a window.
+//
+// Changes that are removed here are computed again, and eventually
+// committed, in subsequent runs.
+func (bal *Balancer) ThrottleChanges(cluster *arvados.Cluster, schedule *arvados.MaintenanceSchedule, now time.Time) {
+	if schedule.Active(now) {
+		return
+	}
+	if !schedule.Empty() {
+		for _, srv := range bal.KeepServices {
+			bal.stats.deferredTrashes += len(srv.ChangeSet.Trashes)
+			srv.ChangeSet.Trashes = nil
+		}
+		if bal.stats.deferredTrashes > 0 {
+			bal.logf("outside maintenance window: deferring %d trash requests", bal.stats.deferredTrashes)
+		}
+	}
+	period := cluster.Collections.BalancePeriod.Duration().Seconds()
+	bal.throttlePulls(
+		int64(float64(cluster.Collections.BalancePullRate)*period),
+		int64(float64(cluster.Collections.BlobPullRate)*period))
+	bal.Metrics.UpdateStats(bal.stats)
+}
+
+// throttlePulls limits the total size of the pulls in all change
+// sets to clusterBudget, and the total size of the pulls in each
+// change set to serviceBudget. Zero means no limit.
+func (bal *Balancer) throttlePulls(clusterBudget, serviceBudget int64) {
+	if clusterBudget <= 0 && serviceBudget <= 0 {
+		return
+	}
+	var pulls []Pull
+	for _, srv := range bal.KeepServices {
+		pulls = append(pulls, srv.ChangeSet.Pulls...)
+		srv.ChangeSet.Pulls = nil
+	}
+	sort.Slice(pulls, func(i, j int) bool {
+		pi, pj := pulls[i], pulls[j]
+		if pi.underreplicated != pj.underreplicated {
+			return pi.underreplicated
+		} else if pi.replicas != pj.replicas {
+			return pi.replicas < pj.replicas
+		} else if pi.SizedDigest != pj.SizedDigest {
+			return pi.SizedDigest < pj.SizedDigest
+		} else {
+			return pi.To.UUID < pj.To.UUID
+		}
+	})
+
+	// A pull larger than the entire budget is sent anyway if
+	// nothing else has been sent, so large blocks aren't
+	// postponed forever.
+	var clusterUsed int64
+	serviceUsed := map[*KeepService]int64{}
+	for _, p := range pulls {
+		srv := p.To.KeepService
+		size := p.SizedDigest.Size()
+		if (clusterBudget > 0 && clusterUsed > 0 && clusterUsed+size > clusterBudget) ||
+			(serviceBudget > 0 && serviceUsed[srv] > 0 && serviceUsed[srv]+size > serviceBudget) {
+			bal.stats.deferredPulls++
+			bal.stats.deferredPullBytes += size
+			continue
+		}
+		clusterUsed += size
+		serviceUsed[srv] += size
+		srv.ChangeSet.Pulls = append(srv.ChangeSet.Pulls, p)
+	}
+	if bal.stats.deferredPulls > 0 {
+		bal.logf("pull rate limit: sending %d bytes of pulls, deferring %d pulls (%d bytes)", clusterUsed, bal.stats.deferredPulls, bal.stats.deferredPullBytes)
+	}
+}
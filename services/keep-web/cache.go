@@ -23,6 +23,7 @@ type cache struct {
 	pdhs        *lru.TwoQueueCache
 	collections *lru.TwoQueueCache
 	permissions *lru.TwoQueueCache
+	accessKeys  *lru.TwoQueueCache
 	setupOnce   sync.Once
 }
 
@@ -102,6 +103,11 @@ type cachedPermission struct {
 	expire time.Time
 }
 
+type cachedAccessKey struct {
+	expire time.Time
+	aca    *arvados.APIClientAuthorization
+}
+
 func (c *cache) setup() {
 	var err error
 	c.pdhs, err = lru.New2Q(c.config.MaxUUIDEntries)
@@ -116,6 +122,10 @@ func (c *cache) setup() {
 	if err != nil {
 		panic(err)
 	}
+	c.accessKeys, err = lru.New2Q(c.config.MaxPermissionEntries)
+	if err != nil {
+		panic(err)
+	}
 
 	reg := c.registry
 	if reg == nil {
@@ -328,3 +338,27 @@ func (c *cache) lookupCollection(key string) *arvados.Collection {
 	c.metrics.collectionHits.Inc()
 	return ent.collection
 }
+
+// lookupAccessKey returns the cached API token with the given UUID
+// (an S3 access key), or nil if it isn't cached.
+func (c *cache) lookupAccessKey(uuid string) *arvados.APIClientAuthorization {
+	c.setupOnce.Do(c.setup)
+	e, cached := c.accessKeys.Get(uuid)
+	if !cached {
+		return nil
+	}
+	ent := e.(*cachedAccessKey)
+	if ent.expire.Before(time.Now()) {
+		c.accessKeys.Remove(uuid)
+		return nil
+	}
+	return ent.aca
+}
+
+func (c *cache) storeAccessKey(uuid string, aca *arvados.APIClientAuthorization) {
+	c.setupOnce.Do(c.setup)
+	c.accessKeys.Add(uuid, &cachedAccessKey{
+		expire: time.Now().Add(time.Duration(c.config.TTL)),
+		aca:    aca,
+	})
+}
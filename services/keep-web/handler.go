@@ -36,6 +36,7 @@ type handler struct {
 	setupOnce     sync.Once
 	healthHandler http.Handler
 	webdavLS      webdav.LockSystem
+	quota         *quotaChecker
 }
 
 // parseCollectionIDFromDNSName returns a UUID or PDH if s begins with
@@ -82,6 +83,12 @@ func (h *handler) setup() {
 
 	keepclient.RefreshServiceDiscoveryOnSIGHUP()
 	keepclient.DefaultBlockCache.MaxBlocks = h.Config.cluster.Collections.WebDAVCache.MaxBlockEntries
+	if dir := h.Config.cluster.Collections.WebDAVCache.DiskCacheDir; dir != "" {
+		keepclient.DefaultBlockCache.Disk = &keepclient.DiskCache{
+			Dir:      dir,
+			MaxBytes: int64(h.Config.cluster.Collections.WebDAVCache.DiskCacheSize),
+		}
+	}
 
 	h.healthHandler = &health.Handler{
 		Token:  h.Config.cluster.ManagementToken,
@@ -91,6 +98,8 @@ func (h *handler) setup() {
 	// Even though we don't accept LOCK requests, every webdav
 	// handler must have a non-nil LockSystem.
 	h.webdavLS = &noLockSystem{}
+
+	h.quota = newQuotaChecker(h.Config.cluster)
 }
 
 func (h *handler) serveStatus(w http.ResponseWriter, r *http.Request) {
@@ -444,6 +453,10 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		http.Error(w, errReadOnly.Error(), http.StatusMethodNotAllowed)
 		return
 	}
+	if (r.Method == "PUT" || r.Method == "COPY") && h.quota.exceeded(r.Context(), client, collection.OwnerUUID) {
+		http.Error(w, errQuotaExceeded.Error(), http.StatusForbidden)
+		return
+	}
 
 	if webdavMethod[r.Method] {
 		if writeMethod[r.Method] {
@@ -0,0 +1,105 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+)
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// How long to remember an owner's storage usage before checking
+// again.
+const quotaCheckInterval = time.Minute
+
+// quotaChecker refuses uploads into collections whose owners have
+// reached their storage quotas (see Collections.StorageQuotas).
+//
+// Uploads are permitted when the owner's usage can't be retrieved,
+// e.g., because keep-balance has not reported usage yet, or the
+// client is not allowed to see the owner's usage.
+type quotaChecker struct {
+	mtx     sync.Mutex
+	checked map[string]quotaCheck // token + " " + UUID => last check
+}
+
+type quotaCheck struct {
+	result  string // owner UUID (collectionOwner) or "exceeded" (exceeded)
+	expires time.Time
+}
+
+// newQuotaChecker returns a quotaChecker, or nil if no storage quotas
+// are configured.
+func newQuotaChecker(cluster *arvados.Cluster) *quotaChecker {
+	if !cluster.StorageQuotasEnabled() {
+		return nil
+	}
+	return &quotaChecker{checked: map[string]quotaCheck{}}
+}
+
+// exceeded returns true if the given owner has reached its storage
+// quota.
+func (qc *quotaChecker) exceeded(ctx context.Context, client *arvados.Client, ownerUUID string) bool {
+	if qc == nil || ownerUUID == "" {
+		return false
+	}
+	result, err := qc.cached(client.AuthToken, "usage:"+ownerUUID, func() (string, error) {
+		var usage arvados.StorageUsage
+		err := client.RequestAndDecodeContext(ctx, &usage, "GET", "arvados/v1/storage_usage", nil, arvados.StorageUsageGetOptions{OwnerUUID: ownerUUID})
+		if err != nil || !usage.Exceeded() {
+			return "", err
+		}
+		return "exceeded", nil
+	})
+	if err != nil {
+		ctxlog.FromContext(ctx).WithError(err).WithField("owner_uuid", ownerUUID).Warn("error retrieving storage usage")
+	}
+	return result == "exceeded"
+}
+
+// collectionOwner returns the UUID of the user or project that owns
+// the given collection. If uuid is a project UUID, it is returned
+// unchanged.
+func (qc *quotaChecker) collectionOwner(ctx context.Context, client *arvados.Client, uuid string) (string, error) {
+	if len(uuid) == 27 && uuid[6:11] == "j7d0g" {
+		return uuid, nil
+	}
+	return qc.cached(client.AuthToken, "owner:"+uuid, func() (string, error) {
+		var coll arvados.Collection
+		err := client.RequestAndDecodeContext(ctx, &coll, "GET", "arvados/v1/collections/"+uuid, nil, arvados.GetOptions{Select: []string{"uuid", "owner_uuid"}})
+		return coll.OwnerUUID, err
+	})
+}
+
+// cached returns the result of a previous call to fetch with the
+// same token and key, if it hasn't expired yet. Otherwise, it calls
+// fetch, and remembers the result. Errors are remembered too, so a
+// failing API call isn't retried for every request.
+func (qc *quotaChecker) cached(token, key string, fetch func() (string, error)) (string, error) {
+	key = token + " " + key
+	now := time.Now()
+	qc.mtx.Lock()
+	check, ok := qc.checked[key]
+	qc.mtx.Unlock()
+	if ok && now.Before(check.expires) {
+		return check.result, nil
+	}
+	result, err := fetch()
+	qc.mtx.Lock()
+	defer qc.mtx.Unlock()
+	for k, c := range qc.checked {
+		if now.After(c.expires) {
+			delete(qc.checked, k)
+		}
+	}
+	qc.checked[key] = quotaCheck{result: result, expires: now.Add(quotaCheckInterval)}
+	return result, err
+}
@@ -0,0 +1,82 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestQuotaChecker(c *check.C) {
+	cluster := &arvados.Cluster{}
+	c.Check(newQuotaChecker(cluster), check.IsNil)
+	c.Check((*quotaChecker)(nil).exceeded(context.Background(), nil, "zzzzz-tpzed-000000000000000"), check.Equals, false)
+
+	var mtx sync.Mutex
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests[req.URL.Path]++
+		switch req.URL.Path {
+		case "/arvados/v1/collections/zzzzz-4zz18-fullfullfullful":
+			json.NewEncoder(w).Encode(arvados.Collection{OwnerUUID: "zzzzz-j7d0g-fullfullfullful"})
+		case "/arvados/v1/storage_usage":
+			su := arvados.StorageUsage{OwnerUUID: req.FormValue("owner_uuid"), UsedBytes: 10, QuotaBytes: 1000, UpdatedAt: time.Now()}
+			if strings.Contains(su.OwnerUUID, "full") {
+				su.UsedBytes = 1000
+			} else if strings.Contains(su.OwnerUUID, "secret") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			json.NewEncoder(w).Encode(su)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	client := &arvados.Client{
+		Scheme:    "http",
+		APIHost:   strings.TrimPrefix(srv.URL, "http://"),
+		AuthToken: "token",
+	}
+
+	ctx := context.Background()
+	cluster.Collections.DefaultStorageQuota = 1000
+	qc := newQuotaChecker(cluster)
+	c.Assert(qc, check.NotNil)
+
+	owner, err := qc.collectionOwner(ctx, client, "zzzzz-4zz18-fullfullfullful")
+	c.Check(err, check.IsNil)
+	c.Check(owner, check.Equals, "zzzzz-j7d0g-fullfullfullful")
+	owner, err = qc.collectionOwner(ctx, client, "zzzzz-j7d0g-okokokokokokoko")
+	c.Check(err, check.IsNil)
+	c.Check(owner, check.Equals, "zzzzz-j7d0g-okokokokokokoko")
+
+	c.Check(qc.exceeded(ctx, client, "zzzzz-j7d0g-fullfullfullful"), check.Equals, true)
+	c.Check(qc.exceeded(ctx, client, "zzzzz-j7d0g-okokokokokokoko"), check.Equals, false)
+	// Errors don't prevent uploads.
+	c.Check(qc.exceeded(ctx, client, "zzzzz-j7d0g-secretsecretsec"), check.Equals, false)
+
+	// Results are cached.
+	c.Check(qc.exceeded(ctx, client, "zzzzz-j7d0g-fullfullfullful"), check.Equals, true)
+	c.Check(qc.exceeded(ctx, client, "zzzzz-j7d0g-secretsecretsec"), check.Equals, false)
+	_, err = qc.collectionOwner(ctx, client, "zzzzz-4zz18-fullfullfullful")
+	c.Check(err, check.IsNil)
+	mtx.Lock()
+	c.Check(requests, check.DeepEquals, map[string]int{
+		"/arvados/v1/collections/zzzzz-4zz18-fullfullfullful": 1,
+		"/arvados/v1/storage_usage":                           3,
+	})
+	mtx.Unlock()
+}
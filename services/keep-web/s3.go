@@ -5,55 +5,46 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
 	"github.com/AdRoll/goamz/s3"
 )
 
 const s3MaxKeys = 1000
 
+// Maximum number of buckets in a ListBuckets response. Like Amazon
+// S3, keep-web returns a continuation token if the caller can see
+// more buckets than this.
+const s3MaxBuckets = 10000
+
 // serveS3 handles r and returns true if r is a request from an S3
 // client, otherwise it returns false.
 func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
-	var token string
-	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "AWS ") {
-		split := strings.SplitN(auth[4:], ":", 2)
-		if len(split) < 2 {
-			w.WriteHeader(http.StatusUnauthorized)
-			return true
-		}
-		token = split[0]
-	} else if strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
-		for _, cmpt := range strings.Split(auth[17:], ",") {
-			cmpt = strings.TrimSpace(cmpt)
-			split := strings.SplitN(cmpt, "=", 2)
-			if len(split) == 2 && split[0] == "Credential" {
-				keyandscope := strings.Split(split[1], "/")
-				if len(keyandscope[0]) > 0 {
-					token = keyandscope[0]
-					break
-				}
-			}
-		}
-		if token == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Println(w, "invalid V4 signature")
-			return true
-		}
-	} else {
+	if !isS3Request(r) {
 		return false
 	}
+	token, err := h.checkS3Signature(r, time.Now())
+	if err != nil {
+		s3error(w, err)
+		return true
+	}
 
 	_, kc, client, release, err := h.getClients(r.Header.Get("X-Request-Id"), token)
 	if err != nil {
@@ -67,7 +58,18 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 
 	objectNameGiven := strings.Count(strings.TrimSuffix(r.URL.Path, "/"), "/") > 1
 
+	if objectNameGiven && h.serveS3Multipart(w, r, fs, client, kc) {
+		return true
+	}
+	if _, ok := r.URL.Query()["tagging"]; ok && objectNameGiven {
+		h.s3objectTagging(w, r, fs, client)
+		return true
+	}
+
 	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/":
+		h.s3listBuckets(w, r, client)
+		return true
 	case r.Method == http.MethodGet && !objectNameGiven:
 		// Path is "/{uuid}" or "/{uuid}/", has no object name
 		if _, ok := r.URL.Query()["versioning"]; ok {
@@ -76,8 +78,8 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			io.WriteString(w, xml.Header)
 			fmt.Fprintln(w, `<VersioningConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"/>`)
 		} else {
-			// ListObjects
-			h.s3list(w, r, fs)
+			// ListObjects, ListObjectsV2
+			h.s3list(w, r, fs, client)
 		}
 		return true
 	case r.Method == http.MethodGet || r.Method == http.MethodHead:
@@ -86,6 +88,7 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 		if r.Method == "HEAD" && !objectNameGiven {
 			// HeadBucket
 			if err == nil && fi.IsDir() {
+				h.s3serveBucketMetadata(w, r, client, strings.Trim(r.URL.Path, "/"))
 				w.WriteHeader(http.StatusOK)
 			} else if os.IsNotExist(err) {
 				w.WriteHeader(http.StatusNotFound)
@@ -105,6 +108,8 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			http.Error(w, "not found", http.StatusNotFound)
 			return true
 		}
+		bucket, key := s3bucketKey(r.URL.Path)
+		h.s3serveObjectMetadata(w, r, fs, bucket, key)
 		// shallow copy r, and change URL path
 		r := *r
 		r.URL.Path = fspath
@@ -139,6 +144,23 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			fspath += "."
 			objectIsDir = true
 		}
+		if !objectIsDir && h.s3quotaExceeded(r, client) {
+			http.Error(w, errQuotaExceeded.Error(), http.StatusForbidden)
+			return true
+		}
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			if objectIsDir {
+				http.Error(w, "invalid object name: trailing slash", http.StatusBadRequest)
+				return true
+			}
+			h.s3copy(w, r, fs, client, kc, src)
+			return true
+		}
+		md, err := s3objectMetadataFromRequest(r)
+		if err != nil {
+			s3error(w, err)
+			return true
+		}
 		fi, err := fs.Stat(fspath)
 		if err != nil && err.Error() == "not a directory" {
 			// requested foo/bar, but foo is a file
@@ -150,28 +172,15 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			http.Error(w, "object name conflicts with existing object", http.StatusBadRequest)
 			return true
 		}
-		// create missing parent/intermediate directories, if any
-		for i, c := range fspath {
-			if i > 0 && c == '/' {
-				dir := fspath[:i]
-				if strings.HasSuffix(dir, "/") {
-					err = errors.New("invalid object name (consecutive '/' chars)")
-					http.Error(w, err.Error(), http.StatusBadRequest)
-					return true
-				}
-				err = fs.Mkdir(dir, 0755)
-				if err == arvados.ErrInvalidArgument {
-					// Cannot create a directory
-					// here.
-					err = fmt.Errorf("mkdir %q failed: %w", dir, err)
-					http.Error(w, err.Error(), http.StatusBadRequest)
-					return true
-				} else if err != nil && !os.IsExist(err) {
-					err = fmt.Errorf("mkdir %q failed: %w", dir, err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return true
-				}
-			}
+		err = h.s3ensureCollection(r, client)
+		if err != nil {
+			s3error(w, err)
+			return true
+		}
+		err = s3mkdirs(fs, fspath)
+		if err != nil {
+			s3error(w, err)
+			return true
 		}
 		if !objectIsDir {
 			f, err := fs.OpenFile(fspath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
@@ -185,7 +194,10 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			}
 			defer f.Close()
 			_, err = io.Copy(f, r.Body)
-			if err != nil {
+			if errors.Is(err, errS3ContentSHA256Mismatch) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return true
+			} else if err != nil {
 				err = fmt.Errorf("write to %q failed: %w", r.URL.Path, err)
 				http.Error(w, err.Error(), http.StatusBadGateway)
 				return true
@@ -203,6 +215,18 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return true
 		}
+		if !objectIsDir {
+			// PutObject replaces any existing metadata
+			// and tags.
+			bucket, key := s3bucketKey(r.URL.Path)
+			err = h.s3updateObjectMetadata(r, client, bucket, key, func(all map[string]s3objectMetadata, path string) {
+				all[path] = md
+			})
+			if err != nil {
+				s3error(w, err)
+				return true
+			}
+		}
 		w.WriteHeader(http.StatusOK)
 		return true
 	case r.Method == http.MethodDelete:
@@ -251,6 +275,24 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return true
 		}
+		bucket, key := s3bucketKey(r.URL.Path)
+		err = h.s3updateObjectMetadata(r, client, bucket, key, func(all map[string]s3objectMetadata, path string) {
+			path = strings.TrimSuffix(path, "/")
+			if path == "" {
+				return
+			}
+			for p := range all {
+				if p == path || strings.HasPrefix(p, path+"/") {
+					delete(all, p)
+				}
+			}
+		})
+		if err != nil {
+			// The object is gone, so the stale metadata
+			// won't be visible, unless a new object is
+			// created with the same name.
+			ctxlog.FromContext(r.Context()).WithError(err).Warn("error removing metadata of deleted object")
+		}
 		w.WriteHeader(http.StatusNoContent)
 		return true
 	default:
@@ -259,6 +301,301 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 	}
 }
 
+// s3error sends an error response for err, using the status code
+// indicated by err's HTTPStatus method if it has one, otherwise 500.
+func s3error(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if he, ok := err.(interface{ HTTPStatus() int }); ok {
+		status = he.HTTPStatus()
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// s3quotaExceeded returns true if the owner of the bucket named in r
+// has reached its storage quota.
+func (h *handler) s3quotaExceeded(r *http.Request, client *arvados.Client) bool {
+	if h.quota == nil {
+		return false
+	}
+	bucket := strings.SplitN(r.URL.Path, "/", 3)[1]
+	owner, err := h.quota.collectionOwner(r.Context(), client, bucket)
+	if err != nil {
+		ctxlog.FromContext(r.Context()).WithError(err).Warn("error retrieving bucket owner")
+		return false
+	}
+	return h.quota.exceeded(r.Context(), client, owner)
+}
+
+// s3mkdirs creates the missing parent/intermediate directories of
+// fspath, if any.
+func s3mkdirs(fs arvados.CustomFileSystem, fspath string) error {
+	for i, c := range fspath {
+		if i > 0 && c == '/' {
+			dir := fspath[:i]
+			if strings.HasSuffix(dir, "/") {
+				err := errors.New("invalid object name (consecutive '/' chars)")
+				return httpserver.ErrorWithStatus(err, http.StatusBadRequest)
+			}
+			err := fs.Mkdir(dir, 0755)
+			if err == arvados.ErrInvalidArgument {
+				// Cannot create a directory
+				// here.
+				err = fmt.Errorf("mkdir %q failed: %w", dir, err)
+				return httpserver.ErrorWithStatus(err, http.StatusBadRequest)
+			} else if err != nil && !os.IsExist(err) {
+				return fmt.Errorf("mkdir %q failed: %w", dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+// s3spliceObject replaces the object at fspath with the given
+// subtree, creating parent directories as needed, and saves the
+// affected collection.
+func s3spliceObject(fs arvados.CustomFileSystem, fspath string, subtree *arvados.Subtree) error {
+	if fi, err := fs.Stat(fspath); (err != nil && err.Error() == "not a directory") || (err == nil && fi.IsDir()) {
+		err := errors.New("object name conflicts with existing object")
+		return httpserver.ErrorWithStatus(err, http.StatusBadRequest)
+	}
+	err := s3mkdirs(fs, fspath)
+	if err != nil {
+		return err
+	}
+	err = arvados.Splice(fs, fspath, subtree)
+	if err == arvados.ErrInvalidArgument || err == arvados.ErrInvalidOperation {
+		err = fmt.Errorf("cannot write %q: %w", fspath, err)
+		return httpserver.ErrorWithStatus(err, http.StatusBadRequest)
+	} else if err != nil {
+		return fmt.Errorf("write to %q failed: %w", fspath, err)
+	}
+	err = fs.Sync()
+	if err != nil {
+		return fmt.Errorf("sync failed: %w", err)
+	}
+	return nil
+}
+
+// s3copy handles CopyObject. The source file's data is spliced into
+// the target collection, so no data is read or written in Keep.
+func (h *handler) s3copy(w http.ResponseWriter, r *http.Request, fs arvados.CustomFileSystem, client *arvados.Client, kc *keepclient.KeepClient, src string) {
+	// The copy source is "bucket/key" or "/bucket/key",
+	// URL-encoded, optionally followed by "?versionId=...".
+	if i := strings.Index(src, "?"); i >= 0 {
+		if v, err := url.ParseQuery(src[i+1:]); err != nil || (v.Get("versionId") != "" && v.Get("versionId") != "null") {
+			http.Error(w, "copying a specific version is not supported", http.StatusNotImplemented)
+			return
+		}
+		src = src[:i]
+	}
+	src, err := url.PathUnescape(strings.TrimPrefix(src, "/"))
+	if err != nil || strings.Count(src, "/") < 1 || strings.HasSuffix(src, "/") {
+		http.Error(w, "invalid copy source", http.StatusBadRequest)
+		return
+	}
+	srcpath := "by_id/" + src
+	fi, err := fs.Stat(srcpath)
+	if os.IsNotExist(err) || (err != nil && err.Error() == "not a directory") || (err == nil && fi.IsDir()) {
+		http.Error(w, "NoSuchKey: copy source not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	md, err := h.s3copyMetadata(r, client, src)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	subtree, err := arvados.Snapshot(fs, srcpath)
+	if err == arvados.ErrInvalidOperation {
+		http.Error(w, fmt.Sprintf("cannot copy %q: %s", src, err), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		s3error(w, fmt.Errorf("copy %q failed: %w", src, err))
+		return
+	}
+	etag, err := s3subtreeETag(subtree, kc)
+	if err != nil {
+		s3error(w, fmt.Errorf("copy %q failed: %w", src, err))
+		return
+	}
+	err = h.s3ensureCollection(r, client)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	err = s3spliceObject(fs, "by_id"+r.URL.Path, subtree)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	bucket, key := s3bucketKey(r.URL.Path)
+	err = h.s3updateObjectMetadata(r, client, bucket, key, func(all map[string]s3objectMetadata, path string) {
+		all[path] = md
+	})
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	s3writeXML(w, r, s3copyObjectResult{
+		LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.999") + "Z",
+		ETag:         etag,
+	})
+}
+
+// s3subtreeETag returns the ETag for a copy of the file in the given
+// Subtree: the MD5 digest part of the portable data hash of a
+// manifest containing only that file. Unlike Amazon S3, which uses
+// the MD5 digest of the file content, this doesn't require reading
+// the data.
+func s3subtreeETag(subtree *arvados.Subtree, kc *keepclient.KeepClient) (string, error) {
+	fs, err := (&arvados.Collection{}).FileSystem(nil, kc)
+	if err != nil {
+		return "", err
+	}
+	err = arvados.Splice(fs, "data", subtree)
+	if err != nil {
+		return "", err
+	}
+	mtxt, err := fs.MarshalManifest(".")
+	if err != nil {
+		return "", err
+	}
+	return `"` + strings.Split(arvados.PortableDataHash(mtxt), "+")[0] + `"`, nil
+}
+
+// s3copyMetadata returns the metadata and tags for the target of a
+// CopyObject request: either copied from the source object
+// (x-amz-metadata-directive and x-amz-tagging-directive "COPY", the
+// default) or taken from the request headers ("REPLACE").
+func (h *handler) s3copyMetadata(r *http.Request, client *arvados.Client, src string) (s3objectMetadata, error) {
+	md, err := s3objectMetadataFromRequest(r)
+	if err != nil {
+		return md, err
+	}
+	copyMetadata := r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE"
+	copyTags := r.Header.Get("X-Amz-Tagging-Directive") != "REPLACE"
+	if !copyMetadata && !copyTags {
+		return md, nil
+	}
+	bucket, key := s3bucketKey("/" + src)
+	coll, path, err := h.s3objectCollection(r, client, bucket, key, false)
+	if err != nil {
+		return md, fmt.Errorf("error retrieving source metadata: %w", err)
+	}
+	all, err := s3loadObjectMetadata(coll)
+	if err != nil {
+		return md, err
+	}
+	if copyMetadata {
+		md.Metadata = all[path].Metadata
+	}
+	if copyTags {
+		md.Tags = all[path].Tags
+	}
+	return md, nil
+}
+
+type s3copyObjectResult struct {
+	XMLName      string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+	LastModified string
+	ETag         string
+}
+
+// s3listBuckets handles ListBuckets. The caller's buckets are all of
+// the projects and collections it can read.
+//
+// At most max-buckets (default s3MaxBuckets) buckets are returned,
+// in name order, starting after the given continuation-token.
+func (h *handler) s3listBuckets(w http.ResponseWriter, r *http.Request, client *arvados.Client) {
+	maxBuckets := s3MaxBuckets
+	if mb, _ := strconv.Atoi(r.FormValue("max-buckets")); mb > 0 && mb < s3MaxBuckets {
+		maxBuckets = mb
+	}
+	after := r.FormValue("continuation-token")
+	var user arvados.User
+	err := client.RequestAndDecodeContext(r.Context(), &user, "GET", "arvados/v1/users/current", nil, nil)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	resp := s3listBucketsResp{
+		Owner: s3.Owner{ID: user.UUID, DisplayName: user.FullName},
+	}
+	if resp.Owner.DisplayName == "" {
+		resp.Owner.DisplayName = user.Username
+	}
+	for _, rsc := range []struct {
+		path    string
+		filters []arvados.Filter
+	}{
+		{"arvados/v1/groups", []arvados.Filter{{Attr: "group_class", Operator: "=", Operand: "project"}}},
+		{"arvados/v1/collections", nil},
+	} {
+		params := arvados.ResourceListParams{
+			Count:   "none",
+			Filters: rsc.filters,
+			Order:   "uuid",
+			Select:  []string{"uuid", "created_at"},
+		}
+		if after != "" {
+			params.Filters = append(rsc.filters, arvados.Filter{Attr: "uuid", Operator: ">", Operand: after})
+		}
+		// Only the first maxBuckets projects and the first
+		// maxBuckets collections can appear in this response.
+		// One more is needed to tell whether the response is
+		// truncated.
+		for found := 0; found <= maxBuckets; {
+			limit := maxBuckets + 1 - found
+			params.Limit = &limit
+			var page struct {
+				Items []struct {
+					UUID      string    `json:"uuid"`
+					CreatedAt time.Time `json:"created_at"`
+				} `json:"items"`
+			}
+			err := client.RequestAndDecodeContext(r.Context(), &page, "GET", rsc.path, nil, params)
+			if err != nil {
+				s3error(w, err)
+				return
+			}
+			if len(page.Items) == 0 {
+				break
+			}
+			for _, item := range page.Items {
+				resp.Buckets = append(resp.Buckets, s3.BucketInfo{
+					Name:         item.UUID,
+					CreationDate: item.CreatedAt.UTC().Format("2006-01-02T15:04:05.999") + "Z",
+				})
+			}
+			found += len(page.Items)
+			params.Filters = append(rsc.filters, arvados.Filter{Attr: "uuid", Operator: ">", Operand: page.Items[len(page.Items)-1].UUID})
+		}
+	}
+	sort.Slice(resp.Buckets, func(i, j int) bool { return resp.Buckets[i].Name < resp.Buckets[j].Name })
+	if len(resp.Buckets) > maxBuckets {
+		resp.Buckets = resp.Buckets[:maxBuckets]
+		resp.ContinuationToken = resp.Buckets[maxBuckets-1].Name
+	}
+	s3writeXML(w, r, resp)
+}
+
+type s3listBucketsResp struct {
+	XMLName           string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner             s3.Owner
+	Buckets           []s3.BucketInfo `xml:">Bucket"`
+	ContinuationToken string          `xml:",omitempty"`
+}
+
+func s3writeXML(w http.ResponseWriter, r *http.Request, resp interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(resp); err != nil {
+		ctxlog.FromContext(r.Context()).WithError(err).Error("error writing xml response")
+	}
+}
+
 // Call fn on the given path (directory) and its contents, in
 // lexicographic order.
 //
@@ -315,25 +652,48 @@ func walkFS(fs arvados.CustomFileSystem, path string, isRoot bool, fn func(path
 
 var errDone = errors.New("done")
 
-func (h *handler) s3list(w http.ResponseWriter, r *http.Request, fs arvados.CustomFileSystem) {
+func (h *handler) s3list(w http.ResponseWriter, r *http.Request, fs arvados.CustomFileSystem, client *arvados.Client) {
 	var params struct {
-		bucket    string
-		delimiter string
-		marker    string
-		maxKeys   int
-		prefix    string
+		v2                bool
+		bucket            string
+		delimiter         string
+		marker            string
+		maxKeys           int
+		prefix            string
+		startAfter        string
+		continuationToken string
+		fetchOwner        bool
 	}
 	params.bucket = strings.SplitN(r.URL.Path[1:], "/", 2)[0]
 	params.delimiter = r.FormValue("delimiter")
-	params.marker = r.FormValue("marker")
 	if mk, _ := strconv.ParseInt(r.FormValue("max-keys"), 10, 64); mk > 0 && mk < s3MaxKeys {
 		params.maxKeys = int(mk)
 	} else {
 		params.maxKeys = s3MaxKeys
 	}
 	params.prefix = r.FormValue("prefix")
+	if r.FormValue("list-type") == "2" {
+		// ListObjectsV2. The continuation token is the
+		// (encoded) first key that hasn't been returned yet;
+		// it's used the same way as a V1 marker.
+		params.v2 = true
+		params.startAfter = r.FormValue("start-after")
+		params.fetchOwner = r.FormValue("fetch-owner") == "true"
+		params.continuationToken = r.FormValue("continuation-token")
+		if params.continuationToken != "" {
+			marker, err := base64.RawURLEncoding.DecodeString(params.continuationToken)
+			if err != nil {
+				http.Error(w, "invalid continuation token", http.StatusBadRequest)
+				return
+			}
+			params.marker = string(marker)
+		}
+	} else {
+		params.marker = r.FormValue("marker")
+	}
 
 	bucketdir := "by_id/" + params.bucket
+	projectBucket := strings.Contains(params.bucket, "-j7d0g-")
 	// walkpath is the directory (relative to bucketdir) we need
 	// to walk: the innermost directory that is guaranteed to
 	// contain all paths that have the requested prefix. Examples:
@@ -348,31 +708,9 @@ func (h *handler) s3list(w http.ResponseWriter, r *http.Request, fs arvados.Cust
 		walkpath = ""
 	}
 
-	type commonPrefix struct {
-		Prefix string
-	}
-	type listResp struct {
-		XMLName string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
-		s3.ListResp
-		// s3.ListResp marshals an empty tag when
-		// CommonPrefixes is nil, which confuses some clients.
-		// Fix by using this nested struct instead.
-		CommonPrefixes []commonPrefix
-		// Similarly, we need omitempty here, because an empty
-		// tag confuses some clients (e.g.,
-		// github.com/aws/aws-sdk-net never terminates its
-		// paging loop).
-		NextMarker string `xml:"NextMarker,omitempty"`
-	}
-	resp := listResp{
-		ListResp: s3.ListResp{
-			Name:      strings.SplitN(r.URL.Path[1:], "/", 2)[0],
-			Prefix:    params.prefix,
-			Delimiter: params.delimiter,
-			Marker:    params.marker,
-			MaxKeys:   params.maxKeys,
-		},
-	}
+	var contents []s3.Key
+	var isTruncated bool
+	var nextMarker string
 	commonPrefixes := map[string]bool{}
 	err := walkFS(fs, strings.TrimSuffix(bucketdir+"/"+walkpath, "/"), true, func(path string, fi os.FileInfo) error {
 		if path == bucketdir {
@@ -412,10 +750,21 @@ func (h *handler) s3list(w http.ResponseWriter, r *http.Request, fs arvados.Cust
 				return errDone
 			}
 		}
-		if path < params.marker || path < params.prefix {
+		if path < params.marker || path < params.prefix || path <= params.startAfter {
 			return nil
 		}
 		if fi.IsDir() && !h.Config.cluster.Collections.S3FolderObjects {
+			if projectBucket && params.delimiter != "" && strings.Count(path, "/") == 1 {
+				// A collection or subproject at
+				// the top level of a project
+				// bucket is listed as a common
+				// prefix even if it's empty, and
+				// without loading its contents.
+				if idx := strings.Index(path[len(params.prefix):], params.delimiter); idx >= 0 {
+					commonPrefixes[path[:len(params.prefix)+idx+1]] = true
+					return filepath.SkipDir
+				}
+			}
 			// Note we don't add anything to
 			// commonPrefixes here even if delimiter is
 			// "/". We descend into the directory, and
@@ -434,14 +783,12 @@ func (h *handler) s3list(w http.ResponseWriter, r *http.Request, fs arvados.Cust
 				return filepath.SkipDir
 			}
 		}
-		if len(resp.Contents)+len(commonPrefixes) >= params.maxKeys {
-			resp.IsTruncated = true
-			if params.delimiter != "" {
-				resp.NextMarker = path
-			}
+		if len(contents)+len(commonPrefixes) >= params.maxKeys {
+			isTruncated = true
+			nextMarker = path
 			return errDone
 		}
-		resp.Contents = append(resp.Contents, s3.Key{
+		contents = append(contents, s3.Key{
 			Key:          path,
 			LastModified: fi.ModTime().UTC().Format("2006-01-02T15:04:05.999") + "Z",
 			Size:         filesize,
@@ -452,16 +799,117 @@ func (h *handler) s3list(w http.ResponseWriter, r *http.Request, fs arvados.Cust
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	var prefixes []s3commonPrefix
 	if params.delimiter != "" {
-		resp.CommonPrefixes = make([]commonPrefix, 0, len(commonPrefixes))
+		prefixes = make([]s3commonPrefix, 0, len(commonPrefixes))
 		for prefix := range commonPrefixes {
-			resp.CommonPrefixes = append(resp.CommonPrefixes, commonPrefix{prefix})
+			prefixes = append(prefixes, s3commonPrefix{prefix})
 		}
-		sort.Slice(resp.CommonPrefixes, func(i, j int) bool { return resp.CommonPrefixes[i].Prefix < resp.CommonPrefixes[j].Prefix })
+		sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].Prefix < prefixes[j].Prefix })
 	}
-	w.Header().Set("Content-Type", "application/xml")
-	io.WriteString(w, xml.Header)
-	if err := xml.NewEncoder(w).Encode(resp); err != nil {
-		ctxlog.FromContext(r.Context()).WithError(err).Error("error writing xml response")
+
+	if !params.v2 {
+		resp := s3listResp{
+			ListResp: s3.ListResp{
+				Name:        params.bucket,
+				Prefix:      params.prefix,
+				Delimiter:   params.delimiter,
+				Marker:      params.marker,
+				MaxKeys:     params.maxKeys,
+				IsTruncated: isTruncated,
+				Contents:    contents,
+			},
+			CommonPrefixes: prefixes,
+		}
+		if params.delimiter != "" {
+			resp.NextMarker = nextMarker
+		}
+		s3writeXML(w, r, resp)
+		return
+	}
+
+	resp := s3listV2Resp{
+		Name:              params.bucket,
+		Prefix:            params.prefix,
+		Delimiter:         params.delimiter,
+		MaxKeys:           params.maxKeys,
+		KeyCount:          len(contents) + len(prefixes),
+		IsTruncated:       isTruncated,
+		ContinuationToken: params.continuationToken,
+		StartAfter:        params.startAfter,
+		CommonPrefixes:    prefixes,
+	}
+	if isTruncated {
+		resp.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(nextMarker))
+	}
+	var owner *s3.Owner
+	if params.fetchOwner {
+		uuid, err := s3bucketOwner(r.Context(), client, params.bucket)
+		if err != nil {
+			ctxlog.FromContext(r.Context()).WithError(err).Warn("error retrieving bucket owner")
+		} else {
+			owner = &s3.Owner{ID: uuid, DisplayName: uuid}
+		}
+	}
+	for _, key := range contents {
+		resp.Contents = append(resp.Contents, s3listV2Key{
+			Key:          key.Key,
+			LastModified: key.LastModified,
+			Size:         key.Size,
+			Owner:        owner,
+		})
+	}
+	s3writeXML(w, r, resp)
+}
+
+type s3commonPrefix struct {
+	Prefix string
+}
+
+type s3listResp struct {
+	XMLName string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	s3.ListResp
+	// s3.ListResp marshals an empty tag when
+	// CommonPrefixes is nil, which confuses some clients.
+	// Fix by using this nested struct instead.
+	CommonPrefixes []s3commonPrefix
+	// Similarly, we need omitempty here, because an empty
+	// tag confuses some clients (e.g.,
+	// github.com/aws/aws-sdk-net never terminates its
+	// paging loop).
+	NextMarker string `xml:"NextMarker,omitempty"`
+}
+
+type s3listV2Key struct {
+	Key          string
+	LastModified string
+	Size         int64
+	Owner        *s3.Owner `xml:",omitempty"`
+}
+
+type s3listV2Resp struct {
+	XMLName               string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	Contents              []s3listV2Key
+	CommonPrefixes        []s3commonPrefix
+}
+
+// s3bucketOwner returns the UUID of the user or project that owns
+// the objects in the given bucket: the owner of the collection, or
+// the project itself.
+func s3bucketOwner(ctx context.Context, client *arvados.Client, bucket string) (string, error) {
+	if len(bucket) == 27 && bucket[6:11] == "j7d0g" {
+		return bucket, nil
 	}
+	var coll arvados.Collection
+	err := client.RequestAndDecodeContext(ctx, &coll, "GET", "arvados/v1/collections/"+bucket, nil, arvados.GetOptions{Select: []string{"uuid", "owner_uuid"}})
+	return coll.OwnerUUID, err
 }
@@ -6,10 +6,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
@@ -21,6 +26,10 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
 	"github.com/AdRoll/goamz/aws"
 	"github.com/AdRoll/goamz/s3"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/defaults"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awss3v2 "github.com/aws/aws-sdk-go-v2/service/s3"
 	check "gopkg.in/check.v1"
 )
 
@@ -70,7 +79,7 @@ func (s *IntegrationSuite) s3setup(c *check.C) s3stage {
 	err = arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+coll.UUID, nil, nil)
 	c.Assert(err, check.IsNil)
 
-	auth := aws.NewAuth(arvadostest.ActiveTokenV2, arvadostest.ActiveTokenV2, "", time.Now().Add(time.Hour))
+	auth := aws.NewAuth(arvadostest.ActiveTokenV2, arvadostest.ActiveToken, "", time.Now().Add(time.Hour))
 	region := aws.Region{
 		Name:       s.testServer.Addr,
 		S3Endpoint: "http://" + s.testServer.Addr,
@@ -116,6 +125,38 @@ func (s *IntegrationSuite) TestS3HeadBucket(c *check.C) {
 	}
 }
 
+func (s *IntegrationSuite) TestS3SignatureCheck(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+
+	// Access key is the token UUID, secret key is the token
+	// secret.
+	client := s3.New(*aws.NewAuth(arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, "", time.Now().Add(time.Hour)), stage.collbucket.S3.Region)
+	bucket := &s3.Bucket{S3: client, Name: stage.coll.UUID}
+	buf, err := bucket.Get("sailboat.txt")
+	c.Check(err, check.IsNil)
+	c.Check(buf, check.DeepEquals, []byte("⛵\n"))
+
+	// Wrong secret key
+	client = s3.New(*aws.NewAuth(arvadostest.ActiveTokenUUID, arvadostest.SpectatorToken, "", time.Now().Add(time.Hour)), stage.collbucket.S3.Region)
+	bucket = &s3.Bucket{S3: client, Name: stage.coll.UUID}
+	_, err = bucket.Get("sailboat.txt")
+	c.Check(err, check.ErrorMatches, `403 Forbidden`)
+
+	// Presigned URL works without any other credentials, until
+	// it expires.
+	resp, err := http.Get(stage.collbucket.SignedURL("sailboat.txt", time.Now().Add(time.Minute)))
+	c.Assert(err, check.IsNil)
+	buf, err = ioutil.ReadAll(resp.Body)
+	c.Check(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Check(buf, check.DeepEquals, []byte("⛵\n"))
+
+	resp, err = http.Get(stage.collbucket.SignedURL("sailboat.txt", time.Now().Add(-time.Minute)))
+	c.Assert(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusForbidden)
+}
+
 func (s *IntegrationSuite) TestS3CollectionGetObject(c *check.C) {
 	stage := s.s3setup(c)
 	defer stage.teardown(c)
@@ -235,10 +276,6 @@ func (s *IntegrationSuite) TestS3ProjectPutObjectNotSupported(c *check.C) {
 			path:        "newfile",
 			size:        1234,
 			contentType: "application/octet-stream",
-		}, {
-			path:        "newdir/newfile",
-			size:        1234,
-			contentType: "application/octet-stream",
 		}, {
 			path:        "newdir2/",
 			size:        0,
@@ -261,6 +298,71 @@ func (s *IntegrationSuite) TestS3ProjectPutObjectNotSupported(c *check.C) {
 	}
 }
 
+func (s *IntegrationSuite) TestS3ProjectPutObjectCreatesCollection(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	bucket := stage.projbucket
+
+	countCollections := func(name string) int {
+		var resp arvados.CollectionList
+		err := stage.arv.RequestAndDecode(&resp, "GET", "arvados/v1/collections", nil, arvados.ResourceListParams{
+			Filters: []arvados.Filter{
+				{Attr: "owner_uuid", Operator: "=", Operand: stage.proj.UUID},
+				{Attr: "name", Operator: "=", Operand: name},
+			},
+		})
+		c.Assert(err, check.IsNil)
+		return len(resp.Items)
+	}
+
+	for _, path := range []string{"newcoll/newdir/newfile", "newcoll/newfile2"} {
+		err := bucket.PutReader(path, bytes.NewReader([]byte("foo")), 3, "application/octet-stream", s3.Private, s3.Options{})
+		c.Assert(err, check.IsNil)
+		buf, err := bucket.Get(path)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf), check.Equals, "foo")
+		c.Check(countCollections("newcoll"), check.Equals, 1)
+	}
+
+	// Invalid requests don't leave empty collections behind
+	_, err := bucket.PutCopy("badcoll/sailboat.txt", s3.Private, s3.CopyOptions{}, stage.coll.UUID+"/nonexistent.txt")
+	c.Check(err, check.ErrorMatches, `.*404.*`)
+	c.Check(countCollections("badcoll"), check.Equals, 0)
+	err = bucket.PutReader("badcoll/", bytes.NewReader(nil), 0, "application/x-directory", s3.Private, s3.Options{})
+	c.Check(err, check.NotNil)
+	c.Check(countCollections("badcoll"), check.Equals, 0)
+
+	_, err = bucket.PutCopy("copiedcoll/sailboat.txt", s3.Private, s3.CopyOptions{}, stage.coll.UUID+"/sailboat.txt")
+	c.Assert(err, check.IsNil)
+	buf, err := bucket.Get("copiedcoll/sailboat.txt")
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "⛵\n")
+	c.Check(countCollections("copiedcoll"), check.Equals, 1)
+
+	multi, err := bucket.InitMulti("multicoll/file", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	part, err := multi.PutPart(1, bytes.NewReader([]byte("bar")))
+	c.Assert(err, check.IsNil)
+	c.Assert(multi.Complete([]s3.Part{part}), check.IsNil)
+	buf, err = bucket.Get("multicoll/file")
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "bar")
+
+	// Collections are listed as common prefixes, even if empty
+	var emptycoll arvados.Collection
+	err = stage.arv.RequestAndDecode(&emptycoll, "POST", "arvados/v1/collections", nil, map[string]interface{}{"collection": map[string]interface{}{
+		"owner_uuid": stage.proj.UUID,
+		"name":       "emptycoll",
+	}})
+	c.Assert(err, check.IsNil)
+	for _, s.testServer.Config.cluster.Collections.S3FolderObjects = range []bool{false, true} {
+		resp, err := bucket.List("", "/", "", 1000)
+		c.Assert(err, check.IsNil)
+		c.Check(resp.Contents, check.HasLen, 0)
+		c.Check(resp.CommonPrefixes, check.DeepEquals, []string{"copiedcoll/", "emptycoll/", stage.coll.Name + "/", "multicoll/", "newcoll/"})
+	}
+}
+
 func (s *IntegrationSuite) TestS3CollectionDeleteObject(c *check.C) {
 	stage := s.s3setup(c)
 	defer stage.teardown(c)
@@ -620,3 +722,430 @@ func (s *IntegrationSuite) testS3CollectionListRollup(c *check.C) {
 		c.Logf("=== trial %+v keys %q prefixes %q nextMarker %q", trial, gotKeys, gotPrefixes, resp.NextMarker)
 	}
 }
+
+func (s *IntegrationSuite) TestS3CollectionMultipartUpload(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3MultipartUpload(c, stage.collbucket, "")
+}
+func (s *IntegrationSuite) TestS3ProjectMultipartUpload(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3MultipartUpload(c, stage.projbucket, stage.coll.Name+"/")
+}
+func (s *IntegrationSuite) testS3MultipartUpload(c *check.C, bucket *s3.Bucket, prefix string) {
+	objname := prefix + "newdir/multipart"
+	multi, err := bucket.InitMulti(objname, "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+
+	var expect []byte
+	var parts []s3.Part
+	for n, size := range []int{5 << 20, 5 << 20, 1234} {
+		buf := make([]byte, size)
+		rand.Read(buf)
+		expect = append(expect, buf...)
+		part, err := multi.PutPart(n+1, bytes.NewReader(buf))
+		c.Assert(err, check.IsNil)
+		c.Check(part.Size, check.Equals, int64(size))
+		parts = append(parts, part)
+	}
+	// Replace part 2
+	buf := make([]byte, 5<<20)
+	rand.Read(buf)
+	copy(expect[5<<20:], buf)
+	parts[1], err = multi.PutPart(2, bytes.NewReader(buf))
+	c.Assert(err, check.IsNil)
+
+	listed, err := multi.ListParts()
+	c.Assert(err, check.IsNil)
+	c.Check(listed, check.DeepEquals, parts)
+
+	// Object doesn't exist until the upload is completed
+	_, err = bucket.GetReader(objname)
+	c.Check(err, check.ErrorMatches, `404 Not Found`)
+
+	err = multi.Complete(parts)
+	c.Assert(err, check.IsNil)
+	rdr, err := bucket.GetReader(objname)
+	c.Assert(err, check.IsNil)
+	got, err := ioutil.ReadAll(rdr)
+	c.Check(err, check.IsNil)
+	c.Check(bytes.Equal(got, expect), check.Equals, true)
+
+	// Completed upload is gone
+	_, err = multi.ListParts()
+	c.Check(err, check.ErrorMatches, `.*404.*`)
+
+	// Aborted upload is gone, and doesn't create an object
+	multi, err = bucket.InitMulti(prefix+"aborted", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	_, err = multi.PutPart(1, bytes.NewReader([]byte("foo")))
+	c.Assert(err, check.IsNil)
+	err = multi.Abort()
+	c.Check(err, check.IsNil)
+	_, err = multi.ListParts()
+	c.Check(err, check.ErrorMatches, `.*404.*`)
+	_, err = bucket.GetReader(prefix + "aborted")
+	c.Check(err, check.ErrorMatches, `404 Not Found`)
+}
+
+func (s *IntegrationSuite) TestS3MultipartUploadInvalidParts(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	multi, err := stage.collbucket.InitMulti("multipart", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	defer multi.Abort()
+	part, err := multi.PutPart(1, bytes.NewReader([]byte("foo")))
+	c.Assert(err, check.IsNil)
+
+	part.ETag = `"acbd18db4cc2f85cedef654fccc4a4d9"`
+	err = multi.Complete([]s3.Part{part})
+	c.Check(err, check.ErrorMatches, `.*400.*`)
+
+	part.N = 2
+	err = multi.Complete([]s3.Part{part})
+	c.Check(err, check.ErrorMatches, `.*400.*`)
+
+	// Upload IDs are only valid for the key they were created for
+	other := *multi
+	other.Key = "othername"
+	_, err = other.ListParts()
+	c.Check(err, check.ErrorMatches, `.*404.*`)
+
+	// ...and the user who created them
+	other = *multi
+	other.Bucket = &s3.Bucket{
+		S3:   s3.New(*aws.NewAuth(arvadostest.SpectatorToken, arvadostest.SpectatorToken, "", time.Now().Add(time.Hour)), stage.collbucket.S3.Region),
+		Name: stage.collbucket.Name,
+	}
+	_, err = other.ListParts()
+	c.Check(err, check.ErrorMatches, `.*404.*`)
+
+	// The staging project is not visible to the caller
+	var upload arvados.Group
+	err = stage.arv.RequestAndDecode(&upload, "GET", "arvados/v1/groups/"+multi.UploadId, nil, nil)
+	c.Check(err, check.ErrorMatches, `.*404.*`)
+}
+
+func (s *IntegrationSuite) TestS3MultipartUploadConcurrentParts(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	multi, err := stage.collbucket.InitMulti("multipart", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	defer multi.Abort()
+
+	// Concurrent uploads of the same part number all succeed,
+	// and one of them wins.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := multi.PutPart(1, bytes.NewReader([]byte(fmt.Sprintf("data %d", i))))
+			c.Check(err, check.IsNil)
+		}(i)
+	}
+	wg.Wait()
+	parts, err := multi.ListParts()
+	c.Assert(err, check.IsNil)
+	c.Check(parts, check.HasLen, 1)
+	err = multi.Complete(parts)
+	c.Assert(err, check.IsNil)
+	rdr, err := stage.collbucket.GetReader("multipart")
+	c.Assert(err, check.IsNil)
+	got, err := ioutil.ReadAll(rdr)
+	c.Check(err, check.IsNil)
+	c.Check(string(got), check.Matches, `data [0-3]`)
+}
+
+func (s *IntegrationSuite) s3v2Client(c *check.C) *awss3v2.Client {
+	cfg := defaults.Config()
+	cfg.Region = "us-east-1"
+	cfg.EndpointResolver = awsv2.ResolveWithEndpointURL("http://" + s.testServer.Addr)
+	cfg.Credentials = awsv2.NewStaticCredentialsProvider(arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, "")
+	client := awss3v2.New(cfg)
+	client.ForcePathStyle = true
+	return client
+}
+
+func (s *IntegrationSuite) TestS3ListObjectsV2(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	stage.writeBigDirs(c, 2, 40)
+
+	v1, err := stage.collbucket.List("", "", "", 1000)
+	c.Assert(err, check.IsNil)
+	var expectKeys []string
+	for _, key := range v1.Contents {
+		expectKeys = append(expectKeys, key.Key)
+	}
+
+	client := s.s3v2Client(c)
+	var gotKeys []string
+	var token *string
+	for pages := 0; ; pages++ {
+		c.Assert(pages < 20, check.Equals, true)
+		resp, err := client.ListObjectsV2Request(&awss3v2.ListObjectsV2Input{
+			Bucket:            awsv2.String(stage.coll.UUID),
+			MaxKeys:           awsv2.Int64(7),
+			ContinuationToken: token,
+		}).Send(context.Background())
+		c.Assert(err, check.IsNil)
+		c.Check(len(resp.Contents) <= 7, check.Equals, true)
+		c.Check(*resp.KeyCount, check.Equals, int64(len(resp.Contents)))
+		for _, key := range resp.Contents {
+			gotKeys = append(gotKeys, *key.Key)
+			c.Check(key.Owner, check.IsNil)
+		}
+		if !*resp.IsTruncated {
+			c.Check(resp.NextContinuationToken, check.IsNil)
+			break
+		}
+		c.Assert(resp.NextContinuationToken, check.NotNil)
+		token = resp.NextContinuationToken
+	}
+	c.Check(gotKeys, check.DeepEquals, expectKeys)
+
+	resp, err := client.ListObjectsV2Request(&awss3v2.ListObjectsV2Input{
+		Bucket:     awsv2.String(stage.coll.UUID),
+		MaxKeys:    awsv2.Int64(2),
+		StartAfter: awsv2.String("dir0/file7.txt"),
+		FetchOwner: awsv2.Bool(true),
+	}).Send(context.Background())
+	c.Assert(err, check.IsNil)
+	if c.Check(resp.Contents, check.HasLen, 2) {
+		c.Check(*resp.Contents[0].Key, check.Equals, "dir0/file8.txt")
+		c.Check(*resp.Contents[1].Key, check.Equals, "dir0/file9.txt")
+		if c.Check(resp.Contents[0].Owner, check.NotNil) {
+			c.Check(*resp.Contents[0].Owner.ID, check.Equals, stage.proj.UUID)
+		}
+	}
+	c.Check(*resp.StartAfter, check.Equals, "dir0/file7.txt")
+
+	resp, err = client.ListObjectsV2Request(&awss3v2.ListObjectsV2Input{
+		Bucket:    awsv2.String(stage.coll.UUID),
+		Delimiter: awsv2.String("/"),
+	}).Send(context.Background())
+	c.Assert(err, check.IsNil)
+	var gotPrefixes []string
+	for _, prefix := range resp.CommonPrefixes {
+		gotPrefixes = append(gotPrefixes, *prefix.Prefix)
+	}
+	c.Check(gotPrefixes, check.DeepEquals, []string{"dir0/", "dir1/"})
+	c.Check(*resp.KeyCount, check.Equals, int64(len(resp.Contents)+2))
+}
+
+func (s *IntegrationSuite) TestS3ListBuckets(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	resp, err := stage.collbucket.S3.GetService()
+	c.Assert(err, check.IsNil)
+	c.Check(resp.Owner.ID, check.Equals, arvadostest.ActiveUserUUID)
+	found := map[string]bool{}
+	for _, bucket := range resp.Buckets {
+		found[bucket.Name] = true
+		c.Check(bucket.CreationDate, check.Matches, `\d{4}-\d\d-\d\dT.*Z`)
+	}
+	c.Check(found[stage.proj.UUID], check.Equals, true)
+	c.Check(found[stage.coll.UUID], check.Equals, true)
+	c.Check(found[arvadostest.AProjectUUID], check.Equals, true)
+	c.Check(len(found), check.Equals, len(resp.Buckets))
+}
+
+func (s *IntegrationSuite) TestS3ListBucketsPaging(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	resp, err := stage.collbucket.S3.GetService()
+	c.Assert(err, check.IsNil)
+	var expect []string
+	for _, bucket := range resp.Buckets {
+		expect = append(expect, bucket.Name)
+	}
+
+	signer := v4.NewSigner(awsv2.NewStaticCredentialsProvider(arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, ""))
+	emptySum := sha256.Sum256(nil)
+	var got []string
+	token := ""
+	for pages := 0; ; pages++ {
+		c.Assert(pages < len(expect), check.Equals, true)
+		req, err := http.NewRequest("GET", "http://"+s.testServer.Addr+"/?max-buckets=7&continuation-token="+url.QueryEscape(token), nil)
+		c.Assert(err, check.IsNil)
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(emptySum[:]))
+		err = signer.SignHTTP(context.Background(), req, hex.EncodeToString(emptySum[:]), "s3", "zzzzz", time.Now())
+		c.Assert(err, check.IsNil)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+		var page struct {
+			Buckets           []s3.BucketInfo `xml:"Buckets>Bucket"`
+			ContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		c.Assert(err, check.IsNil)
+		c.Check(len(page.Buckets) <= 7, check.Equals, true)
+		for _, bucket := range page.Buckets {
+			got = append(got, bucket.Name)
+		}
+		if page.ContinuationToken == "" {
+			break
+		}
+		token = page.ContinuationToken
+	}
+	c.Check(got, check.DeepEquals, expect)
+}
+
+func (s *IntegrationSuite) TestS3CopyObject(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+
+	// Copy within a collection
+	result, err := stage.collbucket.PutCopy("newdir/sailboat-copy.txt", s3.Private, s3.CopyOptions{}, stage.coll.UUID+"/sailboat.txt")
+	c.Assert(err, check.IsNil)
+	c.Check(result.ETag, check.Matches, `"[0-9a-f]{32}"`)
+	buf, err := stage.collbucket.Get("newdir/sailboat-copy.txt")
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "⛵\n")
+
+	// Copy from a collection to a collection in a project bucket
+	_, err = stage.projbucket.PutCopy(stage.coll.Name+"/sailboat 2.txt", s3.Private, s3.CopyOptions{}, stage.coll.UUID+"/newdir/sailboat-copy.txt")
+	c.Assert(err, check.IsNil)
+	buf, err = stage.collbucket.Get("sailboat 2.txt")
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "⛵\n")
+
+	// The data wasn't re-uploaded: the copies refer to the same block
+	var coll arvados.Collection
+	err = stage.arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.ManifestText, check.Matches, `(?ms).*^\. (\S+) .*^\./newdir \1 .*`)
+
+	_, err = stage.collbucket.PutCopy("nonexistent-copy", s3.Private, s3.CopyOptions{}, stage.coll.UUID+"/nonexistent")
+	c.Check(err, check.ErrorMatches, `.*404.*`)
+	_, err = stage.collbucket.PutCopy("emptydir-copy", s3.Private, s3.CopyOptions{}, stage.coll.UUID+"/emptydir")
+	c.Check(err, check.ErrorMatches, `.*404.*`)
+	_, err = stage.collbucket.PutCopy("emptydir", s3.Private, s3.CopyOptions{}, stage.coll.UUID+"/sailboat.txt")
+	c.Check(err, check.ErrorMatches, `.*400.*`)
+}
+
+func (s *IntegrationSuite) TestS3ObjectMetadata(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	err := stage.arv.RequestAndDecode(&stage.coll, "PUT", "arvados/v1/collections/"+stage.coll.UUID, nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"properties": map[string]interface{}{"color": "red"},
+		},
+	})
+	c.Assert(err, check.IsNil)
+
+	client := s.s3v2Client(c)
+	ctx := context.Background()
+	headMetadata := func(bucket, key string) map[string]string {
+		resp, err := client.HeadObjectRequest(&awss3v2.HeadObjectInput{
+			Bucket: awsv2.String(bucket),
+			Key:    awsv2.String(key),
+		}).Send(ctx)
+		c.Assert(err, check.IsNil)
+		md := map[string]string{}
+		for k, v := range resp.Metadata {
+			md[strings.ToLower(k)] = v
+		}
+		return md
+	}
+	getTags := func(bucket, key string) map[string]string {
+		resp, err := client.GetObjectTaggingRequest(&awss3v2.GetObjectTaggingInput{
+			Bucket: awsv2.String(bucket),
+			Key:    awsv2.String(key),
+		}).Send(ctx)
+		c.Assert(err, check.IsNil)
+		tags := map[string]string{}
+		for _, tag := range resp.TagSet {
+			tags[*tag.Key] = *tag.Value
+		}
+		return tags
+	}
+
+	_, err = client.PutObjectRequest(&awss3v2.PutObjectInput{
+		Bucket:   awsv2.String(stage.coll.UUID),
+		Key:      awsv2.String("meta/file"),
+		Body:     bytes.NewReader([]byte("foo")),
+		Metadata: map[string]string{"color": "blue", "owner": "me"},
+		Tagging:  awsv2.String("project=x"),
+	}).Send(ctx)
+	c.Assert(err, check.IsNil)
+	c.Check(headMetadata(stage.coll.UUID, "meta/file"), check.DeepEquals, map[string]string{"color": "blue", "owner": "me"})
+	c.Check(headMetadata(stage.coll.UUID, "sailboat.txt"), check.DeepEquals, map[string]string{})
+	c.Check(headMetadata(stage.proj.UUID, stage.coll.Name+"/meta/file"), check.DeepEquals, map[string]string{"color": "blue", "owner": "me"})
+	c.Check(getTags(stage.coll.UUID, "meta/file"), check.DeepEquals, map[string]string{"project": "x"})
+
+	_, err = client.PutObjectTaggingRequest(&awss3v2.PutObjectTaggingInput{
+		Bucket: awsv2.String(stage.coll.UUID),
+		Key:    awsv2.String("meta/file"),
+		Tagging: &awss3v2.Tagging{TagSet: []awss3v2.Tag{
+			{Key: awsv2.String("a"), Value: awsv2.String("b")},
+		}},
+	}).Send(ctx)
+	c.Assert(err, check.IsNil)
+	c.Check(getTags(stage.coll.UUID, "meta/file"), check.DeepEquals, map[string]string{"a": "b"})
+	c.Check(headMetadata(stage.coll.UUID, "meta/file"), check.DeepEquals, map[string]string{"color": "blue", "owner": "me"})
+
+	_, err = client.GetObjectTaggingRequest(&awss3v2.GetObjectTaggingInput{
+		Bucket: awsv2.String(stage.coll.UUID),
+		Key:    awsv2.String("nonexistent"),
+	}).Send(ctx)
+	c.Check(err, check.ErrorMatches, `(?ms).*404.*`)
+
+	// CopyObject copies metadata and tags by default
+	_, err = client.CopyObjectRequest(&awss3v2.CopyObjectInput{
+		Bucket:     awsv2.String(stage.coll.UUID),
+		Key:        awsv2.String("meta/copy"),
+		CopySource: awsv2.String(stage.coll.UUID + "/meta/file"),
+	}).Send(ctx)
+	c.Assert(err, check.IsNil)
+	c.Check(headMetadata(stage.coll.UUID, "meta/copy"), check.DeepEquals, map[string]string{"color": "blue", "owner": "me"})
+	c.Check(getTags(stage.coll.UUID, "meta/copy"), check.DeepEquals, map[string]string{"a": "b"})
+
+	_, err = client.CopyObjectRequest(&awss3v2.CopyObjectInput{
+		Bucket:            awsv2.String(stage.coll.UUID),
+		Key:               awsv2.String("meta/copy"),
+		CopySource:        awsv2.String(stage.coll.UUID + "/meta/file"),
+		MetadataDirective: awss3v2.MetadataDirectiveReplace,
+		Metadata:          map[string]string{"size": "small"},
+	}).Send(ctx)
+	c.Assert(err, check.IsNil)
+	c.Check(headMetadata(stage.coll.UUID, "meta/copy"), check.DeepEquals, map[string]string{"size": "small"})
+	c.Check(getTags(stage.coll.UUID, "meta/copy"), check.DeepEquals, map[string]string{"a": "b"})
+
+	// Metadata survives copying the collection
+	err = stage.arv.RequestAndDecode(&stage.coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	var copied arvados.Collection
+	err = stage.arv.RequestAndDecode(&copied, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"collection": map[string]interface{}{
+			"owner_uuid":    stage.proj.UUID,
+			"name":          stage.coll.Name,
+			"manifest_text": stage.coll.ManifestText,
+			"properties":    stage.coll.Properties,
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(headMetadata(copied.UUID, "meta/file"), check.DeepEquals, map[string]string{"color": "blue", "owner": "me"})
+	c.Check(getTags(copied.UUID, "meta/copy"), check.DeepEquals, map[string]string{"a": "b"})
+
+	// Deleting or replacing an object removes its metadata
+	_, err = client.DeleteObjectRequest(&awss3v2.DeleteObjectInput{
+		Bucket: awsv2.String(stage.coll.UUID),
+		Key:    awsv2.String("meta/file"),
+	}).Send(ctx)
+	c.Assert(err, check.IsNil)
+	_, err = client.PutObjectRequest(&awss3v2.PutObjectInput{
+		Bucket: awsv2.String(stage.coll.UUID),
+		Key:    awsv2.String("meta/copy"),
+		Body:   bytes.NewReader([]byte("bar")),
+	}).Send(ctx)
+	c.Assert(err, check.IsNil)
+	err = stage.arv.RequestAndDecode(&stage.coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(stage.coll.Properties, check.DeepEquals, map[string]interface{}{"color": "red"})
+}
@@ -0,0 +1,497 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+)
+
+const (
+	s3SignAlgorithm = "AWS4-HMAC-SHA256"
+	s3MaxClockSkew  = 5 * time.Minute
+	// Longest validity period AWS allows for a presigned URL.
+	s3MaxPresignExpiry = 7 * 24 * time.Hour
+	// Layout of timestamps in X-Amz-Date headers and query
+	// parameters (ISO 8601 basic format).
+	s3TimestampLayout = "20060102T150405Z"
+)
+
+var errS3ContentSHA256Mismatch = errors.New("request body does not match X-Amz-Content-Sha256 header")
+
+// Query parameters that are included in the resource part of a V2
+// signature ("sub-resources" in the AWS documentation).
+var s3V2SignedParams = map[string]bool{
+	"acl":                          true,
+	"cors":                         true,
+	"delete":                       true,
+	"lifecycle":                    true,
+	"location":                     true,
+	"logging":                      true,
+	"notification":                 true,
+	"partNumber":                   true,
+	"policy":                       true,
+	"requestPayment":               true,
+	"response-cache-control":       true,
+	"response-content-disposition": true,
+	"response-content-encoding":    true,
+	"response-content-language":    true,
+	"response-content-type":        true,
+	"response-expires":             true,
+	"restore":                      true,
+	"tagging":                      true,
+	"torrent":                      true,
+	"uploadId":                     true,
+	"uploads":                      true,
+	"versionId":                    true,
+	"versioning":                   true,
+	"versions":                     true,
+	"website":                      true,
+}
+
+func s3AuthError(status int, format string, args ...interface{}) error {
+	return httpserver.ErrorWithStatus(fmt.Errorf(format, args...), status)
+}
+
+// isS3Request returns true if r carries S3 credentials, either in an
+// Authorization header or in the query string of a presigned URL.
+func isS3Request(r *http.Request) bool {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "AWS ") || strings.HasPrefix(auth, s3SignAlgorithm+" ") {
+		return true
+	}
+	q := r.URL.Query()
+	return q.Get("X-Amz-Algorithm") != "" || q.Get("AWSAccessKeyId") != ""
+}
+
+// checkS3Signature verifies the V4 or V2 signature on an S3 request,
+// and returns the Arvados API token corresponding to the access key
+// it was signed with.
+//
+// If the signed payload hash is given in an X-Amz-Content-Sha256
+// header, r.Body is replaced with a reader that returns
+// errS3ContentSHA256Mismatch at EOF if the body doesn't match.
+func (h *handler) checkS3Signature(r *http.Request, now time.Time) (string, error) {
+	auth := r.Header.Get("Authorization")
+	q := r.URL.Query()
+	switch {
+	case strings.HasPrefix(auth, s3SignAlgorithm+" "):
+		return h.checkS3SignatureV4(r, now, false)
+	case strings.HasPrefix(auth, "AWS "):
+		return h.checkS3SignatureV2(r, now, false)
+	case q.Get("X-Amz-Algorithm") != "":
+		return h.checkS3SignatureV4(r, now, true)
+	case q.Get("AWSAccessKeyId") != "":
+		return h.checkS3SignatureV2(r, now, true)
+	default:
+		return "", s3AuthError(http.StatusUnauthorized, "no S3 credentials provided")
+	}
+}
+
+func (h *handler) checkS3SignatureV4(r *http.Request, now time.Time, presigned bool) (string, error) {
+	var credential, signedHeaders, signature, payloadHash string
+	var reqTime time.Time
+	var expires time.Duration
+	if presigned {
+		q := r.URL.Query()
+		if alg := q.Get("X-Amz-Algorithm"); alg != s3SignAlgorithm {
+			return "", s3AuthError(http.StatusBadRequest, "unsupported signature algorithm %q", alg)
+		}
+		credential = q.Get("X-Amz-Credential")
+		signedHeaders = q.Get("X-Amz-SignedHeaders")
+		signature = q.Get("X-Amz-Signature")
+		var err error
+		reqTime, err = time.Parse(s3TimestampLayout, q.Get("X-Amz-Date"))
+		if err != nil {
+			return "", s3AuthError(http.StatusBadRequest, "invalid X-Amz-Date parameter %q", q.Get("X-Amz-Date"))
+		}
+		secs, err := strconv.ParseInt(q.Get("X-Amz-Expires"), 10, 64)
+		expires = time.Duration(secs) * time.Second
+		if err != nil || secs < 1 || expires > s3MaxPresignExpiry {
+			return "", s3AuthError(http.StatusBadRequest, "invalid X-Amz-Expires parameter %q", q.Get("X-Amz-Expires"))
+		}
+		payloadHash = "UNSIGNED-PAYLOAD"
+	} else {
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), s3SignAlgorithm+" ")
+		for _, cmpt := range strings.Split(auth, ",") {
+			split := strings.SplitN(strings.TrimSpace(cmpt), "=", 2)
+			if len(split) != 2 {
+				continue
+			}
+			switch split[0] {
+			case "Credential":
+				credential = split[1]
+			case "SignedHeaders":
+				signedHeaders = split[1]
+			case "Signature":
+				signature = split[1]
+			}
+		}
+		var err error
+		if xamzdate := r.Header.Get("X-Amz-Date"); xamzdate != "" {
+			reqTime, err = time.Parse(s3TimestampLayout, xamzdate)
+		} else {
+			reqTime, err = s3ParseDate(r.Header.Get("Date"))
+		}
+		if err != nil {
+			return "", s3AuthError(http.StatusBadRequest, "missing or invalid X-Amz-Date/Date header")
+		}
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			return "", s3AuthError(http.StatusBadRequest, "missing X-Amz-Content-Sha256 header")
+		}
+		if strings.HasPrefix(payloadHash, "STREAMING-") {
+			// Chunked uploads with per-chunk signatures
+			// (Content-Encoding: aws-chunked) are not
+			// supported.
+			return "", s3AuthError(http.StatusNotImplemented, "X-Amz-Content-Sha256 %q is not supported: the client must send UNSIGNED-PAYLOAD or the SHA-256 of the request body", payloadHash)
+		}
+	}
+	if credential == "" || signedHeaders == "" || signature == "" {
+		return "", s3AuthError(http.StatusBadRequest, "malformed V4 authorization: credential, signed headers, and signature are all required")
+	}
+	if err := s3CheckTime(reqTime, now, expires); err != nil {
+		return "", err
+	}
+
+	// The access key can contain "/" (it might be a v2 token), so
+	// the scope is the last four fields of the credential.
+	cred := strings.Split(credential, "/")
+	if len(cred) < 5 {
+		return "", s3AuthError(http.StatusBadRequest, "malformed credential %q", credential)
+	}
+	key := strings.Join(cred[:len(cred)-4], "/")
+	scope := cred[len(cred)-4:]
+	if scope[0] != reqTime.UTC().Format("20060102") || scope[2] != "s3" || scope[3] != "aws4_request" {
+		return "", s3AuthError(http.StatusBadRequest, "invalid credential scope %q", strings.Join(scope, "/"))
+	}
+
+	canonicalRequest, err := s3CanonicalRequest(r, signedHeaders, payloadHash)
+	if err != nil {
+		return "", err
+	}
+	stringToSign := s3SignAlgorithm + "\n" +
+		reqTime.UTC().Format(s3TimestampLayout) + "\n" +
+		strings.Join(scope, "/") + "\n" +
+		hashdigest(sha256.New(), canonicalRequest)
+
+	secret, token, err := h.s3secret(r, key)
+	if err != nil {
+		return "", err
+	}
+	signingKey := []byte("AWS4" + secret)
+	for _, s := range scope {
+		signingKey = hmacsum(sha256.New, signingKey, s)
+	}
+	expect := hex.EncodeToString(hmacsum(sha256.New, signingKey, stringToSign))
+	if !hmac.Equal([]byte(expect), []byte(signature)) {
+		return "", s3AuthError(http.StatusForbidden, "signature does not match")
+	}
+
+	if len(payloadHash) == sha256.Size*2 && r.Body != nil {
+		want, err := hex.DecodeString(payloadHash)
+		if err != nil {
+			return "", s3AuthError(http.StatusBadRequest, "invalid X-Amz-Content-Sha256 header %q", payloadHash)
+		}
+		r.Body = &sha256CheckReader{ReadCloser: r.Body, hash: sha256.New(), want: want}
+	}
+	return token, nil
+}
+
+// s3CanonicalRequest returns the V4 canonical request for r.
+func s3CanonicalRequest(r *http.Request, signedHeaders, payloadHash string) (string, error) {
+	var canonicalHeaders string
+	hostSigned := false
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var value string
+		if name == "host" {
+			hostSigned = true
+			value = r.Host
+		} else {
+			value = strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")
+		}
+		canonicalHeaders += name + ":" + strings.Join(strings.Fields(value), " ") + "\n"
+	}
+	if !hostSigned {
+		return "", s3AuthError(http.StatusBadRequest, "signed headers must include host")
+	}
+
+	q, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return "", s3AuthError(http.StatusBadRequest, "invalid query string: %s", err)
+	}
+	var params [][2]string
+	for k, vs := range q {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			params = append(params, [2]string{s3escape(k, true), s3escape(v, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	var canonicalQuery []string
+	for _, kv := range params {
+		canonicalQuery = append(canonicalQuery, kv[0]+"="+kv[1])
+	}
+
+	return r.Method + "\n" +
+		s3escape(r.URL.Path, false) + "\n" +
+		strings.Join(canonicalQuery, "&") + "\n" +
+		canonicalHeaders + "\n" +
+		signedHeaders + "\n" +
+		payloadHash, nil
+}
+
+func (h *handler) checkS3SignatureV2(r *http.Request, now time.Time, presigned bool) (string, error) {
+	var key, signature, date string
+	if presigned {
+		q := r.URL.Query()
+		key = q.Get("AWSAccessKeyId")
+		signature = q.Get("Signature")
+		date = q.Get("Expires")
+		secs, err := strconv.ParseInt(date, 10, 64)
+		if err != nil {
+			return "", s3AuthError(http.StatusBadRequest, "invalid Expires parameter %q", date)
+		}
+		if exp := time.Unix(secs, 0); now.After(exp) {
+			return "", s3AuthError(http.StatusForbidden, "request has expired")
+		} else if exp.Sub(now) > s3MaxPresignExpiry+s3MaxClockSkew {
+			return "", s3AuthError(http.StatusBadRequest, "invalid Expires parameter %q: too far in the future", date)
+		}
+	} else {
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "AWS ")
+		cut := strings.LastIndex(auth, ":")
+		if cut < 0 {
+			return "", s3AuthError(http.StatusBadRequest, "malformed V2 authorization header")
+		}
+		key, signature = auth[:cut], auth[cut+1:]
+		var reqTime time.Time
+		var err error
+		if xamzdate := r.Header.Get("X-Amz-Date"); xamzdate != "" {
+			// When X-Amz-Date is given, it is signed
+			// along with the other x-amz-* headers, and
+			// the Date line is empty.
+			reqTime, err = s3ParseDate(xamzdate)
+		} else {
+			date = r.Header.Get("Date")
+			reqTime, err = s3ParseDate(date)
+		}
+		if err != nil {
+			return "", s3AuthError(http.StatusBadRequest, "missing or invalid X-Amz-Date/Date header")
+		}
+		if err := s3CheckTime(reqTime, now, 0); err != nil {
+			return "", err
+		}
+	}
+	if key == "" || signature == "" {
+		return "", s3AuthError(http.StatusBadRequest, "malformed V2 authorization: access key and signature are both required")
+	}
+
+	var amzHeaders []string
+	for k, vs := range r.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			amzHeaders = append(amzHeaders, k+":"+strings.Join(vs, ",")+"\n")
+		}
+	}
+	sort.Strings(amzHeaders)
+
+	var subresources []string
+	for k, vs := range r.URL.Query() {
+		if !s3V2SignedParams[k] {
+			continue
+		}
+		for _, v := range vs {
+			if v == "" {
+				subresources = append(subresources, k)
+			} else {
+				subresources = append(subresources, k+"="+v)
+			}
+		}
+	}
+	sort.Strings(subresources)
+	resource := r.URL.EscapedPath()
+	if len(subresources) > 0 {
+		resource += "?" + strings.Join(subresources, "&")
+	}
+
+	stringToSign := r.Method + "\n" +
+		r.Header.Get("Content-Md5") + "\n" +
+		r.Header.Get("Content-Type") + "\n" +
+		date + "\n" +
+		strings.Join(amzHeaders, "") +
+		resource
+
+	secret, token, err := h.s3secret(r, key)
+	if err != nil {
+		return "", err
+	}
+	expect := base64.StdEncoding.EncodeToString(hmacsum(sha1.New, []byte(secret), stringToSign))
+	if !hmac.Equal([]byte(expect), []byte(signature)) {
+		return "", s3AuthError(http.StatusForbidden, "signature does not match")
+	}
+	return token, nil
+}
+
+// s3ParseDate parses a Date or (V2) X-Amz-Date header. In addition to
+// the formats accepted by http.ParseTime, it accepts RFC 1123 with a
+// numeric time zone, which some clients send.
+func s3ParseDate(s string) (time.Time, error) {
+	t, err := http.ParseTime(s)
+	if err != nil {
+		t, err = time.Parse(time.RFC1123Z, s)
+	}
+	return t, err
+}
+
+// s3CheckTime returns an error if a request signed at reqTime is not
+// acceptable at time now. If expires is zero, reqTime must be within
+// s3MaxClockSkew of now. Otherwise, the request (a presigned URL)
+// is valid for the given duration after reqTime.
+func s3CheckTime(reqTime, now time.Time, expires time.Duration) error {
+	if reqTime.Sub(now) > s3MaxClockSkew {
+		return s3AuthError(http.StatusForbidden, "request time %s is too far in the future", reqTime.UTC().Format(time.RFC3339))
+	}
+	if expires > 0 {
+		if now.Sub(reqTime) > expires {
+			return s3AuthError(http.StatusForbidden, "request has expired")
+		}
+	} else if now.Sub(reqTime) > s3MaxClockSkew {
+		return s3AuthError(http.StatusForbidden, "request time %s is too skewed from server time", reqTime.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// s3secret returns the secret key that should have been used to sign
+// a request with the given access key, and the Arvados API token to
+// use for the request.
+//
+// The access key can be an API token UUID, or a complete v2 token
+// (with "_" in place of "/"). In either case the secret key is the
+// secret part of the token. Otherwise, the access key must be a v1
+// token, which is also its own secret key.
+func (h *handler) s3secret(r *http.Request, key string) (secret, token string, err error) {
+	if strings.HasPrefix(key, "v2_") || strings.HasPrefix(key, "v2/") {
+		key = strings.Replace(key, "_", "/", -1)
+		parts := strings.Split(key, "/")
+		if len(parts) != 3 || len(parts[1]) != 27 || parts[1][5:12] != "-gj3su-" || parts[2] == "" {
+			return "", "", s3AuthError(http.StatusForbidden, "invalid access key %q", key)
+		}
+		return parts[2], key, nil
+	}
+	if len(key) != 27 || key[5:12] != "-gj3su-" {
+		return key, key, nil
+	}
+	if h.Config.cluster.SystemRootToken == "" {
+		return "", "", s3AuthError(http.StatusForbidden, "access key %q is a token UUID, but token lookup is not enabled (SystemRootToken is not configured)", key)
+	}
+	aca, err := h.s3lookupAccessKey(r, key)
+	if err != nil {
+		return "", "", err
+	}
+	if aca.ExpiresAt != "" {
+		if exp, err := time.Parse(time.RFC3339Nano, aca.ExpiresAt); err == nil && exp.Before(time.Now()) {
+			return "", "", s3AuthError(http.StatusForbidden, "access key %q has expired", key)
+		}
+	}
+	return aca.APIToken, aca.TokenV2(), nil
+}
+
+// s3lookupAccessKey returns the API token with the given UUID, using
+// the cached result of a previous lookup if available.
+func (h *handler) s3lookupAccessKey(r *http.Request, key string) (*arvados.APIClientAuthorization, error) {
+	if aca := h.Config.Cache.lookupAccessKey(key); aca != nil {
+		return aca, nil
+	}
+	arv := h.clientPool.Get()
+	if arv == nil {
+		return nil, fmt.Errorf("client pool failed: %w", h.clientPool.Err())
+	}
+	defer h.clientPool.Put(arv)
+	client := (&arvados.Client{
+		APIHost:   arv.ApiServer,
+		AuthToken: h.Config.cluster.SystemRootToken,
+		Insecure:  arv.ApiInsecure,
+	}).WithRequestID(r.Header.Get("X-Request-Id"))
+	var aca arvados.APIClientAuthorization
+	err := client.RequestAndDecodeContext(r.Context(), &aca, "GET", "arvados/v1/api_client_authorizations/"+key, nil, nil)
+	if he, ok := err.(interface{ HTTPStatus() int }); ok && he.HTTPStatus() == http.StatusNotFound {
+		return nil, s3AuthError(http.StatusForbidden, "invalid access key %q", key)
+	} else if err != nil {
+		return nil, fmt.Errorf("error looking up access key %q: %w", key, err)
+	}
+	if aca.APIToken == "" {
+		return nil, fmt.Errorf("error looking up access key %q: no secret returned", key)
+	}
+	h.Config.Cache.storeAccessKey(key, &aca)
+	return &aca, nil
+}
+
+// s3escape URI-encodes s the way AWS V4 signatures require: every
+// byte except unreserved characters (and "/", unless encodeSlash is
+// true) is percent-encoded with uppercase hex digits.
+func s3escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && !encodeSlash) {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func hmacsum(h func() hash.Hash, key []byte, data string) []byte {
+	mac := hmac.New(h, key)
+	io.WriteString(mac, data)
+	return mac.Sum(nil)
+}
+
+func hashdigest(h hash.Hash, data string) string {
+	io.WriteString(h, data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sha256CheckReader returns errS3ContentSHA256Mismatch instead of
+// io.EOF if the data read from the wrapped reader doesn't have the
+// expected SHA-256 digest.
+type sha256CheckReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	want []byte
+}
+
+func (r *sha256CheckReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(r.hash.Sum(nil), r.want) {
+		err = errS3ContentSHA256Mismatch
+	}
+	return n, err
+}
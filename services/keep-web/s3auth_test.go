@@ -0,0 +1,277 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	check "gopkg.in/check.v1"
+)
+
+// s3authStub is a keep-web handler (with an API server stub that
+// knows arvadostest.ActiveTokenUUID) behind a test server that
+// reports the result of checkS3Signature for each request.
+type s3authStub struct {
+	h       *handler
+	api     *httptest.Server
+	srv     *httptest.Server
+	now     time.Time
+	token   string
+	err     error
+	body    string
+	bodyOK  bool
+	lookups int
+}
+
+func (s *UnitSuite) newS3AuthStub(c *check.C) *s3authStub {
+	stub := &s3authStub{}
+	stub.api = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		stub.lookups++
+		if req.Header.Get("Authorization") != "OAuth2 "+arvadostest.SystemRootToken {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else if req.URL.Path == "/arvados/v1/api_client_authorizations/"+arvadostest.ActiveTokenUUID {
+			json.NewEncoder(w).Encode(arvados.APIClientAuthorization{UUID: arvadostest.ActiveTokenUUID, APIToken: arvadostest.ActiveToken})
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	stub.h = &handler{Config: newConfig(s.Config)}
+	stub.h.Config.cluster.SystemRootToken = arvadostest.SystemRootToken
+	stub.h.Config.cluster.Services.Controller.ExternalURL = arvados.URL{Scheme: "https", Host: strings.TrimPrefix(stub.api.URL, "https://")}
+	stub.h.Config.cluster.TLS.Insecure = true
+	stub.h.setupOnce.Do(stub.h.setup)
+	stub.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		stub.token, stub.err = stub.h.checkS3Signature(req, stub.now)
+		if stub.err == nil {
+			buf, err := ioutil.ReadAll(req.Body)
+			stub.body, stub.bodyOK = string(buf), err == nil
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return stub
+}
+
+func (stub *s3authStub) Close() {
+	stub.srv.Close()
+	stub.api.Close()
+}
+
+func (stub *s3authStub) do(c *check.C, req *http.Request) {
+	stub.token, stub.err, stub.body, stub.bodyOK = "", nil, "", false
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+}
+
+func (stub *s3authStub) checkError(c *check.C, status int, pattern string) {
+	c.Assert(stub.err, check.NotNil)
+	c.Check(stub.err, check.ErrorMatches, pattern)
+	he, ok := stub.err.(interface{ HTTPStatus() int })
+	c.Assert(ok, check.Equals, true)
+	c.Check(he.HTTPStatus(), check.Equals, status)
+}
+
+func (s *UnitSuite) TestS3SignatureV4(c *check.C) {
+	stub := s.newS3AuthStub(c)
+	defer stub.Close()
+
+	sign := func(method, path, body, key, secret string, t time.Time) *http.Request {
+		req, err := http.NewRequest(method, stub.srv.URL+path, strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+		sum := sha256.Sum256([]byte(body))
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+		// Like the S3 client in aws-sdk-go, pass the path
+		// to the signer already escaped.
+		signer := v4.NewSigner(awsv2.NewStaticCredentialsProvider(key, secret, ""), func(s *v4.Signer) { s.DisableURIPathEscaping = true })
+		err = signer.SignHTTP(context.Background(), req, hex.EncodeToString(sum[:]), "s3", "zzzzz", t)
+		c.Assert(err, check.IsNil)
+		return req
+	}
+
+	t0 := time.Now().Truncate(time.Second)
+	stub.now = t0
+	for _, trial := range []struct {
+		key    string
+		secret string
+		token  string
+	}{
+		{arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, arvadostest.ActiveTokenV2},
+		{arvadostest.ActiveTokenV2, arvadostest.ActiveToken, arvadostest.ActiveTokenV2},
+		{strings.Replace(arvadostest.ActiveTokenV2, "/", "_", -1), arvadostest.ActiveToken, arvadostest.ActiveTokenV2},
+		{arvadostest.ActiveToken, arvadostest.ActiveToken, arvadostest.ActiveToken},
+	} {
+		c.Logf("trial %+v", trial)
+		stub.do(c, sign("PUT", "/zzzzz-4zz18-aaaaaaaaaaaaaaa/dir/file%20name%2Bx.txt?tagging=&a-b=c+d&a=z", "foo", trial.key, trial.secret, t0))
+		c.Check(stub.err, check.IsNil)
+		c.Check(stub.token, check.Equals, trial.token)
+		c.Check(stub.bodyOK, check.Equals, true)
+		c.Check(stub.body, check.Equals, "foo")
+
+		stub.do(c, sign("GET", "/zzzzz-4zz18-aaaaaaaaaaaaaaa/", "", trial.key, trial.secret+"x", t0))
+		stub.checkError(c, http.StatusForbidden, `signature does not match`)
+	}
+
+	// Tampering with the signed request
+	req := sign("GET", "/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo?max-keys=1", "", arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, t0)
+	req.URL.RawQuery = "max-keys=2"
+	stub.do(c, req)
+	stub.checkError(c, http.StatusForbidden, `signature does not match`)
+
+	// Body doesn't match the signed hash
+	req = sign("PUT", "/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo", "foo", arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, t0)
+	req.Body = ioutil.NopCloser(strings.NewReader("bar"))
+	stub.do(c, req)
+	c.Check(stub.err, check.IsNil)
+	c.Check(stub.bodyOK, check.Equals, false)
+
+	// Clock skew
+	stub.do(c, sign("GET", "/zzzzz-4zz18-aaaaaaaaaaaaaaa/", "", arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, t0.Add(-s3MaxClockSkew-time.Second)))
+	stub.checkError(c, http.StatusForbidden, `.* too skewed .*`)
+	stub.do(c, sign("GET", "/zzzzz-4zz18-aaaaaaaaaaaaaaa/", "", arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, t0.Add(s3MaxClockSkew+time.Second)))
+	stub.checkError(c, http.StatusForbidden, `.* too far in the future`)
+	stub.do(c, sign("GET", "/zzzzz-4zz18-aaaaaaaaaaaaaaa/", "", arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, t0.Add(s3MaxClockSkew-time.Second)))
+	c.Check(stub.err, check.IsNil)
+
+	// Token UUID lookups are cached
+	c.Check(stub.lookups, check.Equals, 1)
+
+	// A v2 token is not its own secret key
+	stub.do(c, sign("GET", "/zzzzz-4zz18-aaaaaaaaaaaaaaa/", "", arvadostest.ActiveTokenV2, arvadostest.ActiveTokenV2, t0))
+	stub.checkError(c, http.StatusForbidden, `signature does not match`)
+	stub.do(c, sign("GET", "/zzzzz-4zz18-aaaaaaaaaaaaaaa/", "", "v2_zzzzz-gj3su-077z32aux8dg2s1", "secret", t0))
+	stub.checkError(c, http.StatusForbidden, `invalid access key .*`)
+
+	// Unknown token UUID
+	stub.do(c, sign("GET", "/zzzzz-4zz18-aaaaaaaaaaaaaaa/", "", "zzzzz-gj3su-000000000000000", "secret", t0))
+	stub.checkError(c, http.StatusForbidden, `invalid access key .*`)
+
+	// Streaming (chunk-signed) payloads are not supported
+	req = sign("PUT", "/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo", "foo", arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, t0)
+	req.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	stub.do(c, req)
+	stub.checkError(c, http.StatusNotImplemented, `.*STREAMING-AWS4-HMAC-SHA256-PAYLOAD.* not supported.*`)
+
+	// Token UUID lookup disabled
+	stub.h.Config.cluster.SystemRootToken = ""
+	stub.do(c, sign("GET", "/zzzzz-4zz18-aaaaaaaaaaaaaaa/", "", arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, t0))
+	stub.checkError(c, http.StatusForbidden, `.*SystemRootToken is not configured.*`)
+}
+
+func (s *UnitSuite) TestS3SignatureV4Presigned(c *check.C) {
+	stub := s.newS3AuthStub(c)
+	defer stub.Close()
+
+	t0 := time.Now().Truncate(time.Second)
+	req, err := http.NewRequest("GET", stub.srv.URL+"/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo.txt?response-content-type=text%2Fplain", nil)
+	c.Assert(err, check.IsNil)
+	signer := v4.NewSigner(awsv2.NewStaticCredentialsProvider(arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, ""))
+	signedURL, _, err := signer.PresignHTTP(context.Background(), req, "UNSIGNED-PAYLOAD", "s3", "zzzzz", time.Hour, t0)
+	c.Assert(err, check.IsNil)
+	c.Check(signedURL, check.Matches, `.*X-Amz-Signature=.*`)
+
+	for _, trial := range []struct {
+		now   time.Time
+		url   string
+		match string
+	}{
+		{t0, signedURL, ""},
+		{t0.Add(59 * time.Minute), signedURL, ""},
+		{t0.Add(61 * time.Minute), signedURL, `request has expired`},
+		{t0.Add(-time.Hour), signedURL, `.* too far in the future`},
+		{t0, strings.Replace(signedURL, "foo.txt", "bar.txt", 1), `signature does not match`},
+		{t0, strings.Replace(signedURL, "X-Amz-Expires=3600", "X-Amz-Expires=7200", 1), `signature does not match`},
+		{t0, strings.Replace(signedURL, "X-Amz-Expires=3600", "X-Amz-Expires=999999", 1), `invalid X-Amz-Expires .*`},
+	} {
+		c.Logf("trial %+v", trial)
+		stub.now = trial.now
+		req, err := http.NewRequest("GET", trial.url, nil)
+		c.Assert(err, check.IsNil)
+		stub.do(c, req)
+		if trial.match == "" {
+			c.Check(stub.err, check.IsNil)
+			c.Check(stub.token, check.Equals, arvadostest.ActiveTokenV2)
+		} else {
+			c.Check(stub.err, check.ErrorMatches, trial.match)
+		}
+	}
+}
+
+func (s *UnitSuite) TestS3SignatureV2(c *check.C) {
+	stub := s.newS3AuthStub(c)
+	defer stub.Close()
+	stub.now = time.Now()
+
+	for _, trial := range []struct {
+		key    string
+		secret string
+		token  string
+	}{
+		{arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, arvadostest.ActiveTokenV2},
+		{arvadostest.ActiveTokenV2, arvadostest.ActiveToken, arvadostest.ActiveTokenV2},
+	} {
+		c.Logf("trial %+v", trial)
+		bucket := s3.New(*aws.NewAuth(trial.key, trial.secret, "", time.Now().Add(time.Hour)), aws.Region{
+			Name:       "zzzzz",
+			S3Endpoint: stub.srv.URL,
+		}).Bucket("zzzzz-4zz18-aaaaaaaaaaaaaaa")
+
+		err := bucket.Put("dir/file name+x.txt", []byte("foo"), "text/plain", s3.Private, s3.Options{ContentMD5: "rL0Y20zC+Fzt72VPzMSk2A=="})
+		c.Check(err, check.IsNil)
+		c.Check(stub.err, check.IsNil)
+		c.Check(stub.token, check.Equals, trial.token)
+
+		stub.do(c, mustNewRequest(c, "GET", bucket.SignedURLWithArgs("foo.txt", time.Now().Add(time.Hour), url.Values{"response-content-type": {"text/plain"}, "other": {"x"}}, nil)))
+		c.Check(stub.err, check.IsNil)
+
+		stub.do(c, mustNewRequest(c, "GET", bucket.SignedURL("foo.txt", time.Now().Add(time.Hour))))
+		c.Check(stub.err, check.IsNil)
+		c.Check(stub.token, check.Equals, trial.token)
+
+		stub.do(c, mustNewRequest(c, "GET", strings.Replace(bucket.SignedURL("foo.txt", time.Now().Add(time.Hour)), "foo.txt", "bar.txt", 1)))
+		stub.checkError(c, http.StatusForbidden, `signature does not match`)
+
+		stub.do(c, mustNewRequest(c, "GET", bucket.SignedURL("foo.txt", time.Now().Add(-time.Minute))))
+		stub.checkError(c, http.StatusForbidden, `request has expired`)
+	}
+
+	// Wrong secret
+	bucket := s3.New(*aws.NewAuth(arvadostest.ActiveTokenUUID, arvadostest.ActiveTokenV2, "", time.Now().Add(time.Hour)), aws.Region{
+		Name:       "zzzzz",
+		S3Endpoint: stub.srv.URL,
+	}).Bucket("zzzzz-4zz18-aaaaaaaaaaaaaaa")
+	bucket.Get("foo.txt")
+	stub.checkError(c, http.StatusForbidden, `signature does not match`)
+
+	// Clock skew
+	stub.now = time.Now().Add(s3MaxClockSkew + time.Minute)
+	bucket.Get("foo.txt")
+	stub.checkError(c, http.StatusForbidden, `.* too skewed .*`)
+}
+
+func (s *UnitSuite) TestS3Escape(c *check.C) {
+	c.Check(s3escape("/foo/bar baz+~._-/ø", false), check.Equals, "/foo/bar%20baz%2B~._-/%C3%B8")
+	c.Check(s3escape("a/b=c&d", true), check.Equals, "a%2Fb%3Dc%26d")
+}
+
+func mustNewRequest(c *check.C, method, url string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	c.Assert(err, check.IsNil)
+	return req
+}
@@ -0,0 +1,391 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+)
+
+// S3 object metadata (x-amz-meta-* headers) and tags are stored in
+// the properties of the collection that contains the object, under
+// s3MetadataProperty:
+//
+//	"s3_object_metadata": {
+//	  "path/to/file": {
+//	    "metadata": {"color": "blue"},
+//	    "tags": {"project": "x"}
+//	  }
+//	}
+//
+// Paths are relative to the root of the collection, so the metadata
+// stays with the files when the collection (including its
+// properties) is copied.
+//
+// The collection's other properties, and the properties of a
+// project used as a bucket, are reported as bucket-level metadata:
+// they appear as x-amz-meta-* headers in HeadBucket responses.
+// HeadObject and GetObject responses include only the object's own
+// metadata.
+const (
+	s3MetadataProperty = "s3_object_metadata"
+	s3MetadataPrefix   = "X-Amz-Meta-"
+
+	s3MaxTags           = 10
+	s3MaxTagKeyLength   = 128
+	s3MaxTagValueLength = 256
+)
+
+var errS3NoSuchKey = httpserver.ErrorWithStatus(errors.New("NoSuchKey: the specified key does not exist"), http.StatusNotFound)
+
+type s3objectMetadata struct {
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+type s3tag struct {
+	Key   string
+	Value string
+}
+
+type s3tagging struct {
+	XMLName string  `xml:"http://s3.amazonaws.com/doc/2006-03-01/ Tagging"`
+	TagSet  []s3tag `xml:"TagSet>Tag"`
+}
+
+// s3loadObjectMetadata returns the per-object metadata stored in
+// the given collection's properties.
+func s3loadObjectMetadata(coll *arvados.Collection) (map[string]s3objectMetadata, error) {
+	all := map[string]s3objectMetadata{}
+	prop, ok := coll.Properties[s3MetadataProperty]
+	if !ok {
+		return all, nil
+	}
+	buf, err := json.Marshal(prop)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, &all)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s property in collection %s: %w", s3MetadataProperty, coll.UUID, err)
+	}
+	return all, nil
+}
+
+// s3updateObjectMetadata calls update with the per-object metadata
+// of the collection containing the given object, and the object's
+// path within the collection. If update changes anything, the
+// collection's properties are updated accordingly.
+//
+// Concurrent updates to the same collection can overwrite one
+// another, because the API does not support updating a single key
+// in a properties hash.
+func (h *handler) s3updateObjectMetadata(r *http.Request, client *arvados.Client, bucket, key string, update func(all map[string]s3objectMetadata, path string)) error {
+	coll, path, err := h.s3objectCollection(r, client, bucket, key, false)
+	if err != nil {
+		return err
+	}
+	all, err := s3loadObjectMetadata(coll)
+	if err != nil {
+		return err
+	}
+	before, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	update(all, path)
+	for path, md := range all {
+		if len(md.Metadata) == 0 && len(md.Tags) == 0 {
+			delete(all, path)
+		}
+	}
+	after, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	if string(before) == string(after) {
+		return nil
+	}
+	props := map[string]interface{}{}
+	for k, v := range coll.Properties {
+		props[k] = v
+	}
+	if len(all) == 0 {
+		delete(props, s3MetadataProperty)
+	} else {
+		props[s3MetadataProperty] = all
+	}
+	err = client.RequestAndDecodeContext(r.Context(), nil, "PUT", "arvados/v1/collections/"+coll.UUID, nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"properties": props,
+		},
+		"select": []string{"uuid"},
+	})
+	if err != nil {
+		return fmt.Errorf("error updating metadata: %w", err)
+	}
+	return nil
+}
+
+// s3metadataFromHeaders returns the x-amz-meta-* headers in the given
+// request header, with lowercase keys and the prefix removed.
+func s3metadataFromHeaders(header http.Header) map[string]string {
+	md := map[string]string{}
+	for k, v := range header {
+		if strings.HasPrefix(k, s3MetadataPrefix) && len(k) > len(s3MetadataPrefix) {
+			md[strings.ToLower(k[len(s3MetadataPrefix):])] = strings.Join(v, ",")
+		}
+	}
+	return md
+}
+
+// s3setMetadataHeaders adds an x-amz-meta-* header to w for each
+// entry in md that can be represented in an HTTP header. Values
+// that aren't strings are JSON-encoded.
+func s3setMetadataHeaders(w http.ResponseWriter, md map[string]interface{}) {
+	for k, v := range md {
+		s, ok := v.(string)
+		if !ok {
+			buf, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			s = string(buf)
+		}
+		if !s3validHeaderName(k) || !s3validHeaderValue(s) {
+			continue
+		}
+		w.Header().Set(s3MetadataPrefix+k, s)
+	}
+}
+
+func s3validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > '~' || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+func s3validHeaderValue(s string) bool {
+	for _, c := range s {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// s3fsCollection returns the collection containing the given key,
+// as loaded by fs, and the key's path within the collection. dir is
+// the directory in fs that corresponds to the bucket.
+//
+// Unlike s3objectCollection, this doesn't make any API calls, so it
+// should be used when fs has already been used to find the object.
+func s3fsCollection(fs arvados.FileSystem, dir, key string) (*arvados.Collection, string, error) {
+	names := strings.Split(key, "/")
+	for i := 0; i <= len(names); i++ {
+		fi, err := fs.Stat(strings.Join(append([]string{dir}, names[:i]...), "/"))
+		if os.IsNotExist(err) {
+			return nil, "", errS3NoSuchKey
+		} else if err != nil {
+			return nil, "", err
+		}
+		if coll, ok := fi.Sys().(*arvados.Collection); ok {
+			return coll, strings.Join(names[i:], "/"), nil
+		}
+	}
+	return nil, "", errS3NoSuchKey
+}
+
+// s3serveObjectMetadata adds x-amz-meta-* headers for the given
+// object's own metadata to w. It also adds an x-amz-tagging-count
+// header if the object has tags. Errors are logged, but otherwise
+// ignored, so a problem with metadata doesn't prevent the object from
+// being retrieved.
+func (h *handler) s3serveObjectMetadata(w http.ResponseWriter, r *http.Request, fs arvados.FileSystem, bucket, key string) {
+	coll, path, err := s3fsCollection(fs, "by_id/"+bucket, key)
+	if err == nil {
+		var all map[string]s3objectMetadata
+		all, err = s3loadObjectMetadata(coll)
+		if err == nil {
+			md := map[string]interface{}{}
+			for k, v := range all[path].Metadata {
+				md[k] = v
+			}
+			s3setMetadataHeaders(w, md)
+			if n := len(all[path].Tags); n > 0 {
+				w.Header().Set("X-Amz-Tagging-Count", strconv.Itoa(n))
+			}
+		}
+	}
+	if err != nil {
+		ctxlog.FromContext(r.Context()).WithError(err).Warn("error retrieving object metadata")
+	}
+}
+
+// s3serveBucketMetadata adds x-amz-meta-* headers to w for the
+// properties of the given bucket (project or collection).
+func (h *handler) s3serveBucketMetadata(w http.ResponseWriter, r *http.Request, client *arvados.Client, bucket string) {
+	var props map[string]interface{}
+	var err error
+	if strings.Contains(bucket, "-j7d0g-") {
+		var proj arvados.Group
+		err = client.RequestAndDecodeContext(r.Context(), &proj, "GET", "arvados/v1/groups/"+bucket, nil, arvados.GetOptions{Select: []string{"uuid", "properties"}})
+		props = proj.Properties
+	} else {
+		var coll arvados.Collection
+		err = client.RequestAndDecodeContext(r.Context(), &coll, "GET", "arvados/v1/collections/"+bucket, nil, arvados.GetOptions{Select: []string{"uuid", "properties"}})
+		props = map[string]interface{}{}
+		for k, v := range coll.Properties {
+			if k != s3MetadataProperty {
+				props[k] = v
+			}
+		}
+	}
+	if err != nil {
+		ctxlog.FromContext(r.Context()).WithError(err).Warn("error retrieving bucket metadata")
+		return
+	}
+	s3setMetadataHeaders(w, props)
+}
+
+// s3parseTagging parses the value of an x-amz-tagging header
+// ("key1=value1&key2=value2").
+func s3parseTagging(header string) (map[string]string, error) {
+	values, err := url.ParseQuery(header)
+	if err != nil {
+		return nil, httpserver.ErrorWithStatus(fmt.Errorf("InvalidArgument: invalid x-amz-tagging header: %w", err), http.StatusBadRequest)
+	}
+	var tags []s3tag
+	for k, v := range values {
+		if len(v) != 1 {
+			return nil, httpserver.ErrorWithStatus(fmt.Errorf("InvalidTag: duplicate tag key %q", k), http.StatusBadRequest)
+		}
+		tags = append(tags, s3tag{Key: k, Value: v[0]})
+	}
+	return s3tagsToMap(tags)
+}
+
+// s3tagsToMap checks the given tags against the S3 limits, and
+// returns them as a map.
+func s3tagsToMap(tags []s3tag) (map[string]string, error) {
+	if len(tags) > s3MaxTags {
+		return nil, httpserver.ErrorWithStatus(fmt.Errorf("BadRequest: object tags cannot be greater than %d", s3MaxTags), http.StatusBadRequest)
+	}
+	m := map[string]string{}
+	for _, tag := range tags {
+		if tag.Key == "" || len(tag.Key) > s3MaxTagKeyLength || len(tag.Value) > s3MaxTagValueLength {
+			return nil, httpserver.ErrorWithStatus(fmt.Errorf("InvalidTag: invalid tag key or value %q", tag.Key), http.StatusBadRequest)
+		}
+		if _, dup := m[tag.Key]; dup {
+			return nil, httpserver.ErrorWithStatus(fmt.Errorf("InvalidTag: duplicate tag key %q", tag.Key), http.StatusBadRequest)
+		}
+		m[tag.Key] = tag.Value
+	}
+	return m, nil
+}
+
+// s3objectMetadataFromRequest returns the metadata and tags given in
+// the headers of a PutObject, CopyObject, or CreateMultipartUpload
+// request.
+func s3objectMetadataFromRequest(r *http.Request) (s3objectMetadata, error) {
+	md := s3objectMetadata{Metadata: s3metadataFromHeaders(r.Header)}
+	if hdr := r.Header.Get("X-Amz-Tagging"); hdr != "" {
+		tags, err := s3parseTagging(hdr)
+		if err != nil {
+			return md, err
+		}
+		md.Tags = tags
+	}
+	return md, nil
+}
+
+// s3objectTagging handles GetObjectTagging, PutObjectTagging, and
+// DeleteObjectTagging.
+func (h *handler) s3objectTagging(w http.ResponseWriter, r *http.Request, fs arvados.CustomFileSystem, client *arvados.Client) {
+	fspath := "by_id" + r.URL.Path
+	if fi, err := fs.Stat(fspath); os.IsNotExist(err) || (err != nil && err.Error() == "not a directory") || (err == nil && fi.IsDir()) {
+		s3error(w, errS3NoSuchKey)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	bucket, key := s3bucketKey(r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		coll, path, err := h.s3objectCollection(r, client, bucket, key, false)
+		if err != nil {
+			s3error(w, err)
+			return
+		}
+		all, err := s3loadObjectMetadata(coll)
+		if err != nil {
+			s3error(w, err)
+			return
+		}
+		resp := s3tagging{TagSet: []s3tag{}}
+		for k, v := range all[path].Tags {
+			resp.TagSet = append(resp.TagSet, s3tag{Key: k, Value: v})
+		}
+		sort.Slice(resp.TagSet, func(i, j int) bool { return resp.TagSet[i].Key < resp.TagSet[j].Key })
+		s3writeXML(w, r, resp)
+	case http.MethodPut:
+		var req struct {
+			TagSet []s3tag `xml:"TagSet>Tag"`
+		}
+		err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req)
+		if err != nil {
+			http.Error(w, "MalformedXML: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		tags, err := s3tagsToMap(req.TagSet)
+		if err != nil {
+			s3error(w, err)
+			return
+		}
+		err = h.s3updateObjectMetadata(r, client, bucket, key, func(all map[string]s3objectMetadata, path string) {
+			md := all[path]
+			md.Tags = tags
+			all[path] = md
+		})
+		if err != nil {
+			s3error(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		err := h.s3updateObjectMetadata(r, client, bucket, key, func(all map[string]s3objectMetadata, path string) {
+			md := all[path]
+			md.Tags = nil
+			all[path] = md
+		})
+		if err != nil {
+			s3error(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestS3MetadataFromHeaders(c *check.C) {
+	req := mustNewRequest(c, "PUT", "https://example/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo")
+	req.Header.Set("x-amz-meta-Color", "blue")
+	req.Header.Add("X-Amz-Meta-Size", "large")
+	req.Header.Add("X-Amz-Meta-Size", "heavy")
+	req.Header.Set("X-Amz-Meta-", "empty key")
+	req.Header.Set("X-Amz-Tagging", "project=x&empty=")
+	req.Header.Set("Content-Type", "text/plain")
+	md, err := s3objectMetadataFromRequest(req)
+	c.Check(err, check.IsNil)
+	c.Check(md.Metadata, check.DeepEquals, map[string]string{"color": "blue", "size": "large,heavy"})
+	c.Check(md.Tags, check.DeepEquals, map[string]string{"project": "x", "empty": ""})
+}
+
+func (s *UnitSuite) TestS3Tagging(c *check.C) {
+	for _, trial := range []struct {
+		header string
+		err    string
+	}{
+		{"a=b&c=d", ""},
+		{"a=b&a=d", `InvalidTag: duplicate tag key "a"`},
+		{"=b", `InvalidTag: .*`},
+		{"a=" + strings.Repeat("x", 257), `InvalidTag: .*`},
+		{"a=%zz", `InvalidArgument: .*`},
+		{"1&2&3&4&5&6&7&8&9&10&11", `BadRequest: object tags cannot be greater than 10`},
+	} {
+		_, err := s3parseTagging(trial.header)
+		if trial.err == "" {
+			c.Check(err, check.IsNil)
+		} else if c.Check(err, check.NotNil, check.Commentf("%q", trial.header)) {
+			c.Check(err, check.ErrorMatches, trial.err)
+			c.Check(err.(interface{ HTTPStatus() int }).HTTPStatus(), check.Equals, http.StatusBadRequest)
+		}
+	}
+}
+
+func (s *UnitSuite) TestS3SetMetadataHeaders(c *check.C) {
+	w := httptest.NewRecorder()
+	s3setMetadataHeaders(w, map[string]interface{}{
+		"color":       "blue",
+		"count":       float64(3),
+		"list":        []interface{}{"a", "b"},
+		"has space":   "skipped",
+		"multiline":   "skip\nthis",
+		"Mixed-Case":  "ok",
+		"empty-value": "",
+	})
+	c.Check(w.Header(), check.DeepEquals, http.Header{
+		"X-Amz-Meta-Color":       {"blue"},
+		"X-Amz-Meta-Count":       {"3"},
+		"X-Amz-Meta-List":        {`["a","b"]`},
+		"X-Amz-Meta-Mixed-Case":  {"ok"},
+		"X-Amz-Meta-Empty-Value": {""},
+	})
+}
+
+func (s *UnitSuite) TestS3LoadObjectMetadata(c *check.C) {
+	all, err := s3loadObjectMetadata(&arvados.Collection{})
+	c.Check(err, check.IsNil)
+	c.Check(all, check.HasLen, 0)
+
+	all, err = s3loadObjectMetadata(&arvados.Collection{Properties: map[string]interface{}{
+		"other": "value",
+		s3MetadataProperty: map[string]interface{}{
+			"dir/file": map[string]interface{}{
+				"metadata": map[string]interface{}{"color": "blue"},
+				"tags":     map[string]interface{}{"project": "x"},
+			},
+		},
+	}})
+	c.Check(err, check.IsNil)
+	c.Check(all, check.DeepEquals, map[string]s3objectMetadata{
+		"dir/file": {
+			Metadata: map[string]string{"color": "blue"},
+			Tags:     map[string]string{"project": "x"},
+		},
+	})
+
+	_, err = s3loadObjectMetadata(&arvados.Collection{UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa", Properties: map[string]interface{}{
+		s3MetadataProperty: "bogus",
+	}})
+	c.Check(err, check.ErrorMatches, `invalid s3_object_metadata property in collection zzzzz-4zz18-aaaaaaaaaaaaaaa: .*`)
+}
+
+func (s *UnitSuite) TestS3FSCollection(c *check.C) {
+	coll := &arvados.Collection{
+		UUID:         "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+		ManifestText: "./dir d41d8cd98f00b204e9800998ecf8427e+0 0:0:file\n",
+		Properties:   map[string]interface{}{"color": "red"},
+	}
+	fs, err := coll.FileSystem(nil, s3keepClientStub{})
+	c.Assert(err, check.IsNil)
+
+	got, path, err := s3fsCollection(fs, ".", "dir/file")
+	c.Check(err, check.IsNil)
+	c.Check(got, check.Equals, coll)
+	c.Check(path, check.Equals, "dir/file")
+
+	_, _, err = s3fsCollection(fs, "missing", "file")
+	c.Check(err, check.Equals, errS3NoSuchKey)
+}
@@ -0,0 +1,553 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+)
+
+// Multipart uploads are staged in a project owned by the system user
+// (using SystemRootToken), so they don't appear in the caller's home
+// project. The project UUID is used as the UploadId, and the caller's
+// user UUID is saved in its properties so other users can't use or
+// see it. Each part is saved as a collection in that project.
+// CompleteMultipartUpload splices the parts' data into the target
+// collection without copying any blocks, and then trashes the
+// staging project. The staging project's trash_at is set when the
+// upload is created, so abandoned uploads are cleaned up by the API
+// server after Collections.S3MultipartUploadTTL.
+//
+// Block signatures are replaced when part data moves between the
+// caller's token and the system token, using BlobSigningKey.
+const (
+	s3MaxPartNumber = 10000
+	s3MaxParts      = 1000
+
+	s3UploadBucketProperty = "s3_multipart_upload_bucket"
+	s3UploadKeyProperty    = "s3_multipart_upload_key"
+	s3UploadMetaProperty   = "s3_multipart_upload_metadata"
+	s3UploadUserProperty   = "s3_multipart_upload_user"
+	s3PartNumberProperty   = "s3_part_number"
+	s3PartETagProperty     = "s3_part_etag"
+)
+
+var errS3NoSuchUpload = httpserver.ErrorWithStatus(errors.New("NoSuchUpload: the specified multipart upload does not exist"), http.StatusNotFound)
+
+type s3initiateMultipartUploadResult struct {
+	XMLName  string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type s3part struct {
+	PartNumber   int
+	LastModified string `xml:",omitempty"`
+	ETag         string
+	Size         int64 `xml:",omitempty"`
+}
+
+type s3listPartsResult struct {
+	XMLName              string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket               string
+	Key                  string
+	UploadId             string
+	PartNumberMarker     int
+	NextPartNumberMarker int
+	MaxParts             int
+	IsTruncated          bool
+	Part                 []s3part
+}
+
+type s3completeMultipartUpload struct {
+	Part []s3part
+}
+
+type s3completeMultipartUploadResult struct {
+	XMLName  string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+// serveS3Multipart handles the multipart upload API calls. It returns
+// false if r is not a multipart upload request.
+func (h *handler) serveS3Multipart(w http.ResponseWriter, r *http.Request, fs arvados.CustomFileSystem, client *arvados.Client, kc *keepclient.KeepClient) bool {
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	uploadID := q.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && uploads:
+		h.s3CreateMultipartUpload(w, r, client)
+	case uploadID == "":
+		return false
+	case r.Method == http.MethodPut:
+		h.s3UploadPart(w, r, client, kc, uploadID)
+	case r.Method == http.MethodGet:
+		h.s3ListParts(w, r, client, uploadID)
+	case r.Method == http.MethodPost:
+		h.s3CompleteMultipartUpload(w, r, fs, client, kc, uploadID)
+	case r.Method == http.MethodDelete:
+		h.s3AbortMultipartUpload(w, r, client, uploadID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+	return true
+}
+
+func (h *handler) s3CreateMultipartUpload(w http.ResponseWriter, r *http.Request, client *arvados.Client) {
+	ttl := h.Config.cluster.Collections.S3MultipartUploadTTL.Duration()
+	if ttl <= 0 {
+		http.Error(w, "multipart uploads are disabled", http.StatusNotImplemented)
+		return
+	}
+	bucket, key := s3bucketKey(r.URL.Path)
+	if strings.HasSuffix(key, "/") {
+		http.Error(w, "invalid object name: trailing slash", http.StatusBadRequest)
+		return
+	}
+	md, err := s3objectMetadataFromRequest(r)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	root, err := h.s3rootClient(client)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	var user arvados.User
+	err = client.RequestAndDecodeContext(r.Context(), &user, "GET", "arvados/v1/users/current", nil, nil)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	now := time.Now()
+	var upload arvados.Group
+	err = root.RequestAndDecodeContext(r.Context(), &upload, "POST", "arvados/v1/groups", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"group": map[string]interface{}{
+			"group_class": "project",
+			"name":        "S3 multipart upload " + now.UTC().Format(time.RFC3339),
+			"trash_at":    now.Add(ttl).UTC(),
+			"properties": map[string]interface{}{
+				s3UploadBucketProperty: bucket,
+				s3UploadKeyProperty:    key,
+				s3UploadMetaProperty:   md,
+				s3UploadUserProperty:   user.UUID,
+			},
+		},
+	})
+	if err != nil {
+		s3error(w, fmt.Errorf("error creating upload: %w", err))
+		return
+	}
+	s3writeXML(w, r, s3initiateMultipartUploadResult{
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: upload.UUID,
+	})
+}
+
+func (h *handler) s3UploadPart(w http.ResponseWriter, r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, uploadID string) {
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxPartNumber {
+		http.Error(w, fmt.Sprintf("invalid partNumber (must be an integer between 1 and %d)", s3MaxPartNumber), http.StatusBadRequest)
+		return
+	}
+	bucket, key := s3bucketKey(r.URL.Path)
+	_, root, err := h.s3getUpload(r, client, uploadID, bucket, key)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	if h.s3quotaExceeded(r, client) {
+		http.Error(w, errQuotaExceeded.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Write the part data to a new (unsaved) collection, so it
+	// gets stored in Keep blocks the same way as a regular PUT.
+	cfs, err := (&arvados.Collection{}).FileSystem(client, kc)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	f, err := cfs.OpenFile("data", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	defer f.Close()
+	hash := md5.New()
+	_, err = io.Copy(f, io.TeeReader(r.Body, hash))
+	if errors.Is(err, errS3ContentSHA256Mismatch) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("write part failed: %s", err), http.StatusBadGateway)
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("write part failed: close: %s", err), http.StatusBadGateway)
+		return
+	}
+	sum := hash.Sum(nil)
+	if want := r.Header.Get("Content-Md5"); want != "" && want != base64.StdEncoding.EncodeToString(sum) {
+		http.Error(w, "BadDigest: Content-MD5 does not match the data received", http.StatusBadRequest)
+		return
+	}
+	manifest, err := cfs.MarshalManifest(".")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("write part failed: %s", err), http.StatusBadGateway)
+		return
+	}
+
+	etag := hex.EncodeToString(sum)
+	attrs := map[string]interface{}{
+		"owner_uuid":    uploadID,
+		"name":          s3partName(partNumber),
+		"manifest_text": h.s3signManifest(manifest, root.AuthToken),
+		"properties": map[string]interface{}{
+			s3PartNumberProperty: partNumber,
+			s3PartETagProperty:   etag,
+		},
+	}
+	for attempt := 0; ; attempt++ {
+		var parts []arvados.Collection
+		parts, err = s3listPartCollections(r, root, uploadID, []arvados.Filter{{Attr: "name", Operator: "=", Operand: s3partName(partNumber)}}, []string{"uuid"})
+		if err != nil {
+			s3error(w, err)
+			return
+		}
+		if len(parts) > 0 {
+			// Uploading a part number that was already
+			// uploaded replaces the previous data.
+			err = root.RequestAndDecodeContext(r.Context(), nil, "PUT", "arvados/v1/collections/"+parts[0].UUID, nil, map[string]interface{}{"collection": attrs})
+			break
+		}
+		err = root.RequestAndDecodeContext(r.Context(), nil, "POST", "arvados/v1/collections", nil, map[string]interface{}{"collection": attrs})
+		if err == nil || attempt > 0 {
+			break
+		}
+		// Creating the part collection fails if another
+		// request uploaded the same part number after we
+		// listed the parts. Try again, replacing that
+		// part's data with ours.
+	}
+	if err != nil {
+		s3error(w, fmt.Errorf("error saving part: %w", err))
+		return
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handler) s3ListParts(w http.ResponseWriter, r *http.Request, client *arvados.Client, uploadID string) {
+	bucket, key := s3bucketKey(r.URL.Path)
+	_, root, err := h.s3getUpload(r, client, uploadID, bucket, key)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	resp := s3listPartsResult{
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: uploadID,
+		MaxParts: s3MaxParts,
+	}
+	if mp, _ := strconv.Atoi(r.FormValue("max-parts")); mp > 0 && mp < s3MaxParts {
+		resp.MaxParts = mp
+	}
+	resp.PartNumberMarker, _ = strconv.Atoi(r.FormValue("part-number-marker"))
+
+	parts, err := s3listPartCollections(r, root, uploadID, nil, []string{"uuid", "name", "properties", "modified_at", "file_size_total"})
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	for _, coll := range parts {
+		part, ok := s3partFromCollection(coll)
+		if !ok || part.PartNumber <= resp.PartNumberMarker {
+			continue
+		}
+		if len(resp.Part) >= resp.MaxParts {
+			resp.IsTruncated = true
+			break
+		}
+		resp.Part = append(resp.Part, part)
+		resp.NextPartNumberMarker = part.PartNumber
+	}
+	s3writeXML(w, r, resp)
+}
+
+func (h *handler) s3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request, fs arvados.CustomFileSystem, client *arvados.Client, kc *keepclient.KeepClient, uploadID string) {
+	bucket, key := s3bucketKey(r.URL.Path)
+	upload, root, err := h.s3getUpload(r, client, uploadID, bucket, key)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	var req s3completeMultipartUpload
+	err = xml.NewDecoder(io.LimitReader(r.Body, 1<<22)).Decode(&req)
+	if err != nil {
+		http.Error(w, "MalformedXML: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Part) == 0 {
+		http.Error(w, "MalformedXML: no parts specified", http.StatusBadRequest)
+		return
+	}
+	for i, part := range req.Part {
+		if i > 0 && part.PartNumber <= req.Part[i-1].PartNumber {
+			http.Error(w, "InvalidPartOrder: part numbers must be in ascending order", http.StatusBadRequest)
+			return
+		}
+	}
+
+	parts, err := s3listPartCollections(r, root, uploadID, nil, []string{"uuid", "name", "properties", "manifest_text"})
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	byNumber := map[int]arvados.Collection{}
+	for _, coll := range parts {
+		if part, ok := s3partFromCollection(coll); ok {
+			byNumber[part.PartNumber] = coll
+		}
+	}
+	var manifest strings.Builder
+	var etags []string
+	for _, part := range req.Part {
+		coll, ok := byNumber[part.PartNumber]
+		etag := strings.Trim(part.ETag, `"`)
+		if !ok || coll.Properties[s3PartETagProperty] != etag {
+			http.Error(w, fmt.Sprintf("InvalidPart: part %d not found or ETag does not match", part.PartNumber), http.StatusBadRequest)
+			return
+		}
+		manifest.WriteString(coll.ManifestText)
+		etags = append(etags, etag)
+	}
+	etag, err := s3multipartETag(etags)
+	if err != nil {
+		http.Error(w, "InvalidPart: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Each part's manifest has a single file called "data" in
+	// the top level stream, so the concatenated manifest has a
+	// single file "data" with the parts' content in order.
+	tmpfs, err := (&arvados.Collection{ManifestText: h.s3signManifest(manifest.String(), client.AuthToken)}).FileSystem(client, kc)
+	if err != nil {
+		s3error(w, fmt.Errorf("error loading parts: %w", err))
+		return
+	}
+	subtree, err := arvados.Snapshot(tmpfs, "data")
+	if err != nil {
+		s3error(w, fmt.Errorf("error loading parts: %w", err))
+		return
+	}
+
+	err = h.s3ensureCollection(r, client)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	err = s3spliceObject(fs, "by_id"+r.URL.Path, subtree)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	// Apply the metadata and tags given when the upload was
+	// created.
+	var md s3objectMetadata
+	if buf, err := json.Marshal(upload.Properties[s3UploadMetaProperty]); err == nil {
+		json.Unmarshal(buf, &md)
+	}
+	err = h.s3updateObjectMetadata(r, client, bucket, key, func(all map[string]s3objectMetadata, path string) {
+		all[path] = md
+	})
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+
+	err = root.RequestAndDecodeContext(r.Context(), nil, "DELETE", "arvados/v1/groups/"+uploadID, nil, nil)
+	if err != nil {
+		// The upload will still be cleaned up when its
+		// trash_at time arrives.
+		ctxlog.FromContext(r.Context()).WithError(err).WithField("uploadID", uploadID).Warn("error deleting completed multipart upload")
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	s3writeXML(w, r, s3completeMultipartUploadResult{
+		Location: (&url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path}).String(),
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     `"` + etag + `"`,
+	})
+}
+
+func (h *handler) s3AbortMultipartUpload(w http.ResponseWriter, r *http.Request, client *arvados.Client, uploadID string) {
+	bucket, key := s3bucketKey(r.URL.Path)
+	_, root, err := h.s3getUpload(r, client, uploadID, bucket, key)
+	if err != nil {
+		s3error(w, err)
+		return
+	}
+	err = root.RequestAndDecodeContext(r.Context(), nil, "DELETE", "arvados/v1/groups/"+uploadID, nil, nil)
+	if err != nil {
+		s3error(w, fmt.Errorf("error deleting upload: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// s3getUpload returns the staging project for the given upload ID,
+// and a client that can access it. It returns errS3NoSuchUpload if
+// the upload doesn't exist, belongs to a different bucket/key, or was
+// created by a different user.
+func (h *handler) s3getUpload(r *http.Request, client *arvados.Client, uploadID, bucket, key string) (*arvados.Group, *arvados.Client, error) {
+	if len(uploadID) != 27 || uploadID[5:12] != "-j7d0g-" {
+		return nil, nil, errS3NoSuchUpload
+	}
+	root, err := h.s3rootClient(client)
+	if err != nil {
+		return nil, nil, err
+	}
+	var user arvados.User
+	err = client.RequestAndDecodeContext(r.Context(), &user, "GET", "arvados/v1/users/current", nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var upload arvados.Group
+	err = root.RequestAndDecodeContext(r.Context(), &upload, "GET", "arvados/v1/groups/"+uploadID, nil, arvados.GetOptions{Select: []string{"uuid", "properties"}})
+	if he, ok := err.(interface{ HTTPStatus() int }); ok && he.HTTPStatus() == http.StatusNotFound {
+		return nil, nil, errS3NoSuchUpload
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("error retrieving upload: %w", err)
+	}
+	if upload.Properties[s3UploadBucketProperty] != bucket || upload.Properties[s3UploadKeyProperty] != key || upload.Properties[s3UploadUserProperty] != user.UUID {
+		return nil, nil, errS3NoSuchUpload
+	}
+	return &upload, root, nil
+}
+
+// s3rootClient returns a copy of client that uses the cluster's
+// SystemRootToken, for accessing multipart upload staging projects.
+func (h *handler) s3rootClient(client *arvados.Client) (*arvados.Client, error) {
+	if h.Config.cluster.SystemRootToken == "" {
+		return nil, httpserver.ErrorWithStatus(errors.New("multipart uploads are not enabled (SystemRootToken is not configured)"), http.StatusNotImplemented)
+	}
+	root := *client
+	root.AuthToken = h.Config.cluster.SystemRootToken
+	return &root, nil
+}
+
+// s3signManifest returns the given manifest with its block locators
+// signed for the given token, replacing any existing signatures.
+func (h *handler) s3signManifest(manifest, token string) string {
+	ttl := h.Config.cluster.Collections.BlobSigningTTL.Duration()
+	return arvados.SignManifest(manifest, token, time.Now().Add(ttl), ttl, []byte(h.Config.cluster.Collections.BlobSigningKey))
+}
+
+// s3listPartCollections returns all of the part collections in the
+// given upload that match the given filters, in part number order.
+func s3listPartCollections(r *http.Request, client *arvados.Client, uploadID string, filters []arvados.Filter, sel []string) ([]arvados.Collection, error) {
+	filters = append([]arvados.Filter{{Attr: "owner_uuid", Operator: "=", Operand: uploadID}}, filters...)
+	var parts []arvados.Collection
+	for {
+		var page arvados.CollectionList
+		err := client.RequestAndDecodeContext(r.Context(), &page, "GET", "arvados/v1/collections", nil, arvados.ResourceListParams{
+			Select:  sel,
+			Filters: filters,
+			Order:   "name",
+			Offset:  len(parts),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing parts: %w", err)
+		}
+		parts = append(parts, page.Items...)
+		if len(page.Items) == 0 || len(parts) >= page.ItemsAvailable {
+			return parts, nil
+		}
+	}
+}
+
+// s3partFromCollection returns the part number, ETag, size, and
+// modification time of the given part collection. It returns false if
+// coll is not a valid part collection.
+func s3partFromCollection(coll arvados.Collection) (s3part, bool) {
+	n, ok := coll.Properties[s3PartNumberProperty].(float64)
+	etag, ok2 := coll.Properties[s3PartETagProperty].(string)
+	if !ok || !ok2 || n < 1 || n > s3MaxPartNumber || coll.Name != s3partName(int(n)) {
+		return s3part{}, false
+	}
+	part := s3part{
+		PartNumber: int(n),
+		ETag:       `"` + etag + `"`,
+		Size:       coll.FileSizeTotal,
+	}
+	if !coll.ModifiedAt.IsZero() {
+		part.LastModified = coll.ModifiedAt.UTC().Format("2006-01-02T15:04:05.999") + "Z"
+	}
+	return part, true
+}
+
+func s3partName(partNumber int) string {
+	return fmt.Sprintf("part %05d", partNumber)
+}
+
+// s3multipartETag returns the ETag of a completed multipart upload
+// with the given part ETags: the MD5 digest of the concatenated
+// binary MD5 digests of the parts, followed by "-" and the number of
+// parts. This is the same as the ETag Amazon S3 reports, which some
+// clients use to verify uploads.
+func s3multipartETag(partETags []string) (string, error) {
+	var buf bytes.Buffer
+	for _, etag := range partETags {
+		sum, err := hex.DecodeString(etag)
+		if err != nil || len(sum) != md5.Size {
+			return "", fmt.Errorf("invalid part ETag %q", etag)
+		}
+		buf.Write(sum)
+	}
+	return fmt.Sprintf("%x-%d", md5.Sum(buf.Bytes()), len(partETags)), nil
+}
+
+// s3bucketKey splits an S3 request path "/bucket/key" into bucket and
+// key.
+func s3bucketKey(path string) (bucket, key string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	bucket = parts[0]
+	if len(parts) > 1 {
+		key = parts[1]
+	}
+	return
+}
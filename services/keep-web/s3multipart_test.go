@@ -0,0 +1,113 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestS3MultipartETag(c *check.C) {
+	etag, err := s3multipartETag([]string{"acbd18db4cc2f85cedef654fccc4a4d8", "37b51d194a7513e45b56f6524f2d51f2"})
+	c.Check(err, check.IsNil)
+	c.Check(etag, check.Equals, "0105fcbc9eea8193de8e1834677b6c6b-2")
+
+	_, err = s3multipartETag([]string{"acbd18db4cc2f85cedef654fccc4a4d8", "37b51d19"})
+	c.Check(err, check.ErrorMatches, `invalid part ETag .*`)
+}
+
+func (s *UnitSuite) TestS3BucketKey(c *check.C) {
+	for _, trial := range []struct {
+		path   string
+		bucket string
+		key    string
+	}{
+		{"/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo", "zzzzz-4zz18-aaaaaaaaaaaaaaa", "foo"},
+		{"/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo/bar", "zzzzz-4zz18-aaaaaaaaaaaaaaa", "foo/bar"},
+		{"/zzzzz-j7d0g-aaaaaaaaaaaaaaa/", "zzzzz-j7d0g-aaaaaaaaaaaaaaa", ""},
+		{"/zzzzz-j7d0g-aaaaaaaaaaaaaaa", "zzzzz-j7d0g-aaaaaaaaaaaaaaa", ""},
+	} {
+		bucket, key := s3bucketKey(trial.path)
+		c.Check(bucket, check.Equals, trial.bucket, check.Commentf("%q", trial.path))
+		c.Check(key, check.Equals, trial.key, check.Commentf("%q", trial.path))
+	}
+}
+
+func (s *UnitSuite) TestS3PartFromCollection(c *check.C) {
+	part, ok := s3partFromCollection(arvados.Collection{
+		Name:          s3partName(12),
+		FileSizeTotal: 3,
+		Properties: map[string]interface{}{
+			s3PartNumberProperty: float64(12),
+			s3PartETagProperty:   "acbd18db4cc2f85cedef654fccc4a4d8",
+		},
+	})
+	c.Check(ok, check.Equals, true)
+	c.Check(part, check.DeepEquals, s3part{PartNumber: 12, ETag: `"acbd18db4cc2f85cedef654fccc4a4d8"`, Size: 3})
+
+	for _, coll := range []arvados.Collection{
+		{Name: "part 00012"},
+		{Name: "part 00013", Properties: map[string]interface{}{s3PartNumberProperty: float64(12), s3PartETagProperty: "acbd18db4cc2f85cedef654fccc4a4d8"}},
+		{Name: "part 00000", Properties: map[string]interface{}{s3PartNumberProperty: float64(0), s3PartETagProperty: "acbd18db4cc2f85cedef654fccc4a4d8"}},
+	} {
+		_, ok = s3partFromCollection(coll)
+		c.Check(ok, check.Equals, false, check.Commentf("%+v", coll))
+	}
+}
+
+// s3keepClientStub satisfies the collection filesystem's Keep client
+// interface without storing or retrieving any data.
+type s3keepClientStub struct{}
+
+func (s3keepClientStub) ReadAt(string, []byte, int) (int, error) {
+	return 0, errors.New("not implemented")
+}
+func (s3keepClientStub) PutB([]byte) (string, int, error) {
+	return "", 0, errors.New("not implemented")
+}
+func (s3keepClientStub) LocalLocator(locator string) (string, error) { return locator, nil }
+
+// Concatenating the part manifests yields a single file whose
+// content can be spliced into the target collection without copying
+// any data.
+func (s *UnitSuite) TestS3MultipartSplice(c *check.C) {
+	parts := ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:data\n" +
+		". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:data\n" +
+		". d41d8cd98f00b204e9800998ecf8427e+0 0:0:data\n"
+	tmpfs, err := (&arvados.Collection{ManifestText: parts}).FileSystem(nil, s3keepClientStub{})
+	c.Assert(err, check.IsNil)
+	subtree, err := arvados.Snapshot(tmpfs, "data")
+	c.Assert(err, check.IsNil)
+	c.Check(subtree.Size(), check.Equals, int64(6))
+
+	fs, err := (&arvados.Collection{ManifestText: ". d41d8cd98f00b204e9800998ecf8427e+0 0:0:existing\n"}).FileSystem(nil, s3keepClientStub{})
+	c.Assert(err, check.IsNil)
+	c.Assert(fs.Mkdir("dir", 0755), check.IsNil)
+	c.Assert(arvados.Splice(fs, "dir/multipart", subtree), check.IsNil)
+	mtxt, err := fs.MarshalManifest(".")
+	c.Assert(err, check.IsNil)
+	c.Check(mtxt, check.Equals, ". d41d8cd98f00b204e9800998ecf8427e+0 0:0:existing\n"+
+		"./dir acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:6:multipart\n")
+}
+
+func (s *UnitSuite) TestS3SubtreeETag(c *check.C) {
+	fs, err := (&arvados.Collection{ManifestText: ". acbd18db4cc2f85cedef654fccc4a4d8+3+Aabcdef@12345678 37b51d194a7513e45b56f6524f2d51f2+3 0:3:foo 3:3:bar\n"}).FileSystem(nil, s3keepClientStub{})
+	c.Assert(err, check.IsNil)
+	foo, err := arvados.Snapshot(fs, "foo")
+	c.Assert(err, check.IsNil)
+	bar, err := arvados.Snapshot(fs, "bar")
+	c.Assert(err, check.IsNil)
+
+	etag, err := s3subtreeETag(foo, &keepclient.KeepClient{})
+	c.Check(err, check.IsNil)
+	c.Check(etag, check.Equals, `"`+strings.Split(arvados.PortableDataHash(". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:data\n"), "+")[0]+`"`)
+	etag2, err := s3subtreeETag(bar, &keepclient.KeepClient{})
+	c.Check(err, check.IsNil)
+	c.Check(etag2, check.Not(check.Equals), etag)
+}
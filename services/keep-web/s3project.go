@@ -0,0 +1,139 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// s3objectCollection returns the collection (with uuid and
+// properties) that contains the object with the given key, and the
+// object's path relative to the collection root.
+//
+// If bucket is a project, the leading components of key are
+// subproject names followed by a collection name, as in the site
+// filesystem. In that case, if create is true and the named
+// collection does not exist, it is created in the innermost project
+// -- unless key names the collection itself (like "name/"), rather
+// than a path inside it.
+func (h *handler) s3objectCollection(r *http.Request, client *arvados.Client, bucket, key string, create bool) (*arvados.Collection, string, error) {
+	if !strings.Contains(bucket, "-j7d0g-") {
+		var coll arvados.Collection
+		err := client.RequestAndDecodeContext(r.Context(), &coll, "GET", "arvados/v1/collections/"+bucket, nil, arvados.GetOptions{Select: []string{"uuid", "properties"}})
+		if err != nil {
+			return nil, "", err
+		}
+		return &coll, key, nil
+	}
+	parent := bucket
+	for {
+		cut := strings.Index(key, "/")
+		if cut < 0 {
+			return nil, "", errS3NoSuchKey
+		}
+		name := key[:cut]
+		key = key[cut+1:]
+		item, err := h.s3projectItem(r, client, parent, name)
+		if err != nil {
+			return nil, "", err
+		}
+		if item == nil && create && key != "" {
+			item, err = h.s3createCollection(r, client, parent, name)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		if item == nil {
+			return nil, "", errS3NoSuchKey
+		}
+		if strings.Contains(item.UUID, "-4zz18-") {
+			return item, key, nil
+		}
+		parent = item.UUID
+	}
+}
+
+// s3projectItem returns the collection or subproject with the given
+// (filesystem) name in the given project, or nil if there is no such
+// item. Names are matched the same way as the site filesystem's
+// project directories (see projectsLoadOne in the Go SDK), so an S3
+// key refers to the same collection as the corresponding path in
+// the by_id/{project} directory.
+func (h *handler) s3projectItem(r *http.Request, client *arvados.Client, project, name string) (*arvados.Collection, error) {
+	var contents arvados.CollectionList
+	fsns := h.Config.cluster.Collections.ForwardSlashNameSubstitution
+	for _, subst := range []string{"/", fsns} {
+		contents = arvados.CollectionList{}
+		err := client.RequestAndDecodeContext(r.Context(), &contents, "GET", "arvados/v1/groups/"+project+"/contents", nil, arvados.ResourceListParams{
+			Count:  "none",
+			Select: []string{"uuid", "properties"},
+			Filters: []arvados.Filter{
+				{Attr: "name", Operator: "=", Operand: strings.Replace(name, subst, "/", -1)},
+				{Attr: "uuid", Operator: "is_a", Operand: []string{"arvados#collection", "arvados#group"}},
+				{Attr: "groups.group_class", Operator: "=", Operand: "project"},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(contents.Items) > 0 || fsns == "" || fsns == "/" || !strings.Contains(name, fsns) {
+			break
+		}
+		// As in projectsLoadOne, try again with "/" in place
+		// of the substitution string.
+	}
+	if len(contents.Items) == 0 {
+		return nil, nil
+	}
+	return &contents.Items[0], nil
+}
+
+// s3createCollection creates an empty collection with the given name
+// in the given project. If another request creates a collection with
+// the same name first, that collection is returned instead.
+func (h *handler) s3createCollection(r *http.Request, client *arvados.Client, project, name string) (*arvados.Collection, error) {
+	var coll arvados.Collection
+	err := client.RequestAndDecodeContext(r.Context(), &coll, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"owner_uuid": project,
+			"name":       name,
+		},
+		"select": []string{"uuid", "properties"},
+	})
+	if err != nil {
+		if item, err2 := h.s3projectItem(r, client, project, name); err2 == nil && item != nil {
+			return item, nil
+		}
+		return nil, err
+	}
+	return &coll, nil
+}
+
+// s3ensureCollection creates the collection that will contain the
+// object named in r, if the bucket is a project and the collection
+// doesn't exist yet. This makes it possible to write
+// {project-uuid}/{collection-name}/{path} without creating the
+// collection by other means first.
+//
+// Callers should validate the request first, so an invalid request
+// doesn't leave an empty collection behind.
+//
+// A folder object named like a collection ("name/") doesn't cause a
+// collection to be created. That is left to fail the same way as
+// other unsupported writes to a project directory.
+func (h *handler) s3ensureCollection(r *http.Request, client *arvados.Client) error {
+	bucket, key := s3bucketKey(r.URL.Path)
+	if !strings.Contains(bucket, "-j7d0g-") || !strings.Contains(key, "/") {
+		return nil
+	}
+	_, _, err := h.s3objectCollection(r, client, bucket, key, true)
+	if err == errS3NoSuchKey {
+		return nil
+	}
+	return err
+}
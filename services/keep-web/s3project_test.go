@@ -0,0 +1,79 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	check "gopkg.in/check.v1"
+)
+
+// A name containing the ForwardSlashNameSubstitution string matches
+// an item whose name has "/" in its place, as in the site
+// filesystem's project directories.
+func (s *UnitSuite) TestS3ProjectItemSubstitution(c *check.C) {
+	var mtx sync.Mutex
+	var queried []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var filters [][]interface{}
+		json.Unmarshal([]byte(req.FormValue("filters")), &filters)
+		var name string
+		for _, f := range filters {
+			if f[0] == "name" {
+				name, _ = f[2].(string)
+			}
+		}
+		mtx.Lock()
+		queried = append(queried, name)
+		mtx.Unlock()
+		var resp arvados.CollectionList
+		if name == "foo/bar" {
+			resp.Items = []arvados.Collection{{UUID: "zzzzz-4zz18-foobarfoobarfoo"}}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+	client := &arvados.Client{
+		Scheme:    "http",
+		APIHost:   strings.TrimPrefix(srv.URL, "http://"),
+		AuthToken: "token",
+	}
+	h := &handler{Config: newConfig(s.Config)}
+	h.Config.cluster.Collections.ForwardSlashNameSubstitution = "{SOLIDUS}"
+	r := httptest.NewRequest("PUT", "/zzzzz-j7d0g-aaaaaaaaaaaaaaa/foo{SOLIDUS}bar/file", nil)
+
+	for _, trial := range []struct {
+		name   string
+		expect string
+		query  []string
+	}{
+		{"foo{SOLIDUS}bar", "zzzzz-4zz18-foobarfoobarfoo", []string{"foo{SOLIDUS}bar", "foo/bar"}},
+		{"foo{SOLIDUS}baz", "", []string{"foo{SOLIDUS}baz", "foo/baz"}},
+		{"foobaz", "", []string{"foobaz"}},
+	} {
+		queried = nil
+		item, err := h.s3projectItem(r, client, "zzzzz-j7d0g-aaaaaaaaaaaaaaa", trial.name)
+		c.Check(err, check.IsNil)
+		if trial.expect == "" {
+			c.Check(item, check.IsNil)
+		} else if c.Check(item, check.NotNil) {
+			c.Check(item.UUID, check.Equals, trial.expect)
+		}
+		c.Check(queried, check.DeepEquals, trial.query)
+	}
+
+	// Without a substitution string, there is nothing to retry.
+	h.Config.cluster.Collections.ForwardSlashNameSubstitution = ""
+	queried = nil
+	item, err := h.s3projectItem(r, client, "zzzzz-j7d0g-aaaaaaaaaaaaaaa", "foo{SOLIDUS}bar")
+	c.Check(err, check.IsNil)
+	c.Check(item, check.IsNil)
+	c.Check(queried, check.DeepEquals, []string{"foo{SOLIDUS}bar"})
+}
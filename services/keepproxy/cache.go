@@ -0,0 +1,144 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// blockCache keeps copies of the blocks served by keepproxy on local
+// disk.
+//
+// A cached block is only returned to a client that could have
+// retrieved it from a keepstore server: i.e., if blob signing is
+// enabled, the requested locator must have a valid signature for
+// the client's token.
+type blockCache struct {
+	disk             *keepclient.DiskCache
+	requireSignature bool
+	signingKey       []byte
+	signingTTL       time.Duration
+
+	requests  prometheus.Counter
+	hits      prometheus.Counter
+	hitBytes  prometheus.Counter
+	missBytes prometheus.Counter
+}
+
+// newBlockCache returns a blockCache configured according to
+// cluster.Collections.KeepproxyCache*, or nil if caching is not
+// enabled. Cache metrics are registered with reg.
+func newBlockCache(cluster *arvados.Cluster, reg *prometheus.Registry) *blockCache {
+	if cluster.Collections.KeepproxyCacheDir == "" {
+		return nil
+	}
+	bc := &blockCache{
+		disk: &keepclient.DiskCache{
+			Dir:      cluster.Collections.KeepproxyCacheDir,
+			MaxBytes: int64(cluster.Collections.KeepproxyCacheSize),
+		},
+		requireSignature: cluster.Collections.BlobSigning,
+		signingKey:       []byte(cluster.Collections.BlobSigningKey),
+		signingTTL:       cluster.Collections.BlobSigningTTL.Duration(),
+		requests: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepproxy_blockcache",
+			Name:      "requests",
+			Help:      "Number of GET requests eligible to be served from the block cache.",
+		}),
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepproxy_blockcache",
+			Name:      "hits",
+			Help:      "Number of GET requests served from the block cache.",
+		}),
+		hitBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepproxy_blockcache",
+			Name:      "hit_bytes",
+			Help:      "Total size of blocks served from the block cache.",
+		}),
+		missBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepproxy_blockcache",
+			Name:      "miss_bytes",
+			Help:      "Total size of blocks retrieved from keepstore servers after a cache miss.",
+		}),
+	}
+	if reg != nil {
+		reg.MustRegister(bc.requests, bc.hits, bc.hitBytes, bc.missBytes)
+	}
+	return bc
+}
+
+// usable returns true if the cache can be used to serve the given
+// locator to the holder of the given token.
+//
+// Locators with remote cluster signatures (+R) are never served from
+// the cache, because the remote cluster's permission signatures
+// can't be checked here.
+func (bc *blockCache) usable(locator, token string) bool {
+	if bc == nil || strings.Contains(locator, "+R") {
+		return false
+	}
+	if !bc.requireSignature {
+		return true
+	}
+	return arvados.VerifySignature(locator, token, bc.signingTTL, bc.signingKey) == nil
+}
+
+// get returns the block with the given locator, or nil if it is not
+// in the cache. The caller must check usable() first.
+func (bc *blockCache) get(locator string) []byte {
+	bc.requests.Inc()
+	data := bc.disk.Get(locator[:32])
+	if data != nil {
+		bc.hits.Inc()
+		bc.hitBytes.Add(float64(len(data)))
+	}
+	return data
+}
+
+// newWriter returns a writer that adds a block to the cache as it is
+// retrieved after a cache miss, or nil if the block can't be added.
+// The data is written to a temporary file in the cache directory
+// rather than held in memory. The caller must call commit if the data
+// matches the locator's hash, otherwise abort.
+func (bc *blockCache) newWriter(locator string) *cacheWriter {
+	w := bc.disk.NewWriter(locator[:32])
+	if w == nil {
+		return nil
+	}
+	return &cacheWriter{DiskCacheWriter: w, bc: bc}
+}
+
+type cacheWriter struct {
+	*keepclient.DiskCacheWriter
+	bc *blockCache
+	n  int64
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return w.DiskCacheWriter.Write(p)
+}
+
+func (w *cacheWriter) commit() {
+	if err := w.Commit(); err != nil {
+		log.Printf("block cache: %s", err)
+		return
+	}
+	w.bc.missBytes.Add(float64(w.n))
+}
+
+func (w *cacheWriter) abort() {
+	w.Abort()
+}
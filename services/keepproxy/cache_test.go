@@ -0,0 +1,98 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&CacheSuite{})
+
+type CacheSuite struct {
+	cluster *arvados.Cluster
+}
+
+func (s *CacheSuite) SetUpTest(c *C) {
+	tmpdir, err := ioutil.TempDir("", "keepproxy-test-")
+	c.Assert(err, IsNil)
+	s.cluster = &arvados.Cluster{}
+	s.cluster.Collections.KeepproxyCacheDir = tmpdir
+	s.cluster.Collections.BlobSigning = true
+	s.cluster.Collections.BlobSigningKey = "zfhgfenhffzltr9dixws36j1yhksjoll2grmku38mi7yxd66h5j4q9w4jzanezacp8s6q0ro3hxakfye02152hncy6zml2ed0uc"
+	s.cluster.Collections.BlobSigningTTL = arvados.Duration(time.Hour)
+}
+
+func (s *CacheSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.cluster.Collections.KeepproxyCacheDir)
+}
+
+func (s *CacheSuite) TestDisabled(c *C) {
+	s.cluster.Collections.KeepproxyCacheDir = ""
+	bc := newBlockCache(s.cluster, nil)
+	c.Check(bc, IsNil)
+	c.Check(bc.usable("acbd18db4cc2f85cedef654fccc4a4d8+3", "token"), Equals, false)
+}
+
+func (s *CacheSuite) TestPermission(c *C) {
+	bc := newBlockCache(s.cluster, nil)
+	locator := "acbd18db4cc2f85cedef654fccc4a4d8+3"
+	signed := arvados.SignLocator(locator, "token", time.Now().Add(time.Hour), time.Hour, []byte(s.cluster.Collections.BlobSigningKey))
+	c.Check(bc.usable(signed, "token"), Equals, true)
+	c.Check(bc.usable(signed, "othertoken"), Equals, false)
+	c.Check(bc.usable(locator, "token"), Equals, false)
+	c.Check(bc.usable(locator+"+Rzzzzz-"+signed[36:], "token"), Equals, false)
+
+	expired := arvados.SignLocator(locator, "token", time.Now().Add(-time.Second), time.Hour, []byte(s.cluster.Collections.BlobSigningKey))
+	c.Check(bc.usable(expired, "token"), Equals, false)
+
+	// Without blob signing, any client with a valid token can
+	// read any block.
+	s.cluster.Collections.BlobSigning = false
+	bc = newBlockCache(s.cluster, nil)
+	c.Check(bc.usable(locator, "token"), Equals, true)
+	c.Check(bc.usable(locator+"+Rzzzzz-"+signed[36:], "token"), Equals, false)
+}
+
+func (s *CacheSuite) TestGetPut(c *C) {
+	reg := prometheus.NewRegistry()
+	bc := newBlockCache(s.cluster, reg)
+	data := []byte("foo")
+	locator := fmt.Sprintf("%x+%d", md5.Sum(data), len(data))
+
+	c.Check(bc.get(locator), IsNil)
+
+	// An aborted write doesn't add anything to the cache.
+	w := bc.newWriter(locator)
+	c.Assert(w, NotNil)
+	w.Write(data[:1])
+	w.abort()
+
+	w = bc.newWriter(locator)
+	c.Assert(w, NotNil)
+	w.Write(data[:1])
+	w.Write(data[1:])
+	w.commit()
+	c.Check(bc.get(locator), DeepEquals, data)
+
+	// No writer is needed for a block that's already cached.
+	c.Check(bc.newWriter(locator), IsNil)
+
+	c.Check(testutil.ToFloat64(bc.requests), Equals, float64(2))
+	c.Check(testutil.ToFloat64(bc.hits), Equals, float64(1))
+	c.Check(testutil.ToFloat64(bc.hitBytes), Equals, float64(3))
+	c.Check(testutil.ToFloat64(bc.missBytes), Equals, float64(3))
+	mfs, err := reg.Gather()
+	c.Assert(err, IsNil)
+	c.Check(mfs, HasLen, 4)
+}
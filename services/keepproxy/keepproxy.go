@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -23,12 +24,14 @@ import (
 	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/health"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
 	"github.com/coreos/go-systemd/daemon"
 	"github.com/ghodss/yaml"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -163,8 +166,16 @@ func run(logger log.FieldLogger, cluster *arvados.Cluster) error {
 	signal.Notify(term, syscall.SIGINT)
 
 	// Start serving requests.
-	router = MakeRESTRouter(kc, time.Duration(keepclient.DefaultProxyRequestTimeout), cluster.ManagementToken)
-	return http.Serve(listener, httpserver.AddRequestIDs(httpserver.LogRequests(router)))
+	reg := prometheus.NewRegistry()
+	bc := newBlockCache(cluster, reg)
+	if bc != nil {
+		log.Printf("caching blocks in %s (max size %d bytes)", bc.disk.Dir, bc.disk.MaxBytes)
+	}
+	router = MakeRESTRouter(kc, time.Duration(keepclient.DefaultProxyRequestTimeout), cluster.ManagementToken, bc, newQuotaChecker(cluster))
+	lgr, _ := logger.(*log.Logger)
+	ctx := ctxlog.Context(context.Background(), logger)
+	mh := httpserver.Instrument(reg, lgr, httpserver.HandlerWithContext(ctx, httpserver.AddRequestIDs(httpserver.LogRequests(router))))
+	return http.Serve(listener, mh.ServeAPI(cluster.ManagementToken, mh))
 }
 
 type ApiTokenCache struct {
@@ -266,13 +277,18 @@ type proxyHandler struct {
 	http.Handler
 	*keepclient.KeepClient
 	*ApiTokenCache
-	timeout   time.Duration
-	transport *http.Transport
+	timeout    time.Duration
+	transport  *http.Transport
+	blockCache *blockCache   // nil if caching is disabled
+	quota      *quotaChecker // nil if there are no storage quotas
 }
 
 // MakeRESTRouter returns an http.Handler that passes GET and PUT
-// requests to the appropriate handlers.
-func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, mgmtToken string) http.Handler {
+// requests to the appropriate handlers. If bc is not nil, GET
+// requests are served from bc when possible. If qc is not nil, PUT
+// requests from users who have reached their storage quotas are
+// refused.
+func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, mgmtToken string, bc *blockCache, qc *quotaChecker) http.Handler {
 	rest := mux.NewRouter()
 
 	transport := defaultTransport
@@ -289,6 +305,8 @@ func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, mgmtToken
 		KeepClient: kc,
 		timeout:    timeout,
 		transport:  &transport,
+		blockCache: bc,
+		quota:      qc,
 		ApiTokenCache: &ApiTokenCache{
 			tokens:     make(map[string]int64),
 			expireTime: 300,
@@ -393,6 +411,22 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 
 	locator = removeHint.ReplaceAllString(locator, "$1")
 
+	// useCache is true if the block can be added to the cache
+	// after retrieving it from a keepstore server.
+	useCache := req.Method == "GET" && h.blockCache.usable(locator, tok)
+	if useCache {
+		if data := h.blockCache.get(locator); data != nil {
+			status = http.StatusOK
+			expectLength = int64(len(data))
+			proxiedURI = "cache"
+			resp.Header().Set("Content-Length", fmt.Sprint(expectLength))
+			var n int
+			n, err = resp.Write(data)
+			responseLength = int64(n)
+			return
+		}
+	}
+
 	switch req.Method {
 	case "HEAD":
 		expectLength, proxiedURI, err = kc.Ask(locator)
@@ -418,7 +452,23 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 		case "HEAD":
 			responseLength = 0
 		case "GET":
-			responseLength, err = io.Copy(resp, reader)
+			var cw *cacheWriter
+			if useCache {
+				cw = h.blockCache.newWriter(locator)
+			}
+			if cw == nil {
+				responseLength, err = io.Copy(resp, reader)
+			} else {
+				// The reader returns an error if the
+				// data doesn't match the hash, so
+				// only verified blocks are cached.
+				responseLength, err = io.Copy(resp, io.TeeReader(reader, cw))
+				if err == nil && responseLength == expectLength {
+					cw.commit()
+				} else {
+					cw.abort()
+				}
+			}
 			if err == nil && expectLength > -1 && responseLength != expectLength {
 				err = ContentLengthMismatch
 			}
@@ -438,6 +488,7 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 
 var LengthRequiredError = errors.New(http.StatusText(http.StatusLengthRequired))
 var LengthMismatchError = errors.New("Locator size hint does not match Content-Length header")
+var QuotaExceededError = errors.New("Storage quota exceeded")
 
 func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 	if err := h.checkLoop(resp, req); err != nil {
@@ -499,6 +550,12 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if h.quota.exceeded(kc.Arvados, tok) {
+		err = QuotaExceededError
+		status = http.StatusForbidden
+		return
+	}
+
 	// Copy ArvadosClient struct and use the client's API token
 	arvclient := *kc.Arvados
 	arvclient.ApiToken = tok
@@ -0,0 +1,78 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long to remember a user's storage usage before checking again.
+const quotaCheckInterval = time.Minute
+
+// quotaChecker refuses uploads from users who have reached their
+// storage quota (see Collections.StorageQuotas).
+//
+// Uploads are permitted when the user's usage can't be retrieved,
+// e.g., because keep-balance has not reported usage yet.
+type quotaChecker struct {
+	mtx     sync.Mutex
+	checked map[string]quotaCheck // token => last check
+}
+
+type quotaCheck struct {
+	exceeded bool
+	expires  time.Time
+}
+
+// newQuotaChecker returns a quotaChecker, or nil if no storage quotas
+// are configured.
+func newQuotaChecker(cluster *arvados.Cluster) *quotaChecker {
+	if !cluster.StorageQuotasEnabled() {
+		return nil
+	}
+	return &quotaChecker{checked: map[string]quotaCheck{}}
+}
+
+// exceeded returns true if the user with the given token has reached
+// their storage quota.
+func (qc *quotaChecker) exceeded(arv *arvadosclient.ArvadosClient, token string) bool {
+	if qc == nil {
+		return false
+	}
+	now := time.Now()
+	qc.mtx.Lock()
+	check, ok := qc.checked[token]
+	qc.mtx.Unlock()
+	if ok && now.Before(check.expires) {
+		return check.exceeded
+	}
+
+	client := *arv
+	client.ApiToken = token
+	var usage arvados.StorageUsage
+	err := client.Call("GET", "storage_usage", "", "", nil, &usage)
+	if err != nil {
+		// Don't retry on every upload: remember the
+		// failure like any other result.
+		log.Printf("error retrieving storage usage: %s", err)
+		usage = arvados.StorageUsage{}
+	}
+	check = quotaCheck{exceeded: usage.Exceeded(), expires: now.Add(quotaCheckInterval)}
+
+	qc.mtx.Lock()
+	defer qc.mtx.Unlock()
+	for tok, c := range qc.checked {
+		if now.After(c.expires) {
+			delete(qc.checked, tok)
+		}
+	}
+	qc.checked[token] = check
+	return check.exceeded
+}
@@ -0,0 +1,73 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&QuotaSuite{})
+
+type QuotaSuite struct{}
+
+func (s *QuotaSuite) TestQuotaChecker(c *C) {
+	cluster := &arvados.Cluster{}
+	c.Check(newQuotaChecker(cluster), IsNil)
+	c.Check((*quotaChecker)(nil).exceeded(nil, "token"), Equals, false)
+
+	var mtx sync.Mutex
+	requests := 0
+	usage := map[string]int64{"fulltoken": 2000, "oktoken": 10}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests++
+		c.Check(req.URL.Path, Equals, "/arvados/v1/storage_usage")
+		tok := strings.TrimPrefix(req.Header.Get("Authorization"), "OAuth2 ")
+		used, ok := usage[tok]
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(arvados.StorageUsage{UsedBytes: used, QuotaBytes: 1000, UpdatedAt: time.Now()})
+	}))
+	defer srv.Close()
+	arv := &arvadosclient.ArvadosClient{
+		Scheme:    "http",
+		ApiServer: strings.TrimPrefix(srv.URL, "http://"),
+		Client:    http.DefaultClient,
+	}
+
+	cluster.Collections.DefaultStorageQuota = 1000
+	qc := newQuotaChecker(cluster)
+	c.Assert(qc, NotNil)
+	c.Check(qc.exceeded(arv, "fulltoken"), Equals, true)
+	c.Check(qc.exceeded(arv, "oktoken"), Equals, false)
+	// Errors don't prevent uploads.
+	c.Check(qc.exceeded(arv, "errortoken"), Equals, false)
+	c.Check(requests, Equals, 3)
+
+	// Results (including errors) are cached.
+	c.Check(qc.exceeded(arv, "fulltoken"), Equals, true)
+	c.Check(qc.exceeded(arv, "errortoken"), Equals, false)
+	c.Check(requests, Equals, 3)
+
+	// Usage is checked again after the cached result expires.
+	qc.checked["fulltoken"] = quotaCheck{exceeded: true, expires: time.Now().Add(-time.Second)}
+	mtx.Lock()
+	usage["fulltoken"] = 900
+	mtx.Unlock()
+	c.Check(qc.exceeded(arv, "fulltoken"), Equals, false)
+	c.Check(requests, Equals, 4)
+}
@@ -196,6 +196,61 @@ func (v *AzureBlobVolume) Get(ctx context.Context, loc string, buf []byte) (int,
 	return size, err
 }
 
+// ReadRange implements Volume.
+func (v *AzureBlobVolume) ReadRange(ctx context.Context, loc string, off, length int64, w io.Writer) error {
+	if length <= 0 {
+		return nil
+	}
+	trashed, _, err := v.checkTrashed(loc)
+	if err != nil {
+		return err
+	}
+	if trashed {
+		return os.ErrNotExist
+	}
+	var rdr io.ReadCloser
+	gotRdr := make(chan struct{})
+	go func() {
+		defer close(gotRdr)
+		rdr, err = v.container.GetBlobRange(loc, int(off), int(off+length-1), nil)
+	}()
+	select {
+	case <-ctx.Done():
+		go func() {
+			<-gotRdr
+			if err == nil {
+				rdr.Close()
+			}
+		}()
+		return ctx.Err()
+	case <-gotRdr:
+	}
+	if serr, ok := err.(storage.AzureStorageServiceError); ok && serr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// off is past the end of the block.
+		return nil
+	} else if err != nil {
+		return v.translateError(err)
+	}
+	defer rdr.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rdr.Close()
+		case <-done:
+		}
+	}()
+	// The SDK requests an open-ended range if off+length-1
+	// is zero, so don't rely on the server to stop at the end
+	// of the requested range.
+	_, err = io.Copy(w, io.LimitReader(rdr, length))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return v.translateError(err)
+}
+
 func (v *AzureBlobVolume) get(ctx context.Context, loc string, buf []byte) (int, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -214,8 +269,8 @@ func (v *AzureBlobVolume) get(ctx context.Context, loc string, buf []byte) (int,
 		if err != nil {
 			return 0, v.translateError(err)
 		}
-		if props.ContentLength > int64(BlockSize) || props.ContentLength < 0 {
-			return 0, fmt.Errorf("block %s invalid size %d (max %d)", loc, props.ContentLength, BlockSize)
+		if props.ContentLength > int64(len(buf)) || props.ContentLength < 0 {
+			return 0, fmt.Errorf("block %s invalid size %d (max %d)", loc, props.ContentLength, len(buf))
 		}
 		expectSize = int(props.ContentLength)
 		pieces = (expectSize + pieceSize - 1) / pieceSize
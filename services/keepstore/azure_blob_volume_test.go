@@ -113,7 +113,7 @@ func (h *azStubHandler) unlockAndRace() {
 	h.Lock()
 }
 
-var rangeRegexp = regexp.MustCompile(`^bytes=(\d+)-(\d+)$`)
+var rangeRegexp = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`)
 
 func (h *azStubHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	h.Lock()
@@ -257,8 +257,14 @@ func (h *azStubHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		data := blob.Data
 		if rangeSpec := rangeRegexp.FindStringSubmatch(r.Header.Get("Range")); rangeSpec != nil {
 			b0, err0 := strconv.Atoi(rangeSpec[1])
-			b1, err1 := strconv.Atoi(rangeSpec[2])
-			if err0 != nil || err1 != nil || b0 >= len(data) || b1 >= len(data) || b0 > b1 {
+			b1, err1 := len(data)-1, error(nil)
+			if rangeSpec[2] != "" {
+				b1, err1 = strconv.Atoi(rangeSpec[2])
+			}
+			if b1 >= len(data) {
+				b1 = len(data) - 1
+			}
+			if err0 != nil || err1 != nil || b0 >= len(data) || b0 > b1 {
 				rw.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
 				rw.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
 				return
@@ -0,0 +1,467 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	driver["Cached"] = newCachedVolume
+}
+
+func newCachedVolume(cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) (Volume, error) {
+	v := &CachedVolume{cluster: cluster, logger: logger, metrics: metrics}
+	err := json.Unmarshal(volume.DriverParameters, &v.CachedVolumeDriverParameters)
+	if err != nil {
+		return nil, err
+	}
+	if v.Driver == "" {
+		return nil, errors.New("DriverParameters.Driver was not provided")
+	} else if v.Driver == "Cached" {
+		return nil, errors.New("DriverParameters.Driver cannot be Cached")
+	}
+	dri, ok := driver[v.Driver]
+	if !ok {
+		return nil, fmt.Errorf("DriverParameters: invalid driver %q", v.Driver)
+	}
+	backendVolume := volume
+	backendVolume.Driver = v.Driver
+	backendVolume.DriverParameters = v.DriverParameters
+	v.Volume, err = dri(cluster, backendVolume, logger, metrics)
+	if err != nil {
+		return nil, err
+	}
+	err = v.check()
+	if err != nil {
+		return nil, err
+	}
+	if v.CacheMaxAge > 0 {
+		go v.expireLoop()
+	}
+	return v, nil
+}
+
+// CachedVolume stores blocks on a backend Volume (typically a remote
+// object store), and keeps copies of recently used blocks in a local
+// directory.
+type CachedVolume struct {
+	Volume
+	arvados.CachedVolumeDriverParameters
+
+	cluster *arvados.Cluster
+	logger  logrus.FieldLogger
+	metrics *volumeMetricsVecs
+	cache   *UnixVolume
+
+	// Cached blocks, most recently used first.
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+	// Blocks being read from or written to the backend volume,
+	// which will be added to the cache when done.
+	fills map[string]*cacheFill
+	mtx   sync.Mutex
+
+	hits       prometheus.Counter
+	misses     prometheus.Counter
+	cacheBytes prometheus.Gauge
+}
+
+// How often a cache hit checks that the block still exists on the
+// backend volume.
+const cachedBlockCheckInterval = time.Minute
+
+type cachedBlock struct {
+	loc   string
+	size  int64
+	atime time.Time
+	// Last time the block was known to exist on the backend
+	// volume
+	checked time.Time
+}
+
+// A cacheFill tracks concurrent reads or writes of a block that will
+// add it to the cache. If Trash is called in the meantime, trashed is
+// set, so the block doesn't get put back in the cache.
+type cacheFill struct {
+	refs    int
+	trashed bool
+}
+
+func (v *CachedVolume) check() error {
+	if v.CacheRoot == "" {
+		return errors.New("DriverParameters.CacheRoot was not provided")
+	}
+	if v.CacheSize <= 0 {
+		return errors.New("DriverParameters.CacheSize must be greater than zero")
+	}
+	if v.CacheMaxAge < 0 {
+		return errors.New("DriverParameters.CacheMaxAge must not be negative")
+	}
+	err := os.MkdirAll(v.CacheRoot, 0700)
+	if err != nil {
+		return fmt.Errorf("error creating cache directory: %s", err)
+	}
+	v.cache = &UnixVolume{
+		Root:    v.CacheRoot,
+		cluster: v.cluster,
+		volume:  arvados.Volume{Replication: 1},
+		logger:  v.logger,
+		metrics: v.metrics,
+	}
+	v.cache.logger = v.logger.WithField("Volume", v.cache.String())
+	err = v.cache.check()
+	if err != nil {
+		return fmt.Errorf("cache directory: %s", err)
+	}
+
+	lbls := prometheus.Labels{"device_id": v.Volume.GetDeviceID()}
+	v.hits = v.metrics.cacheRequests.With(prometheus.Labels{"device_id": lbls["device_id"], "result": "hit"})
+	v.misses = v.metrics.cacheRequests.With(prometheus.Labels{"device_id": lbls["device_id"], "result": "miss"})
+	v.cacheBytes = v.metrics.cacheBytes.With(lbls)
+
+	return v.loadCache()
+}
+
+// loadCache builds the LRU list from blocks already present in the
+// cache directory, using their modification times as the last
+// access times.
+func (v *CachedVolume) loadCache() error {
+	var idx bytes.Buffer
+	err := v.cache.IndexTo("", &idx)
+	if err != nil {
+		return fmt.Errorf("error reading cache directory: %s", err)
+	}
+	var blocks []*cachedBlock
+	scanner := bufio.NewScanner(&idx)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || len(fields[0]) < 34 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[0][33:], 10, 64)
+		if err != nil {
+			continue
+		}
+		mtime, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		blocks = append(blocks, &cachedBlock{loc: fields[0][:32], size: size, atime: time.Unix(0, mtime)})
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].atime.Before(blocks[j].atime)
+	})
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.lru = list.New()
+	v.entries = map[string]*list.Element{}
+	v.fills = map[string]*cacheFill{}
+	v.size = 0
+	for _, blk := range blocks {
+		v.entries[blk.loc] = v.lru.PushFront(blk)
+		v.size += blk.size
+	}
+	v.evict(time.Now())
+	return nil
+}
+
+// String implements Volume.
+func (v *CachedVolume) String() string {
+	return fmt.Sprintf("%s (cached in %s)", v.Volume, v.CacheRoot)
+}
+
+// InternalStats returns the backend volume's stats, if any.
+func (v *CachedVolume) InternalStats() interface{} {
+	if is, ok := v.Volume.(InternalStatser); ok {
+		return is.InternalStats()
+	}
+	return nil
+}
+
+// Get returns a block from the cache if possible. Otherwise, it
+// reads the block from the backend volume and adds it to the cache.
+//
+// If ctx was returned by withoutCache, Get reads the block from the
+// backend volume without using or updating the cache.
+func (v *CachedVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	if cacheDisabled(ctx) {
+		return v.Volume.Get(ctx, loc, buf)
+	}
+	if v.cachedCopyValid(loc) {
+		n, err := v.cache.Get(ctx, loc, buf)
+		if err == nil {
+			v.hits.Inc()
+			v.markUsed(loc)
+			return n, nil
+		} else if ctx.Err() != nil {
+			return 0, ctx.Err()
+		} else if !os.IsNotExist(err) {
+			v.logger.WithError(err).Warnf("error reading %s from cache", loc)
+		}
+	}
+	v.misses.Inc()
+	fill := v.startFill(loc)
+	n, err := v.Volume.Get(ctx, loc, buf)
+	if err != nil {
+		v.finishFill(loc, fill, nil)
+		return n, err
+	}
+	v.finishFill(loc, fill, buf[:n])
+	return n, nil
+}
+
+// ReadRange reads part of a block from the cache if possible.
+// Otherwise, it reads the entire block from the backend volume so it
+// can be added to the cache.
+func (v *CachedVolume) ReadRange(ctx context.Context, loc string, off, length int64, w io.Writer) error {
+	if cacheDisabled(ctx) {
+		return v.Volume.ReadRange(ctx, loc, off, length, w)
+	}
+	if v.cachedCopyValid(loc) {
+		err := v.cache.ReadRange(ctx, loc, off, length, w)
+		if err == nil {
+			v.hits.Inc()
+			v.markUsed(loc)
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		} else if !os.IsNotExist(err) {
+			v.logger.WithError(err).Warnf("error reading %s from cache", loc)
+		}
+	}
+	return readRangeWithGet(ctx, v, loc, off, length, w)
+}
+
+// Compare compares the given data with the cached copy if there is
+// one, otherwise with the block stored on the backend volume.
+func (v *CachedVolume) Compare(ctx context.Context, loc string, expect []byte) error {
+	if !cacheDisabled(ctx) && v.cachedCopyValid(loc) && v.cache.Compare(ctx, loc, expect) == nil {
+		v.markUsed(loc)
+		return nil
+	}
+	return v.Volume.Compare(ctx, loc, expect)
+}
+
+// Put writes a block to the backend volume, and also to the cache if
+// WriteThrough is enabled.
+func (v *CachedVolume) Put(ctx context.Context, loc string, block []byte) error {
+	if !v.WriteThrough {
+		return v.Volume.Put(ctx, loc, block)
+	}
+	fill := v.startFill(loc)
+	err := v.Volume.Put(ctx, loc, block)
+	if err != nil {
+		v.finishFill(loc, fill, nil)
+		return err
+	}
+	v.finishFill(loc, fill, block)
+	return nil
+}
+
+// Trash trashes a block on the backend volume, and removes it from
+// the cache if the backend volume no longer has it. (The backend
+// volume doesn't trash blocks newer than BlobSigningTTL.)
+func (v *CachedVolume) Trash(loc string) error {
+	err := v.Volume.Trash(loc)
+	if err != nil {
+		return err
+	}
+	if _, err := v.Volume.Mtime(loc); err == nil {
+		return nil
+	}
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if fill, ok := v.fills[loc]; ok {
+		fill.trashed = true
+	}
+	if e, ok := v.entries[loc]; ok {
+		v.removeCached(e)
+		v.cacheBytes.Set(float64(v.size))
+	} else {
+		v.cache.os.Remove(v.cache.blockPath(loc))
+	}
+	return nil
+}
+
+// cachedCopyValid returns true if the given block is in the cache
+// and the backend volume still has it.
+//
+// The backend volume is checked at most once per
+// cachedBlockCheckInterval for each block, so the cache stops serving
+// a block soon after another keepstore process sharing the same
+// backend storage trashes it. If the backend volume no longer has the
+// block, the cached copy is removed.
+func (v *CachedVolume) cachedCopyValid(loc string) bool {
+	v.mtx.Lock()
+	e, ok := v.entries[loc]
+	if !ok {
+		v.mtx.Unlock()
+		return false
+	} else if time.Since(e.Value.(*cachedBlock).checked) < cachedBlockCheckInterval {
+		v.mtx.Unlock()
+		return true
+	}
+	v.mtx.Unlock()
+
+	t0 := time.Now()
+	_, err := v.Volume.Mtime(loc)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	e, ok = v.entries[loc]
+	if !ok {
+		return false
+	} else if os.IsNotExist(err) {
+		v.removeCached(e)
+		v.cacheBytes.Set(float64(v.size))
+		return false
+	} else if err != nil {
+		v.logger.WithError(err).Warnf("error checking %s on backend volume", loc)
+		return false
+	}
+	e.Value.(*cachedBlock).checked = t0
+	return true
+}
+
+// startFill notes that the given block is being read from (or
+// written to) the backend volume, and will be added to the cache by
+// finishFill.
+func (v *CachedVolume) startFill(loc string) *cacheFill {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	fill, ok := v.fills[loc]
+	if !ok {
+		fill = &cacheFill{}
+		v.fills[loc] = fill
+	}
+	fill.refs++
+	return fill
+}
+
+// finishFill adds the given block data (if not nil) to the cache,
+// unless the block was trashed since startFill.
+func (v *CachedVolume) finishFill(loc string, fill *cacheFill, data []byte) {
+	t0 := time.Now()
+	if data != nil && int64(len(data)) <= int64(v.CacheSize) {
+		err := v.cache.Put(context.Background(), loc, data)
+		if err != nil {
+			v.logger.WithError(err).Warnf("error writing %s to cache", loc)
+			data = nil
+		}
+	} else {
+		data = nil
+	}
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	fill.refs--
+	if fill.refs == 0 {
+		delete(v.fills, loc)
+	}
+	if data == nil {
+		return
+	}
+	if fill.trashed {
+		// Trash was called while we were reading or
+		// writing the block, and might have run before
+		// our copy was written to the cache.
+		if _, ok := v.entries[loc]; !ok {
+			v.cache.os.Remove(v.cache.blockPath(loc))
+		}
+		return
+	}
+	now := time.Now()
+	if e, ok := v.entries[loc]; ok {
+		blk := e.Value.(*cachedBlock)
+		v.size += int64(len(data)) - blk.size
+		blk.size = int64(len(data))
+		blk.atime = now
+		blk.checked = t0
+		v.lru.MoveToFront(e)
+	} else {
+		v.entries[loc] = v.lru.PushFront(&cachedBlock{loc: loc, size: int64(len(data)), atime: now, checked: t0})
+		v.size += int64(len(data))
+	}
+	v.evict(now)
+}
+
+// markUsed marks the given cached block as most recently used, and
+// updates the cache file's timestamp, so the LRU order is preserved
+// across restarts (see loadCache).
+func (v *CachedVolume) markUsed(loc string) {
+	v.mtx.Lock()
+	e, ok := v.entries[loc]
+	if ok {
+		e.Value.(*cachedBlock).atime = time.Now()
+		v.lru.MoveToFront(e)
+	}
+	v.mtx.Unlock()
+	if !ok {
+		return
+	}
+	err := v.cache.Touch(loc)
+	if err != nil && !os.IsNotExist(err) {
+		v.logger.WithError(err).Warnf("error updating timestamp of %s in cache", loc)
+	}
+}
+
+// evict removes least recently used blocks from the cache until the
+// cache is no bigger than CacheSize and no block is older than
+// CacheMaxAge. Caller must have v.mtx locked.
+func (v *CachedVolume) evict(now time.Time) {
+	for e := v.lru.Back(); e != nil; e = v.lru.Back() {
+		blk := e.Value.(*cachedBlock)
+		if v.size <= int64(v.CacheSize) && (v.CacheMaxAge == 0 || now.Sub(blk.atime) < v.CacheMaxAge.Duration()) {
+			break
+		}
+		v.removeCached(e)
+	}
+	v.cacheBytes.Set(float64(v.size))
+}
+
+// removeCached deletes a block from the cache. Caller must have
+// v.mtx locked.
+func (v *CachedVolume) removeCached(e *list.Element) {
+	blk := e.Value.(*cachedBlock)
+	err := v.cache.os.Remove(v.cache.blockPath(blk.loc))
+	if err != nil && !os.IsNotExist(err) {
+		v.logger.WithError(err).Warnf("error removing %s from cache", blk.loc)
+	}
+	v.lru.Remove(e)
+	delete(v.entries, blk.loc)
+	v.size -= blk.size
+}
+
+func (v *CachedVolume) expireLoop() {
+	interval := v.CacheMaxAge.Duration() / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	} else if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.NewTicker(interval).C {
+		v.mtx.Lock()
+		v.evict(time.Now())
+		v.mtx.Unlock()
+	}
+}
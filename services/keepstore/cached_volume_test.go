@@ -0,0 +1,313 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	check "gopkg.in/check.v1"
+)
+
+type TestableCachedVolume struct {
+	*CachedVolume
+	backend TestableVolume
+}
+
+// PutRaw writes a block directly to the backend volume, even if the
+// volume is readonly, and removes any cached copy.
+func (v *TestableCachedVolume) PutRaw(locator string, data []byte) {
+	v.backend.PutRaw(locator, data)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if e, ok := v.entries[locator]; ok {
+		v.removeCached(e)
+	}
+}
+
+func (v *TestableCachedVolume) TouchWithDate(locator string, lastPut time.Time) {
+	v.backend.TouchWithDate(locator, lastPut)
+}
+
+func (v *TestableCachedVolume) Teardown() {
+	v.backend.Teardown()
+	os.RemoveAll(v.CacheRoot)
+}
+
+func (v *TestableCachedVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return v.backend.ReadWriteOperationLabelValues()
+}
+
+var _ = check.Suite(&CachedVolumeSuite{})
+
+type CachedVolumeSuite struct {
+	unix UnixVolumeSuite
+}
+
+func (s *CachedVolumeSuite) SetUpTest(c *check.C) {
+	s.unix = UnixVolumeSuite{}
+	s.unix.SetUpTest(c)
+}
+
+func (s *CachedVolumeSuite) TearDownTest(c *check.C) {
+	s.unix.TearDownTest(c)
+}
+
+func (s *CachedVolumeSuite) newTestableVolume(c *check.C, cluster *arvados.Cluster, volume arvados.Volume, metrics *volumeMetricsVecs, params arvados.CachedVolumeDriverParameters) *TestableCachedVolume {
+	backend := s.unix.newTestableUnixVolume(c, cluster, volume, metrics, false)
+	if params.CacheRoot == "" {
+		d, err := ioutil.TempDir("", "cache_test")
+		c.Assert(err, check.IsNil)
+		params.CacheRoot = d
+	}
+	if params.CacheSize == 0 {
+		params.CacheSize = 1 << 30
+	}
+	v := &CachedVolume{
+		Volume:                       backend,
+		CachedVolumeDriverParameters: params,
+		cluster:                      cluster,
+		logger:                       ctxlog.TestLogger(c),
+		metrics:                      metrics,
+	}
+	c.Assert(v.check(), check.IsNil)
+	return &TestableCachedVolume{CachedVolume: v, backend: backend}
+}
+
+func (s *CachedVolumeSuite) TestGeneric(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics, arvados.CachedVolumeDriverParameters{})
+	})
+}
+
+func (s *CachedVolumeSuite) TestGenericWriteThrough(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics, arvados.CachedVolumeDriverParameters{WriteThrough: true})
+	})
+}
+
+func (s *CachedVolumeSuite) TestGenericReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics, arvados.CachedVolumeDriverParameters{})
+	})
+}
+
+func (s *CachedVolumeSuite) TestDriverConfig(c *check.C) {
+	d, err := ioutil.TempDir("", "volume_test")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(d)
+
+	params, err := json.Marshal(arvados.CachedVolumeDriverParameters{
+		CacheRoot:        d + "/cache",
+		CacheSize:        1 << 20,
+		Driver:           "Directory",
+		DriverParameters: json.RawMessage(fmt.Sprintf(`{"Root":%q}`, d+"/backend")),
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(os.Mkdir(d+"/backend", 0700), check.IsNil)
+	vol, err := newCachedVolume(s.unix.cluster, arvados.Volume{Driver: "Cached", DriverParameters: params}, ctxlog.TestLogger(c), s.unix.metrics)
+	c.Assert(err, check.IsNil)
+	c.Check(vol.String(), check.Equals, "[UnixVolume "+d+"/backend] (cached in "+d+"/cache)")
+
+	for _, trial := range []struct {
+		params  string
+		errorRe string
+	}{
+		{`{"Driver":"Directory","DriverParameters":{"Root":"` + d + `/backend"},"CacheSize":1}`, `DriverParameters.CacheRoot was not provided`},
+		{`{"Driver":"Directory","DriverParameters":{"Root":"` + d + `/backend"},"CacheRoot":"` + d + `/cache"}`, `DriverParameters.CacheSize must be greater than zero`},
+		{`{"Driver":"Cached"}`, `DriverParameters.Driver cannot be Cached`},
+		{`{"Driver":"Bogus"}`, `DriverParameters: invalid driver "Bogus"`},
+	} {
+		_, err = newCachedVolume(s.unix.cluster, arvados.Volume{Driver: "Cached", DriverParameters: json.RawMessage(trial.params)}, ctxlog.TestLogger(c), s.unix.metrics)
+		c.Check(err, check.ErrorMatches, trial.errorRe)
+	}
+}
+
+func (s *CachedVolumeSuite) TestReadThrough(c *check.C) {
+	reg := prometheus.NewRegistry()
+	metrics := newVolumeMetricsVecs(reg)
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, metrics, arvados.CachedVolumeDriverParameters{})
+	defer v.Teardown()
+	lbls := func(result string) prometheus.Labels {
+		return prometheus.Labels{"device_id": v.GetDeviceID(), "result": result}
+	}
+
+	c.Assert(v.Put(context.Background(), TestHash, TestBlock), check.IsNil)
+	_, err := v.cache.Mtime(TestHash)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	buf := make([]byte, BlockSize)
+	for i := 0; i < 3; i++ {
+		n, err := v.Get(context.Background(), TestHash, buf)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf[:n]), check.Equals, string(TestBlock))
+	}
+	c.Check(getValueFrom(metrics.cacheRequests, lbls("miss")), check.Equals, float64(1))
+	c.Check(getValueFrom(metrics.cacheRequests, lbls("hit")), check.Equals, float64(2))
+	c.Check(v.size, check.Equals, int64(len(TestBlock)))
+
+	// After Trash, the block can't be read from the cache.
+	v.TouchWithDate(TestHash, time.Now().Add(-2*s.unix.cluster.Collections.BlobSigningTTL.Duration()))
+	c.Assert(v.Trash(TestHash), check.IsNil)
+	_, err = v.Get(context.Background(), TestHash, buf)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	c.Check(v.size, check.Equals, int64(0))
+}
+
+func (s *CachedVolumeSuite) TestWriteThrough(c *check.C) {
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics, arvados.CachedVolumeDriverParameters{WriteThrough: true})
+	defer v.Teardown()
+	c.Assert(v.Put(context.Background(), TestHash, TestBlock), check.IsNil)
+	_, err := v.cache.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+}
+
+func (s *CachedVolumeSuite) TestEvictBySize(c *check.C) {
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics, arvados.CachedVolumeDriverParameters{CacheSize: 30})
+	defer v.Teardown()
+
+	var locs []string
+	for i := 0; i < 4; i++ {
+		data := []byte(fmt.Sprintf("block %03d", i))
+		loc := fmt.Sprintf("%x", md5.Sum(data))
+		locs = append(locs, loc)
+		v.PutRaw(loc, data)
+	}
+	buf := make([]byte, BlockSize)
+	for _, i := range []int{0, 1, 2, 0, 3} {
+		_, err := v.Get(context.Background(), locs[i], buf)
+		c.Assert(err, check.IsNil)
+	}
+	// Block 1 was least recently used when block 3 was added.
+	for i, expect := range []bool{true, false, true, true} {
+		_, err := v.cache.Mtime(locs[i])
+		c.Check(err == nil, check.Equals, expect, check.Commentf("block %d", i))
+	}
+	c.Check(v.size, check.Equals, int64(27))
+
+	// A new CachedVolume finds the existing cached blocks.
+	v2 := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics, arvados.CachedVolumeDriverParameters{CacheRoot: v.CacheRoot, CacheSize: 30})
+	c.Check(v2.size, check.Equals, int64(27))
+	c.Check(v2.entries, check.HasLen, 3)
+}
+
+func (s *CachedVolumeSuite) TestEvictByAge(c *check.C) {
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics, arvados.CachedVolumeDriverParameters{CacheMaxAge: arvados.Duration(time.Hour)})
+	defer v.Teardown()
+	v.PutRaw(TestHash, TestBlock)
+	buf := make([]byte, BlockSize)
+	_, err := v.Get(context.Background(), TestHash, buf)
+	c.Assert(err, check.IsNil)
+
+	v.mtx.Lock()
+	v.evict(time.Now().Add(time.Minute))
+	v.mtx.Unlock()
+	_, err = v.cache.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+
+	v.mtx.Lock()
+	v.evict(time.Now().Add(2 * time.Hour))
+	v.mtx.Unlock()
+	_, err = v.cache.Mtime(TestHash)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	c.Check(v.size, check.Equals, int64(0))
+
+	// Still readable from the backend.
+	_, err = v.Get(context.Background(), TestHash, buf)
+	c.Check(err, check.IsNil)
+}
+
+func (s *CachedVolumeSuite) TestTrash(c *check.C) {
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics, arvados.CachedVolumeDriverParameters{})
+	defer v.Teardown()
+	buf := make([]byte, BlockSize)
+	v.PutRaw(TestHash, TestBlock)
+	_, err := v.Get(context.Background(), TestHash, buf)
+	c.Assert(err, check.IsNil)
+
+	// The backend doesn't trash a new block, so the cached copy
+	// stays.
+	c.Check(v.Trash(TestHash), check.IsNil)
+	c.Check(v.entries[TestHash], check.NotNil)
+
+	// A fill that overlaps with Trash doesn't put the block
+	// back in the cache.
+	v.PutRaw(TestHash2, TestBlock2)
+	v.TouchWithDate(TestHash2, time.Now().Add(-2*s.unix.cluster.Collections.BlobSigningTTL.Duration()))
+	fill := v.startFill(TestHash2)
+	c.Check(v.Trash(TestHash2), check.IsNil)
+	v.finishFill(TestHash2, fill, TestBlock2)
+	c.Check(v.entries[TestHash2], check.IsNil)
+	c.Check(v.fills, check.HasLen, 0)
+	_, err = v.cache.Mtime(TestHash2)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+// When the block is trashed on the backend by another process, the
+// cache stops serving it.
+func (s *CachedVolumeSuite) TestTrashedElsewhere(c *check.C) {
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics, arvados.CachedVolumeDriverParameters{})
+	defer v.Teardown()
+	buf := make([]byte, BlockSize)
+	v.PutRaw(TestHash, TestBlock)
+	_, err := v.Get(context.Background(), TestHash, buf)
+	c.Assert(err, check.IsNil)
+
+	v.TouchWithDate(TestHash, time.Now().Add(-2*s.unix.cluster.Collections.BlobSigningTTL.Duration()))
+	c.Assert(v.backend.Trash(TestHash), check.IsNil)
+
+	// Still served from cache until it's time to check the
+	// backend again.
+	_, err = v.Get(context.Background(), TestHash, buf)
+	c.Check(err, check.IsNil)
+
+	v.entries[TestHash].Value.(*cachedBlock).checked = time.Now().Add(-cachedBlockCheckInterval)
+	_, err = v.Get(context.Background(), TestHash, buf)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	c.Check(v.entries[TestHash], check.IsNil)
+	c.Check(v.size, check.Equals, int64(0))
+}
+
+// Cache hits update the cache file's timestamp, so a new
+// CachedVolume sees the same LRU order.
+func (s *CachedVolumeSuite) TestHitUpdatesTimestamp(c *check.C) {
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics, arvados.CachedVolumeDriverParameters{})
+	defer v.Teardown()
+	buf := make([]byte, BlockSize)
+	v.PutRaw(TestHash, TestBlock)
+	_, err := v.Get(context.Background(), TestHash, buf)
+	c.Assert(err, check.IsNil)
+
+	old := time.Now().Add(-time.Hour)
+	c.Assert(os.Chtimes(v.cache.blockPath(TestHash), old, old), check.IsNil)
+	_, err = v.Get(context.Background(), TestHash, buf)
+	c.Assert(err, check.IsNil)
+	t, err := v.cache.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+	c.Check(t.After(old.Add(time.Minute)), check.Equals, true)
+}
+
+func (s *CachedVolumeSuite) TestWithoutCache(c *check.C) {
+	reg := prometheus.NewRegistry()
+	metrics := newVolumeMetricsVecs(reg)
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, metrics, arvados.CachedVolumeDriverParameters{})
+	defer v.Teardown()
+	buf := make([]byte, BlockSize)
+	v.PutRaw(TestHash, TestBlock)
+	n, err := v.Get(withoutCache(context.Background()), TestHash, buf)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, string(TestBlock))
+	c.Check(v.entries, check.HasLen, 0)
+	c.Check(getValueFrom(metrics.cacheRequests, prometheus.Labels{"device_id": v.GetDeviceID(), "result": "miss"}), check.Equals, float64(0))
+}
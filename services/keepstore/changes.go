@@ -0,0 +1,197 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+var errChangesUnavailable = errors.New("changes since the given cursor are not available, retrieve the full index instead")
+
+// A changeLog records recent changes to the set of blocks stored on a
+// mount, so keep-balance can update its copy of the mount's index
+// instead of retrieving the whole index again.
+//
+// Each entry records the state of a block (stored with a given mtime,
+// or not stored) at the time the entry was added, rather than the
+// operation that caused the change. Replaying the entries in order
+// therefore yields the current state, even when several operations
+// on the same block run concurrently.
+//
+// A nil *changeLog is valid, and records nothing.
+type changeLog struct {
+	mnt    *VolumeMount
+	size   int
+	logger logrus.FieldLogger
+
+	// Each block's state is looked up and appended while
+	// holding one of these locks, so the entry added last
+	// reflects the latest state.
+	blockLocks [256]sync.Mutex
+
+	mtx     sync.Mutex
+	id      string // changes whenever entries are lost
+	seq     uint64 // sequence number of the last entry
+	entries []changeEntry
+}
+
+type changeEntry struct {
+	seq   uint64
+	loc   string // hash, or hash+size if the size is known
+	mtime int64  // 0 if the block is not stored
+}
+
+func newChangeLog(mnt *VolumeMount, cluster *arvados.Cluster, logger logrus.FieldLogger) *changeLog {
+	if cluster.Collections.BlobChangeLogSize <= 0 {
+		return nil
+	}
+	return &changeLog{
+		mnt:    mnt,
+		size:   cluster.Collections.BlobChangeLogSize,
+		logger: logger.WithField("Volume", mnt.UUID),
+		id:     newChangeLogID(),
+	}
+}
+
+func newChangeLogID() string {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", buf)
+}
+
+// record adds an entry with the current state of the given block on
+// the mount, as reported by the volume. size is the size of the
+// block, or -1 if unknown.
+func (cl *changeLog) record(hash string, size int) {
+	if cl == nil {
+		return
+	}
+	lock := cl.blockLock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var mtime int64
+	t, err := cl.mnt.Volume.Mtime(hash)
+	if err == nil {
+		mtime = t.UnixNano()
+	} else if err != nil && !os.IsNotExist(err) {
+		// We don't know whether the block is still stored,
+		// so clients can't rely on our entries any more.
+		cl.logger.WithError(err).WithField("Block", hash).Warn("cannot determine block state, discarding change log")
+		cl.mtx.Lock()
+		cl.id = newChangeLogID()
+		cl.entries = nil
+		cl.mtx.Unlock()
+		return
+	}
+	cl.add(hash, size, mtime)
+}
+
+// recordWrite adds an entry for a block that has just been written
+// or touched, using the time the write completed instead of asking
+// the volume for the block's mtime. The stored mtime can only be
+// earlier, so the block won't look old enough to trash any sooner
+// than it really is.
+func (cl *changeLog) recordWrite(hash string, size int) {
+	if cl == nil {
+		return
+	}
+	lock := cl.blockLock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+	cl.add(hash, size, time.Now().UnixNano())
+}
+
+func (cl *changeLog) blockLock(hash string) *sync.Mutex {
+	lockIdx, _ := strconv.ParseUint(hash[:2], 16, 8)
+	return &cl.blockLocks[lockIdx]
+}
+
+// add appends an entry. The caller must hold the block's lock.
+func (cl *changeLog) add(hash string, size int, mtime int64) {
+	loc := hash
+	if size >= 0 && mtime != 0 {
+		loc = fmt.Sprintf("%s+%d", hash, size)
+	}
+
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	cl.seq++
+	cl.entries = append(cl.entries, changeEntry{seq: cl.seq, loc: loc, mtime: mtime})
+	if len(cl.entries) > cl.size {
+		cl.entries = cl.entries[len(cl.entries)-cl.size:]
+	}
+}
+
+// since returns the entries added after the given cursor was issued,
+// and a cursor for retrieving subsequent entries. If cursor is "", it
+// returns no entries.
+//
+// If any entries after the given cursor have been discarded, or the
+// cursor was issued by a different changeLog, since returns
+// errChangesUnavailable.
+func (cl *changeLog) since(cursor string) ([]changeEntry, string, error) {
+	if cl == nil {
+		return nil, "", errChangesUnavailable
+	}
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	next := fmt.Sprintf("%s-%d", cl.id, cl.seq)
+	if cursor == "" {
+		return nil, next, nil
+	}
+	dash := strings.IndexByte(cursor, '-')
+	if dash < 0 || cursor[:dash] != cl.id {
+		return nil, "", errChangesUnavailable
+	}
+	seq, err := strconv.ParseUint(cursor[dash+1:], 10, 64)
+	if err != nil || seq > cl.seq || cl.seq-seq > uint64(len(cl.entries)) {
+		return nil, "", errChangesUnavailable
+	}
+	ents := make([]changeEntry, cl.seq-seq)
+	copy(ents, cl.entries[len(cl.entries)-len(ents):])
+	return ents, next, nil
+}
+
+// Trash implements Volume, recording the change in the mount's change
+// log. If a quarantined block is gone afterward, it is removed from
+// the quarantine list.
+func (mnt *VolumeMount) Trash(loc string) error {
+	err := mnt.Volume.Trash(loc)
+	if !os.IsNotExist(err) {
+		// Even if Trash failed, the block might have been
+		// removed, so record its current state.
+		mnt.changes.record(loc, -1)
+	}
+	if mnt.scrub.isQuarantined(loc) {
+		if _, err := mnt.Volume.Mtime(loc); os.IsNotExist(err) {
+			mnt.scrub.unquarantine(loc)
+		}
+	}
+	return err
+}
+
+// Untrash implements Volume, recording the change in the mount's
+// change log.
+func (mnt *VolumeMount) Untrash(loc string) error {
+	err := mnt.Volume.Untrash(loc)
+	if err == nil {
+		mnt.changes.record(loc, -1)
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+func (s *HandlerSuite) TestMountChanges(c *check.C) {
+	s.cluster.Collections.BlobChangeLogSize = 3
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	mnt := s.handler.volmgr.AllWritable()[0]
+	v := mnt.Volume.(*MockVolume)
+	tok := arvadostest.SystemRootToken
+	path := "/mounts/" + mnt.UUID + "/changes"
+
+	resp := s.call("GET", path, "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+
+	resp = s.call("GET", path, tok, nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "\n")
+	cursor0 := resp.Header().Get("X-Keep-Change-Cursor")
+	c.Assert(cursor0, check.Not(check.Equals), "")
+
+	resp = s.call("PUT", "/mounts/"+mnt.UUID+"/blocks/"+TestHash, tok, TestBlock)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	// Writes are recorded with the time they completed, without
+	// asking the volume for the block's mtime.
+	c.Check(v.CallCount("Mtime"), check.Equals, 0)
+	ents, _, err := mnt.changes.since(cursor0)
+	c.Assert(err, check.IsNil)
+	c.Assert(ents, check.HasLen, 1)
+	c.Check(ents[0].mtime >= v.Timestamps[TestHash].UnixNano(), check.Equals, true)
+	c.Check(ents[0].mtime <= time.Now().UnixNano(), check.Equals, true)
+	putTime := ents[0].mtime
+	v.Timestamps[TestHash] = time.Now().Add(-time.Duration(s.cluster.Collections.BlobSigningTTL) - time.Hour)
+	c.Check(mnt.Trash(TestHash), check.IsNil)
+
+	resp = s.call("GET", path+"?since="+cursor0, tok, nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, fmt.Sprintf("%s+%d %d\n%s 0\n\n", TestHash, len(TestBlock), putTime, TestHash))
+	cursor1 := resp.Header().Get("X-Keep-Change-Cursor")
+	c.Check(cursor1, check.Not(check.Equals), cursor0)
+
+	// No changes since cursor1
+	resp = s.call("GET", path+"?since="+cursor1, tok, nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "\n")
+	c.Check(resp.Header().Get("X-Keep-Change-Cursor"), check.Equals, cursor1)
+
+	// Changes on other mounts aren't reported
+	other := s.handler.volmgr.AllWritable()[1]
+	c.Check(other.Put(context.Background(), TestHash2, TestBlock2), check.IsNil)
+	resp = s.call("GET", path+"?since="+cursor1, tok, nil)
+	c.Check(resp.Body.String(), check.Equals, "\n")
+
+	// Touching a block records the new mtime, but not the size
+	c.Check(mnt.Put(context.Background(), TestHash3, TestBlock3), check.IsNil)
+	c.Check(mnt.Touch(TestHash3), check.IsNil)
+	resp = s.call("GET", path+"?since="+cursor1, tok, nil)
+	c.Check(resp.Body.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n%s \d+\n\n`, TestHash3, len(TestBlock3), TestHash3))
+
+	// When more than BlobChangeLogSize changes have happened
+	// since the given cursor, the client has to get the full
+	// index instead.
+	c.Check(mnt.Touch(TestHash3), check.IsNil)
+	resp = s.call("GET", path+"?since="+cursor1, tok, nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(mnt.Touch(TestHash3), check.IsNil)
+	resp = s.call("GET", path+"?since="+cursor1, tok, nil)
+	c.Check(resp.Code, check.Equals, http.StatusGone)
+	resp = s.call("GET", path+"?since="+cursor0, tok, nil)
+	c.Check(resp.Code, check.Equals, http.StatusGone)
+
+	// Cursors from a different change log (e.g., before a
+	// restart) are rejected.
+	resp = s.call("GET", path+"?since=0123456789abcdef-1", tok, nil)
+	c.Check(resp.Code, check.Equals, http.StatusGone)
+
+	resp = s.call("GET", "/mounts/zzzzz-nyw5e-nonexistentmount/changes", tok, nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *HandlerSuite) TestMountChangesDisabled(c *check.C) {
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	mnt := s.handler.volmgr.AllWritable()[0]
+	c.Check(mnt.changes, check.IsNil)
+	resp := s.call("GET", "/mounts/"+mnt.UUID+"/changes", arvadostest.SystemRootToken, nil)
+	c.Check(resp.Code, check.Equals, http.StatusGone)
+}
+
+func (s *HandlerSuite) TestMountChangesQuarantine(c *check.C) {
+	s.cluster.Collections.BlobChangeLogSize = 10
+	mnt, v := s.setupScrub(c)
+	defer s.handler.volmgr.Close()
+	_, cursor, err := mnt.changes.since("")
+	c.Assert(err, check.IsNil)
+
+	// Quarantined blocks are still stored, so they aren't
+	// reported as removed.
+	c.Assert(mnt.scrub.scrubPass(context.Background()), check.IsNil)
+	ents, cursor, err := mnt.changes.since(cursor)
+	c.Check(err, check.IsNil)
+	c.Check(ents, check.HasLen, 0)
+
+	v.Timestamps[TestHash2] = time.Now().Add(-2 * s.cluster.Collections.BlobSigningTTL.Duration())
+	c.Check(mnt.Trash(TestHash2), check.IsNil)
+	ents, _, err = mnt.changes.since(cursor)
+	c.Check(err, check.IsNil)
+	c.Check(ents, check.HasLen, 1)
+	c.Check(ents[0].loc, check.Equals, TestHash2)
+	c.Check(ents[0].mtime, check.Equals, int64(0))
+}
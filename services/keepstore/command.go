@@ -119,10 +119,11 @@ type handler struct {
 	Cluster *arvados.Cluster
 	Logger  logrus.FieldLogger
 
-	pullq      *WorkQueue
-	trashq     *WorkQueue
-	volmgr     *RRVolumeManager
-	keepClient *keepclient.KeepClient
+	pullq       *WorkQueue
+	pullLimiter *pullLimiter
+	trashq      *WorkQueue
+	volmgr      *RRVolumeManager
+	keepClient  *keepclient.KeepClient
 
 	err       error
 	setupOnce sync.Once
@@ -185,6 +186,14 @@ func (h *handler) setup(ctx context.Context, cluster *arvados.Cluster, token str
 	h.volmgr = vm
 
 	// Initialize the pullq and workers
+	schedule, err := arvados.NewMaintenanceSchedule(h.Cluster.Collections.BalanceMaintenanceWindows, h.Cluster.Collections.BalanceMaintenanceTimeZone)
+	if err != nil {
+		return fmt.Errorf("Collections.BalanceMaintenanceWindows: %v", err)
+	}
+	h.pullLimiter = &pullLimiter{
+		rate:     int64(h.Cluster.Collections.BlobPullRate),
+		schedule: schedule,
+	}
 	h.pullq = NewWorkQueue()
 	for i := 0; i < 1 || i < h.Cluster.Collections.BlobReplicateConcurrency; i++ {
 		go h.runPullWorker(h.pullq)
@@ -0,0 +1,289 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed blocks are stored with a fixed-size header:
+//
+//   magic (8 bytes) | locator digest (16 bytes) | plaintext size (8 bytes, big-endian)
+//
+// followed by the compressed data. Including the locator digest in
+// the header means a block that was stored without compression can
+// never be mistaken for a compressed block: that would require the
+// block to contain its own MD5 digest.
+const (
+	compressedBlockMagic     = "\x00keepzs\x01"
+	compressedBlockHeaderLen = 32
+)
+
+// Maximum number of entries in a compressedVolume's size cache.
+// Each entry uses about 50 bytes.
+const compressedSizeCacheMax = 1 << 20
+
+type compressedSize struct {
+	stored int64
+	plain  int64
+}
+
+// compressedVolume wraps a Volume, compressing blocks before writing
+// them to the underlying volume and decompressing them after
+// reading. Blocks that are found without a compression header
+// (e.g., blocks written before compression was enabled) are returned
+// as is.
+type compressedVolume struct {
+	Volume
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+
+	// Plaintext sizes of blocks we have read or written, so
+	// IndexTo can report them. Limited to compressedSizeCacheMax
+	// entries.
+	sizes    map[[md5.Size]byte]compressedSize
+	sizesMtx sync.Mutex
+
+	bufPool sync.Pool
+}
+
+// newCompressedVolume returns a Volume that stores blocks in vol
+// using the given compression algorithm. If algorithm is empty, vol
+// itself is returned.
+func newCompressedVolume(vol Volume, algorithm string) (Volume, error) {
+	switch algorithm {
+	case "":
+		return vol, nil
+	case "zstd":
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q", algorithm)
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedVolume{
+		Volume:  vol,
+		encoder: enc,
+		decoder: dec,
+		sizes:   map[[md5.Size]byte]compressedSize{},
+		bufPool: sync.Pool{New: func() interface{} { return make([]byte, BlockSize) }},
+	}, nil
+}
+
+// InternalStats returns the underlying volume's stats, if any.
+func (v *compressedVolume) InternalStats() interface{} {
+	if is, ok := v.Volume.(InternalStatser); ok {
+		return is.InternalStats()
+	}
+	return nil
+}
+
+// parseHeader returns the plaintext size recorded in hdr, and
+// whether hdr is a valid compression header for the given locator.
+func (v *compressedVolume) parseHeader(loc string, hdr []byte) (int64, bool) {
+	if len(loc) < 32 || len(hdr) < compressedBlockHeaderLen || string(hdr[:8]) != compressedBlockMagic {
+		return 0, false
+	}
+	if hex.EncodeToString(hdr[8:24]) != loc[:32] {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(hdr[24:32])), true
+}
+
+// encode returns the data that should be stored for the given
+// block: either a compressed block with a header, or the original
+// block if compression doesn't make it smaller.
+func (v *compressedVolume) encode(loc string, block []byte) []byte {
+	if len(loc) < 32 || len(block) <= compressedBlockHeaderLen {
+		return block
+	}
+	digest, err := hex.DecodeString(loc[:32])
+	if err != nil {
+		return block
+	}
+	out := make([]byte, compressedBlockHeaderLen, len(block))
+	copy(out, compressedBlockMagic)
+	copy(out[8:24], digest)
+	binary.BigEndian.PutUint64(out[24:32], uint64(len(block)))
+	out = v.encoder.EncodeAll(block, out)
+	if len(out) >= len(block) {
+		return block
+	}
+	return out
+}
+
+// Get reads a block from the underlying volume and decompresses it
+// if needed.
+func (v *compressedVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	n, err := v.Volume.Get(ctx, loc, buf)
+	if err != nil {
+		return n, err
+	}
+	size, ok := v.parseHeader(loc, buf[:n])
+	if !ok {
+		v.setSize(loc, int64(n), int64(n))
+		return n, nil
+	}
+	if size > int64(len(buf)) {
+		return 0, TooLongError
+	}
+	src := append([]byte(nil), buf[compressedBlockHeaderLen:n]...)
+	data, err := v.decoder.DecodeAll(src, buf[:0])
+	if err != nil {
+		return 0, fmt.Errorf("error decompressing block %s: %s", loc, err)
+	}
+	if int64(len(data)) != size {
+		return 0, fmt.Errorf("error decompressing block %s: expected %d bytes, got %d", loc, size, len(data))
+	}
+	v.setSize(loc, int64(n), size)
+	return len(data), nil
+}
+
+// ReadRange implements Volume. Ranges of compressed blocks can't be
+// read without decompressing the entire block, so it uses
+// readRangeWithGet.
+func (v *compressedVolume) ReadRange(ctx context.Context, loc string, off, length int64, w io.Writer) error {
+	return readRangeWithGet(ctx, v, loc, off, length, w)
+}
+
+// Compare returns nil if Get(loc) would return the same content as
+// expect.
+func (v *compressedVolume) Compare(ctx context.Context, loc string, expect []byte) error {
+	buf := v.bufPool.Get().([]byte)
+	defer v.bufPool.Put(buf)
+	n, err := v.Get(ctx, loc, buf)
+	if err != nil {
+		return err
+	}
+	return compareReaderWithBuf(ctx, bytes.NewReader(buf[:n]), expect, loc[:32])
+}
+
+// Put compresses a block and writes it to the underlying volume.
+func (v *compressedVolume) Put(ctx context.Context, loc string, block []byte) error {
+	data := v.encode(loc, block)
+	if len(data) < len(block) {
+		// The stored data doesn't match the MD5 digest in
+		// the locator.
+		ctx = withStoredDigest(ctx, md5.Sum(data))
+	}
+	err := v.Volume.Put(ctx, loc, data)
+	if err == nil {
+		v.setSize(loc, int64(len(data)), int64(len(block)))
+	}
+	return err
+}
+
+// Trash moves the block to the underlying volume's trash area.
+func (v *compressedVolume) Trash(loc string) error {
+	err := v.Volume.Trash(loc)
+	if key, ok := sizeCacheKey(loc); ok && err == nil {
+		v.sizesMtx.Lock()
+		delete(v.sizes, key)
+		v.sizesMtx.Unlock()
+	}
+	return err
+}
+
+func sizeCacheKey(loc string) (key [md5.Size]byte, ok bool) {
+	if len(loc) < 32 {
+		return
+	}
+	_, err := hex.Decode(key[:], []byte(loc[:32]))
+	return key, err == nil
+}
+
+func (v *compressedVolume) setSize(loc string, stored, plain int64) {
+	key, ok := sizeCacheKey(loc)
+	if !ok {
+		return
+	}
+	v.sizesMtx.Lock()
+	defer v.sizesMtx.Unlock()
+	if _, exists := v.sizes[key]; !exists && len(v.sizes) >= compressedSizeCacheMax {
+		// Evict an arbitrary entry.
+		for k := range v.sizes {
+			delete(v.sizes, k)
+			break
+		}
+	}
+	v.sizes[key] = compressedSize{stored: stored, plain: plain}
+}
+
+// plainSize returns the plaintext size of the block stored as loc,
+// given its stored size, and whether the size is known without
+// reading the block.
+func (v *compressedVolume) plainSize(loc string, stored int64) (int64, bool) {
+	if stored <= compressedBlockHeaderLen {
+		// Too small to be a compressed block.
+		return stored, true
+	}
+	key, ok := sizeCacheKey(loc)
+	if !ok {
+		return 0, false
+	}
+	v.sizesMtx.Lock()
+	sz, ok := v.sizes[key]
+	v.sizesMtx.Unlock()
+	if !ok || sz.stored != stored {
+		return 0, false
+	}
+	return sz.plain, true
+}
+
+// IndexTo writes the underlying volume's index, replacing stored
+// sizes with plaintext sizes.
+//
+// Blocks whose plaintext size isn't in the size cache (i.e., blocks
+// that haven't been read or written since keepstore started) are
+// listed without a size. Reading every block's header to find its
+// size would be expensive, especially on an encrypted volume, where
+// it means reading and decrypting the entire block.
+func (v *compressedVolume) IndexTo(prefix string, w io.Writer) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(v.Volume.IndexTo(prefix, pw))
+	}()
+	defer pr.Close()
+	scanner := bufio.NewScanner(pr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		sp := strings.IndexByte(line, ' ')
+		plus := strings.IndexByte(line, '+')
+		if sp < 0 || plus < 0 || plus > sp {
+			return fmt.Errorf("error parsing index line %q", line)
+		}
+		loc := line[:plus]
+		stored, err := strconv.ParseInt(line[plus+1:sp], 10, 64)
+		if err != nil {
+			return fmt.Errorf("error parsing index line %q", line)
+		}
+		if plain, ok := v.plainSize(loc, stored); ok {
+			_, err = fmt.Fprintf(w, "%s+%d%s\n", loc, plain, line[sp:])
+		} else {
+			_, err = fmt.Fprintf(w, "%s%s\n", loc, line[sp:])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,205 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+	check "gopkg.in/check.v1"
+)
+
+type TestableCompressedVolume struct {
+	*compressedVolume
+	inner TestableVolume
+}
+
+// PutRaw writes a compressed block directly to the underlying
+// volume, even if the volume is readonly, and records its size like
+// Put does.
+func (v *TestableCompressedVolume) PutRaw(locator string, data []byte) {
+	stored := v.encode(locator, data)
+	v.inner.PutRaw(locator, stored)
+	v.setSize(locator, int64(len(stored)), int64(len(data)))
+}
+
+func (v *TestableCompressedVolume) TouchWithDate(locator string, lastPut time.Time) {
+	v.inner.TouchWithDate(locator, lastPut)
+}
+
+func (v *TestableCompressedVolume) Teardown() {
+	v.inner.Teardown()
+}
+
+func (v *TestableCompressedVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return v.inner.ReadWriteOperationLabelValues()
+}
+
+var _ = check.Suite(&CompressedVolumeSuite{})
+
+type CompressedVolumeSuite struct {
+	unix UnixVolumeSuite
+}
+
+func (s *CompressedVolumeSuite) SetUpTest(c *check.C) {
+	s.unix = UnixVolumeSuite{}
+	s.unix.SetUpTest(c)
+}
+
+func (s *CompressedVolumeSuite) TearDownTest(c *check.C) {
+	s.unix.TearDownTest(c)
+}
+
+func (s *CompressedVolumeSuite) newTestableVolume(c *check.C, cluster *arvados.Cluster, volume arvados.Volume, metrics *volumeMetricsVecs) *TestableCompressedVolume {
+	return s.wrap(c, s.unix.newTestableUnixVolume(c, cluster, volume, metrics, false))
+}
+
+func (s *CompressedVolumeSuite) wrap(c *check.C, inner TestableVolume) *TestableCompressedVolume {
+	vol, err := newCompressedVolume(inner, "zstd")
+	c.Assert(err, check.IsNil)
+	return &TestableCompressedVolume{
+		compressedVolume: vol.(*compressedVolume),
+		inner:            inner,
+	}
+}
+
+func (s *CompressedVolumeSuite) TestGeneric(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics)
+	})
+}
+
+func (s *CompressedVolumeSuite) TestGenericReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics)
+	})
+}
+
+func (s *CompressedVolumeSuite) TestUnsupportedAlgorithm(c *check.C) {
+	_, err := newCompressedVolume(&MockVolume{}, "rot13")
+	c.Check(err, check.ErrorMatches, `unsupported compression algorithm "rot13"`)
+
+	vol, err := newCompressedVolume(&MockVolume{}, "")
+	c.Check(err, check.IsNil)
+	c.Check(vol, check.FitsTypeOf, &MockVolume{})
+}
+
+func (s *CompressedVolumeSuite) TestCompressAndIndex(c *check.C) {
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics)
+	data := []byte(strings.Repeat("chr1\t12345\t.\tA\tG\t50\tPASS\n", 10000))
+	loc := fmt.Sprintf("%x", md5.Sum(data))
+
+	err := v.Put(context.Background(), loc, data)
+	c.Assert(err, check.IsNil)
+
+	// Stored data is smaller than the original block.
+	buf := make([]byte, BlockSize)
+	n, err := v.inner.Get(context.Background(), loc, buf)
+	c.Check(err, check.IsNil)
+	c.Check(n < len(data)/10, check.Equals, true)
+
+	n, err = v.Get(context.Background(), loc, buf)
+	c.Check(err, check.IsNil)
+	c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+	c.Check(v.Compare(context.Background(), loc, data), check.IsNil)
+
+	// Index reports the plaintext size from the size cache.
+	var idx bytes.Buffer
+	err = v.IndexTo(loc[:3], &idx)
+	c.Check(err, check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, loc, len(data)))
+
+	// A new volume (with an empty size cache) lists the block
+	// without a size, rather than reading it, until the block is
+	// read.
+	vol2, err := newCompressedVolume(v.inner, "zstd")
+	c.Assert(err, check.IsNil)
+	idx.Reset()
+	c.Check(vol2.IndexTo(loc[:3], &idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s \d+\n`, loc))
+	_, err = vol2.Get(context.Background(), loc, buf)
+	c.Check(err, check.IsNil)
+	idx.Reset()
+	c.Check(vol2.IndexTo(loc[:3], &idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, loc, len(data)))
+}
+
+func (s *CompressedVolumeSuite) TestReadUncompressedBlocks(c *check.C) {
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics)
+
+	plain := []byte(strings.Repeat("ACGT", 10000))
+	// A block that happens to start with the compression
+	// header magic, but was stored without compression.
+	lookalike := append([]byte(compressedBlockMagic), make([]byte, 1000)...)
+	for _, data := range [][]byte{plain, lookalike} {
+		loc := fmt.Sprintf("%x", md5.Sum(data))
+		v.inner.PutRaw(loc, data)
+
+		buf := make([]byte, BlockSize)
+		n, err := v.Get(context.Background(), loc, buf)
+		c.Check(err, check.IsNil)
+		c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+		c.Check(v.Compare(context.Background(), loc, data), check.IsNil)
+
+		var idx bytes.Buffer
+		err = v.IndexTo(loc, &idx)
+		c.Check(err, check.IsNil)
+		c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, loc, len(data)))
+	}
+}
+
+func (s *CompressedVolumeSuite) TestIncompressibleBlock(c *check.C) {
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics)
+	data := make([]byte, 4096)
+	_, err := rand.Read(data)
+	c.Assert(err, check.IsNil)
+	loc := fmt.Sprintf("%x", md5.Sum(data))
+	c.Check(v.encode(loc, data), check.DeepEquals, data)
+	c.Check(v.encode(TestHash, TestBlock), check.DeepEquals, TestBlock)
+}
+
+// Backends that verify the MD5 digest of written data accept
+// compressed blocks.
+func (s *CompressedVolumeSuite) TestChecksummingBackends(c *check.C) {
+	s3suite := &StubbedS3Suite{}
+	s3suite.SetUpTest(c)
+	s3awssuite := &StubbedS3AWSSuite{}
+	s3awssuite.SetUpTest(c)
+	gcssuite := &StubbedGCSSuite{}
+	gcssuite.SetUpTest(c)
+
+	data := []byte(strings.Repeat("chr1\t12345\t.\tA\tG\t50\tPASS\n", 10000))
+	loc := fmt.Sprintf("%x", md5.Sum(data))
+	for _, inner := range []TestableVolume{
+		s3suite.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics, -2*time.Second),
+		s3awssuite.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics, -2*time.Second),
+		gcssuite.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics, -2*time.Second),
+	} {
+		c.Logf("%T", inner)
+		v := s.wrap(c, inner)
+		defer v.Teardown()
+		c.Assert(v.Put(context.Background(), loc, data), check.IsNil)
+
+		buf := make([]byte, BlockSize)
+		n, err := inner.Get(context.Background(), loc, buf)
+		c.Check(err, check.IsNil)
+		c.Check(n < len(data)/10, check.Equals, true)
+
+		n, err = v.Get(context.Background(), loc, buf)
+		c.Check(err, check.IsNil)
+		c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+
+		var idx bytes.Buffer
+		c.Check(v.IndexTo(loc[:3], &idx), check.IsNil)
+		c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, loc, len(data)))
+	}
+}
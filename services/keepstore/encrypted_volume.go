@@ -0,0 +1,248 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	driver["Encrypted"] = newEncryptedVolume
+}
+
+// Encrypted blocks are stored as
+//
+//   magic (8 bytes) | key ID (32 bytes, NUL-padded) | nonce (12 bytes) | ciphertext | GCM tag (16 bytes)
+//
+// The ciphertext is always the same size as the plaintext, so the
+// plaintext size can be computed from the stored size without
+// reading the block.
+const (
+	encryptedBlockMagic     = "\x00keepen\x01"
+	encryptedKeyIDLen       = 32
+	encryptedNonceLen       = 12
+	encryptedBlockHeaderLen = 8 + encryptedKeyIDLen + encryptedNonceLen
+	encryptedBlockOverhead  = encryptedBlockHeaderLen + 16
+)
+
+func newEncryptedVolume(cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) (Volume, error) {
+	var params arvados.EncryptedVolumeDriverParameters
+	err := json.Unmarshal(volume.DriverParameters, &params)
+	if err != nil {
+		return nil, err
+	}
+	if params.Driver == "" {
+		return nil, errors.New("DriverParameters.Driver was not provided")
+	} else if params.Driver == "Encrypted" {
+		return nil, errors.New("DriverParameters.Driver cannot be Encrypted")
+	}
+	dri, ok := driver[params.Driver]
+	if !ok {
+		return nil, fmt.Errorf("DriverParameters: invalid driver %q", params.Driver)
+	}
+	innerVolume := volume
+	innerVolume.Driver = params.Driver
+	innerVolume.DriverParameters = params.DriverParameters
+	inner, err := dri(cluster, innerVolume, logger, metrics)
+	if err != nil {
+		return nil, err
+	}
+	v := &EncryptedVolume{Volume: inner, cluster: cluster}
+	return v, v.check()
+}
+
+// EncryptedVolume stores blocks on an underlying Volume, encrypting
+// them with AES-256-GCM using one of the cluster's
+// BlobEncryptionKeys.
+type EncryptedVolume struct {
+	Volume
+	cluster *arvados.Cluster
+
+	keyID   string
+	ciphers map[string]cipher.AEAD
+	bufPool sync.Pool
+}
+
+func (v *EncryptedVolume) check() error {
+	v.ciphers = map[string]cipher.AEAD{}
+	for id, secret := range v.cluster.Collections.BlobEncryptionKeys {
+		if id == "" || len(id) > encryptedKeyIDLen || strings.IndexByte(id, 0) >= 0 {
+			return fmt.Errorf("invalid key ID %q in Collections.BlobEncryptionKeys (must be 1-%d characters)", id, encryptedKeyIDLen)
+		}
+		if secret == "" {
+			return fmt.Errorf("Collections.BlobEncryptionKeys: key %q is empty", id)
+		}
+		// Derive a 256-bit AES key from the configured
+		// secret.
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("keepstore block encryption"))
+		block, err := aes.NewCipher(mac.Sum(nil))
+		if err != nil {
+			return err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		v.ciphers[id] = gcm
+	}
+	v.keyID = v.cluster.Collections.BlobEncryptionKeyID
+	if _, ok := v.ciphers[v.keyID]; !ok {
+		return fmt.Errorf("Collections.BlobEncryptionKeyID %q is not one of the configured Collections.BlobEncryptionKeys", v.keyID)
+	}
+	v.bufPool.New = func() interface{} { return make([]byte, BlockSize+encryptedBlockOverhead) }
+	return nil
+}
+
+// String implements Volume.
+func (v *EncryptedVolume) String() string {
+	return "encrypted " + v.Volume.String()
+}
+
+// InternalStats returns the underlying volume's stats, if any.
+func (v *EncryptedVolume) InternalStats() interface{} {
+	if is, ok := v.Volume.(InternalStatser); ok {
+		return is.InternalStats()
+	}
+	return nil
+}
+
+// encrypt returns the data that should be stored for the given
+// block, using the current key.
+func (v *EncryptedVolume) encrypt(loc string, block []byte) ([]byte, error) {
+	out := make([]byte, encryptedBlockHeaderLen, len(block)+encryptedBlockOverhead)
+	copy(out, encryptedBlockMagic)
+	copy(out[len(encryptedBlockMagic):], v.keyID)
+	nonce := out[encryptedBlockHeaderLen-encryptedNonceLen : encryptedBlockHeaderLen]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return v.ciphers[v.keyID].Seal(out, nonce, block, v.additionalData(loc)), nil
+}
+
+// decrypt decrypts stored data, appending the plaintext to dst.
+func (v *EncryptedVolume) decrypt(loc string, dst, stored []byte) ([]byte, error) {
+	if len(stored) < encryptedBlockOverhead || string(stored[:len(encryptedBlockMagic)]) != encryptedBlockMagic {
+		return nil, fmt.Errorf("block %s is not encrypted", loc)
+	}
+	keyID := string(bytes.TrimRight(stored[len(encryptedBlockMagic):len(encryptedBlockMagic)+encryptedKeyIDLen], "\x00"))
+	gcm, ok := v.ciphers[keyID]
+	if !ok {
+		return nil, fmt.Errorf("block %s is encrypted with unknown key ID %q", loc, keyID)
+	}
+	nonce := stored[encryptedBlockHeaderLen-encryptedNonceLen : encryptedBlockHeaderLen]
+	data, err := gcm.Open(dst, nonce, stored[encryptedBlockHeaderLen:], v.additionalData(loc))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting block %s: %s", loc, err)
+	}
+	return data, nil
+}
+
+// additionalData returns the authenticated data for a block, which
+// ensures stored data cannot be moved to a different locator without
+// detection.
+func (v *EncryptedVolume) additionalData(loc string) []byte {
+	if len(loc) > 32 {
+		loc = loc[:32]
+	}
+	return []byte(loc)
+}
+
+// Get reads a block from the underlying volume and decrypts it.
+func (v *EncryptedVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	stored := v.bufPool.Get().([]byte)
+	defer v.bufPool.Put(stored)
+	n, err := v.Volume.Get(ctx, loc, stored)
+	if err != nil {
+		return 0, err
+	}
+	if n-encryptedBlockOverhead > len(buf) {
+		return 0, TooLongError
+	}
+	data, err := v.decrypt(loc, buf[:0], stored[:n])
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// ReadRange implements Volume. The whole block must be read and
+// authenticated before any of it can be returned, so it uses
+// readRangeWithGet.
+func (v *EncryptedVolume) ReadRange(ctx context.Context, loc string, off, length int64, w io.Writer) error {
+	return readRangeWithGet(ctx, v, loc, off, length, w)
+}
+
+// Compare returns nil if Get(loc) would return the same content as
+// expect.
+func (v *EncryptedVolume) Compare(ctx context.Context, loc string, expect []byte) error {
+	buf := v.bufPool.Get().([]byte)
+	defer v.bufPool.Put(buf)
+	n, err := v.Get(ctx, loc, buf)
+	if err != nil {
+		return err
+	}
+	return compareReaderWithBuf(ctx, bytes.NewReader(buf[:n]), expect, loc[:32])
+}
+
+// Put encrypts a block and writes it to the underlying volume.
+func (v *EncryptedVolume) Put(ctx context.Context, loc string, block []byte) error {
+	data, err := v.encrypt(loc, block)
+	if err != nil {
+		return err
+	}
+	return v.Volume.Put(withStoredDigest(ctx, md5.Sum(data)), loc, data)
+}
+
+// IndexTo writes the underlying volume's index, replacing stored
+// sizes with plaintext sizes. Blocks that are too small to be
+// encrypted blocks are omitted, since Get would not be able to
+// retrieve them.
+func (v *EncryptedVolume) IndexTo(prefix string, w io.Writer) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(v.Volume.IndexTo(prefix, pw))
+	}()
+	defer pr.Close()
+	scanner := bufio.NewScanner(pr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		sp := strings.IndexByte(line, ' ')
+		plus := strings.IndexByte(line, '+')
+		if sp < 0 || plus < 0 || plus > sp {
+			return fmt.Errorf("error parsing index line %q", line)
+		}
+		stored, err := strconv.ParseInt(line[plus+1:sp], 10, 64)
+		if err != nil {
+			return fmt.Errorf("error parsing index line %q", line)
+		}
+		if stored < encryptedBlockOverhead {
+			continue
+		}
+		_, err = fmt.Fprintf(w, "%s+%d%s\n", line[:plus], stored-encryptedBlockOverhead, line[sp:])
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,287 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/sirupsen/logrus"
+	check "gopkg.in/check.v1"
+)
+
+type TestableEncryptedVolume struct {
+	*EncryptedVolume
+	inner TestableVolume
+}
+
+// PutRaw encrypts a block and writes it directly to the underlying
+// volume, even if the volume is readonly.
+func (v *TestableEncryptedVolume) PutRaw(locator string, data []byte) {
+	enc, err := v.encrypt(locator, data)
+	if err != nil {
+		panic(err)
+	}
+	v.inner.PutRaw(locator, enc)
+}
+
+func (v *TestableEncryptedVolume) TouchWithDate(locator string, lastPut time.Time) {
+	v.inner.TouchWithDate(locator, lastPut)
+}
+
+func (v *TestableEncryptedVolume) Teardown() {
+	v.inner.Teardown()
+}
+
+func (v *TestableEncryptedVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return v.inner.ReadWriteOperationLabelValues()
+}
+
+var _ = check.Suite(&EncryptedVolumeSuite{})
+
+type EncryptedVolumeSuite struct {
+	unix UnixVolumeSuite
+}
+
+func (s *EncryptedVolumeSuite) SetUpTest(c *check.C) {
+	s.unix = UnixVolumeSuite{}
+	s.unix.SetUpTest(c)
+	s.setKeys(s.unix.cluster, "key1")
+}
+
+func (s *EncryptedVolumeSuite) TearDownTest(c *check.C) {
+	s.unix.TearDownTest(c)
+}
+
+func (s *EncryptedVolumeSuite) setKeys(cluster *arvados.Cluster, current string) {
+	cluster.Collections.BlobEncryptionKeys = map[string]string{
+		"key1": "4b1cq0pqhv8wst4tbh9o7vyn2rw6nyw9vbdmf1vpr3ktzu1ocs",
+		"key2": "1zhdi6pfu1hvn6jdhw5xawbh2j8jhnl3qdqbzlrvffgt3gvmp9",
+	}
+	cluster.Collections.BlobEncryptionKeyID = current
+}
+
+func (s *EncryptedVolumeSuite) newTestableVolume(c *check.C, cluster *arvados.Cluster, volume arvados.Volume, metrics *volumeMetricsVecs) *TestableEncryptedVolume {
+	return s.wrap(c, cluster, s.unix.newTestableUnixVolume(c, cluster, volume, metrics, false))
+}
+
+func (s *EncryptedVolumeSuite) wrap(c *check.C, cluster *arvados.Cluster, inner TestableVolume) *TestableEncryptedVolume {
+	s.setKeys(cluster, "key1")
+	v := &EncryptedVolume{Volume: inner, cluster: cluster}
+	c.Assert(v.check(), check.IsNil)
+	return &TestableEncryptedVolume{EncryptedVolume: v, inner: inner}
+}
+
+func (s *EncryptedVolumeSuite) TestGeneric(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics)
+	})
+}
+
+func (s *EncryptedVolumeSuite) TestGenericReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics)
+	})
+}
+
+// Encrypted blocks are stored with the correct checksum on backends
+// that verify the MD5 digest of written data.
+func (s *EncryptedVolumeSuite) TestGenericGCS(c *check.C) {
+	gcssuite := &StubbedGCSSuite{}
+	gcssuite.SetUpTest(c)
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.wrap(c, cluster, gcssuite.newTestableVolume(c, cluster, volume, metrics, -2*time.Second))
+	})
+}
+
+func (s *EncryptedVolumeSuite) TestGenericS3(c *check.C) {
+	s3suite := &StubbedS3Suite{}
+	s3suite.SetUpTest(c)
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.wrap(c, cluster, s3suite.newTestableVolume(c, cluster, volume, metrics, -2*time.Second))
+	})
+}
+
+func (s *EncryptedVolumeSuite) TestDriverConfig(c *check.C) {
+	d, err := ioutil.TempDir("", "volume_test")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(d)
+
+	params, err := json.Marshal(arvados.EncryptedVolumeDriverParameters{
+		Driver:           "Directory",
+		DriverParameters: json.RawMessage(fmt.Sprintf(`{"Root":%q}`, d)),
+	})
+	c.Assert(err, check.IsNil)
+	vol, err := newEncryptedVolume(s.unix.cluster, arvados.Volume{Driver: "Encrypted", DriverParameters: params}, ctxlog.TestLogger(c), s.unix.metrics)
+	c.Assert(err, check.IsNil)
+	c.Check(vol.String(), check.Equals, "encrypted [UnixVolume "+d+"]")
+
+	err = vol.Put(context.Background(), TestHash, TestBlock)
+	c.Check(err, check.IsNil)
+	stored, err := ioutil.ReadFile(d + "/" + TestHash[:3] + "/" + TestHash)
+	c.Check(err, check.IsNil)
+	c.Check(len(stored), check.Equals, len(TestBlock)+encryptedBlockOverhead)
+	c.Check(bytes.Contains(stored, TestBlock), check.Equals, false)
+
+	for _, trial := range []struct {
+		params  string
+		current string
+		errorRe string
+	}{
+		{`{"Driver":""}`, "key1", `DriverParameters.Driver was not provided`},
+		{`{"Driver":"Encrypted"}`, "key1", `DriverParameters.Driver cannot be Encrypted`},
+		{`{"Driver":"Bogus"}`, "key1", `DriverParameters: invalid driver "Bogus"`},
+		{string(params), "key3", `Collections.BlobEncryptionKeyID "key3" is not .*`},
+	} {
+		s.setKeys(s.unix.cluster, trial.current)
+		_, err = newEncryptedVolume(s.unix.cluster, arvados.Volume{Driver: "Encrypted", DriverParameters: json.RawMessage(trial.params)}, ctxlog.TestLogger(c), s.unix.metrics)
+		c.Check(err, check.ErrorMatches, trial.errorRe)
+	}
+}
+
+func (s *EncryptedVolumeSuite) TestKeyRotation(c *check.C) {
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics)
+	data1 := []byte("written with key1")
+	loc1 := fmt.Sprintf("%x", md5.Sum(data1))
+	c.Assert(v.Put(context.Background(), loc1, data1), check.IsNil)
+
+	s.setKeys(s.unix.cluster, "key2")
+	c.Assert(v.check(), check.IsNil)
+	data2 := []byte("written with key2")
+	loc2 := fmt.Sprintf("%x", md5.Sum(data2))
+	c.Assert(v.Put(context.Background(), loc2, data2), check.IsNil)
+
+	buf := make([]byte, BlockSize)
+	for _, trial := range []struct {
+		loc   string
+		data  []byte
+		keyID string
+	}{
+		{loc1, data1, "key1"},
+		{loc2, data2, "key2"},
+	} {
+		n, err := v.inner.Get(context.Background(), trial.loc, buf)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf[len(encryptedBlockMagic):len(encryptedBlockMagic)+len(trial.keyID)]), check.Equals, trial.keyID)
+		c.Check(n, check.Equals, len(trial.data)+encryptedBlockOverhead)
+
+		n, err = v.Get(context.Background(), trial.loc, buf)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf[:n]), check.Equals, string(trial.data))
+	}
+
+	// Without key1, blocks encrypted with key1 are unreadable.
+	delete(s.unix.cluster.Collections.BlobEncryptionKeys, "key1")
+	c.Assert(v.check(), check.IsNil)
+	_, err := v.Get(context.Background(), loc1, buf)
+	c.Check(err, check.ErrorMatches, `block .* is encrypted with unknown key ID "key1"`)
+	_, err = v.Get(context.Background(), loc2, buf)
+	c.Check(err, check.IsNil)
+}
+
+func (s *EncryptedVolumeSuite) TestTamperedBlock(c *check.C) {
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics)
+	c.Assert(v.Put(context.Background(), TestHash, TestBlock), check.IsNil)
+
+	buf := make([]byte, BlockSize)
+	n, err := v.inner.Get(context.Background(), TestHash, buf)
+	c.Assert(err, check.IsNil)
+	stored := append([]byte(nil), buf[:n]...)
+
+	// Encrypted data copied to a different locator is
+	// detected.
+	v.inner.PutRaw(TestHash2, stored)
+	_, err = v.Get(context.Background(), TestHash2, buf)
+	c.Check(err, check.ErrorMatches, `error decrypting block .*`)
+
+	// Modified ciphertext is detected.
+	stored[encryptedBlockHeaderLen] ^= 1
+	v.inner.PutRaw(TestHash, stored)
+	_, err = v.Get(context.Background(), TestHash, buf)
+	c.Check(err, check.ErrorMatches, `error decrypting block .*`)
+
+	// Unencrypted data is not returned.
+	v.inner.PutRaw(TestHash, TestBlock)
+	_, err = v.Get(context.Background(), TestHash, buf)
+	c.Check(err, check.ErrorMatches, `block .* is not encrypted`)
+}
+
+func (s *EncryptedVolumeSuite) TestIndexWithCompression(c *check.C) {
+	v := s.newTestableVolume(c, s.unix.cluster, arvados.Volume{Replication: 1}, s.unix.metrics)
+	vol, err := newCompressedVolume(v, "zstd")
+	c.Assert(err, check.IsNil)
+
+	data := []byte(strings.Repeat("@read1\nACGTACGTTTGA\n+\nIIIIIIIIIIII\n", 1000))
+	loc := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(vol.Put(context.Background(), loc, data), check.IsNil)
+	c.Assert(v.Put(context.Background(), TestHash, TestBlock), check.IsNil)
+
+	buf := make([]byte, BlockSize)
+	n, err := vol.Get(context.Background(), loc, buf)
+	c.Check(err, check.IsNil)
+	c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+	n, err = v.inner.Get(context.Background(), loc, buf)
+	c.Check(err, check.IsNil)
+	c.Check(n < len(data)/10, check.Equals, true)
+
+	var idx bytes.Buffer
+	c.Check(v.IndexTo("", &idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`(?ms).*^%s\+%d \d+$.*`, TestHash, len(TestBlock)))
+
+	// The block written without compression is listed without a
+	// size until it has been read through the compressed volume.
+	idx.Reset()
+	c.Check(vol.IndexTo("", &idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`(?ms).*^%s\+%d \d+$.*`, loc, len(data)))
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`(?ms).*^%s \d+$.*`, TestHash))
+	_, err = vol.Get(context.Background(), TestHash, buf)
+	c.Check(err, check.IsNil)
+	idx.Reset()
+	c.Check(vol.IndexTo("", &idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`(?ms).*^%s\+%d \d+$.*`, TestHash, len(TestBlock)))
+}
+
+// When an Encrypted volume is configured with Compression, blocks
+// are compressed before they are encrypted.
+func (s *EncryptedVolumeSuite) TestCompressBeforeEncrypt(c *check.C) {
+	d, err := ioutil.TempDir("", "volume_test")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(d)
+
+	params, err := json.Marshal(arvados.EncryptedVolumeDriverParameters{
+		Driver:           "Directory",
+		DriverParameters: json.RawMessage(fmt.Sprintf(`{"Root":%q}`, d)),
+	})
+	c.Assert(err, check.IsNil)
+	s.unix.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Driver: "Encrypted", DriverParameters: params, Compression: "zstd", Replication: 1},
+	}
+	vm, err := makeRRVolumeManager(ctxlog.TestLogger(c), s.unix.cluster, arvados.URL{}, s.unix.metrics)
+	c.Assert(err, check.IsNil)
+	defer vm.Close()
+	c.Assert(vm.Mounts(), check.HasLen, 1)
+
+	data := []byte(strings.Repeat("@read1\nACGTACGTTTGA\n+\nIIIIIIIIIIII\n", 1000))
+	loc := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(vm.Mounts()[0].Put(context.Background(), loc, data), check.IsNil)
+	stored, err := ioutil.ReadFile(d + "/" + loc[:3] + "/" + loc)
+	c.Assert(err, check.IsNil)
+	c.Check(len(stored) < len(data)/10, check.Equals, true)
+	c.Check(string(stored[:len(encryptedBlockMagic)]), check.Equals, encryptedBlockMagic)
+
+	buf := make([]byte, BlockSize)
+	n, err := vm.Mounts()[0].Get(context.Background(), loc, buf)
+	c.Check(err, check.IsNil)
+	c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+}
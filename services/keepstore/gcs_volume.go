@@ -0,0 +1,803 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+func init() {
+	driver["GCS"] = newGCSVolume
+}
+
+func newGCSVolume(cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) (Volume, error) {
+	v := &GCSVolume{cluster: cluster, volume: volume, metrics: metrics}
+	err := json.Unmarshal(volume.DriverParameters, v)
+	if err != nil {
+		return nil, err
+	}
+	v.logger = logger.WithField("Volume", v.String())
+	return v, v.check()
+}
+
+const (
+	gcsDefaultRequestTimeout = arvados.Duration(10 * time.Minute)
+)
+
+var gcsKeepBlockRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+var gcsZeroTime time.Time
+
+// GCSVolume implements Volume using a Google Cloud Storage bucket.
+//
+// Like S3Volume, it stores each block as an object named by its
+// hash, uses an empty "recent/X" object to record the last time
+// block X was written or touched, and moves trashed blocks to
+// "trash/X".
+type GCSVolume struct {
+	arvados.GCSVolumeDriverParameters
+
+	cluster *arvados.Cluster
+	volume  arvados.Volume
+	logger  logrus.FieldLogger
+	metrics *volumeMetricsVecs
+	bucket  *gcsBucket
+}
+
+// gcsBucket wraps a storage service client and counts I/O and API
+// usage stats.
+type gcsBucket struct {
+	bucket string
+	svc    *storage.Service
+	stats  gcsBucketStats
+}
+
+// check validates the driver parameters and sets up the storage
+// service client. If any opts are given, they are used instead of
+// the configured credentials and timeouts (this is used by tests to
+// connect to a fake GCS server).
+func (v *GCSVolume) check(opts ...option.ClientOption) error {
+	if v.Bucket == "" {
+		return errors.New("DriverParameters: Bucket must be provided")
+	}
+	if v.IndexPageSize == 0 {
+		v.IndexPageSize = 1000
+	}
+	if v.RaceWindow < 0 {
+		return errors.New("DriverParameters: RaceWindow must not be negative")
+	}
+	if v.RequestTimeout == 0 {
+		v.RequestTimeout = gcsDefaultRequestTimeout
+	}
+
+	ctx := context.Background()
+	if len(opts) == 0 {
+		client, err := v.newHTTPClient(ctx)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, option.WithHTTPClient(client))
+	}
+	if v.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(v.Endpoint))
+	}
+	svc, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("creating GCS client: %s", err)
+	}
+	v.bucket = &gcsBucket{
+		bucket: v.Bucket,
+		svc:    svc,
+	}
+
+	// Set up prometheus metrics
+	lbls := prometheus.Labels{"device_id": v.GetDeviceID()}
+	v.bucket.stats.opsCounters, v.bucket.stats.errCounters, v.bucket.stats.ioBytes = v.metrics.getCounterVecsFor(lbls)
+
+	return nil
+}
+
+// newHTTPClient returns an authenticated HTTP client, using the
+// configured CredentialsFile if any, otherwise the application
+// default credentials.
+func (v *GCSVolume) newHTTPClient(ctx context.Context) (*http.Client, error) {
+	var creds *google.Credentials
+	if v.CredentialsFile != "" {
+		buf, err := ioutil.ReadFile(v.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CredentialsFile: %s", err)
+		}
+		creds, err = google.CredentialsFromJSON(ctx, buf, storage.DevstorageReadWriteScope)
+		if err != nil {
+			return nil, fmt.Errorf("loading CredentialsFile: %s", err)
+		}
+	} else {
+		var err error
+		creds, err = google.FindDefaultCredentials(ctx, storage.DevstorageReadWriteScope)
+		if err != nil {
+			return nil, fmt.Errorf("finding default GCS credentials: %s", err)
+		}
+	}
+	client := oauth2.NewClient(ctx, creds.TokenSource)
+	client.Timeout = time.Duration(v.RequestTimeout)
+	return client, nil
+}
+
+func (v *GCSVolume) isKeepBlock(s string) bool {
+	return gcsKeepBlockRegexp.MatchString(s)
+}
+
+func (v *GCSVolume) translateError(err error) error {
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// String implements fmt.Stringer.
+func (v *GCSVolume) String() string {
+	return fmt.Sprintf("gcs-bucket:%+q", v.Bucket)
+}
+
+// GetDeviceID returns a globally unique ID for the storage bucket.
+func (v *GCSVolume) GetDeviceID() string {
+	return "gs://" + v.Endpoint + "/" + v.Bucket
+}
+
+// Head returns the metadata for the given object.
+func (v *GCSVolume) Head(name string) (*storage.Object, error) {
+	obj, err := v.bucket.svc.Objects.Get(v.bucket.bucket, name).Do()
+	v.bucket.stats.TickOps("head")
+	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.HeadOps)
+	v.bucket.stats.TickErr(err)
+	if err != nil {
+		return nil, v.translateError(err)
+	}
+	return obj, nil
+}
+
+// gcsUpdated returns the last-modified time of the given object.
+func gcsUpdated(obj *storage.Object) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, obj.Updated)
+}
+
+// safeCopy copies src to dst, and checks the response to make sure
+// the copy succeeded and updated the timestamp on the destination
+// object.
+func (v *GCSVolume) safeCopy(dst, src string) error {
+	obj, err := v.bucket.svc.Objects.Copy(v.bucket.bucket, src, v.bucket.bucket, dst, &storage.Object{ContentType: "application/octet-stream"}).Do()
+	v.bucket.stats.TickOps("copy")
+	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.CopyOps)
+	v.bucket.stats.TickErr(err)
+	err = v.translateError(err)
+	if os.IsNotExist(err) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("Copy(%q ← %q): %s", dst, src, err)
+	}
+	t, err := gcsUpdated(obj)
+	if err != nil {
+		return fmt.Errorf("Copy succeeded but did not return a valid timestamp: %q: %s", obj.Updated, err)
+	} else if time.Now().Sub(t) > maxClockSkew {
+		return fmt.Errorf("Copy succeeded but returned an old timestamp: %q", obj.Updated)
+	}
+	return nil
+}
+
+func (v *GCSVolume) readWorker(ctx context.Context, loc string) (io.ReadCloser, error) {
+	resp, err := v.bucket.svc.Objects.Get(v.bucket.bucket, loc).Context(ctx).Download()
+	v.bucket.stats.TickOps("get")
+	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.GetOps)
+	v.bucket.stats.TickErr(err)
+	if err != nil {
+		return nil, v.translateError(err)
+	}
+	return resp.Body, nil
+}
+
+// Get a block: copy the block data into buf, and return the number of
+// bytes copied.
+func (v *GCSVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	return getWithPipe(ctx, loc, buf, v)
+}
+
+// ReadBlock implements BlockReader.
+func (v *GCSVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) error {
+	rdr, err := v.readWorker(ctx, loc)
+	if err == nil {
+		defer rdr.Close()
+		_, err = io.Copy(w, NewCountingReader(rdr, v.bucket.stats.TickInBytes))
+		return err
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	_, err = v.Head("recent/" + loc)
+	if err != nil {
+		// If we can't read recent/X, there's no point in
+		// trying fixRace. Give up.
+		return err
+	}
+	if !v.fixRace(loc) {
+		return os.ErrNotExist
+	}
+
+	rdr, err = v.readWorker(ctx, loc)
+	if err != nil {
+		v.logger.Warnf("reading %s after successful fixRace: %s", loc, err)
+		return err
+	}
+	defer rdr.Close()
+	_, err = io.Copy(w, NewCountingReader(rdr, v.bucket.stats.TickInBytes))
+	return err
+}
+
+// ReadRange implements Volume.
+func (v *GCSVolume) ReadRange(ctx context.Context, loc string, off, length int64, w io.Writer) error {
+	if length <= 0 {
+		return nil
+	}
+	call := v.bucket.svc.Objects.Get(v.bucket.bucket, loc).Context(ctx)
+	call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	resp, err := call.Download()
+	v.bucket.stats.TickOps("get")
+	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.GetOps)
+	v.bucket.stats.TickErr(err)
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusRequestedRangeNotSatisfiable {
+		// off is past the end of the block.
+		return nil
+	}
+	err = v.translateError(err)
+	if os.IsNotExist(err) {
+		// Use the full ReadBlock code path, which can recover
+		// from a Trash race (see fixRace).
+		return readRangeWithGet(ctx, v, loc, off, length, w)
+	} else if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, NewCountingReader(resp.Body, v.bucket.stats.TickInBytes))
+	return err
+}
+
+// Compare the given data with the stored data.
+func (v *GCSVolume) Compare(ctx context.Context, loc string, expect []byte) error {
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := v.Head("recent/" + loc)
+		errChan <- err
+	}()
+	var err error
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err = <-errChan:
+	}
+	if err != nil {
+		// As in S3Volume, avoid checking for "loc" itself
+		// until we know it has been written.
+		return err
+	}
+	rdr, err := v.readWorker(ctx, loc)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	return v.translateError(compareReaderWithBuf(ctx, NewCountingReader(rdr, v.bucket.stats.TickInBytes), expect, loc[:32]))
+}
+
+func (v *GCSVolume) writeObject(ctx context.Context, name string, r io.Reader) error {
+	obj := &storage.Object{
+		Name:        name,
+		ContentType: "application/octet-stream",
+	}
+	if len(name) == 32 {
+		md5, err := storedDigest(ctx, name)
+		if err != nil {
+			return err
+		}
+		obj.Md5Hash = base64.StdEncoding.EncodeToString(md5)
+	}
+	if r == nil {
+		r = strings.NewReader("")
+	}
+	// ChunkSize(0) uploads the whole object in a single request
+	// instead of using a resumable upload session.
+	_, err := v.bucket.svc.Objects.Insert(v.bucket.bucket, obj).Media(r, googleapi.ChunkSize(0), googleapi.ContentType("application/octet-stream")).Context(ctx).Do()
+	v.bucket.stats.TickOps("put")
+	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.PutOps)
+	v.bucket.stats.TickErr(err)
+	return v.translateError(err)
+}
+
+// Put writes a block.
+func (v *GCSVolume) Put(ctx context.Context, loc string, block []byte) error {
+	return putWithPipe(ctx, loc, block, v)
+}
+
+// WriteBlock implements BlockWriter.
+func (v *GCSVolume) WriteBlock(ctx context.Context, loc string, rdr io.Reader) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	err := v.writeObject(ctx, loc, NewCountingReader(rdr, v.bucket.stats.TickOutBytes))
+	if err != nil {
+		return err
+	}
+	return v.writeObject(ctx, "recent/"+loc, nil)
+}
+
+// Touch sets the timestamp for the given locator to the current time.
+func (v *GCSVolume) Touch(loc string) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	_, err := v.Head(loc)
+	if os.IsNotExist(err) && v.fixRace(loc) {
+		// The data object got trashed in a race, but fixRace
+		// rescued it.
+	} else if err != nil {
+		return err
+	}
+	return v.writeObject(context.Background(), "recent/"+loc, nil)
+}
+
+// Mtime returns the stored timestamp for the given locator.
+func (v *GCSVolume) Mtime(loc string) (time.Time, error) {
+	_, err := v.Head(loc)
+	if err != nil {
+		return gcsZeroTime, err
+	}
+	obj, err := v.Head("recent/" + loc)
+	if os.IsNotExist(err) {
+		// The data object X exists, but recent/X is missing.
+		err = v.writeObject(context.Background(), "recent/"+loc, nil)
+		if err != nil {
+			v.logger.WithError(err).Errorf("error creating %q", "recent/"+loc)
+			return gcsZeroTime, err
+		}
+		v.logger.Infof("Mtime: created %q to migrate existing block to new storage scheme", "recent/"+loc)
+		obj, err = v.Head("recent/" + loc)
+		if err != nil {
+			v.logger.WithError(err).Errorf("HEAD failed after creating %q", "recent/"+loc)
+			return gcsZeroTime, err
+		}
+	} else if err != nil {
+		// HEAD recent/X failed for some other reason.
+		return gcsZeroTime, err
+	}
+	return gcsUpdated(obj)
+}
+
+// IndexTo writes a complete list of locators with the given prefix
+// for which Get() can retrieve data.
+func (v *GCSVolume) IndexTo(prefix string, writer io.Writer) error {
+	// Use a merge sort to find matching sets of X and recent/X.
+	dataL := gcsLister{
+		Logger:   v.logger,
+		Bucket:   v.bucket,
+		Prefix:   prefix,
+		PageSize: v.IndexPageSize,
+	}
+	recentL := gcsLister{
+		Logger:   v.logger,
+		Bucket:   v.bucket,
+		Prefix:   "recent/" + prefix,
+		PageSize: v.IndexPageSize,
+	}
+	for data, recent := dataL.First(), recentL.First(); data != nil && dataL.Error() == nil; data = dataL.Next() {
+		if data.Name >= "g" {
+			// Conveniently, "recent/*" and "trash/*" are
+			// lexically greater than all hex-encoded data
+			// hashes, so stopping here avoids iterating
+			// over all of them needlessly with dataL.
+			break
+		}
+		if !v.isKeepBlock(data.Name) {
+			continue
+		}
+
+		// stamp is the list entry we should use to report the
+		// last-modified time for this data block: it will be
+		// the recent/X entry if one exists, otherwise the
+		// entry for the data block itself.
+		stamp := data
+
+		// Advance to the corresponding recent/X marker, if any
+		for recent != nil && recentL.Error() == nil {
+			if cmp := strings.Compare(recent.Name[7:], data.Name); cmp < 0 {
+				recent = recentL.Next()
+				continue
+			} else if cmp == 0 {
+				stamp = recent
+				recent = recentL.Next()
+				break
+			} else {
+				// recent/X marker is missing: we'll
+				// use the timestamp on the data
+				// object.
+				break
+			}
+		}
+		if err := recentL.Error(); err != nil {
+			return err
+		}
+		t, err := gcsUpdated(stamp)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q on object %q: %s", stamp.Updated, stamp.Name, err)
+		}
+		fmt.Fprintf(writer, "%s+%d %d\n", data.Name, data.Size, t.UnixNano())
+	}
+	return dataL.Error()
+}
+
+// Trash a Keep block.
+func (v *GCSVolume) Trash(loc string) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	if t, err := v.Mtime(loc); err != nil {
+		return err
+	} else if time.Since(t) < v.cluster.Collections.BlobSigningTTL.Duration() {
+		return nil
+	}
+	if v.cluster.Collections.BlobTrashLifetime == 0 {
+		if !v.UnsafeDelete {
+			return ErrS3TrashDisabled
+		}
+		return v.translateError(v.bucket.Del(loc))
+	}
+	err := v.checkRaceWindow(loc)
+	if err != nil {
+		return err
+	}
+	err = v.safeCopy("trash/"+loc, loc)
+	if err != nil {
+		return err
+	}
+	return v.translateError(v.bucket.Del(loc))
+}
+
+// checkRaceWindow returns a non-nil error if trash/loc is, or might
+// be, in the race window (i.e., it's not safe to trash loc).
+func (v *GCSVolume) checkRaceWindow(loc string) error {
+	obj, err := v.Head("trash/" + loc)
+	if os.IsNotExist(err) {
+		// OK, trash/X doesn't exist so we're not in the race
+		// window
+		return nil
+	} else if err != nil {
+		// Error looking up trash/X. We don't know whether
+		// we're in the race window
+		return err
+	}
+	t, err := gcsUpdated(obj)
+	if err != nil {
+		return err
+	}
+	safeWindow := t.Add(v.cluster.Collections.BlobTrashLifetime.Duration()).Sub(time.Now().Add(time.Duration(v.RaceWindow)))
+	if safeWindow <= 0 {
+		// We can't count on "touch trash/X" to prolong
+		// trash/X's lifetime. The new timestamp might not
+		// become visible until now+raceWindow, and EmptyTrash
+		// is allowed to delete trash/X before then.
+		return fmt.Errorf("same block is already in trash, and safe window ended %s ago", -safeWindow)
+	}
+	// trash/X exists, but it won't be eligible for deletion until
+	// after now+raceWindow, so it's safe to overwrite it.
+	return nil
+}
+
+// Untrash moves block from trash back into store
+func (v *GCSVolume) Untrash(loc string) error {
+	err := v.safeCopy(loc, "trash/"+loc)
+	if err != nil {
+		return err
+	}
+	return v.writeObject(context.Background(), "recent/"+loc, nil)
+}
+
+// fixRace(X) is called when "recent/X" exists but "X" doesn't
+// exist. If the timestamps on "recent/"+loc and "trash/"+loc indicate
+// there was a race between Put and Trash, fixRace recovers from the
+// race by Untrashing the block.
+func (v *GCSVolume) fixRace(loc string) bool {
+	trash, err := v.Head("trash/" + loc)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			v.logger.WithError(err).Errorf("fixRace: HEAD %q failed", "trash/"+loc)
+		}
+		return false
+	}
+	trashTime, err := gcsUpdated(trash)
+	if err != nil {
+		v.logger.WithError(err).Errorf("fixRace: invalid timestamp on %q", "trash/"+loc)
+		return false
+	}
+
+	recent, err := v.Head("recent/" + loc)
+	if err != nil {
+		v.logger.WithError(err).Errorf("fixRace: HEAD %q failed", "recent/"+loc)
+		return false
+	}
+	recentTime, err := gcsUpdated(recent)
+	if err != nil {
+		v.logger.WithError(err).Errorf("fixRace: invalid timestamp on %q", "recent/"+loc)
+		return false
+	}
+
+	ageWhenTrashed := trashTime.Sub(recentTime)
+	if ageWhenTrashed >= v.cluster.Collections.BlobSigningTTL.Duration() {
+		// No evidence of a race: block hasn't been written
+		// since it became eligible for Trash. No fix needed.
+		return false
+	}
+
+	v.logger.Infof("fixRace: %q: trashed at %s but touched at %s (age when trashed = %s < %s)", loc, trashTime, recentTime, ageWhenTrashed, v.cluster.Collections.BlobSigningTTL)
+	v.logger.Infof("fixRace: copying %q to %q to recover from race between Put/Touch and Trash", "recent/"+loc, loc)
+	err = v.safeCopy(loc, "trash/"+loc)
+	if err != nil {
+		v.logger.WithError(err).Error("fixRace: copy failed")
+		return false
+	}
+	return true
+}
+
+// EmptyTrash looks for trashed blocks that exceeded BlobTrashLifetime
+// and deletes them from the volume.
+func (v *GCSVolume) EmptyTrash() {
+	if v.cluster.Collections.BlobDeleteConcurrency < 1 {
+		return
+	}
+
+	var bytesInTrash, blocksInTrash, bytesDeleted, blocksDeleted int64
+
+	// Define "ready to delete" as "...when EmptyTrash started".
+	startT := time.Now()
+
+	emptyOneKey := func(trash *storage.Object) {
+		loc := strings.TrimPrefix(trash.Name, "trash/")
+		if !v.isKeepBlock(loc) {
+			return
+		}
+		atomic.AddInt64(&bytesInTrash, int64(trash.Size))
+		atomic.AddInt64(&blocksInTrash, 1)
+
+		trashT, err := gcsUpdated(trash)
+		if err != nil {
+			v.logger.WithError(err).Warnf("EmptyTrash: invalid timestamp on %q", trash.Name)
+			return
+		}
+		recent, err := v.Head("recent/" + loc)
+		if os.IsNotExist(err) {
+			v.logger.Warnf("EmptyTrash: found trash marker %q but no %q (%s); calling Untrash", trash.Name, "recent/"+loc, err)
+			err = v.Untrash(loc)
+			if err != nil {
+				v.logger.WithError(err).Errorf("EmptyTrash: Untrash(%q) failed", loc)
+			}
+			return
+		} else if err != nil {
+			v.logger.WithError(err).Warnf("EmptyTrash: HEAD %q failed", "recent/"+loc)
+			return
+		}
+		recentT, err := gcsUpdated(recent)
+		if err != nil {
+			v.logger.WithError(err).Warnf("EmptyTrash: invalid timestamp on %q", "recent/"+loc)
+			return
+		}
+		if trashT.Sub(recentT) < v.cluster.Collections.BlobSigningTTL.Duration() {
+			if age := startT.Sub(recentT); age >= v.cluster.Collections.BlobSigningTTL.Duration()-time.Duration(v.RaceWindow) {
+				// recent/loc is too old to protect
+				// loc from being Trashed again during
+				// the raceWindow that starts if we
+				// delete trash/X now.
+				//
+				// Note this means (TrashSweepInterval
+				// < BlobSigningTTL - raceWindow) is
+				// necessary to avoid starvation.
+				v.logger.Infof("EmptyTrash: detected old race for %q, calling fixRace + Touch", loc)
+				v.fixRace(loc)
+				v.Touch(loc)
+				return
+			}
+			_, err := v.Head(loc)
+			if os.IsNotExist(err) {
+				v.logger.Infof("EmptyTrash: detected recent race for %q, calling fixRace", loc)
+				v.fixRace(loc)
+				return
+			} else if err != nil {
+				v.logger.WithError(err).Warnf("EmptyTrash: HEAD %q failed", loc)
+				return
+			}
+		}
+		if startT.Sub(trashT) < v.cluster.Collections.BlobTrashLifetime.Duration() {
+			return
+		}
+		err = v.bucket.Del(trash.Name)
+		if err != nil {
+			v.logger.WithError(err).Errorf("EmptyTrash: error deleting %q", trash.Name)
+			return
+		}
+		atomic.AddInt64(&bytesDeleted, int64(trash.Size))
+		atomic.AddInt64(&blocksDeleted, 1)
+
+		_, err = v.Head(loc)
+		if err == nil {
+			v.logger.Warnf("EmptyTrash: HEAD %q succeeded immediately after deleting %q", loc, loc)
+			return
+		}
+		if !os.IsNotExist(err) {
+			v.logger.WithError(err).Warnf("EmptyTrash: HEAD %q failed", loc)
+			return
+		}
+		err = v.bucket.Del("recent/" + loc)
+		if err != nil {
+			v.logger.WithError(err).Warnf("EmptyTrash: error deleting %q", "recent/"+loc)
+		}
+	}
+
+	var wg sync.WaitGroup
+	todo := make(chan *storage.Object, v.cluster.Collections.BlobDeleteConcurrency)
+	for i := 0; i < v.cluster.Collections.BlobDeleteConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range todo {
+				emptyOneKey(key)
+			}
+		}()
+	}
+
+	trashL := gcsLister{
+		Logger:   v.logger,
+		Bucket:   v.bucket,
+		Prefix:   "trash/",
+		PageSize: v.IndexPageSize,
+	}
+	for trash := trashL.First(); trash != nil; trash = trashL.Next() {
+		todo <- trash
+	}
+	close(todo)
+	wg.Wait()
+
+	if err := trashL.Error(); err != nil {
+		v.logger.WithError(err).Error("EmptyTrash: lister failed")
+	}
+	v.logger.Infof("EmptyTrash: stats for %v: Deleted %v bytes in %v blocks. Remaining in trash: %v bytes in %v blocks.", v.String(), bytesDeleted, blocksDeleted, bytesInTrash-bytesDeleted, blocksInTrash-blocksDeleted)
+}
+
+// Status returns a *VolumeStatus representing the current in-use
+// storage capacity and a fake available capacity that doesn't make
+// the volume seem full or nearly-full.
+func (v *GCSVolume) Status() *VolumeStatus {
+	return &VolumeStatus{
+		DeviceNum: 1,
+		BytesFree: BlockSize * 1000,
+		BytesUsed: 1,
+	}
+}
+
+// InternalStats returns bucket I/O and API call counters.
+func (v *GCSVolume) InternalStats() interface{} {
+	return &v.bucket.stats
+}
+
+// Del deletes the given object.
+func (b *gcsBucket) Del(name string) error {
+	err := b.svc.Objects.Delete(b.bucket, name).Do()
+	b.stats.TickOps("delete")
+	b.stats.Tick(&b.stats.Ops, &b.stats.DelOps)
+	b.stats.TickErr(err)
+	return err
+}
+
+type gcsLister struct {
+	Logger    logrus.FieldLogger
+	Bucket    *gcsBucket
+	Prefix    string
+	PageSize  int
+	pageToken string
+	buf       []*storage.Object
+	err       error
+}
+
+// First fetches the first page and returns the first item. It returns
+// nil if the response is the empty set or an error occurs.
+func (lister *gcsLister) First() *storage.Object {
+	lister.getPage()
+	return lister.pop()
+}
+
+// Next returns the next item, fetching the next page if necessary. It
+// returns nil if the last available item has already been fetched, or
+// an error occurs.
+func (lister *gcsLister) Next() *storage.Object {
+	if len(lister.buf) == 0 && lister.pageToken != "" {
+		lister.getPage()
+	}
+	return lister.pop()
+}
+
+// Return the most recent error encountered by First or Next.
+func (lister *gcsLister) Error() error {
+	return lister.err
+}
+
+func (lister *gcsLister) getPage() {
+	stats := &lister.Bucket.stats
+	stats.TickOps("list")
+	stats.Tick(&stats.Ops, &stats.ListOps)
+	call := lister.Bucket.svc.Objects.List(lister.Bucket.bucket).Prefix(lister.Prefix).MaxResults(int64(lister.PageSize))
+	if lister.pageToken != "" {
+		call = call.PageToken(lister.pageToken)
+	}
+	resp, err := call.Do()
+	stats.TickErr(err)
+	if err != nil {
+		lister.err = err
+		lister.pageToken = ""
+		return
+	}
+	lister.pageToken = resp.NextPageToken
+	lister.buf = make([]*storage.Object, 0, len(resp.Items))
+	for _, obj := range resp.Items {
+		if !strings.HasPrefix(obj.Name, lister.Prefix) {
+			lister.Logger.Warnf("gcsLister: GCS Objects.List(prefix=%q) returned object %q", lister.Prefix, obj.Name)
+			continue
+		}
+		lister.buf = append(lister.buf, obj)
+	}
+}
+
+func (lister *gcsLister) pop() (obj *storage.Object) {
+	if len(lister.buf) > 0 {
+		obj = lister.buf[0]
+		lister.buf = lister.buf[1:]
+	}
+	return
+}
+
+type gcsBucketStats struct {
+	statsTicker
+	Ops     uint64
+	GetOps  uint64
+	PutOps  uint64
+	HeadOps uint64
+	CopyOps uint64
+	DelOps  uint64
+	ListOps uint64
+}
+
+func (s *gcsBucketStats) TickErr(err error) {
+	if err == nil {
+		return
+	}
+	errType := fmt.Sprintf("%T", err)
+	if gerr, ok := err.(*googleapi.Error); ok {
+		errType = errType + fmt.Sprintf(" %d", gerr.Code)
+	}
+	s.statsTicker.TickErr(err, errType)
+}
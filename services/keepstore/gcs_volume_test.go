@@ -0,0 +1,645 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+	check "gopkg.in/check.v1"
+)
+
+const (
+	GCSTestBucketName = "testbucket"
+)
+
+type fakeGCSObject struct {
+	data    []byte
+	updated time.Time
+}
+
+// fakeGCSServer implements the subset of the Google Cloud Storage
+// JSON API used by GCSVolume, storing objects in memory.
+type fakeGCSServer struct {
+	// If now is not nil, it is used as the timestamp for new
+	// objects instead of the current time.
+	now *time.Time
+
+	objects map[string]*fakeGCSObject
+	mtx     sync.Mutex
+}
+
+func newFakeGCSServer() *fakeGCSServer {
+	return &fakeGCSServer{objects: map[string]*fakeGCSObject{}}
+}
+
+func (srv *fakeGCSServer) Now() time.Time {
+	if srv.now == nil {
+		return time.Now().UTC()
+	}
+	return srv.now.UTC()
+}
+
+// put stores an object directly, bypassing the API.
+func (srv *fakeGCSServer) put(name string, data []byte, t time.Time) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	srv.objects[name] = &fakeGCSObject{data: append([]byte(nil), data...), updated: t}
+}
+
+func (srv *fakeGCSServer) objectJSON(name string, obj *fakeGCSObject) map[string]interface{} {
+	sum := md5.Sum(obj.data)
+	return map[string]interface{}{
+		"kind":        "storage#object",
+		"bucket":      GCSTestBucketName,
+		"name":        name,
+		"size":        strconv.Itoa(len(obj.data)),
+		"md5Hash":     base64.StdEncoding.EncodeToString(sum[:]),
+		"contentType": "application/octet-stream",
+		"updated":     obj.updated.Format(time.RFC3339Nano),
+	}
+}
+
+func (srv *fakeGCSServer) sendError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": msg},
+	})
+}
+
+func (srv *fakeGCSServer) sendJSON(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (srv *fakeGCSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	var path []string
+	for _, p := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		p, err := url.PathUnescape(p)
+		if err != nil {
+			srv.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		path = append(path, p)
+	}
+	if len(path) > 0 && path[0] == "upload" {
+		path = path[1:]
+	}
+	if len(path) < 5 || path[0] != "storage" || path[1] != "v1" || path[2] != "b" || path[3] != GCSTestBucketName || path[4] != "o" {
+		srv.sendError(w, http.StatusNotFound, "no such bucket")
+		return
+	}
+	path = path[5:]
+
+	switch {
+	case r.Method == "GET" && len(path) == 0:
+		srv.list(w, r)
+	case r.Method == "POST" && len(path) == 0:
+		srv.insert(w, r)
+	case r.Method == "GET" && len(path) == 1:
+		obj, ok := srv.objects[path[0]]
+		if !ok {
+			srv.sendError(w, http.StatusNotFound, "no such object")
+		} else if r.FormValue("alt") == "media" {
+			// ServeContent handles Range requests.
+			http.ServeContent(w, r, path[0], time.Time{}, bytes.NewReader(obj.data))
+		} else {
+			srv.sendJSON(w, srv.objectJSON(path[0], obj))
+		}
+	case r.Method == "DELETE" && len(path) == 1:
+		if _, ok := srv.objects[path[0]]; !ok {
+			srv.sendError(w, http.StatusNotFound, "no such object")
+			return
+		}
+		delete(srv.objects, path[0])
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && len(path) == 6 && path[1] == "copyTo" && path[2] == "b" && path[4] == "o":
+		src, ok := srv.objects[path[0]]
+		if !ok {
+			srv.sendError(w, http.StatusNotFound, "no such object")
+			return
+		}
+		dst := &fakeGCSObject{data: src.data, updated: srv.Now()}
+		srv.objects[path[5]] = dst
+		srv.sendJSON(w, srv.objectJSON(path[5], dst))
+	default:
+		srv.sendError(w, http.StatusBadRequest, "unsupported request")
+	}
+}
+
+func (srv *fakeGCSServer) insert(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" {
+		srv.sendError(w, http.StatusBadRequest, "expected multipart upload")
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		srv.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var meta struct {
+		Name    string
+		Md5Hash string
+	}
+	err = json.NewDecoder(part).Decode(&meta)
+	if err != nil {
+		srv.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		srv.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	data, err := ioutil.ReadAll(part)
+	if err != nil {
+		srv.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if meta.Md5Hash != "" {
+		sum := md5.Sum(data)
+		if meta.Md5Hash != base64.StdEncoding.EncodeToString(sum[:]) {
+			srv.sendError(w, http.StatusBadRequest, "md5 mismatch")
+			return
+		}
+	}
+	obj := &fakeGCSObject{data: data, updated: srv.Now()}
+	srv.objects[meta.Name] = obj
+	srv.sendJSON(w, srv.objectJSON(meta.Name, obj))
+}
+
+func (srv *fakeGCSServer) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.FormValue("prefix")
+	maxResults, _ := strconv.Atoi(r.FormValue("maxResults"))
+	if maxResults < 1 {
+		maxResults = 1000
+	}
+	var names []string
+	for name := range srv.objects {
+		if strings.HasPrefix(name, prefix) && name > r.FormValue("pageToken") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	resp := map[string]interface{}{"kind": "storage#objects"}
+	if len(names) > maxResults {
+		names = names[:maxResults]
+		resp["nextPageToken"] = names[maxResults-1]
+	}
+	items := []interface{}{}
+	for _, name := range names {
+		items = append(items, srv.objectJSON(name, srv.objects[name]))
+	}
+	resp["items"] = items
+	srv.sendJSON(w, resp)
+}
+
+var _ = check.Suite(&StubbedGCSSuite{})
+
+type StubbedGCSSuite struct {
+	// If not nil, newTestableVolume connects to this server
+	// instead of a new fakeGCSServer.
+	gcsserver *httptest.Server
+	cluster   *arvados.Cluster
+}
+
+func (s *StubbedGCSSuite) SetUpTest(c *check.C) {
+	s.gcsserver = nil
+	s.cluster = testCluster(c)
+}
+
+func (s *StubbedGCSSuite) TestGeneric(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics, -2*time.Second)
+	})
+}
+
+func (s *StubbedGCSSuite) TestGenericReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics, -2*time.Second)
+	})
+}
+
+func (s *StubbedGCSSuite) TestIndex(c *check.C) {
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 0)
+	v.IndexPageSize = 3
+	for i := 0; i < 256; i++ {
+		v.PutRaw(fmt.Sprintf("%02x%030x", i, i), []byte{102, 111, 111})
+	}
+	for _, spec := range []struct {
+		prefix      string
+		expectMatch int
+	}{
+		{"", 256},
+		{"c", 16},
+		{"bc", 1},
+		{"abc", 0},
+	} {
+		buf := new(bytes.Buffer)
+		err := v.IndexTo(spec.prefix, buf)
+		c.Check(err, check.IsNil)
+
+		idx := bytes.SplitAfter(buf.Bytes(), []byte{10})
+		c.Check(len(idx), check.Equals, spec.expectMatch+1)
+		c.Check(len(idx[len(idx)-1]), check.Equals, 0)
+	}
+}
+
+func (s *StubbedGCSSuite) TestStats(c *check.C) {
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 5*time.Minute)
+	stats := func() string {
+		buf, err := json.Marshal(v.InternalStats())
+		c.Check(err, check.IsNil)
+		return string(buf)
+	}
+
+	c.Check(stats(), check.Matches, `.*"Ops":0,.*`)
+
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	_, err := v.Get(context.Background(), loc, make([]byte, 3))
+	c.Check(err, check.NotNil)
+	c.Check(stats(), check.Matches, `.*"Ops":[^0],.*`)
+	c.Check(stats(), check.Matches, `.*"\*googleapi.Error 404[^"]*":[^0].*`)
+	c.Check(stats(), check.Matches, `.*"InBytes":0,.*`)
+
+	err = v.Put(context.Background(), loc, []byte("foo"))
+	c.Check(err, check.IsNil)
+	c.Check(stats(), check.Matches, `.*"OutBytes":3,.*`)
+	c.Check(stats(), check.Matches, `.*"PutOps":2,.*`)
+
+	_, err = v.Get(context.Background(), loc, make([]byte, 3))
+	c.Check(err, check.IsNil)
+	_, err = v.Get(context.Background(), loc, make([]byte, 3))
+	c.Check(err, check.IsNil)
+	c.Check(stats(), check.Matches, `.*"InBytes":6,.*`)
+}
+
+func (s *StubbedGCSSuite) TestPutChecksMD5(c *check.C) {
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 0)
+	err := v.Put(context.Background(), "acbd18db4cc2f85cedef654fccc4a4d8", []byte("bar"))
+	c.Check(err, check.NotNil)
+	_, err = v.Mtime("acbd18db4cc2f85cedef654fccc4a4d8")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+type gcsBlockingHandler struct {
+	requested chan *http.Request
+	unblock   chan struct{}
+}
+
+func (h *gcsBlockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.requested != nil {
+		h.requested <- r
+	}
+	if h.unblock != nil {
+		<-h.unblock
+	}
+	http.Error(w, "nothing here", http.StatusNotFound)
+}
+
+func (s *StubbedGCSSuite) TestGetContextCancel(c *check.C) {
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	buf := make([]byte, 3)
+
+	s.testContextCancel(c, func(ctx context.Context, v *TestableGCSVolume) error {
+		_, err := v.Get(ctx, loc, buf)
+		return err
+	})
+}
+
+func (s *StubbedGCSSuite) TestCompareContextCancel(c *check.C) {
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	buf := []byte("bar")
+
+	s.testContextCancel(c, func(ctx context.Context, v *TestableGCSVolume) error {
+		return v.Compare(ctx, loc, buf)
+	})
+}
+
+func (s *StubbedGCSSuite) TestPutContextCancel(c *check.C) {
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	buf := []byte("foo")
+
+	s.testContextCancel(c, func(ctx context.Context, v *TestableGCSVolume) error {
+		return v.Put(ctx, loc, buf)
+	})
+}
+
+func (s *StubbedGCSSuite) testContextCancel(c *check.C, testFunc func(context.Context, *TestableGCSVolume) error) {
+	handler := &gcsBlockingHandler{}
+	s.gcsserver = httptest.NewServer(handler)
+	defer s.gcsserver.Close()
+
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 5*time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	handler.requested = make(chan *http.Request)
+	handler.unblock = make(chan struct{})
+	defer close(handler.unblock)
+
+	doneFunc := make(chan struct{})
+	go func() {
+		err := testFunc(ctx, v)
+		c.Check(err, check.Equals, context.Canceled)
+		close(doneFunc)
+	}()
+
+	timeout := time.After(10 * time.Second)
+
+	// Wait for the stub server to receive a request, meaning
+	// the test func is waiting for a GCS operation.
+	select {
+	case <-timeout:
+		c.Fatal("timed out waiting for test func to call our handler")
+	case <-doneFunc:
+		c.Fatal("test func finished without even calling our handler!")
+	case <-handler.requested:
+	}
+
+	cancel()
+
+	select {
+	case <-timeout:
+		c.Fatal("timed out")
+	case <-doneFunc:
+	}
+}
+
+func (s *StubbedGCSSuite) TestBackendStates(c *check.C) {
+	s.cluster.Collections.BlobTrashLifetime.Set("1h")
+	s.cluster.Collections.BlobSigningTTL.Set("1h")
+
+	v := s.newTestableVolume(c, s.cluster, arvados.Volume{Replication: 2}, newVolumeMetricsVecs(prometheus.NewRegistry()), 5*time.Minute)
+	var none time.Time
+
+	putGCSObj := func(t time.Time, key string, data []byte) {
+		if t == none {
+			return
+		}
+		v.server.put(key, data, t)
+	}
+
+	t0 := time.Now()
+	nextKey := 0
+	for _, scenario := range []struct {
+		label               string
+		dataT               time.Time
+		recentT             time.Time
+		trashT              time.Time
+		canGet              bool
+		canTrash            bool
+		canGetAfterTrash    bool
+		canUntrash          bool
+		haveTrashAfterEmpty bool
+		freshAfterEmpty     bool
+	}{
+		{
+			"No related objects",
+			none, none, none,
+			false, false, false, false, false, false,
+		},
+		{
+			// Stored by older version, or there was a
+			// race between EmptyTrash and Put: Trash is a
+			// no-op even though the data object is very
+			// old
+			"No recent/X",
+			t0.Add(-48 * time.Hour), none, none,
+			true, true, true, false, false, false,
+		},
+		{
+			"Not trash, but old enough to be eligible for trash",
+			t0.Add(-24 * time.Hour), t0.Add(-2 * time.Hour), none,
+			true, true, false, false, false, false,
+		},
+		{
+			"Not trash, and not old enough to be eligible for trash",
+			t0.Add(-24 * time.Hour), t0.Add(-30 * time.Minute), none,
+			true, true, true, false, false, false,
+		},
+		{
+			"Trashed + untrashed copies exist, due to recent race between Trash and Put",
+			t0.Add(-24 * time.Hour), t0.Add(-3 * time.Minute), t0.Add(-2 * time.Minute),
+			true, true, true, true, true, false,
+		},
+		{
+			"Trashed + untrashed copies exist, trash nearly eligible for deletion: prone to Trash race",
+			t0.Add(-24 * time.Hour), t0.Add(-12 * time.Hour), t0.Add(-59 * time.Minute),
+			true, false, true, true, true, false,
+		},
+		{
+			"Trashed + untrashed copies exist, trash is eligible for deletion: prone to Trash race",
+			t0.Add(-24 * time.Hour), t0.Add(-12 * time.Hour), t0.Add(-61 * time.Minute),
+			true, false, true, true, false, false,
+		},
+		{
+			"Trashed + untrashed copies exist, due to old race between Put and unfinished Trash: emptying trash is unsafe",
+			t0.Add(-24 * time.Hour), t0.Add(-12 * time.Hour), t0.Add(-12 * time.Hour),
+			true, false, true, true, true, true,
+		},
+		{
+			"Trashed + untrashed copies exist, used to be unsafe to empty, but since made safe by fixRace+Touch",
+			t0.Add(-time.Second), t0.Add(-time.Second), t0.Add(-12 * time.Hour),
+			true, true, true, true, false, false,
+		},
+		{
+			"Trashed + untrashed copies exist because Trash operation was interrupted (no race)",
+			t0.Add(-24 * time.Hour), t0.Add(-24 * time.Hour), t0.Add(-12 * time.Hour),
+			true, false, true, true, false, false,
+		},
+		{
+			"Trash, not yet eligible for deletion",
+			none, t0.Add(-12 * time.Hour), t0.Add(-time.Minute),
+			false, false, false, true, true, false,
+		},
+		{
+			"Trash, not yet eligible for deletion, prone to races",
+			none, t0.Add(-12 * time.Hour), t0.Add(-59 * time.Minute),
+			false, false, false, true, true, false,
+		},
+		{
+			"Trash, eligible for deletion",
+			none, t0.Add(-12 * time.Hour), t0.Add(-2 * time.Hour),
+			false, false, false, true, false, false,
+		},
+		{
+			"Erroneously trashed during a race, detected before BlobTrashLifetime",
+			none, t0.Add(-30 * time.Minute), t0.Add(-29 * time.Minute),
+			true, false, true, true, true, false,
+		},
+		{
+			"Erroneously trashed during a race, rescue during EmptyTrash despite reaching BlobTrashLifetime",
+			none, t0.Add(-90 * time.Minute), t0.Add(-89 * time.Minute),
+			true, false, true, true, true, false,
+		},
+		{
+			"Trashed copy exists with no recent/* marker (cause unknown); repair by untrashing",
+			none, none, t0.Add(-time.Minute),
+			false, false, false, true, true, true,
+		},
+	} {
+		c.Log("Scenario: ", scenario.label)
+
+		// We have a few tests to run for each scenario, and
+		// the tests are expected to change state. By calling
+		// this setup func between tests, we (re)create the
+		// scenario as specified, using a new unique block
+		// locator to prevent interference from previous
+		// tests.
+
+		setupScenario := func() (string, []byte) {
+			nextKey++
+			blk := []byte(fmt.Sprintf("%d", nextKey))
+			loc := fmt.Sprintf("%x", md5.Sum(blk))
+			c.Log("\t", loc)
+			putGCSObj(scenario.dataT, loc, blk)
+			putGCSObj(scenario.recentT, "recent/"+loc, nil)
+			putGCSObj(scenario.trashT, "trash/"+loc, blk)
+			v.server.now = &t0
+			return loc, blk
+		}
+
+		// Check canGet
+		loc, blk := setupScenario()
+		buf := make([]byte, len(blk))
+		_, err := v.Get(context.Background(), loc, buf)
+		c.Check(err == nil, check.Equals, scenario.canGet)
+		if err != nil {
+			c.Check(os.IsNotExist(err), check.Equals, true)
+		}
+
+		// Call Trash, then check canTrash and canGetAfterTrash
+		loc, _ = setupScenario()
+		err = v.Trash(loc)
+		c.Check(err == nil, check.Equals, scenario.canTrash)
+		_, err = v.Get(context.Background(), loc, buf)
+		c.Check(err == nil, check.Equals, scenario.canGetAfterTrash)
+		if err != nil {
+			c.Check(os.IsNotExist(err), check.Equals, true)
+		}
+
+		// Call Untrash, then check canUntrash
+		loc, _ = setupScenario()
+		err = v.Untrash(loc)
+		c.Check(err == nil, check.Equals, scenario.canUntrash)
+		if scenario.dataT != none || scenario.trashT != none {
+			// In all scenarios where the data exists, we
+			// should be able to Get after Untrash --
+			// regardless of timestamps, errors, race
+			// conditions, etc.
+			_, err = v.Get(context.Background(), loc, buf)
+			c.Check(err, check.IsNil)
+		}
+
+		// Call EmptyTrash, then check haveTrashAfterEmpty and
+		// freshAfterEmpty
+		loc, _ = setupScenario()
+		v.EmptyTrash()
+		_, err = v.Head("trash/" + loc)
+		c.Check(err == nil, check.Equals, scenario.haveTrashAfterEmpty)
+		if scenario.freshAfterEmpty {
+			t, err := v.Mtime(loc)
+			c.Check(err, check.IsNil)
+			// new mtime must be current (with an
+			// allowance for 1s timestamp precision)
+			c.Check(t.After(t0.Add(-time.Second)), check.Equals, true)
+		}
+
+		// Check for current Mtime after Put (applies to all
+		// scenarios)
+		loc, blk = setupScenario()
+		err = v.Put(context.Background(), loc, blk)
+		c.Check(err, check.IsNil)
+		t, err := v.Mtime(loc)
+		c.Check(err, check.IsNil)
+		c.Check(t.After(t0.Add(-time.Second)), check.Equals, true)
+	}
+}
+
+type TestableGCSVolume struct {
+	*GCSVolume
+	server     *fakeGCSServer
+	httpserver *httptest.Server
+}
+
+func (s *StubbedGCSSuite) newTestableVolume(c *check.C, cluster *arvados.Cluster, volume arvados.Volume, metrics *volumeMetricsVecs, raceWindow time.Duration) *TestableGCSVolume {
+	fake := newFakeGCSServer()
+	srv := httptest.NewServer(fake)
+	endpoint := srv.URL
+	if s.gcsserver != nil {
+		endpoint = s.gcsserver.URL
+	}
+
+	v := &TestableGCSVolume{
+		GCSVolume: &GCSVolume{
+			GCSVolumeDriverParameters: arvados.GCSVolumeDriverParameters{
+				Bucket:        GCSTestBucketName,
+				Endpoint:      endpoint + "/storage/v1/",
+				IndexPageSize: 1000,
+				UnsafeDelete:  true,
+			},
+			cluster: cluster,
+			volume:  volume,
+			logger:  ctxlog.TestLogger(c),
+			metrics: metrics,
+		},
+		server:     fake,
+		httpserver: srv,
+	}
+	c.Assert(v.GCSVolume.check(option.WithHTTPClient(&http.Client{})), check.IsNil)
+	// We need to set this after check() since negative
+	// RaceWindow values are not allowed in config.
+	v.GCSVolume.RaceWindow = arvados.Duration(raceWindow)
+	return v
+}
+
+// PutRaw stores data directly in the fake server, bypassing
+// readonly checks and MD5 verification.
+func (v *TestableGCSVolume) PutRaw(loc string, block []byte) {
+	t := v.server.Now()
+	v.server.put(loc, block, t)
+	v.server.put("recent/"+loc, nil, t)
+}
+
+// TouchWithDate sets the timestamp on the recent/X marker.
+func (v *TestableGCSVolume) TouchWithDate(locator string, lastPut time.Time) {
+	v.server.put("recent/"+locator, nil, lastPut)
+}
+
+func (v *TestableGCSVolume) Teardown() {
+	v.httpserver.Close()
+}
+
+func (v *TestableGCSVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return "get", "put"
+}
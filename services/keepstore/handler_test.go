@@ -16,11 +16,15 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
@@ -29,6 +33,7 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
 	"github.com/prometheus/client_golang/prometheus"
 	check "gopkg.in/check.v1"
 )
@@ -71,10 +76,11 @@ func (s *HandlerSuite) SetUpTest(c *check.C) {
 // A RequestTester represents the parameters for an HTTP request to
 // be issued on behalf of a unit test.
 type RequestTester struct {
-	uri         string
-	apiToken    string
-	method      string
-	requestBody []byte
+	uri            string
+	apiToken       string
+	method         string
+	requestBody    []byte
+	storageClasses string
 }
 
 // Test GetBlockHandler on the following situations:
@@ -200,6 +206,142 @@ func (s *HandlerSuite) TestGetHandler(c *check.C) {
 		503, response)
 }
 
+// Test GetBlockHandler with Range headers. Ranges are honored only if
+// the locator has a size hint, and are computed from the actual block
+// size if the hint is wrong.
+func (s *HandlerSuite) TestGetHandlerRange(c *check.C) {
+	s.cluster.Collections.BlobSigning = false
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+
+	vols := s.handler.volmgr.AllWritable()
+	c.Assert(vols[0].Put(context.Background(), TestHash, TestBlock), check.IsNil)
+
+	sizedLocator := fmt.Sprintf("/%s+%d", TestHash, len(TestBlock))
+	for _, trial := range []struct {
+		uri          string
+		rangeHeader  string
+		expectCode   int
+		expectBody   string
+		contentRange string
+	}{
+		{sizedLocator, "bytes=4-8", http.StatusPartialContent, "quick", "bytes 4-8/44"},
+		{sizedLocator, "bytes=40-", http.StatusPartialContent, "dog.", "bytes 40-43/44"},
+		{sizedLocator, "bytes=-4", http.StatusPartialContent, "dog.", "bytes 40-43/44"},
+		{sizedLocator, "bytes=36-1000", http.StatusPartialContent, "azy dog.", "bytes 36-43/44"},
+		{sizedLocator, "bytes=44-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */44"},
+		{sizedLocator, "bytes=0-1,4-5", http.StatusOK, string(TestBlock), ""},
+		{sizedLocator, "bytes=8-4", http.StatusOK, string(TestBlock), ""},
+		{sizedLocator, "items=4-8", http.StatusOK, string(TestBlock), ""},
+		{"/" + TestHash, "bytes=4-8", http.StatusOK, string(TestBlock), ""},
+		{fmt.Sprintf("/%s+%d", TestHash2, len(TestBlock2)), "bytes=4-8", http.StatusNotFound, "", ""},
+		{"/" + TestHash + "+50", "bytes=4-8", http.StatusPartialContent, "quick", "bytes 4-8/44"},
+		{"/" + TestHash + "+50", "bytes=40-", http.StatusPartialContent, "dog.", "bytes 40-43/44"},
+		{"/" + TestHash + "+50", "bytes=46-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */44"},
+		{"/" + TestHash + "+40", "bytes=36-", http.StatusPartialContent, "azy dog.", "bytes 36-43/44"},
+		{"/" + TestHash + "+40", "bytes=4-8", http.StatusPartialContent, "quick", "bytes 4-8/44"},
+		{"/" + TestHash + "+40", "bytes=40-", http.StatusPartialContent, "dog.", "bytes 40-43/44"},
+	} {
+		comment := check.Commentf("%s %s", trial.uri, trial.rangeHeader)
+		response := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", trial.uri, nil)
+		req.Header.Set("Range", trial.rangeHeader)
+		s.handler.ServeHTTP(response, req)
+		c.Check(response.Code, check.Equals, trial.expectCode, comment)
+		if trial.expectBody != "" {
+			c.Check(response.Body.String(), check.Equals, trial.expectBody, comment)
+			c.Check(response.Header().Get("Content-Length"), check.Equals, fmt.Sprintf("%d", len(trial.expectBody)), comment)
+		}
+		c.Check(response.Header().Get("Content-Range"), check.Equals, trial.contentRange, comment)
+	}
+	// Each ranged read that doesn't include the end of the block
+	// needs a second ReadRange call to check the size hint.
+	c.Check(vols[0].Volume.(*MockVolume).CallCount("ReadRange"), check.Equals, 13)
+}
+
+// Small range requests don't wait for a block-sized buffer.
+func (s *HandlerSuite) TestGetRangeNeedsNoBuffer(c *check.C) {
+	s.cluster.Collections.BlobSigning = false
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	vols := s.handler.volmgr.AllWritable()
+	c.Assert(vols[0].Put(context.Background(), TestHash, TestBlock), check.IsNil)
+
+	defer func(orig *bufferPool) {
+		bufs = orig
+	}(bufs)
+	bufs = newBufferPool(ctxlog.TestLogger(c), 1, BlockSize)
+	defer bufs.Put(bufs.Get(BlockSize))
+
+	ok := make(chan struct{})
+	go func() {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/%s+%d", TestHash, len(TestBlock)), nil)
+		req.Header.Set("Range", "bytes=4-7")
+		s.handler.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+		c.Check(resp.Body.String(), check.Equals, string(TestBlock[4:8]))
+		close(ok)
+	}()
+	select {
+	case <-ok:
+	case <-time.After(time.Second):
+		c.Fatal("range request waited for a buffer")
+	}
+}
+
+// Test GetBlockHandler and the mount block API with erasure-coded
+// shards.
+func (s *HandlerSuite) TestGetErasureShard(c *check.C) {
+	s.cluster.Collections.BlobSigning = true
+	s.cluster.Collections.BlobSigningKey = knownKey
+	s.cluster.Collections.BlobSigningTTL.Set("5m")
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	vols := s.handler.volmgr.AllWritable()
+	tok := arvadostest.SystemRootToken
+
+	codec, err := erasure.NewCodec(2, 1)
+	c.Assert(err, check.IsNil)
+	shards := erasure.Split(codec, TestHash, TestBlock)
+	shard := shards[1].Marshal()
+
+	// A shard is accepted only under its own locator.
+	resp := s.call("PUT", "/mounts/"+vols[0].UUID+"/blocks/"+erasure.ShardLocator(TestHash, 0), tok, shard)
+	c.Check(resp.Code, check.Equals, http.StatusUnprocessableEntity)
+	resp = s.call("PUT", "/mounts/"+vols[0].UUID+"/blocks/"+erasure.ShardLocator(TestHash, 1), tok, shard)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+
+	get := func(locator, shardIdx string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/"+locator, nil)
+		req.Header.Set("Authorization", "OAuth2 "+knownToken)
+		req.Header.Set("Range", "bytes=0-1")
+		if shardIdx != "" {
+			req.Header.Set("X-Keep-Erasure-Shard", shardIdx)
+		}
+		s.handler.ServeHTTP(resp, req)
+		return resp
+	}
+	signed := SignLocator(s.cluster, TestHash+"+"+fmt.Sprint(len(TestBlock)), knownToken, time.Now().Add(time.Minute))
+	resp = get(signed, "1")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.Bytes(), check.DeepEquals, shard)
+	resp = get(signed, "0")
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+	resp = get(signed, "")
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+	resp = get(signed, "-1")
+	c.Check(resp.Code, check.Equals, http.StatusBadRequest)
+
+	// The shard header doesn't bypass permission checks.
+	resp = get(TestHash, "1")
+	c.Check(resp.Code, check.Equals, PermissionError.HTTPCode)
+
+	// A corrupt shard is not returned.
+	shard[len(shard)-1]++
+	vols[0].Volume.(*MockVolume).Store[erasure.ShardLocator(TestHash, 1)] = shard
+	resp = get(signed, "1")
+	c.Check(resp.Code, check.Equals, DiskHashError.HTTPCode)
+}
+
 // Test PutBlockHandler on the following situations:
 //   - no server key
 //   - with server key, authenticated request, unsigned locator
@@ -275,6 +417,99 @@ func (s *HandlerSuite) TestPutHandler(c *check.C) {
 		TestHashPutResp, response)
 }
 
+// Test that PUT requests are written directly from the request body
+// to volumes that support streaming, without using a buffer from the
+// buffer pool.
+func (s *HandlerSuite) TestPutHandlerStreaming(c *check.C) {
+	var roots []string
+	s.cluster.Volumes = map[string]arvados.Volume{}
+	for i := 0; i < 2; i++ {
+		root, err := ioutil.TempDir("", "keepstore-stream")
+		c.Assert(err, check.IsNil)
+		defer os.RemoveAll(root)
+		roots = append(roots, root)
+		s.cluster.Volumes[fmt.Sprintf("zzzzz-nyw5e-%015d", i)] = arvados.Volume{
+			Replication:      1,
+			Driver:           "Directory",
+			DriverParameters: json.RawMessage(fmt.Sprintf(`{"Root":%q}`, root)),
+		}
+	}
+	s.cluster.Collections.BlobSigningKey = ""
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+
+	// Hold the only buffer, so a buffered write would block.
+	defer func(orig *bufferPool) {
+		bufs = orig
+	}(bufs)
+	bufs = newBufferPool(ctxlog.TestLogger(c), 1, BlockSize)
+	buf := bufs.Get(BlockSize)
+
+	blockFiles := func() (files []string) {
+		for _, root := range roots {
+			found, err := filepath.Glob(root + "/*/*")
+			c.Assert(err, check.IsNil)
+			files = append(files, found...)
+		}
+		return
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		// Checksum mismatch => 422, and nothing is stored.
+		response := IssueRequest(s.handler, &RequestTester{
+			method:      "PUT",
+			uri:         "/" + TestHash,
+			requestBody: TestBlock2,
+		})
+		ExpectStatusCode(c, "checksum mismatch", RequestHashError.HTTPCode, response)
+		c.Check(blockFiles(), check.HasLen, 0)
+
+		response = IssueRequest(s.handler, &RequestTester{
+			method:      "PUT",
+			uri:         "/" + TestHash,
+			requestBody: TestBlock,
+		})
+		ExpectStatusCode(c, "streaming put", http.StatusOK, response)
+		ExpectBody(c, "streaming put", TestHashPutResp, response)
+		c.Check(response.Header().Get("X-Keep-Replicas-Stored"), check.Equals, "1")
+		c.Check(blockFiles(), check.HasLen, 1)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out, assuming PUT was waiting for a buffer")
+	}
+
+	// Writing an existing block uses the buffered path, so the
+	// existing data can be compared.
+	bufs.Put(buf)
+	response := IssueRequest(s.handler, &RequestTester{
+		method:      "PUT",
+		uri:         "/" + TestHash,
+		requestBody: TestBlock,
+	})
+	ExpectStatusCode(c, "existing block", http.StatusOK, response)
+	c.Check(blockFiles(), check.HasLen, 1)
+}
+
+func (s *HandlerSuite) TestHashCheckReader(c *check.C) {
+	for _, trial := range []struct {
+		data      string
+		size      int64
+		expectErr error
+	}{
+		{string(TestBlock), int64(len(TestBlock)), nil},
+		{string(TestBlock2), int64(len(TestBlock2)), RequestHashError},
+		{string(TestBlock[:10]), int64(len(TestBlock)), io.ErrUnexpectedEOF},
+		{string(TestBlock) + "extra", int64(len(TestBlock)), nil},
+	} {
+		hr := &hashCheckReader{Reader: strings.NewReader(trial.data), Hash: md5.New(), Check: TestHash, Size: trial.size}
+		_, err := ioutil.ReadAll(hr)
+		c.Check(err, check.Equals, trial.expectErr, check.Commentf("%q", trial.data))
+	}
+}
+
 func (s *HandlerSuite) TestPutAndDeleteSkipReadonlyVolumes(c *check.C) {
 	s.cluster.Volumes["zzzzz-nyw5e-000000000000000"] = arvados.Volume{Driver: "mock", ReadOnly: true}
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
@@ -318,6 +553,59 @@ func (s *HandlerSuite) TestPutAndDeleteSkipReadonlyVolumes(c *check.C) {
 	}
 }
 
+func (s *HandlerSuite) TestPutWithStorageClasses(c *check.C) {
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "mock"}, // "default" is implicit
+		"zzzzz-nyw5e-111111111111111": {Replication: 1, Driver: "mock", StorageClasses: map[string]bool{"special": true, "extra": true}},
+		"zzzzz-nyw5e-222222222222222": {Replication: 1, Driver: "mock", StorageClasses: map[string]bool{"readonly": true}, ReadOnly: true},
+	}
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	rt := RequestTester{
+		method:      "PUT",
+		uri:         "/" + TestHash,
+		requestBody: TestBlock,
+	}
+
+	for _, trial := range []struct {
+		ask            string
+		expectReplicas string
+		expectClasses  string
+		expectPuts     map[string]int
+	}{
+		{"default", "1", "default=1",
+			map[string]int{"zzzzz-nyw5e-000000000000000": 1}},
+		{" special ", "1", "extra=1, special=1",
+			map[string]int{"zzzzz-nyw5e-111111111111111": 1}},
+		{"special, extra", "1", "extra=1, special=1",
+			map[string]int{"zzzzz-nyw5e-111111111111111": 1}},
+		{"default,special", "2", "default=1, extra=1, special=1",
+			map[string]int{"zzzzz-nyw5e-000000000000000": 1, "zzzzz-nyw5e-111111111111111": 1}},
+		{"readonly", "", "", nil},
+		{"special, readonly", "1", "extra=1, special=1",
+			map[string]int{"zzzzz-nyw5e-111111111111111": 1}},
+	} {
+		c.Logf("%+v", trial)
+		s.handler.volmgr.counter = 0
+		for _, mnt := range s.handler.volmgr.mounts {
+			mnt.Volume.(*MockVolume).Store = map[string][]byte{}
+			mnt.Volume.(*MockVolume).called = map[string]int{}
+		}
+		rt.storageClasses = trial.ask
+		resp := IssueRequest(s.handler, &rt)
+		if trial.expectReplicas == "" {
+			c.Check(resp.Code, check.Equals, StorageClassError.HTTPCode)
+			c.Check(resp.Body.String(), check.Matches, `No writable volume offers the requested storage classes\n`)
+			continue
+		}
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Header().Get("X-Keep-Replicas-Stored"), check.Equals, trial.expectReplicas)
+		c.Check(resp.Header().Get("X-Keep-Storage-Classes-Confirmed"), check.Equals, trial.expectClasses)
+		for uuid, mnt := range s.handler.volmgr.mountMap {
+			c.Check(mnt.Volume.(*MockVolume).CallCount("Put"), check.Equals, trial.expectPuts[uuid], check.Commentf("%s", uuid))
+		}
+	}
+}
+
 // Test TOUCH requests.
 func (s *HandlerSuite) TestTouchHandler(c *check.C) {
 	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
@@ -754,25 +1042,25 @@ func (s *HandlerSuite) TestPullHandler(c *check.C) {
 	var testcases = []pullTest{
 		{
 			"Valid pull list from an ordinary user",
-			RequestTester{"/pull", userToken, "PUT", goodJSON},
+			RequestTester{"/pull", userToken, "PUT", goodJSON, ""},
 			http.StatusUnauthorized,
 			"Unauthorized\n",
 		},
 		{
 			"Invalid pull request from an ordinary user",
-			RequestTester{"/pull", userToken, "PUT", badJSON},
+			RequestTester{"/pull", userToken, "PUT", badJSON, ""},
 			http.StatusUnauthorized,
 			"Unauthorized\n",
 		},
 		{
 			"Valid pull request from the data manager",
-			RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", goodJSON},
+			RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", goodJSON, ""},
 			http.StatusOK,
 			"Received 3 pull requests\n",
 		},
 		{
 			"Invalid pull request from the data manager",
-			RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", badJSON},
+			RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", badJSON, ""},
 			http.StatusBadRequest,
 			"",
 		},
@@ -866,25 +1154,25 @@ func (s *HandlerSuite) TestTrashHandler(c *check.C) {
 	var testcases = []trashTest{
 		{
 			"Valid trash list from an ordinary user",
-			RequestTester{"/trash", userToken, "PUT", goodJSON},
+			RequestTester{"/trash", userToken, "PUT", goodJSON, ""},
 			http.StatusUnauthorized,
 			"Unauthorized\n",
 		},
 		{
 			"Invalid trash list from an ordinary user",
-			RequestTester{"/trash", userToken, "PUT", badJSON},
+			RequestTester{"/trash", userToken, "PUT", badJSON, ""},
 			http.StatusUnauthorized,
 			"Unauthorized\n",
 		},
 		{
 			"Valid trash list from the data manager",
-			RequestTester{"/trash", s.cluster.SystemRootToken, "PUT", goodJSON},
+			RequestTester{"/trash", s.cluster.SystemRootToken, "PUT", goodJSON, ""},
 			http.StatusOK,
 			"Received 3 trash requests\n",
 		},
 		{
 			"Invalid trash list from the data manager",
-			RequestTester{"/trash", s.cluster.SystemRootToken, "PUT", badJSON},
+			RequestTester{"/trash", s.cluster.SystemRootToken, "PUT", badJSON, ""},
 			http.StatusBadRequest,
 			"",
 		},
@@ -921,6 +1209,9 @@ func IssueRequest(handler http.Handler, rt *RequestTester) *httptest.ResponseRec
 	if rt.apiToken != "" {
 		req.Header.Set("Authorization", "OAuth2 "+rt.apiToken)
 	}
+	if rt.storageClasses != "" {
+		req.Header.Set("X-Keep-Storage-Classes", rt.storageClasses)
+	}
 	handler.ServeHTTP(response, req)
 	return response
 }
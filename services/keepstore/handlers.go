@@ -5,16 +5,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"container/list"
 	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"os"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,6 +27,7 @@ import (
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/erasure"
 	"git.arvados.org/arvados.git/sdk/go/health"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
 	"github.com/gorilla/mux"
@@ -77,8 +83,16 @@ func MakeRESTRouter(ctx context.Context, cluster *arvados.Cluster, reg *promethe
 
 	// List mounts: UUID, readonly, tier, device ID, ...
 	rtr.HandleFunc(`/mounts`, rtr.MountsHandler).Methods("GET")
+	rtr.HandleFunc(`/mounts/{uuid}`, rtr.handleMountStatus).Methods("GET")
 	rtr.HandleFunc(`/mounts/{uuid}/blocks`, rtr.handleIndex).Methods("GET")
 	rtr.HandleFunc(`/mounts/{uuid}/blocks/`, rtr.handleIndex).Methods("GET")
+	// List blocks written, touched, or removed since the
+	// given cursor. Privileged client only.
+	rtr.HandleFunc(`/mounts/{uuid}/changes`, rtr.handleMountChanges).Methods("GET")
+	// Read/write a block on a specific mount, bypassing the
+	// usual volume selection. Privileged client only.
+	rtr.HandleFunc(`/mounts/{uuid}/blocks/{hash:[0-9a-f]{32}}`, rtr.handleMountBlockGET).Methods("GET")
+	rtr.HandleFunc(`/mounts/{uuid}/blocks/{hash:[0-9a-f]{32}}`, rtr.handleMountBlockPUT).Methods("PUT")
 
 	// Replace the current pull queue.
 	rtr.HandleFunc(`/pull`, rtr.handlePull).Methods("PUT")
@@ -92,6 +106,7 @@ func MakeRESTRouter(ctx context.Context, cluster *arvados.Cluster, reg *promethe
 	rtr.Handle("/_health/{check}", &health.Handler{
 		Token:  cluster.ManagementToken,
 		Prefix: "/_health/",
+		Routes: health.Routes{"volumes": rtr.checkVolumeHealth},
 	}).Methods("GET")
 
 	// Any request which does not match any of these routes gets
@@ -128,6 +143,19 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	hash := mux.Vars(req)["hash"]
+	if hdr := req.Header.Get("X-Keep-Erasure-Shard"); hdr != "" {
+		// The client has permission to read the block, and
+		// wants one of its erasure-coded shards instead.
+		idx, err := strconv.Atoi(hdr)
+		if err != nil || idx < 0 || idx >= erasure.MaxShards {
+			http.Error(resp, "invalid X-Keep-Erasure-Shard header", http.StatusBadRequest)
+			return
+		}
+		hash = erasure.ShardLocator(hash, idx)
+		req.Header.Del("Range")
+	}
+
 	// TODO: Probe volumes to check whether the block _might_
 	// exist. Some volumes/types could support a quick existence
 	// check without causing other operations to suffer. If all
@@ -135,6 +163,28 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 	// isn't here, we can return 404 now instead of waiting for a
 	// buffer.
 
+	// A Range header is only honored if the locator has a size
+	// hint.
+	rangeHdr := req.Header.Get("Range")
+	sizeHint, ranged := locatorSizeHint(locator)
+	ranged = ranged && rangeHdr != ""
+
+	if off, length, ok := parseRange(rangeHdr, sizeHint); ranged && ok && off < sizeHint && length <= maxRangeReadSize {
+		// Small ranges don't need a full-size buffer from
+		// the pool. The extra byte lets GetBlockRange detect
+		// a block that is longer than the size hint.
+		data, err := GetBlockRange(ctx, rtr.volmgr, hash, off, length, sizeHint, make([]byte, length+1))
+		if err == nil {
+			writeRange(resp, data, off, sizeHint)
+			return
+		} else if err != errSizeHintMismatch {
+			writeKeepError(resp, err)
+			return
+		}
+		// The size hint is wrong, so the range has to be
+		// computed from the size of the stored block.
+	}
+
 	buf, err := getBufferWithContext(ctx, bufs, BlockSize)
 	if err != nil {
 		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
@@ -142,21 +192,119 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 	}
 	defer bufs.Put(buf)
 
-	size, err := GetBlock(ctx, rtr.volmgr, mux.Vars(req)["hash"], buf, resp)
+	size, err := GetBlock(ctx, rtr.volmgr, hash, buf, resp)
 	if err != nil {
-		code := http.StatusInternalServerError
-		if err, ok := err.(*KeepError); ok {
-			code = err.HTTPCode
-		}
-		http.Error(resp, err.Error(), code)
+		writeKeepError(resp, err)
 		return
 	}
 
+	if off, length, ok := parseRange(rangeHdr, int64(size)); ranged && ok {
+		// We read (and verified) the entire block, but the
+		// client only wants part of it.
+		if off >= int64(size) {
+			resp.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(resp, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		writeRange(resp, buf[off:off+length], off, int64(size))
+		return
+	}
 	resp.Header().Set("Content-Length", strconv.Itoa(size))
 	resp.Header().Set("Content-Type", "application/octet-stream")
 	resp.Write(buf[:size])
 }
 
+// Range requests for up to maxRangeReadSize bytes are served by
+// reading just the requested part of the block from a volume. Bigger
+// ranges are served by reading (and verifying) the entire block.
+const maxRangeReadSize = 4 << 20
+
+// writeKeepError sends an error response, using err's HTTP status
+// code if it is a KeepError.
+func writeKeepError(resp http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if err, ok := err.(*KeepError); ok {
+		code = err.HTTPCode
+	}
+	http.Error(resp, err.Error(), code)
+}
+
+// writeRange sends a 206 response with the given part of a block.
+func writeRange(resp http.ResponseWriter, data []byte, off, blockSize int64) {
+	resp.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+int64(len(data))-1, blockSize))
+	resp.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.WriteHeader(http.StatusPartialContent)
+	resp.Write(data)
+}
+
+// locatorSizeHint returns the size hint from a block locator like
+// "{hash}+{size}+...".
+func locatorSizeHint(locator string) (int64, bool) {
+	parts := strings.SplitN(locator, "+", 3)
+	if len(parts) < 2 {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 || size > BlockSize {
+		return 0, false
+	}
+	return size, true
+}
+
+// parseRange parses the value of a Range header ("bytes=0-99",
+// "bytes=100-", or "bytes=-100") and returns the offset and length
+// of the requested range, truncated to fit in a block of the given
+// size. If the range starts past the end of the block, the returned
+// offset is greater than or equal to size.
+//
+// ok is false if the header is malformed or requests multiple
+// ranges: as permitted by RFC 7233, such headers are ignored and the
+// whole block is returned.
+func parseRange(hdr string, size int64) (off, length int64, ok bool) {
+	if !strings.HasPrefix(hdr, "bytes=") || strings.Contains(hdr, ",") {
+		return 0, 0, false
+	}
+	spec := strings.TrimSpace(hdr[6:])
+	dash := strings.IndexByte(spec, '-')
+	if dash < 0 {
+		return 0, 0, false
+	}
+	first, last := spec[:dash], spec[dash+1:]
+	if first == "" {
+		// Suffix range: last N bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		}
+		if n == 0 {
+			return size, 0, true
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+	off, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || off < 0 {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < off {
+			return 0, 0, false
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if off >= size {
+		return off, 0, true
+	}
+	return off, end - off + 1, true
+}
+
 // Return a new context that gets cancelled by resp's CloseNotifier.
 func contextForResponse(parent context.Context, resp http.ResponseWriter) (context.Context, context.CancelFunc) {
 	ctx, cancel := context.WithCancel(parent)
@@ -246,22 +394,36 @@ func (rtr *router) handlePUT(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	buf, err := getBufferWithContext(ctx, bufs, int(req.ContentLength))
-	if err != nil {
-		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
-		return
+	var wantStorageClasses []string
+	if hdr := req.Header.Get("X-Keep-Storage-Classes"); hdr != "" {
+		for _, sc := range strings.Split(hdr, ",") {
+			if sc = strings.TrimSpace(sc); sc != "" {
+				wantStorageClasses = append(wantStorageClasses, sc)
+			}
+		}
 	}
 
-	_, err = io.ReadFull(req.Body, buf)
-	if err != nil {
-		http.Error(resp, err.Error(), 500)
-		bufs.Put(buf)
-		return
-	}
+	result, streamed, err := PutBlockStream(ctx, rtr.volmgr, req.Body, req.ContentLength, hash, wantStorageClasses)
+	if !streamed {
+		// Fall back to reading the whole block into a
+		// buffer.
+		var buf []byte
+		buf, err = getBufferWithContext(ctx, bufs, int(req.ContentLength))
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 
-	replication, err := PutBlock(ctx, rtr.volmgr, buf, hash)
-	bufs.Put(buf)
+		_, err = io.ReadFull(req.Body, buf)
+		if err != nil {
+			http.Error(resp, err.Error(), 500)
+			bufs.Put(buf)
+			return
+		}
 
+		result, err = PutBlock(ctx, rtr.volmgr, buf, hash, wantStorageClasses)
+		bufs.Put(buf)
+	}
 	if err != nil {
 		code := http.StatusInternalServerError
 		if err, ok := err.(*KeepError); ok {
@@ -279,7 +441,8 @@ func (rtr *router) handlePUT(resp http.ResponseWriter, req *http.Request) {
 		expiry := time.Now().Add(rtr.cluster.Collections.BlobSigningTTL.Duration())
 		returnHash = SignLocator(rtr.cluster, returnHash, apiToken, expiry)
 	}
-	resp.Header().Set("X-Keep-Replicas-Stored", strconv.Itoa(replication))
+	resp.Header().Set("X-Keep-Replicas-Stored", result.TotalReplication())
+	resp.Header().Set("X-Keep-Storage-Classes-Confirmed", result.ClassReplication())
 	resp.Write([]byte(returnHash + "\n"))
 }
 
@@ -328,14 +491,189 @@ func (rtr *router) handleIndex(resp http.ResponseWriter, req *http.Request) {
 	resp.Write([]byte{'\n'})
 }
 
+// handleMountChanges responds to "GET /mounts/{uuid}/changes"
+// requests by sending the changes recorded in the mount's change log
+// since the given cursor, in index format (with mtime 0 for blocks
+// that are no longer stored), followed by a blank line. The cursor
+// for the next request is sent in the X-Keep-Change-Cursor header.
+func (rtr *router) handleMountChanges(resp http.ResponseWriter, req *http.Request) {
+	if !rtr.isSystemAuth(GetAPIToken(req)) {
+		http.Error(resp, UnauthorizedError.Error(), UnauthorizedError.HTTPCode)
+		return
+	}
+	mnt := rtr.volmgr.Lookup(mux.Vars(req)["uuid"], false)
+	if mnt == nil {
+		http.Error(resp, "mount not found", http.StatusNotFound)
+		return
+	}
+	ents, cursor, err := mnt.changes.since(req.FormValue("since"))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusGone)
+		return
+	}
+	resp.Header().Set("X-Keep-Change-Cursor", cursor)
+	bufw := bufio.NewWriter(resp)
+	for _, ent := range ents {
+		fmt.Fprintf(bufw, "%s %d\n", ent.loc, ent.mtime)
+	}
+	bufw.WriteByte('\n')
+	bufw.Flush()
+}
+
+// handleMountBlockGET responds to "GET /mounts/{uuid}/blocks/{hash}"
+// requests by sending the block's content from the given mount. The
+// data is sent as stored; it is up to the client to check the hash.
+func (rtr *router) handleMountBlockGET(resp http.ResponseWriter, req *http.Request) {
+	ctx, cancel := contextForResponse(context.TODO(), resp)
+	defer cancel()
+
+	if !rtr.isSystemAuth(GetAPIToken(req)) {
+		http.Error(resp, UnauthorizedError.Error(), UnauthorizedError.HTTPCode)
+		return
+	}
+	mnt := rtr.volmgr.Lookup(mux.Vars(req)["uuid"], false)
+	if mnt == nil {
+		http.Error(resp, "mount not found", http.StatusNotFound)
+		return
+	}
+	buf, err := getBufferWithContext(ctx, bufs, BlockSize)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer bufs.Put(buf)
+	n, err := mnt.Get(ctx, mux.Vars(req)["hash"], buf)
+	if os.IsNotExist(err) {
+		http.Error(resp, NotFoundError.Error(), NotFoundError.HTTPCode)
+		return
+	} else if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Length", strconv.Itoa(n))
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.Write(buf[:n])
+}
+
+// handleMountBlockPUT responds to "PUT /mounts/{uuid}/blocks/{hash}"
+// requests by storing the block on the given mount, regardless of
+// storage classes and the mount's position in the write rotation.
+func (rtr *router) handleMountBlockPUT(resp http.ResponseWriter, req *http.Request) {
+	ctx, cancel := contextForResponse(context.TODO(), resp)
+	defer cancel()
+
+	if !rtr.isSystemAuth(GetAPIToken(req)) {
+		http.Error(resp, UnauthorizedError.Error(), UnauthorizedError.HTTPCode)
+		return
+	}
+	if req.ContentLength == -1 {
+		http.Error(resp, SizeRequiredError.Error(), SizeRequiredError.HTTPCode)
+		return
+	} else if req.ContentLength > BlockSize {
+		http.Error(resp, TooLongError.Error(), TooLongError.HTTPCode)
+		return
+	}
+	mnt := rtr.volmgr.Lookup(mux.Vars(req)["uuid"], true)
+	if mnt == nil {
+		http.Error(resp, "mount not found", http.StatusNotFound)
+		return
+	}
+	hash := mux.Vars(req)["hash"]
+	buf, err := getBufferWithContext(ctx, bufs, int(req.ContentLength))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer bufs.Put(buf)
+	if _, err := io.ReadFull(req.Body, buf); err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !verifyBlock(hash, buf) {
+		http.Error(resp, RequestHashError.Error(), RequestHashError.HTTPCode)
+		return
+	}
+	// As in PutBlock, errors other than a collision (block not
+	// found, corrupt data on disk, etc.) mean we should go ahead
+	// and write.
+	err = mnt.Compare(ctx, hash, buf)
+	if err == nil {
+		err = mnt.Touch(hash)
+	} else if err != CollisionError {
+		err = mnt.Put(ctx, hash, buf)
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err, ok := err.(*KeepError); ok {
+			code = err.HTTPCode
+		}
+		http.Error(resp, err.Error(), code)
+		return
+	}
+	resp.Write([]byte("OK\n"))
+}
+
+// mountStatus is the information about a mount reported by the
+// /mounts and /mounts/{uuid} APIs.
+type mountStatus struct {
+	VolumeMount
+	Health volumeHealthStatus `json:"health"`
+	Scrub  *scrubState        `json:"scrub,omitempty"`
+}
+
+func newMountStatus(mnt *VolumeMount) mountStatus {
+	ms := mountStatus{
+		VolumeMount: *mnt,
+		Health:      mnt.health.Status(),
+		Scrub:       mnt.scrub.Status(),
+	}
+	ms.Degraded = mnt.health.Degraded()
+	if ms.Scrub != nil {
+		ms.Quarantined = ms.Scrub.Quarantined
+	}
+	return ms
+}
+
 // MountsHandler responds to "GET /mounts" requests.
 func (rtr *router) MountsHandler(resp http.ResponseWriter, req *http.Request) {
-	err := json.NewEncoder(resp).Encode(rtr.volmgr.Mounts())
+	var mounts []mountStatus
+	for _, mnt := range rtr.volmgr.Mounts() {
+		mounts = append(mounts, newMountStatus(mnt))
+	}
+	err := json.NewEncoder(resp).Encode(mounts)
+	if err != nil {
+		httpserver.Error(resp, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleMountStatus responds to "GET /mounts/{uuid}" requests.
+func (rtr *router) handleMountStatus(resp http.ResponseWriter, req *http.Request) {
+	mnt := rtr.volmgr.Lookup(mux.Vars(req)["uuid"], false)
+	if mnt == nil {
+		http.Error(resp, "mount not found", http.StatusNotFound)
+		return
+	}
+	err := json.NewEncoder(resp).Encode(newMountStatus(mnt))
 	if err != nil {
 		httpserver.Error(resp, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// checkVolumeHealth returns an error describing the degraded mounts,
+// if any.
+func (rtr *router) checkVolumeHealth() error {
+	var degraded []string
+	for _, mnt := range rtr.volmgr.Mounts() {
+		if st := mnt.health.Status(); mnt.health.Degraded() {
+			degraded = append(degraded, fmt.Sprintf("%s (%s)", mnt.UUID, st.Reason))
+		}
+	}
+	if len(degraded) > 0 {
+		return fmt.Errorf("degraded volumes: %s", strings.Join(degraded, ", "))
+	}
+	return nil
+}
+
 // PoolStatus struct
 type PoolStatus struct {
 	Alloc uint64 `json:"BytesAllocatedCumulative"`
@@ -675,7 +1013,8 @@ func (rtr *router) handleUntrash(resp http.ResponseWriter, req *http.Request) {
 //
 // If the block cannot be found on any volume, returns NotFoundError.
 //
-// If the block found does not have the correct MD5 hash, returns
+// If the block found does not have the correct MD5 hash (and is not
+// an erasure-coded shard stored under that hash), returns
 // DiskHashError.
 //
 func GetBlock(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []byte, resp http.ResponseWriter) (int, error) {
@@ -708,11 +1047,10 @@ func GetBlock(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []b
 			continue
 		}
 		// Check the file checksum.
-		filehash := fmt.Sprintf("%x", md5.Sum(buf[:size]))
-		if filehash != hash {
+		if !verifyBlock(hash, buf[:size]) {
 			// TODO: Try harder to tell a sysadmin about
 			// this.
-			log.Error("checksum mismatch for block %s (actual %s) on %s", hash, filehash, vol)
+			log.Errorf("checksum mismatch for block %s on %s", hash, vol)
 			errorToCaller = DiskHashError
 			continue
 		}
@@ -724,16 +1062,179 @@ func GetBlock(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []b
 	return 0, errorToCaller
 }
 
+// verifyBlock returns true if data is a good copy of the block with
+// the given hash: either its MD5 hash matches, or it is an intact
+// erasure-coded shard that belongs under that hash.
+func verifyBlock(hash string, data []byte) bool {
+	return fmt.Sprintf("%x", md5.Sum(data)) == hash || erasure.VerifyShard(hash, data)
+}
+
+// errSizeHintMismatch is returned by GetBlockRange if the stored
+// block is not the size given in the client's locator.
+var errSizeHintMismatch = errors.New("stored block size does not match locator size hint")
+
+// GetBlockRange reads length bytes at offset off of a block from the
+// first volume that has it, using buf (which must have capacity for
+// length+1 bytes), and returns the data.
+//
+// size is the block size hint from the client's locator. Because
+// the client might be wrong, GetBlockRange also reads the byte after
+// the end of the block (and, unless the range includes it, the last
+// byte of the block) to confirm the stored block is exactly size
+// bytes long. If it isn't, GetBlockRange returns errSizeHintMismatch
+// and the caller should read the entire block instead.
+//
+// Unlike GetBlock, GetBlockRange cannot verify the block's checksum.
+// A volume that returns the wrong number of bytes might have a
+// truncated copy of the block, so the next volume is tried.
+func GetBlockRange(ctx context.Context, volmgr *RRVolumeManager, hash string, off, length, size int64, buf []byte) ([]byte, error) {
+	log := ctxlog.FromContext(ctx)
+	var errorToCaller error = NotFoundError
+	want := length
+	tail := off+length == size
+	if tail {
+		want++
+	}
+	for _, vol := range volmgr.AllReadable() {
+		data := bytes.NewBuffer(buf[:0])
+		err := vol.ReadRange(ctx, hash, off, want, data)
+		if err == nil && !tail && int64(data.Len()) == length {
+			var probe bytes.Buffer
+			err = vol.ReadRange(ctx, hash, size-1, 2, &probe)
+			if err == nil && probe.Len() != 1 {
+				log.Warnf("ReadRange(%s) on %s: stored block size does not match locator size hint %d", hash, vol, size)
+				errorToCaller = errSizeHintMismatch
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ErrClientDisconnect
+		default:
+		}
+		if err != nil {
+			// As in GetBlock, try other volumes after
+			// any error.
+			if !os.IsNotExist(err) {
+				log.WithError(err).Errorf("ReadRange(%s) failed on %s", hash, vol)
+			}
+			if err == VolumeBusyError {
+				errorToCaller = err.(*KeepError)
+			}
+			continue
+		}
+		if int64(data.Len()) != length {
+			log.Warnf("ReadRange(%s, %d, %d) returned %d bytes on %s, expected %d with locator size hint %d", hash, off, want, data.Len(), vol, length, size)
+			errorToCaller = errSizeHintMismatch
+			continue
+		}
+		return data.Bytes(), nil
+	}
+	return nil, errorToCaller
+}
+
+// putProgress tracks the replicas written so far during a PutBlock
+// call, and the requested storage classes that have not yet been
+// satisfied.
+type putProgress struct {
+	classTodo        map[string]bool
+	mountUsed        map[*VolumeMount]bool
+	totalReplication int
+	classDone        map[string]int
+}
+
+func newPutProgress(classes []string) putProgress {
+	pr := putProgress{
+		classTodo: make(map[string]bool, len(classes)),
+		classDone: map[string]int{},
+		mountUsed: map[*VolumeMount]bool{},
+	}
+	for _, c := range classes {
+		if c != "" {
+			pr.classTodo[c] = true
+		}
+	}
+	return pr
+}
+
+// TotalReplication returns the number of replicas stored, formatted
+// as a decimal number. "2" can mean the block was stored on 2
+// different volumes with replication 1, or on 1 volume with
+// replication 2.
+func (pr putProgress) TotalReplication() string {
+	return strconv.Itoa(pr.totalReplication)
+}
+
+// ClassReplication returns the number of replicas satisfying each
+// storage class, formatted like "default=2, special=1".
+func (pr putProgress) ClassReplication() string {
+	var classes []string
+	for class := range pr.classDone {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for i, class := range classes {
+		classes[i] = class + "=" + strconv.Itoa(pr.classDone[class])
+	}
+	return strings.Join(classes, ", ")
+}
+
+// Add records a successful write (or touch) on mnt.
+func (pr *putProgress) Add(mnt *VolumeMount) {
+	if pr.mountUsed[mnt] {
+		return
+	}
+	pr.mountUsed[mnt] = true
+	pr.totalReplication += mnt.Replication
+	for class := range mnt.StorageClasses {
+		pr.classDone[class] += mnt.Replication
+		delete(pr.classTodo, class)
+	}
+}
+
+// Done returns true if at least one replica has been stored and all
+// requested storage classes have been satisfied.
+func (pr *putProgress) Done() bool {
+	return len(pr.classTodo) == 0 && pr.totalReplication > 0
+}
+
+// Want returns true if writing to mnt would make progress toward
+// satisfying the request.
+func (pr *putProgress) Want(mnt *VolumeMount) bool {
+	if pr.Done() || pr.mountUsed[mnt] {
+		return false
+	}
+	if len(pr.classTodo) == 0 {
+		// No storage classes requested (or all of them are
+		// already satisfied), so any mount will do.
+		return true
+	}
+	for class := range mnt.StorageClasses {
+		if pr.classTodo[class] {
+			return true
+		}
+	}
+	return false
+}
+
 // PutBlock Stores the BLOCK (identified by the content id HASH) in Keep.
 //
-// PutBlock(ctx, block, hash)
+// PutBlock(ctx, volmgr, block, hash, wantStorageClasses)
 //   Stores the BLOCK (identified by the content id HASH) in Keep.
 //
 //   The MD5 checksum of the block must be identical to the content id HASH.
 //   If not, an error is returned.
 //
-//   PutBlock stores the BLOCK on the first Keep volume with free space.
+//   If wantStorageClasses is empty, PutBlock stores the BLOCK on the
+//   first Keep volume with free space. Otherwise, it writes to as
+//   many volumes as needed to store at least one replica in each of
+//   the requested storage classes, and does not write to volumes
+//   that don't offer any of the requested storage classes.
+//
 //   A failure code is returned to the user only if all volumes fail.
+//   If some (but not all) of the requested storage classes could be
+//   satisfied, PutBlock returns success, and the caller can check
+//   the returned putProgress to see which classes were stored.
 //
 //   On success, PutBlock returns nil.
 //   On failure, it returns a KeepError with one of the following codes:
@@ -746,58 +1247,81 @@ func GetBlock(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []b
 //   503 Full
 //          There was not enough space left in any Keep volume to store
 //          the object.
+//   422 No writable volume offers the requested storage classes
+//          None of the writable volumes offer any of the requested
+//          storage classes.
 //   500 Fail
 //          The object could not be stored for some other reason (e.g.
 //          all writes failed). The text of the error message should
 //          provide as much detail as possible.
 //
-func PutBlock(ctx context.Context, volmgr *RRVolumeManager, block []byte, hash string) (int, error) {
+func PutBlock(ctx context.Context, volmgr *RRVolumeManager, block []byte, hash string, wantStorageClasses []string) (putProgress, error) {
 	log := ctxlog.FromContext(ctx)
 
 	// Check that BLOCK's checksum matches HASH.
 	blockhash := fmt.Sprintf("%x", md5.Sum(block))
 	if blockhash != hash {
 		log.Printf("%s: MD5 checksum %s did not match request", hash, blockhash)
-		return 0, RequestHashError
+		return putProgress{}, RequestHashError
 	}
 
+	result := newPutProgress(wantStorageClasses)
+
 	// If we already have this data, it's intact on disk, and we
 	// can update its timestamp, return success. If we have
 	// different data with the same hash, return failure.
-	if n, err := CompareAndTouch(ctx, volmgr, hash, block); err == nil || err == CollisionError {
-		return n, err
+	if err := CompareAndTouch(ctx, volmgr, hash, block, &result); err == CollisionError {
+		return putProgress{}, err
 	} else if ctx.Err() != nil {
-		return 0, ErrClientDisconnect
+		return putProgress{}, ErrClientDisconnect
+	} else if result.Done() {
+		return result, nil
 	}
 
-	// Choose a Keep volume to write to.
-	// If this volume fails, try all of the volumes in order.
-	if mnt := volmgr.NextWritable(); mnt != nil {
-		if err := mnt.Put(ctx, hash, block); err != nil {
-			log.WithError(err).Errorf("%s: Put(%s) failed", mnt.Volume, hash)
-		} else {
-			return mnt.Replication, nil // success!
+	return putToWritables(ctx, volmgr, block, hash, result)
+}
+
+// sortedWritables returns the writable volumes, starting with the one
+// suggested by NextWritable.
+func sortedWritables(volmgr *RRVolumeManager) []*VolumeMount {
+	writables := volmgr.AllWritable()
+	if first := volmgr.NextWritable(); first != nil {
+		sorted := []*VolumeMount{first}
+		for _, mnt := range writables {
+			if mnt != first {
+				sorted = append(sorted, mnt)
+			}
 		}
+		writables = sorted
 	}
-	if ctx.Err() != nil {
-		return 0, ErrClientDisconnect
-	}
+	return writables
+}
 
-	writables := volmgr.AllWritable()
+// putToWritables writes block to as many writable volumes as needed
+// to complete result.
+func putToWritables(ctx context.Context, volmgr *RRVolumeManager, block []byte, hash string, result putProgress) (putProgress, error) {
+	log := ctxlog.FromContext(ctx)
+
+	writables := sortedWritables(volmgr)
 	if len(writables) == 0 {
 		log.Error("no writable volumes")
-		return 0, FullError
+		return putProgress{}, FullError
 	}
 
 	allFull := true
-	for _, vol := range writables {
-		err := vol.Put(ctx, hash, block)
+	anyWanted := false
+	for _, mnt := range writables {
+		if !result.Want(mnt) {
+			continue
+		}
+		anyWanted = true
+		err := mnt.Put(ctx, hash, block)
 		if ctx.Err() != nil {
-			return 0, ErrClientDisconnect
+			return putProgress{}, ErrClientDisconnect
 		}
 		switch err {
 		case nil:
-			return vol.Replication, nil // success!
+			result.Add(mnt)
 		case FullError:
 			continue
 		default:
@@ -805,30 +1329,180 @@ func PutBlock(ctx context.Context, volmgr *RRVolumeManager, block []byte, hash s
 			// write did not succeed.  Report the
 			// error and continue trying.
 			allFull = false
-			log.WithError(err).Errorf("%s: Put(%s) failed", vol, hash)
+			log.WithError(err).Errorf("%s: Put(%s) failed", mnt.Volume, hash)
 		}
 	}
 
+	if result.totalReplication > 0 {
+		// Either all requested storage classes were
+		// satisfied, or some (but not all) of them were,
+		// which qualifies as success.
+		return result, nil
+	}
+	if !anyWanted {
+		log.Error("no writable volumes offer the requested storage classes")
+		return putProgress{}, StorageClassError
+	}
 	if allFull {
-		log.Error("all volumes are full")
-		return 0, FullError
+		log.Error("all volumes with qualifying storage classes are full")
+		return putProgress{}, FullError
 	}
 	// Already logged the non-full errors.
-	return 0, GenericError
+	return putProgress{}, GenericError
+}
+
+// PutBlockStream stores a block by copying it directly from r (which
+// must provide exactly size bytes) to a volume, without buffering the
+// whole block in memory. The MD5 checksum is computed while the data
+// is being written, and the volume discards the data instead of
+// storing it if the checksum does not match hash.
+//
+// If the block cannot be streamed -- because the first volume chosen
+// for the write doesn't implement BlockWriter, the block might
+// already exist on a writable volume and needs to be compared, or
+// the volume refused the write without reading any data --
+// PutBlockStream returns false without consuming any data from r, and
+// the caller should use PutBlock instead.
+//
+// If more replicas are needed after the first one has been written
+// (e.g., to satisfy multiple storage classes), PutBlockStream reads
+// the block back from the first volume and writes it to others.
+func PutBlockStream(ctx context.Context, volmgr *RRVolumeManager, r io.Reader, size int64, hash string, wantStorageClasses []string) (putProgress, bool, error) {
+	log := ctxlog.FromContext(ctx)
+	result := newPutProgress(wantStorageClasses)
+
+	var target *VolumeMount
+	var bw BlockWriter
+	for _, mnt := range sortedWritables(volmgr) {
+		if !result.Want(mnt) {
+			continue
+		}
+		// If the block already exists, PutBlock will compare
+		// and touch it instead of writing a new copy.
+		if _, err := mnt.Mtime(hash); !os.IsNotExist(err) {
+			return result, false, nil
+		}
+		if target == nil {
+			target = mnt
+			bw = streamWriter(mnt)
+			if bw == nil {
+				return result, false, nil
+			}
+		}
+	}
+	if target == nil {
+		return result, false, nil
+	}
+
+	hr := &hashCheckReader{Reader: r, Hash: md5.New(), Check: hash, Size: size}
+	t0 := time.Now()
+	err := bw.WriteBlock(ctx, hash, hr)
+	if err != nil && (hr.err == nil || hr.err == io.EOF) {
+		// Only count failures that weren't caused by the
+		// client. Successful writes aren't counted either,
+		// because their duration depends on the client.
+		target.health.record(err, time.Since(t0))
+	}
+	if hr.err == RequestHashError {
+		log.Printf("%s: MD5 checksum did not match request", hash)
+		return putProgress{}, true, RequestHashError
+	} else if ctx.Err() != nil {
+		return putProgress{}, true, ErrClientDisconnect
+	} else if err != nil && hr.n == 0 {
+		// Nothing was read from r, so the caller can still
+		// use the buffered code path, which will try other
+		// volumes.
+		return result, false, nil
+	} else if err != nil {
+		log.WithError(err).Errorf("%s: WriteBlock(%s) failed", target.Volume, hash)
+		return putProgress{}, true, GenericError
+	}
+	result.Add(target)
+	target.changes.recordWrite(hash, int(size))
+	if result.Done() {
+		return result, true, nil
+	}
+
+	buf, err := getBufferWithContext(ctx, bufs, int(size))
+	if err != nil {
+		return result, true, nil
+	}
+	defer bufs.Put(buf)
+	n, err := target.Get(ctx, hash, buf)
+	if err != nil {
+		log.WithError(err).Errorf("%s: Get(%s) failed after WriteBlock", target.Volume, hash)
+		return result, true, nil
+	}
+	result, err = putToWritables(ctx, volmgr, buf[:n], hash, result)
+	return result, true, err
+}
+
+// streamWriter returns mnt's volume as a BlockWriter, or nil if it
+// doesn't support writing blocks directly from a client's request
+// body.
+func streamWriter(mnt *VolumeMount) BlockWriter {
+	if v, ok := mnt.Volume.(*UnixVolume); ok && v.locker != nil {
+		// With Serialize enabled, WriteBlock holds the
+		// volume's lock while reading, so a slow client
+		// would stall all other operations on the volume.
+		return nil
+	}
+	bw, _ := mnt.Volume.(BlockWriter)
+	return bw
 }
 
-// CompareAndTouch returns the current replication level if one of the
-// volumes already has the given content and it successfully updates
-// the relevant block's modification time in order to protect it from
-// premature garbage collection. Otherwise, it returns a non-nil
-// error.
-func CompareAndTouch(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []byte) (int, error) {
+// hashCheckReader reads exactly Size bytes from Reader, and returns
+// RequestHashError instead of EOF if the data does not match the
+// expected MD5 hash.
+type hashCheckReader struct {
+	io.Reader
+	Hash  hash.Hash
+	Check string
+	Size  int64
+
+	n   int64
+	err error
+}
+
+func (hr *hashCheckReader) Read(p []byte) (int, error) {
+	if hr.err != nil {
+		return 0, hr.err
+	}
+	if int64(len(p)) > hr.Size-hr.n {
+		p = p[:hr.Size-hr.n]
+	}
+	n, err := hr.Reader.Read(p)
+	hr.Hash.Write(p[:n])
+	hr.n += int64(n)
+	if hr.n == hr.Size {
+		// Check the hash as soon as we have all of the
+		// data, in case the caller doesn't read until EOF.
+		if fmt.Sprintf("%x", hr.Hash.Sum(nil)) != hr.Check {
+			err = RequestHashError
+		} else {
+			err = io.EOF
+		}
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	hr.err = err
+	return n, err
+}
+
+// CompareAndTouch looks for volumes where the given content already
+// exists and its modification time can be updated (i.e., it is
+// protected from garbage collection), and updates result accordingly.
+// It returns when the result is Done() or all volumes have been
+// checked.
+func CompareAndTouch(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []byte, result *putProgress) error {
 	log := ctxlog.FromContext(ctx)
-	var bestErr error = NotFoundError
 	for _, mnt := range volmgr.AllWritable() {
+		if !result.Want(mnt) {
+			continue
+		}
 		err := mnt.Compare(ctx, hash, buf)
 		if ctx.Err() != nil {
-			return 0, ctx.Err()
+			return ctx.Err()
 		} else if err == CollisionError {
 			// Stop if we have a block with same hash but
 			// different content. (It will be impossible
@@ -836,7 +1510,7 @@ func CompareAndTouch(ctx context.Context, volmgr *RRVolumeManager, hash string,
 			// both, so there's no point writing it even
 			// on a different volume.)
 			log.Error("collision in Compare(%s) on volume %s", hash, mnt.Volume)
-			return 0, err
+			return err
 		} else if os.IsNotExist(err) {
 			// Block does not exist. This is the only
 			// "normal" error: we don't log anything.
@@ -850,13 +1524,15 @@ func CompareAndTouch(ctx context.Context, volmgr *RRVolumeManager, hash string,
 		}
 		if err := mnt.Touch(hash); err != nil {
 			log.WithError(err).Errorf("error in Touch(%s) on volume %s", hash, mnt.Volume)
-			bestErr = err
 			continue
 		}
 		// Compare and Touch both worked --> done.
-		return mnt.Replication, nil
+		result.Add(mnt)
+		if result.Done() {
+			return nil
+		}
 	}
-	return 0, bestErr
+	return nil
 }
 
 var validLocatorRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
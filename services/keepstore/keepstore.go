@@ -11,6 +11,11 @@ import (
 // A Keep "block" is 64MB.
 const BlockSize = 64 * 1024 * 1024
 
+// Volume wrappers that add a header to each block (see
+// EncryptedVolume) can store up to maxStoredBlockSize bytes in the
+// underlying volume for a full-size block.
+const maxStoredBlockSize = BlockSize + 1024
+
 // A Keep volume must have at least MinFreeKilobytes available
 // in order to permit writes.
 const MinFreeKilobytes = BlockSize / 1024
@@ -36,6 +41,7 @@ var (
 	VolumeBusyError     = &KeepError{503, "Volume backend busy"}
 	GenericError        = &KeepError{500, "Fail"}
 	FullError           = &KeepError{503, "Full"}
+	StorageClassError   = &KeepError{422, "No writable volume offers the requested storage classes"}
 	SizeRequiredError   = &KeepError{411, "Missing Content-Length"}
 	TooLongError        = &KeepError{413, "Block is too large"}
 	MethodDisabledError = &KeepError{405, "Method disabled"}
@@ -69,6 +69,18 @@ type volumeMetricsVecs struct {
 	ioBytes     *prometheus.CounterVec
 	errCounters *prometheus.CounterVec
 	opsCounters *prometheus.CounterVec
+
+	cacheRequests *prometheus.CounterVec
+	cacheBytes    *prometheus.GaugeVec
+
+	healthDegraded  *prometheus.GaugeVec
+	healthErrorRate *prometheus.GaugeVec
+	healthLatency   *prometheus.GaugeVec
+
+	scrubBlocks      *prometheus.CounterVec
+	scrubBytes       *prometheus.CounterVec
+	scrubPasses      *prometheus.CounterVec
+	scrubQuarantined *prometheus.GaugeVec
 }
 
 func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
@@ -103,6 +115,96 @@ func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
 		[]string{"device_id", "direction"},
 	)
 	reg.MustRegister(m.ioBytes)
+	m.cacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_cache_requests",
+			Help:      "Number of reads from cached volumes, by result (hit or miss)",
+		},
+		[]string{"device_id", "result"},
+	)
+	reg.MustRegister(m.cacheRequests)
+	m.cacheBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_cache_bytes",
+			Help:      "Size of blocks in cached volumes' local caches",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.cacheBytes)
+	m.healthDegraded = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_degraded",
+			Help:      "1 if the volume is degraded and not being used for writes, otherwise 0",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.healthDegraded)
+	m.healthErrorRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_error_rate",
+			Help:      "Rolling average fraction of volume operations that failed",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.healthErrorRate)
+	m.healthLatency = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_latency_seconds",
+			Help:      "Rolling average duration of volume operations",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.healthLatency)
+	m.scrubBlocks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_scrub_blocks",
+			Help:      "Number of blocks verified by the scrubber, by result (ok, corrupt, or error)",
+		},
+		[]string{"device_id", "result"},
+	)
+	reg.MustRegister(m.scrubBlocks)
+	m.scrubBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_scrub_bytes",
+			Help:      "Number of bytes read by the scrubber",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.scrubBytes)
+	m.scrubPasses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_scrub_passes",
+			Help:      "Number of complete scrub passes",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.scrubPasses)
+	m.scrubQuarantined = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_quarantined_blocks",
+			Help:      "Number of corrupt blocks found by the scrubber and hidden from the volume's index",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.scrubQuarantined)
 
 	return m
 }
@@ -150,3 +150,42 @@ func (s *HandlerSuite) call(method, path, tok string, body []byte) *httptest.Res
 	s.handler.ServeHTTP(resp, req)
 	return resp
 }
+
+func (s *HandlerSuite) TestMountBlock(c *check.C) {
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	vols := s.handler.volmgr.AllWritable()
+	tok := arvadostest.SystemRootToken
+
+	// Bad auth
+	for _, method := range []string{"GET", "PUT"} {
+		for _, tok := range []string{"", "xyzzy"} {
+			resp := s.call(method, "/mounts/"+vols[0].UUID+"/blocks/"+TestHash, tok, TestBlock)
+			c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+		}
+		resp := s.call(method, "/mounts/X/blocks/"+TestHash, tok, TestBlock)
+		c.Check(resp.Code, check.Equals, http.StatusNotFound)
+		c.Check(resp.Body.String(), check.Equals, "mount not found\n")
+	}
+
+	resp := s.call("PUT", "/mounts/"+vols[1].UUID+"/blocks/"+TestHash, tok, TestBlock2)
+	c.Check(resp.Code, check.Equals, http.StatusUnprocessableEntity)
+
+	resp = s.call("GET", "/mounts/"+vols[1].UUID+"/blocks/"+TestHash, tok, nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+
+	// The block is written to the requested mount, even though
+	// it isn't next in the rotation.
+	for i := 0; i < 2; i++ {
+		resp = s.call("PUT", "/mounts/"+vols[1].UUID+"/blocks/"+TestHash, tok, TestBlock)
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+	}
+	c.Check(vols[0].Volume.(*MockVolume).Store[TestHash], check.IsNil)
+	c.Check(vols[1].Volume.(*MockVolume).Store[TestHash], check.DeepEquals, TestBlock)
+
+	resp = s.call("GET", "/mounts/"+vols[1].UUID+"/blocks/"+TestHash, tok, nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.Bytes(), check.DeepEquals, TestBlock)
+
+	resp = s.call("GET", "/mounts/"+vols[0].UUID+"/blocks/"+TestHash, tok, nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+}
@@ -91,3 +91,27 @@ func putWithPipe(ctx context.Context, loc string, buf []byte, bw BlockWriter) er
 		return err
 	}
 }
+
+// readRangeWithGet implements ReadRange for a volume that can only
+// retrieve entire blocks: it reads the whole block into a buffer from
+// the global buffer pool, then writes the requested range to w.
+func readRangeWithGet(ctx context.Context, v Volume, loc string, off, length int64, w io.Writer) error {
+	buf, err := getBufferWithContext(ctx, bufs, BlockSize)
+	if err != nil {
+		return err
+	}
+	defer bufs.Put(buf)
+	size, err := v.Get(ctx, loc, buf)
+	if err != nil {
+		return err
+	}
+	if off >= int64(size) {
+		return nil
+	}
+	end := off + length
+	if end > int64(size) {
+		end = int64(size)
+	}
+	_, err = w.Write(buf[off:end])
+	return err
+}
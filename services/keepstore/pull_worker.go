@@ -9,17 +9,60 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sync"
 	"time"
 
+	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
 )
 
+// A pullLimiter limits the rate at which pull workers retrieve blocks
+// (see Collections.BlobPullRate). All pull workers share one
+// pullLimiter, so the limit applies to the keepstore process as a
+// whole. There is no limit during maintenance windows.
+//
+// A nil *pullLimiter does not limit anything.
+type pullLimiter struct {
+	rate     int64 // bytes per second
+	schedule *arvados.MaintenanceSchedule
+
+	mtx  sync.Mutex
+	next time.Time // earliest time the next pull can start
+}
+
+// wait reserves the bandwidth needed to pull a block of the given
+// size, and blocks until the pulls that reserved bandwidth earlier
+// have used no more than their share.
+//
+// The reservation is made before sleeping, so concurrent pull
+// workers are scheduled one after another instead of all waking up
+// at the same time.
+func (pl *pullLimiter) wait(size int64) {
+	if pl == nil || pl.rate <= 0 || pl.schedule.Active(time.Now()) {
+		return
+	}
+	pl.mtx.Lock()
+	now := time.Now()
+	if pl.next.Before(now) {
+		pl.next = now
+	}
+	start := pl.next
+	pl.next = pl.next.Add(time.Duration(float64(size) / float64(pl.rate) * float64(time.Second)))
+	pl.mtx.Unlock()
+	time.Sleep(time.Until(start))
+}
+
 // RunPullWorker receives PullRequests from pullq, invokes
 // PullItemAndProcess on each one. After each PR, it logs a message
 // indicating whether the pull was successful.
 func (h *handler) runPullWorker(pullq *WorkQueue) {
 	for item := range pullq.NextItem {
 		pr := item.(PullRequest)
+		size, ok := locatorSizeHint(pr.Locator)
+		if !ok {
+			size = BlockSize
+		}
+		h.pullLimiter.wait(size)
 		err := h.pullItemAndProcess(pr)
 		pullq.DoneItem <- struct{}{}
 		if err == nil {
@@ -89,6 +132,6 @@ var writePulledBlock = func(volmgr *RRVolumeManager, volume Volume, data []byte,
 	if volume != nil {
 		return volume.Put(context.Background(), locator, data)
 	}
-	_, err := PutBlock(context.Background(), volmgr, data, locator)
+	_, err := PutBlock(context.Background(), volmgr, data, locator, nil)
 	return err
 }
@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -136,7 +137,7 @@ func (s *PullWorkerTestSuite) TestSpecifyMountUUID(c *C) {
 func (s *PullWorkerTestSuite) TestPullWorkerPullList_with_two_locators(c *C) {
 	testData := PullWorkerTestData{
 		name:         "TestPullWorkerPullList_with_two_locators",
-		req:          RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", firstPullList},
+		req:          RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", firstPullList, ""},
 		responseCode: http.StatusOK,
 		responseBody: "Received 2 pull requests\n",
 		readContent:  "hello",
@@ -150,7 +151,7 @@ func (s *PullWorkerTestSuite) TestPullWorkerPullList_with_two_locators(c *C) {
 func (s *PullWorkerTestSuite) TestPullWorkerPullList_with_one_locator(c *C) {
 	testData := PullWorkerTestData{
 		name:         "TestPullWorkerPullList_with_one_locator",
-		req:          RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", secondPullList},
+		req:          RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", secondPullList, ""},
 		responseCode: http.StatusOK,
 		responseBody: "Received 1 pull requests\n",
 		readContent:  "hola",
@@ -164,7 +165,7 @@ func (s *PullWorkerTestSuite) TestPullWorkerPullList_with_one_locator(c *C) {
 func (s *PullWorkerTestSuite) TestPullWorker_error_on_get_one_locator(c *C) {
 	testData := PullWorkerTestData{
 		name:         "TestPullWorker_error_on_get_one_locator",
-		req:          RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", secondPullList},
+		req:          RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", secondPullList, ""},
 		responseCode: http.StatusOK,
 		responseBody: "Received 1 pull requests\n",
 		readContent:  "unused",
@@ -178,7 +179,7 @@ func (s *PullWorkerTestSuite) TestPullWorker_error_on_get_one_locator(c *C) {
 func (s *PullWorkerTestSuite) TestPullWorker_error_on_get_two_locators(c *C) {
 	testData := PullWorkerTestData{
 		name:         "TestPullWorker_error_on_get_two_locators",
-		req:          RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", firstPullList},
+		req:          RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", firstPullList, ""},
 		responseCode: http.StatusOK,
 		responseBody: "Received 2 pull requests\n",
 		readContent:  "unused",
@@ -192,7 +193,7 @@ func (s *PullWorkerTestSuite) TestPullWorker_error_on_get_two_locators(c *C) {
 func (s *PullWorkerTestSuite) TestPullWorker_error_on_put_one_locator(c *C) {
 	testData := PullWorkerTestData{
 		name:         "TestPullWorker_error_on_put_one_locator",
-		req:          RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", secondPullList},
+		req:          RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", secondPullList, ""},
 		responseCode: http.StatusOK,
 		responseBody: "Received 1 pull requests\n",
 		readContent:  "hello hello",
@@ -206,7 +207,7 @@ func (s *PullWorkerTestSuite) TestPullWorker_error_on_put_one_locator(c *C) {
 func (s *PullWorkerTestSuite) TestPullWorker_error_on_put_two_locators(c *C) {
 	testData := PullWorkerTestData{
 		name:         "TestPullWorker_error_on_put_two_locators",
-		req:          RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", firstPullList},
+		req:          RequestTester{"/pull", s.cluster.SystemRootToken, "PUT", firstPullList, ""},
 		responseCode: http.StatusOK,
 		responseBody: "Received 2 pull requests\n",
 		readContent:  "hello again",
@@ -221,7 +222,7 @@ func (s *PullWorkerTestSuite) TestPullWorker_error_on_put_two_locators(c *C) {
 func (s *PullWorkerTestSuite) TestPullWorker_invalidToken(c *C) {
 	testData := PullWorkerTestData{
 		name:         "TestPullWorkerPullList_with_two_locators",
-		req:          RequestTester{"/pull", "invalidToken", "PUT", firstPullList},
+		req:          RequestTester{"/pull", "invalidToken", "PUT", firstPullList, ""},
 		responseCode: http.StatusUnauthorized,
 		responseBody: "Unauthorized\n",
 		readContent:  "hello",
@@ -313,3 +314,38 @@ func (s *PullWorkerTestSuite) performTest(testData PullWorkerTestData, c *C) {
 
 	expectChannelEmpty(c, pullq.NextItem)
 }
+
+func (s *PullWorkerTestSuite) TestPullLimiter(c *C) {
+	pl := &pullLimiter{rate: 1000}
+	t0 := time.Now()
+	for i := 0; i < 3; i++ {
+		pl.wait(100)
+	}
+	c.Check(time.Since(t0) >= 200*time.Millisecond, Equals, true)
+	c.Check(time.Since(t0) < time.Second, Equals, true)
+
+	// Concurrent workers don't exceed the rate
+	pl = &pullLimiter{rate: 1000}
+	t0 = time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pl.wait(100)
+		}()
+	}
+	wg.Wait()
+	c.Check(time.Since(t0) >= 300*time.Millisecond, Equals, true)
+	c.Check(time.Since(t0) < time.Second, Equals, true)
+
+	// No limit during maintenance windows
+	schedule, err := arvados.NewMaintenanceSchedule([]string{"Sun-Sat"}, "")
+	c.Assert(err, IsNil)
+	pl = &pullLimiter{rate: 1000, schedule: schedule}
+	t0 = time.Now()
+	for i := 0; i < 3; i++ {
+		pl.wait(100)
+	}
+	c.Check(time.Since(t0) < 100*time.Millisecond, Equals, true)
+}
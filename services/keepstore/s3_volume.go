@@ -10,7 +10,6 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -371,6 +370,58 @@ func (v *S3Volume) Get(ctx context.Context, loc string, buf []byte) (int, error)
 	}
 }
 
+// ReadRange implements Volume.
+func (v *S3Volume) ReadRange(ctx context.Context, loc string, off, length int64, w io.Writer) error {
+	if length <= 0 {
+		return nil
+	}
+	ready := make(chan bool)
+	var rdr io.ReadCloser
+	var err error
+	go func() {
+		defer close(ready)
+		rdr, err = v.bucket.GetRangeReader(loc, off, length)
+	}()
+	select {
+	case <-ctx.Done():
+		go func() {
+			<-ready
+			if err == nil {
+				rdr.Close()
+			}
+		}()
+		return ctx.Err()
+	case <-ready:
+	}
+	if err, ok := err.(*s3.Error); ok && err.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// off is past the end of the block.
+		return nil
+	}
+	err = v.translateError(err)
+	if os.IsNotExist(err) {
+		// Use the full Get code path, which can recover
+		// from a Trash race (see fixRace).
+		return readRangeWithGet(ctx, v, loc, off, length, w)
+	} else if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rdr.Close()
+		case <-done:
+		}
+	}()
+	_, err = io.Copy(w, rdr)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return v.translateError(err)
+}
+
 // Compare the given data with the stored data.
 func (v *S3Volume) Compare(ctx context.Context, loc string, expect []byte) error {
 	errChan := make(chan error, 1)
@@ -423,7 +474,7 @@ func (v *S3Volume) Put(ctx context.Context, loc string, block []byte) error {
 	var opts s3.Options
 	size := len(block)
 	if size > 0 {
-		md5, err := hex.DecodeString(loc)
+		md5, err := storedDigest(ctx, loc)
 		if err != nil {
 			return err
 		}
@@ -1006,6 +1057,21 @@ func (b *s3bucket) GetReader(path string) (io.ReadCloser, error) {
 	return NewCountingReader(rdr, b.stats.TickInBytes), err
 }
 
+// GetRangeReader returns up to length bytes of the object at path,
+// starting at offset off.
+func (b *s3bucket) GetRangeReader(path string, off, length int64) (io.ReadCloser, error) {
+	resp, err := b.Bucket().GetResponseWithHeaders(path, map[string][]string{
+		"Range": {fmt.Sprintf("bytes=%d-%d", off, off+length-1)},
+	})
+	b.stats.TickOps("get")
+	b.stats.Tick(&b.stats.Ops, &b.stats.GetOps)
+	b.stats.TickErr(err)
+	if err != nil {
+		return nil, err
+	}
+	return NewCountingReader(resp.Body, b.stats.TickInBytes), nil
+}
+
 func (b *s3bucket) Head(path string, headers map[string][]string) (*http.Response, error) {
 	resp, err := b.Bucket().Head(path, headers)
 	b.stats.TickOps("head")
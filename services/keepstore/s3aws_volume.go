@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -517,6 +516,37 @@ func (v *S3AWSVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) er
 	return err
 }
 
+// ReadRange implements Volume.
+func (v *S3AWSVolume) ReadRange(ctx context.Context, loc string, off, length int64, w io.Writer) error {
+	if length <= 0 {
+		return nil
+	}
+	req := v.bucket.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(v.bucket.bucket),
+		Key:    aws.String(loc),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, off+length-1)),
+	})
+	resp, err := req.Send(ctx)
+	v.bucket.stats.TickOps("get")
+	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.GetOps)
+	v.bucket.stats.TickErr(err)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidRange" {
+		// off is past the end of the block.
+		return nil
+	}
+	err = v.translateError(err)
+	if os.IsNotExist(err) {
+		// Use the full ReadBlock code path, which can recover
+		// from a Trash race (see fixRace).
+		return readRangeWithGet(ctx, v, loc, off, length, w)
+	} else if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, NewCountingReader(resp.Body, v.bucket.stats.TickInBytes))
+	return err
+}
+
 func (v *S3AWSVolume) writeObject(ctx context.Context, name string, r io.Reader) error {
 	if r == nil {
 		// r == nil leads to a memory violation in func readFillBuf in
@@ -532,7 +562,7 @@ func (v *S3AWSVolume) writeObject(ctx context.Context, name string, r io.Reader)
 
 	if len(name) == 32 {
 		var contentMD5 string
-		md5, err := hex.DecodeString(name)
+		md5, err := storedDigest(ctx, name)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,373 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// scrubState is a mount's scrub progress and list of quarantined
+// blocks. It is saved in BlobScrubStateDir so a pass can resume where
+// it left off after a restart, and reported by the /mounts/{uuid}
+// API.
+type scrubState struct {
+	// Last block verified in the current pass
+	Position          string    `json:"position"`
+	PassStarted       time.Time `json:"pass_started"`
+	LastPassCompleted time.Time `json:"last_pass_completed"`
+	Passes            int       `json:"passes"`
+
+	// Time each quarantined block was found to be corrupt
+	Quarantined map[string]time.Time `json:"quarantined"`
+}
+
+// A scrubber periodically reads every block on a mount and checks
+// its hash. Blocks that don't match are quarantined, i.e., reported
+// as corrupt by the /mounts API so keep-balance can trash them and
+// pull good copies. A block stays quarantined until it is verified
+// again, overwritten with good data, or removed.
+//
+// A nil *scrubber is valid, and never quarantines anything.
+type scrubber struct {
+	mnt       *VolumeMount
+	rate      int64 // bytes per second
+	stateFile string
+	logger    logrus.FieldLogger
+
+	// Minimum time from the start of one pass to the start of
+	// the next, so a small volume isn't scrubbed continuously.
+	minPassInterval time.Duration
+	// Time to wait before resuming after an error (e.g., failing
+	// to get an index).
+	retryInterval time.Duration
+	// Minimum time between saves of the state file.
+	saveInterval time.Duration
+
+	okBlocks      prometheus.Counter
+	corruptBlocks prometheus.Counter
+	errorBlocks   prometheus.Counter
+	bytesRead     prometheus.Counter
+	passes        prometheus.Counter
+	quarantined   prometheus.Gauge
+
+	mtx      sync.Mutex
+	state    scrubState
+	lastSave time.Time
+}
+
+func newScrubber(mnt *VolumeMount, cluster *arvados.Cluster, logger logrus.FieldLogger, metrics *volumeMetricsVecs) *scrubber {
+	s := &scrubber{
+		mnt:             mnt,
+		rate:            int64(cluster.Collections.BlobScrubRate),
+		logger:          logger.WithField("Volume", mnt.UUID),
+		minPassInterval: time.Hour,
+		retryInterval:   time.Minute,
+		saveInterval:    time.Minute,
+		state:           scrubState{Quarantined: map[string]time.Time{}},
+	}
+	if dir := cluster.Collections.BlobScrubStateDir; dir != "" {
+		s.stateFile = filepath.Join(dir, mnt.UUID+".json")
+	}
+	lbls := prometheus.Labels{"device_id": mnt.DeviceID}
+	s.okBlocks = metrics.scrubBlocks.With(prometheus.Labels{"device_id": mnt.DeviceID, "result": "ok"})
+	s.corruptBlocks = metrics.scrubBlocks.With(prometheus.Labels{"device_id": mnt.DeviceID, "result": "corrupt"})
+	s.errorBlocks = metrics.scrubBlocks.With(prometheus.Labels{"device_id": mnt.DeviceID, "result": "error"})
+	s.bytesRead = metrics.scrubBytes.With(lbls)
+	s.passes = metrics.scrubPasses.With(lbls)
+	s.quarantined = metrics.scrubQuarantined.With(lbls)
+	s.loadState()
+	return s
+}
+
+func (s *scrubber) loadState() {
+	if s.stateFile == "" {
+		return
+	}
+	buf, err := ioutil.ReadFile(s.stateFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		s.logger.WithError(err).Warn("error reading scrub state file, starting a new pass")
+		return
+	}
+	var state scrubState
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		s.logger.WithError(err).Warn("error decoding scrub state file, starting a new pass")
+		return
+	}
+	if state.Quarantined == nil {
+		state.Quarantined = map[string]time.Time{}
+	}
+	s.state = state
+	s.quarantined.Set(float64(len(state.Quarantined)))
+}
+
+// Caller must have lock.
+func (s *scrubber) saveState() {
+	if s.stateFile == "" {
+		return
+	}
+	s.lastSave = time.Now()
+	buf, err := json.Marshal(s.state)
+	if err != nil {
+		s.logger.WithError(err).Error("error encoding scrub state")
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(s.stateFile), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(s.stateFile+".tmp", buf, 0600)
+	}
+	if err == nil {
+		err = os.Rename(s.stateFile+".tmp", s.stateFile)
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("error saving scrub state file")
+	}
+}
+
+// run scrubs the mount repeatedly until stop is closed.
+func (s *scrubber) run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for ctx.Err() == nil {
+		s.mtx.Lock()
+		if s.state.PassStarted.IsZero() {
+			s.state.PassStarted = time.Now()
+			s.state.Position = ""
+			s.saveState()
+		}
+		started := s.state.PassStarted
+		s.mtx.Unlock()
+
+		wait := time.Until(started.Add(s.minPassInterval))
+		if err := s.scrubPass(ctx); ctx.Err() != nil {
+			return
+		} else if err != nil {
+			s.logger.WithError(err).Warn("error during scrub pass, will resume later")
+			wait = s.retryInterval
+		} else {
+			s.dropRemoved()
+			s.mtx.Lock()
+			s.state.Passes++
+			s.state.LastPassCompleted = time.Now()
+			s.state.PassStarted = time.Time{}
+			s.state.Position = ""
+			s.saveState()
+			s.mtx.Unlock()
+			s.passes.Inc()
+			s.logger.WithField("Started", started).Info("scrub pass completed")
+		}
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// scrubPass verifies all blocks after the current position, in
+// order of their hashes, one index prefix at a time.
+func (s *scrubber) scrubPass(ctx context.Context) error {
+	s.mtx.Lock()
+	pos := s.state.Position
+	s.mtx.Unlock()
+
+	t0 := time.Now()
+	var bytesDone int64
+	for p := 0; p < 256; p++ {
+		prefix := fmt.Sprintf("%02x", p)
+		if pos != "" && prefix < pos[:2] {
+			continue
+		}
+		var index bytes.Buffer
+		err := s.mnt.Volume.IndexTo(prefix, &index)
+		if err != nil {
+			return fmt.Errorf("error getting index for prefix %s: %s", prefix, err)
+		}
+		// Index lines are "hash+size mtime", or "hash mtime"
+		// if the volume doesn't know the size.
+		var hashes []string
+		for _, line := range strings.Split(index.String(), "\n") {
+			if len(line) < 34 || (line[32] != '+' && line[32] != ' ') {
+				continue
+			}
+			hashes = append(hashes, line[:32])
+		}
+		sort.Strings(hashes)
+		for _, hash := range hashes {
+			if hash <= pos {
+				continue
+			}
+			bytesDone += int64(s.scrubBlock(ctx, hash))
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			s.mtx.Lock()
+			s.state.Position = hash
+			if time.Since(s.lastSave) > s.saveInterval {
+				s.saveState()
+			}
+			s.mtx.Unlock()
+			s.throttle(ctx, t0, bytesDone)
+		}
+	}
+	return nil
+}
+
+// throttle waits until enough time has passed since t0 to read the
+// given number of bytes at the configured rate.
+func (s *scrubber) throttle(ctx context.Context, t0 time.Time, bytesDone int64) {
+	if s.rate <= 0 {
+		return
+	}
+	wait := time.Until(t0.Add(time.Duration(float64(bytesDone) / float64(s.rate) * float64(time.Second))))
+	if wait <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(wait):
+	}
+}
+
+// scrubBlock reads a block and checks its hash, and updates the
+// quarantine list accordingly. It returns the number of bytes read.
+func (s *scrubber) scrubBlock(ctx context.Context, hash string) int {
+	buf, err := getBufferWithContext(ctx, bufs, BlockSize)
+	if err != nil {
+		return 0
+	}
+	defer bufs.Put(buf)
+	n, err := s.mnt.Get(withoutCache(ctx), hash, buf)
+	s.bytesRead.Add(float64(n))
+	if ctx.Err() != nil {
+		return n
+	} else if os.IsNotExist(err) {
+		// Block was deleted since we got the index.
+		s.unquarantine(hash)
+		return n
+	}
+	if err == nil && !verifyBlock(hash, buf[:n]) {
+		err = DiskHashError
+	}
+	switch err {
+	case nil:
+		s.okBlocks.Inc()
+		s.unquarantine(hash)
+	case DiskHashError:
+		s.corruptBlocks.Inc()
+		s.quarantine(hash)
+	default:
+		// Read errors might be transient, so we don't
+		// quarantine the block. It will be checked again on
+		// the next pass.
+		s.errorBlocks.Inc()
+		s.logger.WithError(err).WithField("Block", hash).Warn("error reading block during scrub")
+	}
+	return n
+}
+
+func (s *scrubber) quarantine(hash string) {
+	s.mtx.Lock()
+	if _, ok := s.state.Quarantined[hash]; ok {
+		s.mtx.Unlock()
+		return
+	}
+	s.state.Quarantined[hash] = time.Now()
+	s.quarantined.Set(float64(len(s.state.Quarantined)))
+	s.saveState()
+	s.mtx.Unlock()
+	s.logger.WithField("Block", hash).Error("block data does not match hash, quarantining")
+}
+
+// unquarantine removes the given block from the quarantine list, if
+// it is there, after it has been verified, overwritten with good
+// data, or removed.
+func (s *scrubber) unquarantine(hash string) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	if _, ok := s.state.Quarantined[hash]; !ok {
+		s.mtx.Unlock()
+		return
+	}
+	delete(s.state.Quarantined, hash)
+	s.quarantined.Set(float64(len(s.state.Quarantined)))
+	s.saveState()
+	s.mtx.Unlock()
+	s.logger.WithField("Block", hash).Info("removed block from quarantine")
+}
+
+func (s *scrubber) isQuarantined(hash string) bool {
+	if s == nil {
+		return false
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, ok := s.state.Quarantined[hash]
+	return ok
+}
+
+// dropRemoved removes blocks that are no longer stored on the mount
+// (e.g., trashed by another keepstore process sharing the backend)
+// from the quarantine list. Blocks removed by this process are
+// dropped right away by unquarantine, but others wouldn't be
+// noticed otherwise, because they no longer appear in the index.
+func (s *scrubber) dropRemoved() {
+	s.mtx.Lock()
+	var hashes []string
+	for hash := range s.state.Quarantined {
+		hashes = append(hashes, hash)
+	}
+	s.mtx.Unlock()
+	for _, hash := range hashes {
+		if _, err := s.mnt.Volume.Mtime(hash); os.IsNotExist(err) {
+			s.unquarantine(hash)
+		}
+	}
+}
+
+// Status returns a copy of the current scrub state, or nil if
+// scrubbing is disabled and nothing is quarantined.
+func (s *scrubber) Status() *scrubState {
+	if s == nil {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.rate <= 0 && len(s.state.Quarantined) == 0 {
+		return nil
+	}
+	st := s.state
+	st.Quarantined = make(map[string]time.Time, len(s.state.Quarantined))
+	for hash, t := range s.state.Quarantined {
+		st.Quarantined[hash] = t
+	}
+	return &st
+}
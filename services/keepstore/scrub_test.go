@@ -0,0 +1,185 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+func (s *HandlerSuite) setupScrub(c *check.C) (*VolumeMount, *MockVolume) {
+	s.cluster.Collections.BlobScrubStateDir = c.MkDir()
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	mnt := s.handler.volmgr.AllWritable()[0]
+	v := mnt.Volume.(*MockVolume)
+	v.Store[TestHash] = TestBlock
+	v.Store[TestHash2] = []byte("bit rot")
+	v.Store[TestHash3] = TestBlock3
+	for hash := range v.Store {
+		v.Timestamps[hash] = time.Now()
+	}
+	return mnt, v
+}
+
+func (s *HandlerSuite) TestScrubQuarantine(c *check.C) {
+	mnt, v := s.setupScrub(c)
+	defer s.handler.volmgr.Close()
+	c.Check(mnt.scrub.Status(), check.IsNil)
+
+	c.Assert(mnt.scrub.scrubPass(context.Background()), check.IsNil)
+	c.Check(v.CallCount("Get"), check.Equals, 3)
+	c.Check(mnt.scrub.isQuarantined(TestHash), check.Equals, false)
+	c.Check(mnt.scrub.isQuarantined(TestHash2), check.Equals, true)
+
+	// Quarantined block is still listed in the index, so
+	// keep-balance can trash it.
+	tok := arvadostest.SystemRootToken
+	for _, path := range []string{"/index", "/mounts/" + mnt.UUID + "/blocks"} {
+		resp := s.call("GET", path, tok, nil)
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Body.String(), check.Matches, `(?ms).*`+TestHash+`.*`)
+		c.Check(resp.Body.String(), check.Matches, `(?ms).*`+TestHash2+`.*`)
+		c.Check(resp.Body.String(), check.Matches, `(?ms).*`+TestHash3+`.*\n\n`)
+	}
+
+	// Quarantine is reported by /mounts/{uuid} and saved in the
+	// state file.
+	resp := s.call("GET", "/mounts/"+mnt.UUID, "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	var status struct {
+		arvados.KeepMount
+		Scrub scrubState
+	}
+	c.Check(json.Unmarshal(resp.Body.Bytes(), &status), check.IsNil)
+	c.Check(status.UUID, check.Equals, mnt.UUID)
+	c.Check(status.Scrub.Quarantined, check.HasLen, 1)
+	c.Check(status.Scrub.Quarantined[TestHash2].IsZero(), check.Equals, false)
+	c.Check(status.Quarantined, check.DeepEquals, status.Scrub.Quarantined)
+	resp = s.call("GET", "/mounts/zzzzz-nyw5e-nonexistentmount", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+
+	buf, err := ioutil.ReadFile(mnt.scrub.stateFile)
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Matches, `.*"quarantined":\{"`+TestHash2+`":.*`)
+
+	// Quarantine persists across restarts.
+	loaded := newScrubber(mnt, s.cluster, s.handler.Logger, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Check(loaded.isQuarantined(TestHash2), check.Equals, true)
+
+	// Writing good data replaces the corrupt copy.
+	resp = s.call("PUT", "/mounts/"+mnt.UUID+"/blocks/"+TestHash2, tok, TestBlock2)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(mnt.scrub.isQuarantined(TestHash2), check.Equals, false)
+}
+
+// A quarantined block is dropped from the quarantine list when it is
+// removed from the volume.
+func (s *HandlerSuite) TestScrubQuarantineRemoved(c *check.C) {
+	mnt, v := s.setupScrub(c)
+	defer s.handler.volmgr.Close()
+	v.Store[TestHash3] = []byte("more bit rot")
+	c.Assert(mnt.scrub.scrubPass(context.Background()), check.IsNil)
+	c.Check(mnt.scrub.isQuarantined(TestHash2), check.Equals, true)
+	c.Check(mnt.scrub.isQuarantined(TestHash3), check.Equals, true)
+
+	// Trashed by this process (e.g., as requested by
+	// keep-balance).
+	v.Timestamps[TestHash2] = time.Now().Add(-2 * s.cluster.Collections.BlobSigningTTL.Duration())
+	c.Check(mnt.Trash(TestHash2), check.IsNil)
+	c.Check(mnt.scrub.isQuarantined(TestHash2), check.Equals, false)
+
+	// Deleted some other way.
+	delete(v.Store, TestHash3)
+	delete(v.Timestamps, TestHash3)
+	mnt.scrub.scrubBlock(context.Background(), TestHash3)
+	c.Check(mnt.scrub.isQuarantined(TestHash3), check.Equals, false)
+	mnt.scrub.quarantine(TestHash3)
+	mnt.scrub.dropRemoved()
+	c.Check(mnt.scrub.isQuarantined(TestHash3), check.Equals, false)
+	c.Check(mnt.scrub.Status(), check.IsNil)
+}
+
+func (s *HandlerSuite) TestScrubResume(c *check.C) {
+	mnt, v := s.setupScrub(c)
+	defer s.handler.volmgr.Close()
+
+	// Pretend a previous process stopped after verifying the
+	// first block (in hash order).
+	hashes := []string{TestHash, TestHash2, TestHash3}
+	first := hashes[0]
+	for _, h := range hashes {
+		if h < first {
+			first = h
+		}
+	}
+	mnt.scrub.state.Position = first
+	mnt.scrub.state.PassStarted = time.Now()
+	mnt.scrub.saveState()
+	scrubber := newScrubber(mnt, s.cluster, s.handler.Logger, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Check(scrubber.state.Position, check.Equals, first)
+
+	c.Assert(scrubber.scrubPass(context.Background()), check.IsNil)
+	c.Check(v.CallCount("Get"), check.Equals, 2)
+}
+
+func (s *HandlerSuite) TestScrubRun(c *check.C) {
+	mnt, v := s.setupScrub(c)
+	mnt.scrub.rate = 1 << 30
+	go mnt.scrub.run(s.handler.volmgr.stop)
+	defer s.handler.volmgr.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := mnt.scrub.Status()
+		if st != nil && st.Passes > 0 {
+			c.Check(st.PassStarted.IsZero(), check.Equals, true)
+			c.Check(st.LastPassCompleted.IsZero(), check.Equals, false)
+			c.Check(st.Quarantined, check.HasLen, 1)
+			c.Check(st.Passes, check.Equals, 1)
+			break
+		}
+		c.Assert(time.Now().Before(deadline), check.Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(v.CallCount("Get"), check.Equals, 3)
+}
+
+var _ = check.Suite(&ScrubSuite{})
+
+type ScrubSuite struct{}
+
+func (*ScrubSuite) TestThrottle(c *check.C) {
+	s := &scrubber{rate: 10000}
+	t0 := time.Now()
+	s.throttle(context.Background(), t0, 1000)
+	c.Check(time.Since(t0) >= 100*time.Millisecond, check.Equals, true)
+
+	s.rate = 0
+	t0 = time.Now()
+	s.throttle(context.Background(), t0, 1<<30)
+	c.Check(time.Since(t0) < time.Second, check.Equals, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.rate = 1
+	t0 = time.Now()
+	s.throttle(ctx, t0, 1<<30)
+	c.Check(time.Since(t0) < time.Second, check.Equals, true)
+}
+
+func (*ScrubSuite) TestNil(c *check.C) {
+	var s *scrubber
+	c.Check(s.isQuarantined(TestHash), check.Equals, false)
+	c.Check(s.Status(), check.IsNil)
+	s.unquarantine(TestHash)
+}
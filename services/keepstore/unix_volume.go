@@ -211,7 +211,7 @@ func (v *UnixVolume) stat(path string) (os.FileInfo, error) {
 	if err == nil {
 		if stat.Size() < 0 {
 			err = os.ErrInvalid
-		} else if stat.Size() > BlockSize {
+		} else if stat.Size() > maxStoredBlockSize {
 			err = TooLongError
 		}
 	}
@@ -240,6 +240,33 @@ func (v *UnixVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) err
 	})
 }
 
+// ReadRange implements Volume.
+func (v *UnixVolume) ReadRange(ctx context.Context, loc string, off, length int64, w io.Writer) error {
+	path := v.blockPath(loc)
+	stat, err := v.stat(path)
+	if err != nil {
+		return v.translateError(err)
+	}
+	if off >= stat.Size() {
+		return nil
+	}
+	if err := v.lock(ctx); err != nil {
+		return err
+	}
+	defer v.unlock()
+	f, err := v.os.Open(path)
+	if err != nil {
+		return v.translateError(err)
+	}
+	defer f.Close()
+	_, err = f.Seek(off, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, NewCountingReader(io.LimitReader(f, length), v.os.stats.TickInBytes))
+	return err
+}
+
 // Compare returns nil if Get(loc) would return the same content as
 // expect. It is functionally equivalent to Get() followed by
 // bytes.Compare(), but uses less memory.
@@ -6,10 +6,13 @@ package main
 
 import (
 	"context"
+	"crypto/md5"
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"math/big"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -20,6 +23,11 @@ import (
 type BlockWriter interface {
 	// WriteBlock reads all data from r, writes it to a backing
 	// store as "loc", and returns the number of bytes written.
+	//
+	// If reading from r returns an error other than io.EOF,
+	// WriteBlock must return an error, and must not leave any
+	// data stored as "loc". PutBlockStream relies on this to
+	// discard blocks whose checksum does not match.
 	WriteBlock(ctx context.Context, loc string, r io.Reader) error
 }
 
@@ -31,6 +39,43 @@ type BlockReader interface {
 
 var driver = map[string]func(*arvados.Cluster, arvados.Volume, logrus.FieldLogger, *volumeMetricsVecs) (Volume, error){}
 
+type storedDigestKey struct{}
+
+// withStoredDigest returns a context indicating that the data passed
+// to Put is not the block itself -- e.g., a wrapper like
+// EncryptedVolume has transformed it -- and its MD5 digest is sum.
+func withStoredDigest(ctx context.Context, sum [md5.Size]byte) context.Context {
+	return context.WithValue(ctx, storedDigestKey{}, sum)
+}
+
+// storedDigest returns the MD5 digest of the data being stored as
+// loc: the digest given to withStoredDigest, if any, otherwise the
+// digest in the locator itself. Drivers that send a checksum to the
+// backend along with the data (e.g., Content-MD5) should use this
+// instead of decoding loc.
+func storedDigest(ctx context.Context, loc string) ([]byte, error) {
+	if sum, ok := ctx.Value(storedDigestKey{}).([md5.Size]byte); ok {
+		return sum[:], nil
+	}
+	return hex.DecodeString(loc)
+}
+
+type withoutCacheKey struct{}
+
+// withoutCache returns a context indicating that a read should go to
+// the backing store, bypassing any cache (see CachedVolume) -- e.g.,
+// when scrubbing, the purpose is to check the stored data, and
+// reading every block through the cache would evict the blocks that
+// clients are using.
+func withoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutCacheKey{}, true)
+}
+
+// cacheDisabled returns true if ctx was returned by withoutCache.
+func cacheDisabled(ctx context.Context) bool {
+	return ctx.Value(withoutCacheKey{}) != nil
+}
+
 // A Volume is an interface representing a Keep back-end storage unit:
 // for example, a single mounted disk, a RAID array, an Amazon S3 volume,
 // etc.
@@ -62,9 +107,25 @@ type Volume interface {
 	// then Get is permitted to return an error without reading
 	// any of the data.
 	//
-	// len(buf) will not exceed BlockSize.
+	// len(buf) will not exceed maxStoredBlockSize.
 	Get(ctx context.Context, loc string, buf []byte) (int, error)
 
+	// ReadRange writes part of a block to w: up to length bytes,
+	// starting at offset off.
+	//
+	// loc is as described in Get.
+	//
+	// If the block is shorter than off+length, ReadRange writes
+	// the data that is available (possibly none) and returns
+	// nil. Like Get, ReadRange should not verify the integrity
+	// of the data, and should return an error satisfying
+	// os.IsNotExist(err) if the block does not exist.
+	//
+	// Drivers that cannot retrieve part of a block from their
+	// backing store can implement ReadRange with
+	// readRangeWithGet.
+	ReadRange(ctx context.Context, loc string, off, length int64, w io.Writer) error
+
 	// Compare the given data with the stored data (i.e., what Get
 	// would return). If equal, return nil. If not, return
 	// CollisionError or DiskHashError (depending on whether the
@@ -76,7 +137,13 @@ type Volume interface {
 	//
 	// loc is as described in Get.
 	//
-	// len(block) is guaranteed to be between 0 and BlockSize.
+	// len(block) is guaranteed to be between 0 and
+	// maxStoredBlockSize: a full-size block can exceed BlockSize
+	// after a wrapper like EncryptedVolume adds its header.
+	//
+	// If a wrapper has transformed the block, the MD5 digest of
+	// the stored data is not the digest in loc. Drivers must use
+	// storedDigest(ctx, loc) to get the digest of the data.
 	//
 	// If a block is already stored under the same name (loc) with
 	// different content, Put must either overwrite the existing
@@ -152,6 +219,12 @@ type Volume interface {
 	//   - size is the number of bytes of content, given as a
 	//     decimal number with one or more digits
 	//
+	//     If the size can't be determined without reading the
+	//     block (e.g., a compressed block that hasn't been read
+	//     since keepstore started), the "+" size part is
+	//     omitted. Clients such as keep-balance match such
+	//     entries with blocks of known size by hash.
+	//
 	//   - timestamp is the timestamp stored for the locator,
 	//     given as a decimal number of seconds after January 1,
 	//     1970 UTC.
@@ -268,6 +341,9 @@ type VolumeManager interface {
 type VolumeMount struct {
 	arvados.KeepMount
 	Volume
+	health  *volumeHealth
+	scrub   *scrubber
+	changes *changeLog
 }
 
 // Generate a UUID the way API server would for a "KeepVolumeMount"
@@ -288,6 +364,9 @@ func (*VolumeMount) generateUUID() string {
 // RRVolumeManager is a round-robin VolumeManager: the Nth call to
 // NextWritable returns the (N % len(writables))th writable Volume
 // (where writables are all Volumes v where v.Writable()==true).
+//
+// Writable mounts that are degraded (see volumeHealth) are skipped by
+// AllWritable and NextWritable, unless all of them are degraded.
 type RRVolumeManager struct {
 	mounts    []*VolumeMount
 	mountMap  map[string]*VolumeMount
@@ -295,11 +374,19 @@ type RRVolumeManager struct {
 	writables []*VolumeMount
 	counter   uint32
 	iostats   map[Volume]*ioStats
+	logger    logrus.FieldLogger
+
+	healthyMtx sync.Mutex
+	healthy    []*VolumeMount // writables that aren't degraded
+	stop       chan struct{}
+	stopOnce   sync.Once
 }
 
 func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, myURL arvados.URL, metrics *volumeMetricsVecs) (*RRVolumeManager, error) {
 	vm := &RRVolumeManager{
 		iostats: make(map[Volume]*ioStats),
+		logger:  logger,
+		stop:    make(chan struct{}),
 	}
 	vm.mountMap = make(map[string]*VolumeMount)
 	for uuid, cfgvol := range cluster.Volumes {
@@ -315,6 +402,13 @@ func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, my
 		if err != nil {
 			return nil, fmt.Errorf("error initializing volume %s: %s", uuid, err)
 		}
+		// Compression is always the outermost wrapper, so
+		// blocks are compressed before being encrypted by an
+		// Encrypted driver (ciphertext doesn't compress).
+		vol, err = newCompressedVolume(vol, cfgvol.Compression)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing volume %s: %s", uuid, err)
+		}
 		logger.Printf("started volume %s (%s), ReadOnly=%v", uuid, vol, cfgvol.ReadOnly)
 
 		sc := cfgvol.StorageClasses
@@ -334,6 +428,13 @@ func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, my
 				StorageClasses: sc,
 			},
 			Volume: vol,
+			health: newVolumeHealth(cluster.Collections.VolumeHealth, logger.WithField("Volume", uuid), metrics, vol.GetDeviceID()),
+		}
+		mnt.health.onChange = vm.updateHealthy
+		mnt.scrub = newScrubber(mnt, cluster, logger, metrics)
+		mnt.changes = newChangeLog(mnt, cluster, logger)
+		if cluster.Collections.BlobScrubRate > 0 {
+			go mnt.scrub.run(vm.stop)
 		}
 		vm.iostats[vol] = &ioStats{}
 		vm.mounts = append(vm.mounts, mnt)
@@ -343,15 +444,39 @@ func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, my
 			vm.writables = append(vm.writables, mnt)
 		}
 	}
+	vm.updateHealthy()
+	if d := cluster.Collections.VolumeHealth.ProbeInterval.Duration(); d > 0 {
+		go vm.probeLoop(d)
+	}
 	return vm, nil
 }
 
+// updateHealthy updates the list of writable mounts returned by
+// AllWritable and NextWritable after a mount's health changes.
+func (vm *RRVolumeManager) updateHealthy() {
+	var healthy []*VolumeMount
+	for _, mnt := range vm.writables {
+		if !mnt.health.Degraded() {
+			healthy = append(healthy, mnt)
+		}
+	}
+	if len(healthy) == 0 && len(vm.writables) > 0 {
+		// Refusing all writes wouldn't help anyone, so
+		// keep trying all of them.
+		vm.logger.Warn("all writable volumes are degraded")
+		healthy = vm.writables
+	}
+	vm.healthyMtx.Lock()
+	vm.healthy = healthy
+	vm.healthyMtx.Unlock()
+}
+
 func (vm *RRVolumeManager) Mounts() []*VolumeMount {
 	return vm.mounts
 }
 
 func (vm *RRVolumeManager) Lookup(uuid string, needWrite bool) *VolumeMount {
-	if mnt, ok := vm.mountMap[uuid]; ok && (!needWrite || !mnt.ReadOnly) {
+	if mnt, ok := vm.mountMap[uuid]; ok && (!needWrite || !mnt.ReadOnly && !mnt.health.Degraded()) {
 		return mnt
 	} else {
 		return nil
@@ -363,18 +488,22 @@ func (vm *RRVolumeManager) AllReadable() []*VolumeMount {
 	return vm.readables
 }
 
-// AllWritable returns an array of all writable volumes
+// AllWritable returns an array of all writable volumes that aren't
+// degraded
 func (vm *RRVolumeManager) AllWritable() []*VolumeMount {
-	return vm.writables
+	vm.healthyMtx.Lock()
+	defer vm.healthyMtx.Unlock()
+	return vm.healthy
 }
 
 // NextWritable returns the next writable
 func (vm *RRVolumeManager) NextWritable() *VolumeMount {
-	if len(vm.writables) == 0 {
+	writables := vm.AllWritable()
+	if len(writables) == 0 {
 		return nil
 	}
 	i := atomic.AddUint32(&vm.counter, 1)
-	return vm.writables[i%uint32(len(vm.writables))]
+	return writables[i%uint32(len(writables))]
 }
 
 // VolumeStats returns an ioStats for the given volume.
@@ -384,6 +513,7 @@ func (vm *RRVolumeManager) VolumeStats(v Volume) *ioStats {
 
 // Close the RRVolumeManager
 func (vm *RRVolumeManager) Close() {
+	vm.stopOnce.Do(func() { close(vm.stop) })
 }
 
 // VolumeStatus describes the current condition of a volume
@@ -50,6 +50,7 @@ func DoGenericVolumeTests(t TB, readonly bool, factory TestableVolumeFactory) {
 
 	s.testGet(t, factory)
 	s.testGetNoSuchBlock(t, factory)
+	s.testReadRange(t, factory)
 
 	s.testCompareNonexistent(t, factory)
 	s.testCompareSameContent(t, factory, TestHash, TestBlock)
@@ -144,6 +145,55 @@ func (s *genericVolumeSuite) testGet(t TB, factory TestableVolumeFactory) {
 	}
 }
 
+// Put a test block, read parts of it with ReadRange, and verify
+// content. Ranges that extend past the end of the block return the
+// available data.
+// Test should pass for both writable and read-only volumes
+func (s *genericVolumeSuite) testReadRange(t TB, factory TestableVolumeFactory) {
+	s.setup(t)
+	v := s.newVolume(t, factory)
+	defer v.Teardown()
+
+	v.PutRaw(TestHash, TestBlock)
+
+	size := int64(len(TestBlock))
+	for _, trial := range []struct {
+		off    int64
+		length int64
+	}{
+		{0, size},
+		{0, 1},
+		{1, 3},
+		{3, size - 3},
+		{size - 1, 1},
+		{size - 2, 10},
+		{0, BlockSize},
+		{size, 1},
+		{size + 10, 1},
+	} {
+		expect := []byte{}
+		if trial.off < size {
+			end := trial.off + trial.length
+			if end > size {
+				end = size
+			}
+			expect = TestBlock[trial.off:end]
+		}
+		var buf bytes.Buffer
+		err := v.ReadRange(context.Background(), TestHash, trial.off, trial.length, &buf)
+		if err != nil {
+			t.Errorf("ReadRange(%d, %d): %s", trial.off, trial.length, err)
+		} else if !bytes.Equal(buf.Bytes(), expect) {
+			t.Errorf("ReadRange(%d, %d): expected %q, got %q", trial.off, trial.length, expect, buf.Bytes())
+		}
+	}
+
+	err := v.ReadRange(context.Background(), TestHash2, 0, 1, &bytes.Buffer{})
+	if !os.IsNotExist(err) {
+		t.Errorf("ReadRange(nonexistent block): expected os.IsNotExist, got %v", err)
+	}
+}
+
 // Invoke get on a block that does not exist in volume; should result in error
 // Test should pass for both writable and read-only volumes
 func (s *genericVolumeSuite) testGetNoSuchBlock(t TB, factory TestableVolumeFactory) {
@@ -0,0 +1,273 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Weight given to each new observation in a mount's rolling error
+// rate and latency. Until a mount has seen 1/healthEWMAWeight
+// operations, each observation is weighted equally instead.
+const healthEWMAWeight = 0.05
+
+// volumeHealth keeps a rolling error rate and latency score for a
+// mount, and decides when the mount should be considered degraded
+// (i.e., skipped for writes until a probe succeeds).
+//
+// A nil *volumeHealth is valid, and never reports a degraded state.
+type volumeHealth struct {
+	config   arvados.VolumeHealthConfig
+	logger   logrus.FieldLogger
+	onChange func()
+
+	degradedGauge  prometheus.Gauge
+	errorRateGauge prometheus.Gauge
+	latencyGauge   prometheus.Gauge
+
+	mtx      sync.Mutex
+	ops      int
+	errRate  float64
+	latency  float64 // seconds
+	degraded bool
+	since    time.Time
+	reason   string
+}
+
+// volumeHealthStatus is the health information reported for each
+// mount by the /mounts API.
+type volumeHealthStatus struct {
+	ErrorRate      float64   `json:"error_rate"`
+	LatencySeconds float64   `json:"latency_seconds"`
+	Operations     int       `json:"operations"`
+	DegradedSince  time.Time `json:"degraded_since,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+}
+
+func newVolumeHealth(config arvados.VolumeHealthConfig, logger logrus.FieldLogger, metrics *volumeMetricsVecs, deviceID string) *volumeHealth {
+	h := &volumeHealth{
+		config: config,
+		logger: logger,
+	}
+	if metrics != nil {
+		lbls := prometheus.Labels{"device_id": deviceID}
+		h.degradedGauge = metrics.healthDegraded.With(lbls)
+		h.errorRateGauge = metrics.healthErrorRate.With(lbls)
+		h.latencyGauge = metrics.healthLatency.With(lbls)
+		h.degradedGauge.Set(0)
+	}
+	return h
+}
+
+// record updates the health scores with the outcome of one volume
+// operation. Errors that don't indicate a problem with the volume
+// itself (block not found, volume full, client went away) count as
+// successes.
+func (h *volumeHealth) record(err error, elapsed time.Duration) {
+	if h == nil || err == context.Canceled || err == context.DeadlineExceeded || err == ErrClientDisconnect {
+		return
+	}
+	failed := err != nil && !os.IsNotExist(err) && err != FullError && err != MethodDisabledError && err != CollisionError && err != TooLongError
+	h.mtx.Lock()
+	h.ops++
+	weight := 1 / float64(h.ops)
+	if weight < healthEWMAWeight {
+		weight = healthEWMAWeight
+	}
+	x := 0.0
+	if failed {
+		x = 1
+	}
+	h.errRate += weight * (x - h.errRate)
+	h.latency += weight * (elapsed.Seconds() - h.latency)
+	changed := false
+	if !h.degraded && h.ops >= h.config.MinOperations {
+		if h.config.ErrorRateThreshold > 0 && h.errRate > h.config.ErrorRateThreshold {
+			h.reason = fmt.Sprintf("error rate %.2f exceeds threshold %.2f", h.errRate, h.config.ErrorRateThreshold)
+			changed = true
+		} else if lt := h.config.LatencyThreshold.Duration(); lt > 0 && h.latency > lt.Seconds() {
+			h.reason = fmt.Sprintf("average latency %v exceeds threshold %v", time.Duration(h.latency*float64(time.Second)), lt)
+			changed = true
+		}
+		if changed {
+			h.degraded = true
+			h.since = time.Now()
+		}
+	}
+	h.updateGauges()
+	reason := h.reason
+	h.mtx.Unlock()
+	if changed {
+		h.logger.Warnf("volume is degraded (%s), not writing new blocks until it recovers", reason)
+		if h.onChange != nil {
+			h.onChange()
+		}
+	}
+}
+
+// recover clears the health scores and degraded state after a
+// successful probe.
+func (h *volumeHealth) recover() {
+	h.mtx.Lock()
+	wasDegraded := h.degraded
+	h.ops, h.errRate, h.latency = 0, 0, 0
+	h.degraded, h.since, h.reason = false, time.Time{}, ""
+	h.updateGauges()
+	h.mtx.Unlock()
+	if wasDegraded {
+		h.logger.Info("volume recovered, resuming writes")
+		if h.onChange != nil {
+			h.onChange()
+		}
+	}
+}
+
+// Caller must have lock.
+func (h *volumeHealth) updateGauges() {
+	if h.degradedGauge == nil {
+		return
+	}
+	if h.degraded {
+		h.degradedGauge.Set(1)
+	} else {
+		h.degradedGauge.Set(0)
+	}
+	h.errorRateGauge.Set(h.errRate)
+	h.latencyGauge.Set(h.latency)
+}
+
+// Degraded returns true if the mount should not be used for writes.
+func (h *volumeHealth) Degraded() bool {
+	if h == nil {
+		return false
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.degraded
+}
+
+// Status returns the current health scores.
+func (h *volumeHealth) Status() volumeHealthStatus {
+	if h == nil {
+		return volumeHealthStatus{}
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return volumeHealthStatus{
+		ErrorRate:      h.errRate,
+		LatencySeconds: h.latency,
+		Operations:     h.ops,
+		DegradedSince:  h.since,
+		Reason:         h.reason,
+	}
+}
+
+// probe checks whether a degraded mount is working again by writing
+// and reading back the empty block. It returns nil if the mount can
+// be used for writes again.
+func (h *volumeHealth) probe(ctx context.Context, v Volume) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	err := v.Put(ctx, emptyBlockHash, nil)
+	if err != nil && err != FullError {
+		return fmt.Errorf("probe write failed: %s", err)
+	}
+	if _, err = v.Get(ctx, emptyBlockHash, nil); err != nil {
+		return fmt.Errorf("probe read failed: %s", err)
+	}
+	return nil
+}
+
+const emptyBlockHash = "d41d8cd98f00b204e9800998ecf8427e"
+
+// probeLoop periodically probes degraded mounts, and returns them to
+// service when they are working again.
+func (vm *RRVolumeManager) probeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-vm.stop:
+			return
+		case <-ticker.C:
+		}
+		vm.probeDegraded()
+	}
+}
+
+func (vm *RRVolumeManager) probeDegraded() {
+	for _, mnt := range vm.writables {
+		if !mnt.health.Degraded() {
+			continue
+		}
+		if err := mnt.health.probe(context.Background(), mnt.Volume); err != nil {
+			mnt.health.logger.WithError(err).Info("volume is still degraded")
+			continue
+		}
+		mnt.health.recover()
+	}
+}
+
+// Get implements Volume, recording the outcome in the mount's health
+// scores.
+func (mnt *VolumeMount) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	t0 := time.Now()
+	n, err := mnt.Volume.Get(ctx, loc, buf)
+	mnt.health.record(err, time.Since(t0))
+	return n, err
+}
+
+// ReadRange implements Volume, recording the outcome in the mount's
+// health scores.
+func (mnt *VolumeMount) ReadRange(ctx context.Context, loc string, off, length int64, w io.Writer) error {
+	t0 := time.Now()
+	err := mnt.Volume.ReadRange(ctx, loc, off, length, w)
+	mnt.health.record(err, time.Since(t0))
+	return err
+}
+
+// Compare implements Volume, recording the outcome in the mount's
+// health scores.
+func (mnt *VolumeMount) Compare(ctx context.Context, loc string, data []byte) error {
+	t0 := time.Now()
+	err := mnt.Volume.Compare(ctx, loc, data)
+	mnt.health.record(err, time.Since(t0))
+	return err
+}
+
+// Put implements Volume, recording the outcome in the mount's health
+// scores and change log. A successful write also replaces a
+// quarantined copy of the block.
+func (mnt *VolumeMount) Put(ctx context.Context, loc string, block []byte) error {
+	t0 := time.Now()
+	err := mnt.Volume.Put(ctx, loc, block)
+	mnt.health.record(err, time.Since(t0))
+	if err == nil {
+		mnt.scrub.unquarantine(loc)
+		mnt.changes.recordWrite(loc, len(block))
+	}
+	return err
+}
+
+// Touch implements Volume, recording the outcome in the mount's
+// health scores and change log.
+func (mnt *VolumeMount) Touch(loc string) error {
+	t0 := time.Now()
+	err := mnt.Volume.Touch(loc)
+	mnt.health.record(err, time.Since(t0))
+	if err == nil {
+		mnt.changes.recordWrite(loc, -1)
+	}
+	return err
+}
@@ -0,0 +1,185 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&VolumeHealthSuite{})
+
+type VolumeHealthSuite struct{}
+
+func (*VolumeHealthSuite) TestErrorRate(c *check.C) {
+	h := newVolumeHealth(arvados.VolumeHealthConfig{ErrorRateThreshold: 0.5, MinOperations: 10}, ctxlog.TestLogger(c), nil, "")
+	changes := 0
+	h.onChange = func() { changes++ }
+
+	// Errors that aren't the volume's fault don't count.
+	for i := 0; i < 20; i++ {
+		h.record(os.ErrNotExist, time.Millisecond)
+		h.record(FullError, time.Millisecond)
+		h.record(context.Canceled, time.Millisecond)
+	}
+	c.Check(h.Degraded(), check.Equals, false)
+	c.Check(h.Status().ErrorRate, check.Equals, 0.0)
+	c.Check(h.Status().Operations, check.Equals, 40)
+
+	for i := 0; h.Status().ErrorRate <= 0.5; i++ {
+		c.Assert(i < 100, check.Equals, true)
+		c.Check(h.Degraded(), check.Equals, false)
+		h.record(errors.New("test error"), time.Millisecond)
+	}
+	c.Check(h.Degraded(), check.Equals, true)
+	c.Check(h.Status().Reason, check.Matches, `error rate .* exceeds threshold 0.50`)
+	c.Check(changes, check.Equals, 1)
+
+	// Successes alone don't bring a degraded mount back.
+	for i := 0; i < 100; i++ {
+		h.record(nil, time.Millisecond)
+	}
+	c.Check(h.Degraded(), check.Equals, true)
+
+	h.recover()
+	c.Check(h.Degraded(), check.Equals, false)
+	c.Check(h.Status(), check.DeepEquals, volumeHealthStatus{})
+	c.Check(changes, check.Equals, 2)
+}
+
+func (*VolumeHealthSuite) TestMinOperations(c *check.C) {
+	h := newVolumeHealth(arvados.VolumeHealthConfig{ErrorRateThreshold: 0.5, MinOperations: 10}, ctxlog.TestLogger(c), nil, "")
+	for i := 0; i < 9; i++ {
+		h.record(errors.New("test error"), time.Millisecond)
+	}
+	c.Check(h.Degraded(), check.Equals, false)
+	h.record(errors.New("test error"), time.Millisecond)
+	c.Check(h.Degraded(), check.Equals, true)
+}
+
+func (*VolumeHealthSuite) TestLatency(c *check.C) {
+	h := newVolumeHealth(arvados.VolumeHealthConfig{LatencyThreshold: arvados.Duration(time.Second), MinOperations: 4}, ctxlog.TestLogger(c), nil, "")
+	for i := 0; i < 4; i++ {
+		h.record(nil, 500*time.Millisecond)
+	}
+	c.Check(h.Degraded(), check.Equals, false)
+	for i := 0; i < 4; i++ {
+		h.record(nil, 2*time.Second)
+	}
+	c.Check(h.Degraded(), check.Equals, true)
+	c.Check(h.Status().Reason, check.Matches, `average latency .* exceeds threshold 1s`)
+}
+
+func (*VolumeHealthSuite) TestNil(c *check.C) {
+	var h *volumeHealth
+	h.record(errors.New("test error"), time.Second)
+	c.Check(h.Degraded(), check.Equals, false)
+	c.Check(h.Status(), check.DeepEquals, volumeHealthStatus{})
+}
+
+func (s *HandlerSuite) TestVolumeHealthDemotion(c *check.C) {
+	s.cluster.Collections.VolumeHealth = arvados.VolumeHealthConfig{
+		ErrorRateThreshold: 0.5,
+		MinOperations:      5,
+	}
+	s.cluster.ManagementToken = arvadostest.ManagementToken
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	defer s.handler.volmgr.Close()
+
+	vols := s.handler.volmgr.AllWritable()
+	c.Assert(vols, check.HasLen, 2)
+	bad, good := vols[0], vols[1]
+	badvol := bad.Volume.(*MockVolume)
+	badvol.Bad = true
+	badvol.BadVolumeError = errors.New("test error")
+
+	resp := s.call("GET", "/_health/volumes", arvadostest.ManagementToken, nil)
+	c.Check(resp.Body.String(), check.Equals, `{"health":"OK"}`+"\n")
+
+	for i := 0; i < 5; i++ {
+		bad.Get(context.Background(), TestHash, make([]byte, BlockSize))
+	}
+	c.Check(s.handler.volmgr.AllWritable(), check.DeepEquals, []*VolumeMount{good})
+	for i := 0; i < 4; i++ {
+		c.Check(s.handler.volmgr.NextWritable(), check.Equals, good)
+	}
+	c.Check(s.handler.volmgr.Lookup(bad.UUID, true), check.IsNil)
+	c.Check(s.handler.volmgr.Lookup(bad.UUID, false), check.Equals, bad)
+
+	// New blocks go to the healthy volume.
+	resp = s.call("PUT", "/"+TestHash2, "", TestBlock2)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(good.Volume.(*MockVolume).Store[TestHash2], check.NotNil)
+	c.Check(badvol.CallCount("Put"), check.Equals, 0)
+
+	resp = s.call("GET", "/mounts", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	var mntList []arvados.KeepMount
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &mntList), check.IsNil)
+	c.Assert(mntList, check.HasLen, 2)
+	for _, mnt := range mntList {
+		c.Check(mnt.Degraded, check.Equals, mnt.UUID == bad.UUID)
+	}
+	c.Check(strings.Count(resp.Body.String(), `"degraded":`), check.Equals, 2)
+
+	resp = s.call("GET", "/_health/volumes", arvadostest.ManagementToken, nil)
+	c.Check(resp.Body.String(), check.Matches, `{"error":"degraded volumes: `+bad.UUID+` \(error rate .*\)","health":"ERROR"}\n`)
+
+	// Probe fails while the volume is still broken.
+	s.handler.volmgr.probeDegraded()
+	c.Check(bad.health.Degraded(), check.Equals, true)
+
+	badvol.Bad = false
+	s.handler.volmgr.probeDegraded()
+	c.Check(bad.health.Degraded(), check.Equals, false)
+	c.Check(s.handler.volmgr.AllWritable(), check.HasLen, 2)
+	resp = s.call("GET", "/_health/volumes", arvadostest.ManagementToken, nil)
+	c.Check(resp.Body.String(), check.Equals, `{"health":"OK"}`+"\n")
+}
+
+func (s *HandlerSuite) TestVolumeHealthAllDegraded(c *check.C) {
+	s.cluster.Collections.VolumeHealth = arvados.VolumeHealthConfig{
+		ErrorRateThreshold: 0.5,
+		MinOperations:      1,
+	}
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	defer s.handler.volmgr.Close()
+
+	for _, mnt := range s.handler.volmgr.AllWritable() {
+		mnt.Volume.(*MockVolume).Bad = true
+		mnt.Volume.(*MockVolume).BadVolumeError = errors.New("test error")
+		mnt.Put(context.Background(), TestHash, TestBlock)
+		c.Check(mnt.health.Degraded(), check.Equals, true)
+	}
+	// With nowhere else to go, writes are still attempted on
+	// degraded volumes.
+	c.Check(s.handler.volmgr.AllWritable(), check.HasLen, 2)
+	c.Check(s.handler.volmgr.NextWritable(), check.NotNil)
+}
+
+func (s *HandlerSuite) TestVolumeHealthDisabledByDefault(c *check.C) {
+	c.Assert(s.handler.setup(context.Background(), s.cluster, "", prometheus.NewRegistry(), testServiceURL), check.IsNil)
+	defer s.handler.volmgr.Close()
+
+	for _, mnt := range s.handler.volmgr.AllWritable() {
+		mnt.Volume.(*MockVolume).Bad = true
+		mnt.Volume.(*MockVolume).BadVolumeError = errors.New("test error")
+		for i := 0; i < 100; i++ {
+			mnt.Put(context.Background(), TestHash, TestBlock)
+		}
+		c.Check(mnt.health.Degraded(), check.Equals, false)
+	}
+}
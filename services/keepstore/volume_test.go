@@ -164,6 +164,26 @@ func (v *MockVolume) Get(ctx context.Context, loc string, buf []byte) (int, erro
 	return 0, os.ErrNotExist
 }
 
+func (v *MockVolume) ReadRange(ctx context.Context, loc string, off, length int64, w io.Writer) error {
+	v.gotCall("ReadRange")
+	<-v.Gate
+	if v.Bad {
+		return v.BadVolumeError
+	}
+	block, ok := v.Store[loc]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if off >= int64(len(block)) {
+		return nil
+	}
+	if end := off + length; end < int64(len(block)) {
+		block = block[:end]
+	}
+	_, err := w.Write(block[off:])
+	return err
+}
+
 func (v *MockVolume) Put(ctx context.Context, loc string, block []byte) error {
 	v.gotCall("Put")
 	<-v.Gate
@@ -239,6 +259,7 @@ func (v *MockVolume) Trash(loc string) error {
 			return nil
 		}
 		delete(v.Store, loc)
+		delete(v.Timestamps, loc)
 		return nil
 	}
 	return os.ErrNotExist